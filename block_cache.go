@@ -0,0 +1,69 @@
+package ext
+
+import "github.com/asalih/go-ext/internal/lru"
+
+// DefaultBlockCacheSize is the memory limit, in bytes, of the block cache a
+// FileSystem uses unless configured otherwise with WithBlockCacheSize or
+// WithBlockCache.
+const DefaultBlockCacheSize = 8 << 20
+
+// BlockCache caches filesystem blocks by block number. The FileSystem reads
+// its metadata (inodes, extent tree nodes, indirect blocks and directory
+// blocks) through it, so that every metadata block is read from the device
+// once and parsed from memory afterwards.
+//
+// Implementations must be safe for concurrent use. A BlockCache must not be
+// shared between FileSystems since blocks are keyed by number only.
+type BlockCache interface {
+	// Get returns the cached content of block blk. Callers must not modify
+	// the returned slice.
+	Get(blk uint64) ([]byte, bool)
+
+	// Add caches data as the content of block blk. The cache takes ownership
+	// of data.
+	Add(blk uint64, data []byte)
+
+	// Stats returns the effectiveness of the cache.
+	Stats() CacheStats
+}
+
+// lruBlockCache is a BlockCache bounded by the total size of the blocks it
+// holds, evicting the least recently used blocks first.
+type lruBlockCache struct {
+	// maxBytes is the memory limit. Immutable.
+	maxBytes int64
+
+	blocks *lru.Cache[uint64, []byte]
+}
+
+// NewLRUBlockCache returns a BlockCache which holds at most maxBytes of block
+// data and evicts the least recently used blocks first.
+func NewLRUBlockCache(maxBytes int64) BlockCache {
+	return &lruBlockCache{
+		maxBytes: maxBytes,
+		blocks:   lru.New[uint64](maxBytes, lru.Bytes),
+	}
+}
+
+// Get implements BlockCache.Get.
+func (c *lruBlockCache) Get(blk uint64) ([]byte, bool) {
+	return c.blocks.Get(blk)
+}
+
+// Add implements BlockCache.Add.
+func (c *lruBlockCache) Add(blk uint64, data []byte) {
+	c.blocks.Add(blk, data)
+}
+
+// Stats implements BlockCache.Stats.
+func (c *lruBlockCache) Stats() CacheStats {
+	stats := c.blocks.Stats()
+	return CacheStats{
+		Hits:      stats.Hits,
+		Misses:    stats.Misses,
+		Evictions: stats.Evictions,
+		Len:       stats.Len,
+		Bytes:     stats.Cost,
+		MaxBytes:  c.maxBytes,
+	}
+}
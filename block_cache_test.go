@@ -0,0 +1,152 @@
+package ext
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sync/atomic"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+// countingReaderAt counts the reads reaching the underlying device.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.r.ReadAt(p, off)
+}
+
+func TestLRUBlockCacheEviction(t *testing.T) {
+	c := NewLRUBlockCache(12)
+	c.Add(1, make([]byte, 4))
+	c.Add(2, make([]byte, 4))
+	c.Add(3, make([]byte, 4))
+	c.Get(1)
+	c.Add(4, make([]byte, 4))
+
+	if _, ok := c.Get(2); ok {
+		t.Error("block 2 was not evicted")
+	}
+	for _, blk := range []uint64{1, 3, 4} {
+		if _, ok := c.Get(blk); !ok {
+			t.Errorf("block %d was evicted", blk)
+		}
+	}
+
+	// Blocks larger than the whole cache are not cached at all.
+	c.Add(5, make([]byte, 13))
+	if _, ok := c.Get(5); ok {
+		t.Error("oversized block was cached")
+	}
+
+	want := CacheStats{Hits: 4, Misses: 2, Evictions: 1, Len: 3, Bytes: 12, MaxBytes: 12}
+	if got := c.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestBlockReaderCoalesces(t *testing.T) {
+	disk := make([]byte, 16*1024)
+	for i := range disk {
+		disk[i] = byte(i / 1024)
+	}
+	dev := &countingReaderAt{r: bytes.NewReader(disk)}
+	r := newBlockReader(dev, 1024, NewLRUBlockCache(1<<20), 4)
+
+	// A read spanning blocks 1 to 5 reaches the device once.
+	buf := make([]byte, 4*1024)
+	if _, err := r.ReadAt(buf, 1024+512); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, disk[1024+512:5*1024+512]) {
+		t.Error("ReadAt returned the wrong data")
+	}
+	if dev.reads != 1 {
+		t.Errorf("ReadAt made %d device reads, want 1", dev.reads)
+	}
+
+	for _, blk := range []uint64{1, 3, 5} {
+		data, err := r.block(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[0] != byte(blk) || len(data) != 1024 {
+			t.Errorf("block(%d) returned the wrong data", blk)
+		}
+	}
+	if dev.reads != 1 {
+		t.Errorf("cached blocks made %d device reads, want 1", dev.reads)
+	}
+
+	// A miss reads the readahead window, which covers the next blocks.
+	if _, err := r.block(10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.block(13); err != nil {
+		t.Fatal(err)
+	}
+	if dev.reads != 2 {
+		t.Errorf("readahead made %d device reads, want 2", dev.reads)
+	}
+
+	// The readahead window stops at the end of the device.
+	if _, err := r.block(15); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.block(16); err == nil {
+		t.Error("block past the end of the device was read")
+	}
+}
+
+func TestFileSystemBlockCache(t *testing.T) {
+	b := testimage.New(testimage.Ext3())
+	for name, e := range testEntries() {
+		e.Name = name
+		b.Add(e)
+	}
+	img := b.MustBuild()
+
+	// readTree reads every file of the image and returns the file count and
+	// the number of device reads it took.
+	readTree := func(opts ...Option) (int, int64, *FileSystem) {
+		dev := &countingReaderAt{r: bytes.NewReader(img)}
+		fsys, err := NewFS(dev, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := 0
+		err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			files++
+			_, err = fs.ReadFile(fsys, path)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files, dev.reads, fsys
+	}
+
+	uncachedFiles, uncachedReads, fsys := readTree(WithBlockCacheSize(0), WithInodeCacheSize(0))
+	if stats := fsys.BlockCacheStats(); stats != (CacheStats{}) {
+		t.Errorf("disabled block cache reported %+v", stats)
+	}
+
+	cachedFiles, cachedReads, fsys := readTree(WithInodeCacheSize(0))
+	if cachedFiles != uncachedFiles {
+		t.Errorf("read %d files with the block cache and %d without", cachedFiles, uncachedFiles)
+	}
+	if cachedReads >= uncachedReads {
+		t.Errorf("block cache made %d device reads, %d without it", cachedReads, uncachedReads)
+	}
+	if stats := fsys.BlockCacheStats(); stats.Hits == 0 || stats.Bytes == 0 {
+		t.Errorf("block cache was not used: %+v", stats)
+	}
+}
@@ -1,6 +1,7 @@
 package ext
 
 import (
+	"encoding/binary"
 	"io"
 	"math"
 
@@ -66,6 +67,11 @@ func newBlockMapFile(args inodeArgs) (*blockMapFile, error) {
 
 // ReadAt implements io.ReaderAt.ReadAt.
 func (f *blockMapFile) ReadAt(dst []byte, off int64) (int, error) {
+	return f.readAt(f.regFile.inode.fsR, dst, off)
+}
+
+// readAt implements fileReader.readAt.
+func (f *blockMapFile) readAt(fsR *FileSystem, dst []byte, off int64) (int, error) {
 	if len(dst) == 0 {
 		return 0, nil
 	}
@@ -75,7 +81,7 @@ func (f *blockMapFile) ReadAt(dst []byte, off int64) (int, error) {
 	}
 
 	offset := uint64(off)
-	size := f.regFile.inode.diskInode.Size()
+	size := f.regFile.dataSize()
 	if offset >= size {
 		return 0, io.EOF
 	}
@@ -106,16 +112,16 @@ func (f *blockMapFile) ReadAt(dst []byte, off int64) (int, error) {
 		switch {
 		case offset < dirBlksEnd:
 			// Direct block.
-			curR, err = f.read(uint32(f.directBlks[offset/f.regFile.inode.blkSize]), offset%f.regFile.inode.blkSize, 0, dst[read:])
+			curR, err = f.read(fsR, uint32(f.directBlks[offset/f.regFile.inode.blkSize]), offset%f.regFile.inode.blkSize, 0, dst[read:])
 		case offset < indirBlkEnd:
 			// Indirect block.
-			curR, err = f.read(uint32(f.indirectBlk), offset-dirBlksEnd, 1, dst[read:])
+			curR, err = f.read(fsR, uint32(f.indirectBlk), offset-dirBlksEnd, 1, dst[read:])
 		case offset < doubIndirBlkEnd:
 			// Doubly indirect block.
-			curR, err = f.read(uint32(f.doubleIndirectBlk), offset-indirBlkEnd, 2, dst[read:])
+			curR, err = f.read(fsR, uint32(f.doubleIndirectBlk), offset-indirBlkEnd, 2, dst[read:])
 		default:
 			// Triply indirect block.
-			curR, err = f.read(uint32(f.tripleIndirectBlk), offset-doubIndirBlkEnd, 3, dst[read:])
+			curR, err = f.read(fsR, uint32(f.tripleIndirectBlk), offset-doubIndirBlkEnd, 3, dst[read:])
 		}
 
 		read += curR
@@ -136,7 +142,16 @@ func (f *blockMapFile) ReadAt(dst []byte, off int64) (int, error) {
 // tree. A height of 0 shows that the current node is actually holding file
 // data. relFileOff tells the offset from which we need to start to reading
 // under the current node. It is completely relative to the current node.
-func (f *blockMapFile) read(curPhyBlk uint32, relFileOff uint64, height uint, dst []byte) (int, error) {
+func (f *blockMapFile) read(fsR *FileSystem, curPhyBlk uint32, relFileOff uint64, height uint, dst []byte) (int, error) {
+	if curPhyBlk == 0 {
+		// Block number 0 marks a hole. It spans everything this node covers.
+		toRead := f.coverage[height] - relFileOff
+		if uint64(len(dst)) < toRead {
+			toRead = uint64(len(dst))
+		}
+		return zero(dst[:toRead]), nil
+	}
+
 	curPhyBlkOff := int64(curPhyBlk) * int64(f.regFile.inode.blkSize)
 	if height == 0 {
 		toRead := int(f.regFile.inode.blkSize - relFileOff)
@@ -144,9 +159,12 @@ func (f *blockMapFile) read(curPhyBlk uint32, relFileOff uint64, height uint, ds
 			toRead = len(dst)
 		}
 
-		n, _ := f.regFile.inode.fsR.dev.ReadAt(dst[:toRead], curPhyBlkOff+int64(relFileOff))
+		n, err := f.regFile.inode.dataReader(fsR).ReadAt(dst[:toRead], curPhyBlkOff+int64(relFileOff))
 		if n < toRead {
-			return n, syserror.EIO
+			if err == nil || err == io.EOF {
+				err = syserror.EIO
+			}
+			return n, err
 		}
 		return n, nil
 	}
@@ -160,16 +178,18 @@ func (f *blockMapFile) read(curPhyBlk uint32, relFileOff uint64, height uint, ds
 		endIdx = wantEndIdx
 	}
 
+	// The block numbers of the children are parsed from the cached block.
+	blk, err := fsR.meta.block(uint64(curPhyBlk))
+	if err != nil {
+		return 0, err
+	}
+
 	read := 0
 	curChildOff := relFileOff % childCov
 	for i := startIdx; i < endIdx; i++ {
-		var childPhyBlk common.Uint32
-		err := readFromDisk(f.regFile.inode.fsR.dev, curPhyBlkOff+int64(i*4), &childPhyBlk)
-		if err != nil {
-			return read, err
-		}
+		childPhyBlk := binary.LittleEndian.Uint32(blk[i*4:])
 
-		n, err := f.read(uint32(childPhyBlk), curChildOff, height-1, dst[read:])
+		n, err := f.read(fsR, childPhyBlk, curChildOff, height-1, dst[read:])
 		read += n
 		if err != nil {
 			return read, err
@@ -181,6 +201,51 @@ func (f *blockMapFile) read(curPhyBlk uint32, relFileOff uint64, height uint, ds
 	return read, nil
 }
 
+// dataRanges returns the file ranges mapped to data blocks, up to the file
+// size.
+func (f *blockMapFile) dataRanges(fsR *FileSystem) ([]dataRange, error) {
+	blkSize := f.regFile.inode.blkSize
+	var ranges []dataRange
+	for i, blk := range f.directBlks {
+		if blk != 0 {
+			ranges = append(ranges, dataRange{off: uint64(i) * blkSize, length: blkSize})
+		}
+	}
+	off := numDirectBlks * f.coverage[0]
+	for height, blk := range []common.Uint32{f.indirectBlk, f.doubleIndirectBlk, f.tripleIndirectBlk} {
+		var err error
+		if ranges, err = f.mappedRanges(fsR, uint32(blk), off, uint(height+1), ranges); err != nil {
+			return nil, err
+		}
+		off += f.coverage[height+1]
+	}
+	return ranges, nil
+}
+
+// mappedRanges appends the ranges mapped by the block map node curPhyBlk at
+// height, which covers the file from off, to ranges.
+func (f *blockMapFile) mappedRanges(fsR *FileSystem, curPhyBlk uint32, off uint64, height uint, ranges []dataRange) ([]dataRange, error) {
+	if curPhyBlk == 0 || off >= f.regFile.dataSize() {
+		return ranges, nil
+	}
+	if height == 0 {
+		return append(ranges, dataRange{off: off, length: f.regFile.inode.blkSize}), nil
+	}
+
+	blk, err := fsR.meta.block(uint64(curPhyBlk))
+	if err != nil {
+		return nil, err
+	}
+	childCov := f.coverage[height-1]
+	for i := uint64(0); i < f.regFile.inode.blkSize/4; i++ {
+		child := binary.LittleEndian.Uint32(blk[i*4:])
+		if ranges, err = f.mappedRanges(fsR, child, off+i*childCov, height-1, ranges); err != nil {
+			return nil, err
+		}
+	}
+	return ranges, nil
+}
+
 // getCoverage returns the number of bytes a node at the given height covers.
 // Height 0 is the file data block itself. Height 1 is the indirect block.
 //
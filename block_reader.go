@@ -0,0 +1,121 @@
+package ext
+
+import (
+	"io"
+
+	"github.com/asalih/go-ext/syserror"
+)
+
+// DefaultMetadataReadahead is the number of blocks read from the device at
+// once when a metadata block misses the block cache.
+const DefaultMetadataReadahead = 8
+
+// blockReader reads whole blocks from the device through a BlockCache.
+// Misses are coalesced into a single device read covering the rest of the
+// request, or the readahead window if that is larger, and every block read
+// is cached. Metadata tends to be clustered (inode tables, extent leaves
+// next to each other), so neighbouring blocks are likely to be needed next.
+//
+// blockReader is safe for concurrent use if its cache is.
+type blockReader struct {
+	// All fields are immutable.
+	dev       io.ReaderAt
+	blkSize   uint64
+	cache     BlockCache
+	readahead uint64
+}
+
+var _ io.ReaderAt = (*blockReader)(nil)
+
+// newBlockReader returns a blockReader over dev. A nil cache disables caching
+// and readahead.
+func newBlockReader(dev io.ReaderAt, blkSize uint64, cache BlockCache, readahead int) *blockReader {
+	r := &blockReader{
+		dev:       dev,
+		blkSize:   blkSize,
+		cache:     cache,
+		readahead: 1,
+	}
+	if cache != nil && readahead > 1 {
+		r.readahead = uint64(readahead)
+	}
+	return r
+}
+
+// withDevice returns a blockReader sharing the cache of r which reads missing
+// blocks from dev.
+func (r *blockReader) withDevice(dev io.ReaderAt) *blockReader {
+	view := *r
+	view.dev = dev
+	return &view
+}
+
+// block returns the content of block blk. The returned slice may be shared
+// with the cache and must not be modified.
+func (r *blockReader) block(blk uint64) ([]byte, error) {
+	if r.cache != nil {
+		if data, ok := r.cache.Get(blk); ok {
+			return data, nil
+		}
+	}
+	data, err := r.fill(blk, 1)
+	if err != nil {
+		return nil, err
+	}
+	return data[:r.blkSize], nil
+}
+
+// fill reads at least count blocks starting at blk in a single device read,
+// caches them and returns their content. Blocks past the end of the device
+// are left out of the readahead, but the first count blocks must be there.
+func (r *blockReader) fill(blk uint64, count uint64) ([]byte, error) {
+	n := count
+	if n < r.readahead {
+		n = r.readahead
+	}
+	buf := make([]byte, n*r.blkSize)
+	read, err := r.dev.ReadAt(buf, int64(blk*r.blkSize))
+	if uint64(read) < count*r.blkSize {
+		if err == nil || err == io.EOF {
+			err = syserror.EIO
+		}
+		return nil, err
+	}
+
+	if r.cache != nil {
+		for i := uint64(0); i < uint64(read)/r.blkSize; i++ {
+			// Full slice expressions keep appends by the cache from spilling
+			// into the next block.
+			r.cache.Add(blk+i, buf[i*r.blkSize:(i+1)*r.blkSize:(i+1)*r.blkSize])
+		}
+	}
+	return buf[:uint64(read)/r.blkSize*r.blkSize], nil
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (r *blockReader) ReadAt(dst []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syserror.EINVAL
+	}
+
+	read := 0
+	for read < len(dst) {
+		pos := uint64(off) + uint64(read)
+		blk, blkOff := pos/r.blkSize, pos%r.blkSize
+
+		var data []byte
+		if r.cache != nil {
+			data, _ = r.cache.Get(blk)
+		}
+		if data == nil {
+			// Read every block the rest of the request touches at once.
+			count := (blkOff + uint64(len(dst)-read) + r.blkSize - 1) / r.blkSize
+			var err error
+			if data, err = r.fill(blk, count); err != nil {
+				return read, err
+			}
+		}
+		read += copy(dst[read:], data[blkOff:])
+	}
+	return read, nil
+}
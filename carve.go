@@ -0,0 +1,256 @@
+package ext
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/asalih/go-ext/common"
+	"github.com/asalih/go-ext/disklayout"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// carveAlign is the alignment superblocks are searched at. Filesystems
+	// start on sector boundaries and superblocks are 1024 bytes into the
+	// filesystem or at the start of a block.
+	carveAlign = 512
+
+	// carveChunkSize is the amount of the image read at once while carving.
+	carveChunkSize = 4 << 20
+
+	// sbMagicOffset, sbChecksumTypeOffset and sbChecksumOffset locate
+	// s_magic, s_checksum_type and s_checksum in the superblock.
+	sbMagicOffset        = 0x38
+	sbChecksumTypeOffset = 0x175
+	sbChecksumOffset     = 0x3fc
+
+	// sbSize is the size of the superblock.
+	sbSize = 1024
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// CarvedVolume is an ext filesystem found by CarveVolumes.
+type CarvedVolume struct {
+	// Offset is where the filesystem starts in the scanned image.
+	Offset int64
+
+	// Size is the size of the filesystem according to its superblock.
+	Size int64
+
+	// Truncated is set if the filesystem extends past the end of the image.
+	Truncated bool
+
+	// BackupGroup is the block group whose backup superblock and group
+	// descriptors were used because the primary ones did not survive, or 0
+	// if the primary superblock is intact.
+	BackupGroup uint32
+
+	// SuperBlock is the superblock the filesystem was recognized by.
+	SuperBlock disklayout.SuperBlock
+
+	// Type is the ext version reported by Check.
+	Type disklayout.ExtType
+
+	// Reader reads the filesystem and can be passed to NewFS. For backup
+	// survivors it presents the backup superblock and group descriptors in
+	// place of the primary ones, as e2fsck -b does.
+	Reader io.ReaderAt
+}
+
+// CarveVolumes looks for ext filesystems anywhere in the image r, which is
+// size bytes long, by their superblocks rather than a partition table. Every
+// 512 byte boundary is checked for the ext magic, and candidates must pass the
+// sanity checks NewFS performs and, with metadata_csum, their checksum.
+//
+// A filesystem is found by its primary superblock, or by the backup copies
+// kept in some block groups if the primary one is damaged. The volumes are
+// returned by offset.
+func CarveVolumes(r io.ReaderAt, size int64) ([]CarvedVolume, error) {
+	return CarveVolumesContext(context.Background(), r, size)
+}
+
+// CarveVolumesContext is CarveVolumes bound to ctx. The scan stops with
+// ctx.Err() once ctx is done.
+func CarveVolumesContext(ctx context.Context, r io.ReaderAt, size int64) ([]CarvedVolume, error) {
+	// found holds, by filesystem offset, the superblock with the lowest
+	// group number seen for it.
+	type candidate struct {
+		sb    disklayout.SuperBlock
+		group uint32
+	}
+	found := make(map[int64]candidate)
+
+	buf := make([]byte, carveChunkSize+sbSize)
+	for chunk := int64(0); chunk < size; chunk += carveChunkSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n := int64(len(buf))
+		if chunk+n > size {
+			n = size - chunk
+		}
+		if read, err := r.ReadAt(buf[:n], chunk); int64(read) < n {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, xerrors.Errorf("failed to read image at %d: %w", chunk, err)
+		}
+
+		for i := int64(0); i < carveChunkSize && i+sbSize <= n; i += carveAlign {
+			raw := buf[i : i+sbSize]
+			if binary.LittleEndian.Uint16(raw[sbMagicOffset:]) != common.EXT_SUPER_MAGIC {
+				continue
+			}
+			sb, start, group, ok := parseCarvedSuperBlock(raw, chunk+i)
+			if !ok {
+				continue
+			}
+			if c, ok := found[start]; !ok || group < c.group {
+				found[start] = candidate{sb: sb, group: group}
+			}
+		}
+	}
+
+	offsets := make([]int64, 0, len(found))
+	for off := range found {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	var volumes []CarvedVolume
+	for _, off := range offsets {
+		c := found[off]
+		v := CarvedVolume{
+			Offset:      off,
+			Size:        int64(c.sb.BlocksCount() * c.sb.BlockSize()),
+			BackupGroup: c.group,
+			SuperBlock:  c.sb,
+		}
+		length := v.Size
+		if off+length > size {
+			length = size - off
+			v.Truncated = true
+		}
+		section := io.NewSectionReader(r, off, length)
+		v.Reader = section
+		if c.group != 0 {
+			overlay, err := backupOverlay(section, c.sb, c.group)
+			if err != nil {
+				continue
+			}
+			v.Reader = overlay
+		}
+		extType, err := Check(v.Reader)
+		if err != nil {
+			continue
+		}
+		v.Type = extType
+		volumes = append(volumes, v)
+	}
+	return volumes, nil
+}
+
+// parseCarvedSuperBlock decodes and checks the candidate superblock raw found
+// at offset pos. It returns where the filesystem starts and the block group
+// the superblock belongs to.
+func parseCarvedSuperBlock(raw []byte, pos int64) (disklayout.SuperBlock, int64, uint32, bool) {
+	// readSuperBlock expects the superblock at its usual offset.
+	dev := make([]byte, disklayout.SbOffset+sbSize)
+	copy(dev[disklayout.SbOffset:], raw)
+	sb, err := readSuperBlock(bytes.NewReader(dev))
+	if err != nil || isCompatible(sb) != nil || sb.Revision() > disklayout.DynamicRev {
+		return nil, 0, 0, false
+	}
+
+	if sb.ReadOnlyCompatibleFeatures().MetadataCsum {
+		le := binary.LittleEndian
+		want := le.Uint32(raw[sbChecksumOffset:])
+		if raw[sbChecksumTypeOffset] != 1 || ^crc32.Checksum(raw[:sbChecksumOffset], crc32c) != want {
+			return nil, 0, 0, false
+		}
+	}
+
+	// The primary superblock is 1024 bytes into the filesystem, and the
+	// backups of group g start its first block.
+	var group uint32
+	if sb.Revision() == disklayout.DynamicRev {
+		group = uint32(binary.LittleEndian.Uint16(raw[0x5a:]))
+	}
+	if group == 0 {
+		return sb, pos - disklayout.SbOffset, 0, pos >= disklayout.SbOffset
+	}
+	if uint64(group) >= blockGroupsCount(sb) {
+		return nil, 0, 0, false
+	}
+	block := uint64(group)*uint64(sb.BlocksPerGroup()) + uint64(sb.FirstDataBlock())
+	off := block * sb.BlockSize()
+	if off > uint64(pos) {
+		return nil, 0, 0, false
+	}
+	return sb, pos - int64(off), group, true
+}
+
+// backupOverlay returns a reader of the filesystem fsR with the primary
+// superblock and group descriptors replaced by the backups of group.
+func backupOverlay(fsR io.ReaderAt, sb disklayout.SuperBlock, group uint32) (io.ReaderAt, error) {
+	blkSize := sb.BlockSize()
+	backup := (uint64(group)*uint64(sb.BlocksPerGroup()) + uint64(sb.FirstDataBlock())) * blkSize
+
+	sbData := make([]byte, sbSize)
+	if n, err := fsR.ReadAt(sbData, int64(backup)); n < sbSize {
+		return nil, err
+	}
+	// The backup records its own group; the copy stands in for group 0.
+	binary.LittleEndian.PutUint16(sbData[0x5a:], 0)
+
+	gdtSize := blockGroupsCount(sb) * uint64(sb.BgDescSize())
+	gdt := make([]byte, gdtSize)
+	// The group descriptors follow the superblock's block.
+	if n, err := fsR.ReadAt(gdt, int64(backup+blkSize)); uint64(n) < gdtSize {
+		return nil, err
+	}
+	primaryGDT := (uint64(sb.FirstDataBlock()) + 1) * blkSize
+	return &overlayReader{
+		r: fsR,
+		patches: []overlayPatch{
+			{off: disklayout.SbOffset, data: sbData},
+			{off: int64(primaryGDT), data: gdt},
+		},
+	}, nil
+}
+
+// overlayReader reads r with some ranges replaced by patches.
+type overlayReader struct {
+	r       io.ReaderAt
+	patches []overlayPatch
+}
+
+type overlayPatch struct {
+	off  int64
+	data []byte
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (o *overlayReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := o.r.ReadAt(p, off)
+	for _, patch := range o.patches {
+		start, end := patch.off, patch.off+int64(len(patch.data))
+		if end <= off || start >= off+int64(n) {
+			continue
+		}
+		src := patch.data
+		dst := p[:n]
+		if start < off {
+			src = src[off-start:]
+		} else {
+			dst = dst[start-off:]
+		}
+		copy(dst, src)
+	}
+	return n, err
+}
@@ -0,0 +1,119 @@
+package ext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/fs"
+	"testing"
+
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+func TestCarveVolumes(t *testing.T) {
+	b := testimage.New(testimage.Ext4())
+	b.File("a.txt", []byte("intact"))
+	ext4Img := b.MustBuild()
+
+	// Four groups of 1k blocks, with backups in groups 1 and 3.
+	opts := testimage.Ext2()
+	opts.BlocksPerGroup = 1024
+	opts.BlocksCount = 4096
+	b = testimage.New(opts)
+	b.File("b.txt", []byte("survivor"))
+	ext2Img := b.MustBuild()
+	// Wipe the primary superblock and the group descriptors in block 2.
+	for i := 1024; i < 3*1024; i++ {
+		ext2Img[i] = 0
+	}
+
+	// Junk, including a stray magic, in front of and between the images.
+	ext4Off, ext2Off := 3*512, 3*512+len(ext4Img)+5*512
+	disk := make([]byte, ext2Off+len(ext2Img)+1024)
+	for i := range disk {
+		disk[i] = byte(i * 13)
+	}
+	binary.LittleEndian.PutUint16(disk[512+0x38:], 0xef53)
+	copy(disk[ext4Off:], ext4Img)
+	copy(disk[ext2Off:], ext2Img)
+
+	volumes, err := CarveVolumes(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 2 {
+		t.Fatalf("found %d volumes, want 2: %+v", len(volumes), volumes)
+	}
+	for i, tc := range []struct {
+		off   int
+		size  int
+		group uint32
+		typ   disklayout.ExtType
+		name  string
+		data  string
+	}{
+		{ext4Off, len(ext4Img), 0, disklayout.Ext4, "a.txt", "intact"},
+		{ext2Off, len(ext2Img), 1, disklayout.Ext2, "b.txt", "survivor"},
+	} {
+		v := volumes[i]
+		if v.Offset != int64(tc.off) || v.Size != int64(tc.size) || v.BackupGroup != tc.group || v.Type != tc.typ || v.Truncated {
+			t.Errorf("volume %d: offset %d, size %d, group %d, type %v, truncated %t", i, v.Offset, v.Size, v.BackupGroup, v.Type, v.Truncated)
+			continue
+		}
+		fsys, err := NewFS(v.Reader)
+		if err != nil {
+			t.Errorf("volume %d: %v", i, err)
+			continue
+		}
+		if data, err := fs.ReadFile(fsys, tc.name); err != nil || string(data) != tc.data {
+			t.Errorf("volume %d: ReadFile returned %q, %v", i, data, err)
+		}
+	}
+}
+
+func TestCarveTruncated(t *testing.T) {
+	b := testimage.New(testimage.Ext4())
+	b.File("a.txt", []byte("hello"))
+	img := b.MustBuild()
+	img = img[:len(img)/2]
+
+	volumes, err := CarveVolumes(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 || !volumes[0].Truncated || volumes[0].Size <= int64(len(img)) {
+		t.Fatalf("found %+v, want one truncated volume", volumes)
+	}
+}
+
+func TestCarveChecksum(t *testing.T) {
+	b := testimage.New(testimage.Ext4())
+	b.File("a.txt", []byte("hello"))
+	img := b.MustBuild()
+
+	// Turn on metadata_csum and checksum the superblock.
+	sb := img[disklayout.SbOffset : disklayout.SbOffset+sbSize]
+	ro := binary.LittleEndian.Uint32(sb[0x64:])
+	binary.LittleEndian.PutUint32(sb[0x64:], ro|0x400)
+	sb[sbChecksumTypeOffset] = 1
+	sum := ^crc32.Checksum(sb[:sbChecksumOffset], crc32.MakeTable(crc32.Castagnoli))
+	binary.LittleEndian.PutUint32(sb[sbChecksumOffset:], sum)
+
+	volumes, err := CarveVolumes(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 {
+		t.Fatalf("found %d volumes with a valid checksum, want 1", len(volumes))
+	}
+
+	binary.LittleEndian.PutUint32(sb[sbChecksumOffset:], sum+1)
+	volumes, err = CarveVolumes(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 0 {
+		t.Fatalf("found %d volumes with a bad checksum, want 0", len(volumes))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"text/tabwriter"
+	"time"
+
+	ext "github.com/asalih/go-ext"
+	"golang.org/x/xerrors"
+)
+
+func catFlags(flags *flag.FlagSet) func(*ext.FileSystem, []string, io.Writer, io.Writer) error {
+	return func(fsys *ext.FileSystem, args []string, stdout, stderr io.Writer) error {
+		if len(args) == 0 {
+			return errors.New("cat needs a path")
+		}
+		for _, arg := range args {
+			if err := cat(fsys, cleanPath(arg), stdout); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func cat(fsys *ext.FileSystem, name string, stdout io.Writer) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(stdout, f); err != nil {
+		return xerrors.Errorf("%s: %w", displayPath(name), err)
+	}
+	return nil
+}
+
+func statFlags(flags *flag.FlagSet) func(*ext.FileSystem, []string, io.Writer, io.Writer) error {
+	return func(fsys *ext.FileSystem, args []string, stdout, stderr io.Writer) error {
+		if len(args) == 0 {
+			return errors.New("stat needs a path")
+		}
+		for i, arg := range args {
+			if i > 0 {
+				fmt.Fprintln(stdout)
+			}
+			if err := stat(fsys, cleanPath(arg), stdout); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func stat(fsys *ext.FileSystem, name string, stdout io.Writer) error {
+	info, err := fsys.Stat(name)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 1, ' ', 0)
+	line := func(name string, value any) {
+		fmt.Fprintf(w, "%s:\t%v\n", name, value)
+	}
+
+	display := displayPath(name)
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := readlink(fsys, name)
+		if err != nil {
+			return err
+		}
+		display += " -> " + target
+	}
+	line("File", display)
+	line("Size", info.Size())
+	line("Type", typeName(info.Mode().Type()))
+	line("Mode", info.Mode())
+	if st, ok := info.Sys().(*ext.Statx); ok {
+		line("Permissions", fmt.Sprintf("%04o", st.Mode&07777))
+		line("Inode", st.Ino)
+		line("Generation", st.Generation)
+		line("Blocks", st.Blocks)
+		line("Links", st.Nlink)
+		if info.Mode()&fs.ModeDevice != 0 {
+			line("Device", fmt.Sprintf("%d,%d", st.RdevMajor, st.RdevMinor))
+		}
+		line("Uid", st.UID)
+		line("Gid", st.GID)
+		line("Access", formatStatTime(st.Atime))
+		line("Modify", formatStatTime(st.Mtime))
+		line("Change", formatStatTime(st.Ctime))
+		birth := "-"
+		if !st.Btime.IsZero() {
+			birth = formatStatTime(st.Btime)
+		}
+		line("Birth", birth)
+		if !st.Dtime.IsZero() {
+			line("Deleted", formatStatTime(st.Dtime))
+		}
+	}
+	return w.Flush()
+}
+
+func typeName(t fs.FileMode) string {
+	switch typeLetter(t) {
+	case "d":
+		return "directory"
+	case "l":
+		return "symbolic link"
+	case "c":
+		return "character device"
+	case "b":
+		return "block device"
+	case "p":
+		return "fifo"
+	case "s":
+		return "socket"
+	case "f":
+		return "regular file"
+	}
+	return "unknown"
+}
+
+func formatStatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.000000000 -0700")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+
+	ext "github.com/asalih/go-ext"
+	"golang.org/x/xerrors"
+)
+
+func extractFlags(flags *flag.FlagSet) func(*ext.FileSystem, []string, io.Writer, io.Writer) error {
+	var verbose, dryRun bool
+	flags.BoolVar(&verbose, "v", false, "print the extracted paths")
+	flags.BoolVar(&dryRun, "n", false, "print what would be extracted without writing anything")
+	return func(fsys *ext.FileSystem, args []string, stdout, stderr io.Writer) error {
+		if len(args) != 2 {
+			return errors.New("extract needs a path and a destination")
+		}
+
+		// Failures are reported and skipped so that as much as possible is
+		// recovered.
+		failed := 0
+		report := func(name, target string, d fs.DirEntry, err error) error {
+			if err != nil {
+				fmt.Fprintf(stderr, "extfs: %s: %v\n", displayPath(cleanPath(name)), err)
+				failed++
+				return nil
+			}
+			if verbose || dryRun {
+				fmt.Fprintf(stdout, "%s -> %s\n", displayPath(cleanPath(name)), target)
+			}
+			return nil
+		}
+		err := fsys.Extract(context.Background(), cleanPath(args[0]), args[1], ext.WithDryRun(dryRun), ext.WithExtractFunc(report))
+		if err != nil {
+			return err
+		}
+		if failed > 0 {
+			return xerrors.Errorf("%d files could not be extracted", failed)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	ext "github.com/asalih/go-ext"
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/internal/uuid"
+)
+
+func infoFlags(flags *flag.FlagSet) func(*ext.FileSystem, []string, io.Writer, io.Writer) error {
+	return func(fsys *ext.FileSystem, args []string, stdout, stderr io.Writer) error {
+		if len(args) != 0 {
+			return errors.New("info takes no arguments")
+		}
+		return info(fsys, stdout)
+	}
+}
+
+func info(fsys *ext.FileSystem, stdout io.Writer) error {
+	sb := fsys.SuperBlock()
+	w := tabwriter.NewWriter(stdout, 0, 8, 1, ' ', 0)
+	line := func(name string, value any) {
+		fmt.Fprintf(w, "%s:\t%v\n", name, value)
+	}
+
+	line("Type", extTypeName(sb.ExtType()))
+	var sb32 *disklayout.SuperBlock32Bit
+	switch sb := sb.(type) {
+	case *disklayout.SuperBlock32Bit:
+		sb32 = sb
+	case *disklayout.SuperBlock64Bit:
+		sb32 = &sb.SuperBlock32Bit
+	}
+	if sb32 != nil {
+		line("Volume name", cString(sb32.VolumeName[:]))
+		line("UUID", uuid.Format(sb32.UUID))
+		line("Last mounted on", cString(sb32.LastMounted[:]))
+		line("Created", formatTime(sb32.MkfsTime))
+	}
+	line("Revision", sb.Revision())
+	line("Block size", sb.BlockSize())
+	line("Blocks", sb.BlocksCount())
+	line("Free blocks", sb.FreeBlocksCount())
+	line("Blocks per group", sb.BlocksPerGroup())
+	line("Inodes", sb.InodesCount())
+	line("Free inodes", sb.FreeInodesCount())
+	line("Inodes per group", sb.InodesPerGroup())
+	line("Inode size", sb.InodeSize())
+	line("Mount count", fmt.Sprintf("%d/%d", sb.MountCount(), sb.MaxMountCount()))
+
+	var features []string
+	features = append(features, featureNames(sb.CompatibleFeatures())...)
+	features = append(features, featureNames(sb.IncompatibleFeatures())...)
+	features = append(features, featureNames(sb.ReadOnlyCompatibleFeatures())...)
+	line("Features", strings.Join(features, " "))
+	return w.Flush()
+}
+
+func extTypeName(t disklayout.ExtType) string {
+	switch t {
+	case disklayout.Ext2:
+		return "ext2"
+	case disklayout.Ext3:
+		return "ext3"
+	case disklayout.Ext4:
+		return "ext4"
+	}
+	return fmt.Sprintf("unknown (%d)", t)
+}
+
+// featureNames returns the names of the feature flags set in features, one
+// of the disklayout feature structs.
+func featureNames(features any) []string {
+	v := reflect.ValueOf(features)
+	var names []string
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Bool() {
+			names = append(names, strings.ToLower(v.Type().Field(i).Name))
+		}
+	}
+	return names
+}
+
+// cString returns the NUL terminated string in b.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func formatTime(sec uint32) string {
+	if sec == 0 {
+		return "never"
+	}
+	return time.Unix(int64(sec), 0).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	ext "github.com/asalih/go-ext"
+	"golang.org/x/xerrors"
+)
+
+func lsFlags(flags *flag.FlagSet) func(*ext.FileSystem, []string, io.Writer, io.Writer) error {
+	var o lsOptions
+	flags.BoolVar(&o.long, "l", false, "use the long listing format")
+	flags.BoolVar(&o.recursive, "R", false, "list subdirectories recursively")
+	flags.BoolVar(&o.inodes, "i", false, "print inode numbers")
+	return func(fsys *ext.FileSystem, args []string, stdout, stderr io.Writer) error {
+		if len(args) == 0 {
+			args = []string{"/"}
+		}
+		o.headers = len(args) > 1 || o.recursive
+		for i, arg := range args {
+			if i > 0 {
+				fmt.Fprintln(stdout)
+			}
+			if err := ls(fsys, cleanPath(arg), o, stdout); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+type lsOptions struct {
+	long      bool
+	recursive bool
+	inodes    bool
+
+	// headers prints the directory name above its listing.
+	headers bool
+}
+
+// ls lists name, which is listed itself unless it is a directory.
+func ls(fsys *ext.FileSystem, name string, o lsOptions, stdout io.Writer) error {
+	info, err := fsys.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		w := tabwriter.NewWriter(stdout, 0, 8, 1, ' ', tabwriter.AlignRight)
+		if err := lsLine(fsys, w, name, info, o); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		return err
+	}
+	if o.headers {
+		fmt.Fprintf(stdout, "%s:\n", displayPath(name))
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 1, ' ', tabwriter.AlignRight)
+	var dirs []string
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if err := lsLine(fsys, w, path.Join(name, e.Name()), info, o); err != nil {
+			return err
+		}
+		if e.IsDir() {
+			dirs = append(dirs, path.Join(name, e.Name()))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if o.recursive {
+		for _, dir := range dirs {
+			fmt.Fprintln(stdout)
+			if err := ls(fsys, dir, o, stdout); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lsLine writes the listing of the file name to w. Columns are right aligned
+// except for the last one, the file name.
+func lsLine(fsys *ext.FileSystem, w io.Writer, name string, info fs.FileInfo, o lsOptions) error {
+	st, _ := info.Sys().(*ext.Statx)
+	if o.inodes && st != nil {
+		fmt.Fprintf(w, "%d\t ", st.Ino)
+	}
+	if !o.long {
+		fmt.Fprintf(w, "%s\n", info.Name())
+		return nil
+	}
+
+	display := info.Name()
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := readlink(fsys, name)
+		if err != nil {
+			return err
+		}
+		display += " -> " + target
+	}
+	var nlink, uid, gid uint32
+	if st != nil {
+		nlink, uid, gid = st.Nlink, st.UID, st.GID
+	}
+	// Device nodes show their device numbers in place of their size.
+	size := strconv.FormatInt(info.Size(), 10)
+	if info.Mode()&fs.ModeDevice != 0 && st != nil {
+		size = fmt.Sprintf("%d, %d", st.RdevMajor, st.RdevMinor)
+	}
+	fmt.Fprintf(w, "%s\t %d\t %d\t %d\t %s\t %s\t %s\n", info.Mode(), nlink, uid, gid, size, formatModTime(info.ModTime()), display)
+	return nil
+}
+
+func formatModTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04")
+}
+
+// readlink returns the target of the symlink name.
+func readlink(fsys *ext.FileSystem, name string) (string, error) {
+	target, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
+func treeFlags(flags *flag.FlagSet) func(*ext.FileSystem, []string, io.Writer, io.Writer) error {
+	return func(fsys *ext.FileSystem, args []string, stdout, stderr io.Writer) error {
+		root := "/"
+		switch len(args) {
+		case 0:
+		case 1:
+			root = args[0]
+		default:
+			return errors.New("tree takes a single path")
+		}
+		name := cleanPath(root)
+		if _, err := fsys.Stat(name); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(stdout, displayPath(name))
+		var dirs, files int
+		if err := tree(fsys, name, "", &dirs, &files, stdout); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "\n%d directories, %d files\n", dirs, files)
+		return nil
+	}
+}
+
+// tree prints the content of the directory name below its own line, each line
+// starting with prefix.
+func tree(fsys *ext.FileSystem, name, prefix string, dirs, files *int, stdout io.Writer) error {
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		branch, indent := "├── ", "│   "
+		if i == len(entries)-1 {
+			branch, indent = "└── ", "    "
+		}
+		child := path.Join(name, e.Name())
+		display := e.Name()
+		if e.Type()&fs.ModeSymlink != 0 {
+			target, err := readlink(fsys, child)
+			if err != nil {
+				return err
+			}
+			display += " -> " + target
+		}
+		fmt.Fprintf(stdout, "%s%s%s\n", prefix, branch, display)
+
+		if !e.IsDir() {
+			*files++
+			continue
+		}
+		*dirs++
+		if err := tree(fsys, child, prefix+indent, dirs, files, stdout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func findFlags(flags *flag.FlagSet) func(*ext.FileSystem, []string, io.Writer, io.Writer) error {
+	var pattern, typ string
+	flags.StringVar(&pattern, "name", "", "only print files whose name matches the shell `pattern`")
+	flags.StringVar(&typ, "type", "", "only print files of `type` f, d, l, b, c, p or s")
+	return func(fsys *ext.FileSystem, args []string, stdout, stderr io.Writer) error {
+		root := "/"
+		switch len(args) {
+		case 0:
+		case 1:
+			root = args[0]
+		default:
+			return errors.New("find takes a single path")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return xerrors.Errorf("bad -name pattern %q: %w", pattern, err)
+		}
+		if typ != "" && (len(typ) != 1 || !strings.Contains("fdlbcps", typ)) {
+			return xerrors.Errorf("bad -type %q", typ)
+		}
+
+		return fs.WalkDir(fsys, cleanPath(root), func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if pattern != "" {
+				if ok, _ := path.Match(pattern, d.Name()); !ok {
+					return nil
+				}
+			}
+			if typ != "" && typeLetter(d.Type()) != typ {
+				return nil
+			}
+			fmt.Fprintln(stdout, displayPath(name))
+			return nil
+		})
+	}
+}
+
+// typeLetter returns the find(1) -type letter of a file of type t.
+func typeLetter(t fs.FileMode) string {
+	switch {
+	case t.IsDir():
+		return "d"
+	case t&fs.ModeSymlink != 0:
+		return "l"
+	case t&fs.ModeCharDevice != 0:
+		return "c"
+	case t&fs.ModeDevice != 0:
+		return "b"
+	case t&fs.ModeNamedPipe != 0:
+		return "p"
+	case t&fs.ModeSocket != 0:
+		return "s"
+	case t.IsRegular():
+		return "f"
+	}
+	return "?"
+}
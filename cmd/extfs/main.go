@@ -0,0 +1,218 @@
+// Command extfs inspects ext2, ext3 and ext4 filesystem images without
+// mounting them.
+//
+// Usage:
+//
+//	extfs <command> [flags] <image> [path...]
+//
+// The commands are:
+//
+//	info     print the superblock summary
+//	ls       list directories
+//	cat      print files
+//	stat     print inode metadata
+//	tree     print a directory tree
+//	find     search a directory tree by name and type
+//	extract  copy files and directories out of the image
+//	bodyfile print a bodyfile of every file for mactime
+//	timeline print a CSV timeline of file times
+//
+// Every command takes -offset, the byte offset of the filesystem in the
+// image, or -partition, the number of the partition holding it. Without
+// either, an image which is not a filesystem itself is searched for one.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	ext "github.com/asalih/go-ext"
+	"golang.org/x/xerrors"
+)
+
+// command is an extfs subcommand. run is called with the opened filesystem
+// and the arguments following the image.
+type command struct {
+	name    string
+	args    string
+	summary string
+	flags   func(flags *flag.FlagSet) func(fsys *ext.FileSystem, args []string, stdout, stderr io.Writer) error
+}
+
+var commands = []command{
+	{"info", "", "print the superblock summary", infoFlags},
+	{"ls", "[path...]", "list directories", lsFlags},
+	{"cat", "path...", "print files", catFlags},
+	{"stat", "path...", "print inode metadata", statFlags},
+	{"tree", "[path]", "print a directory tree", treeFlags},
+	{"find", "[path]", "search a directory tree by name and type", findFlags},
+	{"extract", "path dest", "copy files and directories out of the image", extractFlags},
+	{"bodyfile", "", "print a bodyfile of every file for mactime", bodyfileFlags},
+	{"timeline", "", "print a CSV timeline of file times", timelineFlags},
+}
+
+// errUsage is returned after a usage message has been printed.
+var errUsage = errors.New("usage")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+	switch {
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "extfs: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: extfs <command> [flags] <image> [args]")
+	fmt.Fprintln(w, "\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w, "\nRun extfs <command> -h for the flags of a command.")
+}
+
+// run runs the command line args, without the program name.
+func run(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		usage(stderr)
+		return errUsage
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		if args[0] != "-h" && args[0] != "help" {
+			fmt.Fprintf(stderr, "extfs: unknown command %q\n", args[0])
+		}
+		usage(stderr)
+		return errUsage
+	}
+
+	flags := flag.NewFlagSet("extfs "+cmd.name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: extfs %s [flags] <image> %s\n\n%s.\n\nflags:\n", cmd.name, cmd.args, cmd.summary)
+		flags.PrintDefaults()
+	}
+	var src source
+	flags.Int64Var(&src.offset, "offset", -1, "byte `offset` of the filesystem in the image")
+	flags.IntVar(&src.partition, "partition", 0, "`number` of the partition holding the filesystem")
+	exec := cmd.flags(flags)
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return errUsage
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return errUsage
+	}
+
+	src.image = flags.Arg(0)
+	fsys, closer, err := src.open()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	return exec(fsys, flags.Args()[1:], stdout, stderr)
+}
+
+// source is where the filesystem is read from.
+type source struct {
+	image     string
+	offset    int64
+	partition int
+}
+
+// open opens the filesystem. The returned closer closes the image.
+func (s source) open() (*ext.FileSystem, io.Closer, error) {
+	f, err := os.Open(s.image)
+	if err != nil {
+		return nil, nil, err
+	}
+	fsys, err := s.newFS(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return fsys, f, nil
+}
+
+func (s source) newFS(f *os.File) (*ext.FileSystem, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	if s.offset >= 0 {
+		if s.partition != 0 {
+			return nil, errors.New("-offset and -partition are exclusive")
+		}
+		if s.offset > size {
+			return nil, xerrors.Errorf("offset %d is past the end of %s", s.offset, s.image)
+		}
+		return ext.NewFS(io.NewSectionReader(f, s.offset, size-s.offset))
+	}
+	if s.partition == 0 {
+		if _, err := ext.Check(f); err == nil {
+			return ext.NewFS(f)
+		}
+	}
+
+	volumes, err := ext.FindVolumes(f, size)
+	if err != nil {
+		return nil, err
+	}
+	var found []ext.Volume
+	for _, v := range volumes {
+		if s.partition == 0 || v.Partition != nil && v.Partition.Index == s.partition {
+			found = append(found, v)
+		}
+	}
+	switch {
+	case len(found) == 1:
+		return ext.NewFS(found[0].Reader)
+	case s.partition != 0:
+		return nil, xerrors.Errorf("no ext filesystem in partition %d of %s", s.partition, s.image)
+	case len(found) == 0:
+		return nil, xerrors.Errorf("no ext filesystem in %s", s.image)
+	}
+	var parts []string
+	for _, v := range found {
+		if v.Partition != nil {
+			parts = append(parts, fmt.Sprintf("%d (offset %d)", v.Partition.Index, v.Partition.Start))
+		}
+	}
+	return nil, xerrors.Errorf("%s holds %d ext filesystems, select one with -partition: %s", s.image, len(found), strings.Join(parts, ", "))
+}
+
+// cleanPath turns a path given on the command line, which may be absolute,
+// into an io/fs path.
+func cleanPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// displayPath returns the absolute form of the io/fs path name.
+func displayPath(name string) string {
+	if name == "." {
+		return "/"
+	}
+	return "/" + name
+}
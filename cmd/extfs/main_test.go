@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+// writeImage writes an ext4 image with a few files to a temporary file, after
+// pad bytes of zeros.
+func writeImage(t *testing.T, pad int) string {
+	b := testimage.New(testimage.Ext4())
+	b.Add(testimage.Entry{Name: "etc/hostname", Mode: 0644, Data: []byte("evidence\n"), UID: 1000, GID: 100})
+	b.Add(testimage.Entry{Name: "etc/passwd", Mode: 0600, Data: []byte("root:x:0:0::/root:/bin/sh\n")})
+	b.Symlink("home", "etc")
+	b.Add(testimage.Entry{Name: "dev/null", Mode: fs.ModeDevice | fs.ModeCharDevice | 0666, Major: 1, Minor: 3})
+	img := append(make([]byte, pad), b.MustBuild()...)
+
+	name := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(name, img, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func runOutput(t *testing.T, args ...string) string {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	if err := run(args, &stdout, &stderr); err != nil {
+		t.Fatalf("extfs %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+	return stdout.String()
+}
+
+func TestCommands(t *testing.T) {
+	img := writeImage(t, 0)
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"info", img}, []string{"Type:", "ext4", "Block size:       4096", "extents"}},
+		{[]string{"ls", img}, []string{"dev\netc\nhome\n"}},
+		{[]string{"ls", "-l", "-i", img, "/etc"}, []string{"-rw-r--r--", " 1000 ", "hostname", "-rw-------", "passwd"}},
+		{[]string{"ls", "-l", img, "home"}, []string{"home -> etc"}},
+		{[]string{"ls", "-l", img, "dev"}, []string{"crw-rw-rw-", " 1, 3 ", "null"}},
+		{[]string{"ls", "-R", img}, []string{"/:\ndev\netc\nhome\n", "/etc:\nhostname\npasswd\n"}},
+		{[]string{"cat", img, "/etc/hostname", "etc/passwd"}, []string{"evidence\nroot:x:0:0::/root:/bin/sh\n"}},
+		{[]string{"stat", img, "/dev/null"}, []string{"File:", "/dev/null", "character device", "0666", "Device:      1,3", "Birth:       2020-01-02 03:04:05.6"}},
+		{[]string{"tree", img}, []string{"/\n├── dev\n│   └── null\n├── etc\n│   ├── hostname\n│   └── passwd\n├── home -> etc\n└── lost+found\n", "3 directories, 4 files"}},
+		{[]string{"find", "-name", "h*", img}, []string{"/etc/hostname\n/home\n"}},
+		{[]string{"find", "-type", "d", img, "/etc"}, []string{"/etc\n"}},
+		{[]string{"bodyfile", "-m", "/mnt", img}, []string{"0|/mnt/etc/hostname|", "|r/rrw-r--r--|1000|100|9|", "0|/mnt/home -> etc|"}},
+		{[]string{"timeline", "-from", "2020-01-02", "-to", "2020-01-02", img}, []string{"Date,Size,Type,Mode,UID,GID,Meta,File Name\n", "Thu Jan 02 2020 03:04:05.600000000,9,macb,r/rrw-r--r--,1000,100,"}},
+	} {
+		out := runOutput(t, tc.args...)
+		for _, want := range tc.want {
+			if !strings.Contains(out, want) {
+				t.Errorf("extfs %s printed\n%s\nwant it to contain %q", strings.Join(tc.args, " "), out, want)
+			}
+		}
+	}
+}
+
+func TestOffset(t *testing.T) {
+	img := writeImage(t, 1<<20)
+	if out := runOutput(t, "cat", "-offset", "1048576", img, "etc/hostname"); out != "evidence\n" {
+		t.Errorf("cat printed %q", out)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"cat", img, "etc/hostname"}, &stdout, &stderr); err == nil {
+		t.Errorf("cat without offset succeeded")
+	}
+}
+
+func TestExtract(t *testing.T) {
+	img := writeImage(t, 0)
+	dest := filepath.Join(t.TempDir(), "out")
+	runOutput(t, "extract", img, "/", dest)
+
+	if data, err := os.ReadFile(filepath.Join(dest, "etc", "passwd")); err != nil || string(data) != "root:x:0:0::/root:/bin/sh\n" {
+		t.Errorf("etc/passwd holds %q, %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "etc", "passwd")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("etc/passwd stat: %v, %v", info, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "home")); err != nil || target != "etc" {
+		t.Errorf("home links to %q, %v", target, err)
+	}
+
+	dry := filepath.Join(t.TempDir(), "dry")
+	if out := runOutput(t, "extract", "-n", img, "/etc", dry); !strings.Contains(out, "/etc/passwd -> "+filepath.Join(dry, "passwd")) {
+		t.Errorf("extract -n printed %q", out)
+	}
+	if _, err := os.Lstat(dry); err == nil {
+		t.Errorf("extract -n created %s", dry)
+	}
+
+	file := filepath.Join(t.TempDir(), "hostname")
+	runOutput(t, "extract", img, "etc/hostname", file)
+	if data, err := os.ReadFile(file); err != nil || string(data) != "evidence\n" {
+		t.Errorf("hostname holds %q, %v", data, err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"frobnicate"}, {"ls"}} {
+		var stdout, stderr bytes.Buffer
+		if err := run(args, &stdout, &stderr); err != errUsage || stderr.Len() == 0 {
+			t.Errorf("run(%q) = %v, printed %q", args, err, stderr.String())
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	ext "github.com/asalih/go-ext"
+	"github.com/asalih/go-ext/timeline"
+	"golang.org/x/xerrors"
+)
+
+func bodyfileFlags(flags *flag.FlagSet) func(*ext.FileSystem, []string, io.Writer, io.Writer) error {
+	var deleted, md5 bool
+	var mountPoint string
+	flags.BoolVar(&deleted, "deleted", false, "include deleted inodes")
+	flags.BoolVar(&md5, "md5", false, "compute the MD5 digest of regular files")
+	flags.StringVar(&mountPoint, "m", "", "mount point `dir` to prefix the names with")
+	return func(fsys *ext.FileSystem, args []string, stdout, stderr io.Writer) error {
+		if len(args) != 0 {
+			return errors.New("bodyfile takes no arguments")
+		}
+		var failed int
+		err := timeline.WriteBodyfile(context.Background(), stdout, fsys, reportErrors(stderr, &failed),
+			timeline.WithDeleted(deleted), timeline.WithMD5(md5), timeline.WithMountPoint(mountPoint))
+		if err != nil {
+			return err
+		}
+		return unreadFiles(failed)
+	}
+}
+
+func timelineFlags(flags *flag.FlagSet) func(*ext.FileSystem, []string, io.Writer, io.Writer) error {
+	var deleted bool
+	var from, to, tz string
+	flags.BoolVar(&deleted, "deleted", false, "include deleted inodes")
+	flags.StringVar(&from, "from", "", "first `date` of the timeline, as 2006-01-02 or RFC 3339")
+	flags.StringVar(&to, "to", "", "last `date` of the timeline, as 2006-01-02 or RFC 3339")
+	flags.StringVar(&tz, "tz", "UTC", "time `zone` of the dates, as an IANA name or Local")
+	return func(fsys *ext.FileSystem, args []string, stdout, stderr io.Writer) error {
+		if len(args) != 0 {
+			return errors.New("timeline takes no arguments")
+		}
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return err
+		}
+		start, err := parseDate(from, loc, false)
+		if err != nil {
+			return err
+		}
+		end, err := parseDate(to, loc, true)
+		if err != nil {
+			return err
+		}
+
+		var records []timeline.Record
+		var failed int
+		err = timeline.Walk(context.Background(), fsys, func(r timeline.Record) error {
+			records = append(records, r)
+			return nil
+		}, reportErrors(stderr, &failed), timeline.WithDeleted(deleted))
+		if err != nil {
+			return err
+		}
+		if err := timeline.WriteCSV(stdout, timeline.Events(records, start, end), loc); err != nil {
+			return err
+		}
+		return unreadFiles(failed)
+	}
+}
+
+// reportErrors returns the option printing the files a timeline walk cannot
+// read to stderr and counting them in failed. They are skipped so that the
+// timeline holds as much as possible.
+func reportErrors(stderr io.Writer, failed *int) timeline.Option {
+	return timeline.WithErrorFunc(func(name string, err error) error {
+		fmt.Fprintf(stderr, "extfs: %s: %v\n", name, err)
+		*failed++
+		return nil
+	})
+}
+
+// unreadFiles returns the error reporting failed unreadable files, if any.
+func unreadFiles(failed int) error {
+	if failed > 0 {
+		return xerrors.Errorf("%d files could not be read", failed)
+	}
+	return nil
+}
+
+// parseDate parses a -from or -to date in loc. A day without a time stands for
+// its first nanosecond, or its last one if end is set. The empty date is the
+// zero time, which leaves the range open.
+func parseDate(s string, loc *time.Location, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, xerrors.Errorf("invalid date %q, want 2006-01-02 or RFC 3339", s)
+	}
+	return t, nil
+}
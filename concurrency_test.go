@@ -0,0 +1,162 @@
+package ext
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sync"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+// These tests are meant to be run with the race detector. They use tiny caches
+// so that goroutines constantly evict each other's inodes and blocks.
+
+const concurrentWorkers = 8
+
+func newConcurrentFS(t *testing.T) (*FileSystem, map[string]testimage.Entry) {
+	t.Helper()
+	entries := testEntries()
+	b := testimage.New(testimage.Ext4())
+	for _, e := range entries {
+		b.Add(e)
+	}
+	img, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewFS(bytes.NewReader(img), WithInodeCacheSize(16), WithBlockCacheSize(64<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys, entries
+}
+
+// runConcurrently calls fn from concurrentWorkers goroutines and reports the
+// errors they return.
+func runConcurrently(t *testing.T, fn func(worker int) error) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentWorkers)
+	for i := 0; i < concurrentWorkers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			if err := fn(worker); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestConcurrentWalkAndRead(t *testing.T) {
+	fsys, entries := newConcurrentFS(t)
+
+	runConcurrently(t, func(worker int) error {
+		files := 0
+		err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if _, err := d.Info(); err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			got, err := fs.ReadFile(fsys, path)
+			if err != nil {
+				return err
+			}
+			e := entries[path]
+			if e.Link != "" {
+				e = entries[e.Link]
+			}
+			// Sparse files read as their data followed by zeros.
+			want := make([]byte, len(got))
+			copy(want, e.Data)
+			if !bytes.Equal(got, want) {
+				t.Errorf("worker %d: %s content mismatch", worker, path)
+			}
+			files++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if files == 0 {
+			t.Errorf("worker %d: walk found no files", worker)
+		}
+		return nil
+	})
+
+	if stats := fsys.InodeCacheStats(); stats.Evictions == 0 {
+		t.Errorf("inode cache never evicted, stats %+v", stats)
+	}
+}
+
+func TestConcurrentReadAt(t *testing.T) {
+	fsys, entries := newConcurrentFS(t)
+	want := entries["big.bin"].Data
+
+	f, err := fsys.Open("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ra := f.(io.ReaderAt)
+
+	runConcurrently(t, func(worker int) error {
+		buf := make([]byte, 5000)
+		for off := int64(worker * 777); off < int64(len(want)); off += int64(len(buf)) * concurrentWorkers {
+			n, err := ra.ReadAt(buf, off)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if !bytes.Equal(buf[:n], want[off:off+int64(n)]) {
+				t.Errorf("worker %d: ReadAt(%d) content mismatch", worker, off)
+			}
+		}
+		return nil
+	})
+}
+
+func TestConcurrentSharedRead(t *testing.T) {
+	fsys, entries := newConcurrentFS(t)
+	want := entries["big.bin"].Data
+
+	f, err := fsys.Open("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Goroutines sharing a file position must together read every byte
+	// exactly once.
+	var mu sync.Mutex
+	total := 0
+	runConcurrently(t, func(worker int) error {
+		buf := make([]byte, 4096+worker)
+		for {
+			n, err := f.Read(buf)
+			mu.Lock()
+			total += n
+			mu.Unlock()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+	if total != len(want) {
+		t.Errorf("read %d bytes in total, want %d", total, len(want))
+	}
+}
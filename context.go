@@ -0,0 +1,76 @@
+package ext
+
+import (
+	"context"
+	"io"
+	"io/fs"
+)
+
+// ContextReaderAt is implemented by devices which can abandon a read once its
+// context is done, such as network or cloud storage backed readers. The
+// context-aware methods of FileSystem read through ReadAtContext when the
+// device passed to NewFS implements it.
+type ContextReaderAt interface {
+	io.ReaderAt
+
+	// ReadAtContext is ReadAt, abandoned with ctx.Err() when ctx is done.
+	ReadAtContext(ctx context.Context, p []byte, off int64) (int, error)
+}
+
+// contextReaderAt binds a context to the reads of a device. Reads fail with
+// ctx.Err() once ctx is done, and are passed ctx if the device is a
+// ContextReaderAt.
+type contextReaderAt struct {
+	ctx context.Context
+	r   io.ReaderAt
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (c *contextReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if cr, ok := c.r.(ContextReaderAt); ok {
+		return cr.ReadAtContext(c.ctx, p, off)
+	}
+	return c.r.ReadAt(p, off)
+}
+
+// withContext returns a view of f whose device reads are bound to ctx. The
+// view shares the caches of f, and everything opened or listed through it
+// keeps reading with ctx.
+func (f *FileSystem) withContext(ctx context.Context) *FileSystem {
+	root := f.root()
+	view := *root
+	view.dev = &contextReaderAt{ctx: ctx, r: root.dev}
+	view.meta = root.meta.withDevice(view.dev)
+	view.base = root
+	return &view
+}
+
+// root returns the FileSystem created by NewFS that f is a view of, or f
+// itself.
+func (f *FileSystem) root() *FileSystem {
+	if f.base != nil {
+		return f.base
+	}
+	return f
+}
+
+// OpenContext is Open bound to ctx. Reads from the returned file, and from the
+// entries of a returned directory, keep using ctx and fail with ctx.Err()
+// once it is done.
+func (f *FileSystem) OpenContext(ctx context.Context, name string) (fs.File, error) {
+	return f.withContext(ctx).Open(name)
+}
+
+// ReadDirContext is ReadDir bound to ctx. Loading the inodes of the returned
+// entries keeps using ctx.
+func (f *FileSystem) ReadDirContext(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	return f.withContext(ctx).ReadDir(name)
+}
+
+// StatContext is Stat bound to ctx.
+func (f *FileSystem) StatContext(ctx context.Context, name string) (fs.FileInfo, error) {
+	return f.withContext(ctx).Stat(name)
+}
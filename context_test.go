@@ -0,0 +1,153 @@
+package ext
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+type ctxKey struct{}
+
+// hangingDevice is a ContextReaderAt which records the contexts it is passed
+// and, once hang is set, blocks reads until their context is done.
+type hangingDevice struct {
+	r       io.ReaderAt
+	hang    atomic.Bool
+	ctxSeen atomic.Int64
+}
+
+func (d *hangingDevice) ReadAt(p []byte, off int64) (int, error) {
+	return d.r.ReadAt(p, off)
+}
+
+func (d *hangingDevice) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if ctx.Value(ctxKey{}) != nil {
+		d.ctxSeen.Add(1)
+	}
+	if d.hang.Load() {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	return d.r.ReadAt(p, off)
+}
+
+func newContextFS(t *testing.T) (*FileSystem, *hangingDevice) {
+	t.Helper()
+	b := testimage.New(testimage.Ext4())
+	for _, e := range testEntries() {
+		b.Add(e)
+	}
+	dev := &hangingDevice{r: bytes.NewReader(b.MustBuild())}
+	// Without caches every operation reaches the device.
+	fsys, err := NewFS(dev, WithInodeCacheSize(0), WithBlockCacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys, dev
+}
+
+func TestContextCanceled(t *testing.T) {
+	fsys, _ := newContextFS(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := fsys.OpenContext(ctx, "a.txt"); !errors.Is(err, context.Canceled) {
+		t.Errorf("OpenContext returned %v", err)
+	}
+	if _, err := fsys.ReadDirContext(ctx, "dir"); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadDirContext returned %v", err)
+	}
+	if _, err := fsys.StatContext(ctx, "dir/sub/deep.txt"); !errors.Is(err, context.Canceled) {
+		t.Errorf("StatContext returned %v", err)
+	}
+	s := fsys.ScanInodesContext(ctx)
+	if s.Next() || !errors.Is(s.Err(), context.Canceled) {
+		t.Errorf("ScanInodesContext returned %v", s.Err())
+	}
+	err := fsys.Walk(ctx, ".", func(path string, d fs.DirEntry, err error) error {
+		return err
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Walk returned %v", err)
+	}
+
+	// The FileSystem itself is not affected.
+	if _, err := fs.ReadFile(fsys, "a.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestContextBoundFile(t *testing.T) {
+	fsys, _ := newContextFS(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, err := fsys.OpenContext(ctx, "big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 4096)
+	if _, err := f.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if _, err := f.Read(buf); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read after cancel returned %v", err)
+	}
+}
+
+func TestContextReaderAt(t *testing.T) {
+	fsys, dev := newContextFS(t)
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+
+	if _, err := fsys.StatContext(ctx, "dir/sub/deep.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if dev.ctxSeen.Load() == 0 {
+		t.Error("device was not passed the context")
+	}
+
+	// A hung device does not hang the walk past its deadline.
+	dev.hang.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := fsys.Walk(ctx, ".", func(path string, d fs.DirEntry, err error) error {
+		return err
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Walk returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Walk returned after %v", elapsed)
+	}
+}
+
+func TestScanInodesContextStops(t *testing.T) {
+	fsys, _ := newContextFS(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := fsys.ScanInodesContext(ctx)
+	for i := 0; i < 3; i++ {
+		if !s.Next() {
+			t.Fatal(s.Err())
+		}
+	}
+	cancel()
+	if s.Next() {
+		t.Error("scan went on after cancel")
+	}
+	if !errors.Is(s.Err(), context.Canceled) {
+		t.Errorf("Err() = %v", s.Err())
+	}
+}
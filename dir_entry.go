@@ -0,0 +1,87 @@
+package ext
+
+import (
+	"io/fs"
+	"sync"
+
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/linux"
+)
+
+// dirEntry is a named link to an inode found in a directory. Names live here
+// rather than in the inode since an inode may be cached and shared by all of
+// its hard links.
+//
+// The inode itself is only read when it is needed. If the filesystem records
+// file types in its dirents, Name, IsDir and Type never touch the inode.
+type dirEntry struct {
+	fsR      *FileSystem
+	name     string
+	inodeNum uint32
+
+	// typ is the file type recorded in the dirent. Only valid if typeKnown.
+	typ       fs.FileMode
+	typeKnown bool
+
+	// once guards loading inode and err.
+	once  sync.Once
+	inode *inode
+	err   error
+}
+
+var _ fs.DirEntry = (*dirEntry)(nil)
+
+// newDirEntry returns the entry for dirent d, found in a directory of fsR.
+func newDirEntry(fsR *FileSystem, d disklayout.Dirent) *dirEntry {
+	entry := &dirEntry{
+		fsR:      fsR,
+		name:     d.Name(),
+		inodeNum: d.Inode(),
+	}
+	if inodeType, ok := d.FileType(); ok && inodeType != disklayout.Anonymous {
+		entry.typ = linux.FileMode(inodeType.LinuxType()).FSMode().Type()
+		entry.typeKnown = true
+	}
+	return entry
+}
+
+// getInode returns the inode the entry links to, reading it on first use.
+func (d *dirEntry) getInode() (*inode, error) {
+	d.once.Do(func() {
+		d.inode, d.err = d.fsR.getInode(d.inodeNum)
+	})
+	return d.inode, d.err
+}
+
+// Name implements fs.DirEntry.Name.
+func (d *dirEntry) Name() string {
+	return d.name
+}
+
+// IsDir implements fs.DirEntry.IsDir.
+func (d *dirEntry) IsDir() bool {
+	return d.Type().IsDir()
+}
+
+// Type implements fs.DirEntry.Type. Without file types in dirents the inode
+// is read; if that fails the type is reported as fs.ModeIrregular and the
+// error is returned by Info.
+func (d *dirEntry) Type() fs.FileMode {
+	if d.typeKnown {
+		return d.typ
+	}
+	in, err := d.getInode()
+	if err != nil {
+		return fs.ModeIrregular
+	}
+	return in.diskInode.Mode().FSMode().Type()
+}
+
+// Info implements fs.DirEntry.Info.
+func (d *dirEntry) Info() (fs.FileInfo, error) {
+	in, err := d.getInode()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{inode: in, name: d.name}, nil
+}
@@ -0,0 +1,98 @@
+package ext
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+// typedEntries are one entry of every file type, by name.
+var typedEntries = map[string]testimage.Entry{
+	"dir":  {Name: "dir", Mode: fs.ModeDir | 0755},
+	"file": {Name: "file", Mode: 0644, Data: []byte("data")},
+	"link": {Name: "link", Mode: fs.ModeSymlink | 0777, Target: "file"},
+	"chr":  {Name: "chr", Mode: fs.ModeDevice | fs.ModeCharDevice | 0600, Major: 1, Minor: 3},
+	"blk":  {Name: "blk", Mode: fs.ModeDevice | 0600, Major: 8, Minor: 1},
+	"fifo": {Name: "fifo", Mode: fs.ModeNamedPipe | 0600},
+	"sock": {Name: "sock", Mode: fs.ModeSocket | 0600},
+}
+
+func newTypedFS(t *testing.T, opts testimage.Options) *FileSystem {
+	t.Helper()
+
+	b := testimage.New(opts)
+	for _, e := range typedEntries {
+		b.Add(e)
+	}
+	fsys, err := NewFS(bytes.NewReader(b.MustBuild()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestReadDirIsLazy(t *testing.T) {
+	fsys := newTypedFS(t, testimage.Ext4())
+
+	entries, err := fsys.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the root directory itself has been read.
+	if got := fsys.InodeCacheStats().Len; got != 1 {
+		t.Fatalf("ReadDir loaded %d inodes, want 1", got)
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == "lost+found" {
+			continue
+		}
+		want := typedEntries[entry.Name()].Mode
+		if entry.Type() != want.Type() || entry.IsDir() != want.IsDir() {
+			t.Errorf("%s: Type() = %v, want %v", entry.Name(), entry.Type(), want.Type())
+		}
+	}
+	if got := fsys.InodeCacheStats().Len; got != 1 {
+		t.Fatalf("Type and IsDir loaded %d inodes, want 1", got)
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name() != entry.Name() || info.Mode().Type() != entry.Type() {
+			t.Errorf("%s: Info() returned %s with type %v", entry.Name(), info.Name(), info.Mode().Type())
+		}
+	}
+	if got, want := fsys.InodeCacheStats().Len, len(entries)+1; got != want {
+		t.Errorf("Info loaded %d inodes, want %d", got, want)
+	}
+}
+
+func TestReadDirWithoutFileTypes(t *testing.T) {
+	fsys := newTypedFS(t, testimage.Options{BlockSize: 1024, InodeSize: 128, NoFileType: true})
+
+	entries, err := fsys.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == "lost+found" {
+			continue
+		}
+		want := typedEntries[entry.Name()].Mode
+		if entry.Type() != want.Type() {
+			t.Errorf("%s: Type() = %v, want %v", entry.Name(), entry.Type(), want.Type())
+		}
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%s: Info().Mode() = %v, want %v", entry.Name(), info.Mode(), want)
+		}
+	}
+}
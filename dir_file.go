@@ -0,0 +1,75 @@
+package ext
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+
+	"github.com/asalih/go-ext/syserror"
+)
+
+// dirFile is an open directory. ReadDir streams its entries from disk in
+// on-disk order, so paging through a huge directory takes constant memory.
+// It is safe for concurrent use.
+type dirFile struct {
+	// fsR is the FileSystem, possibly a context-bound view, the directory was
+	// opened through. fsR and info are immutable.
+	fsR  *FileSystem
+	info *fileInfo
+
+	// mu protects it.
+	mu sync.Mutex
+	it *direntIterator
+}
+
+var _ fs.ReadDirFile = (*dirFile)(nil)
+
+func newDirFile(fsR *FileSystem, info *fileInfo) *dirFile {
+	return &dirFile{
+		fsR:  fsR,
+		info: info,
+		it:   info.impl.(*directory).dirents(fsR),
+	}
+}
+
+// Stat implements fs.File.Stat.
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+// Read implements fs.File.Read. Directories can not be read.
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, syserror.EISDIR
+}
+
+// Close implements fs.File.Close.
+func (d *dirFile) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.ReadDir. Entries are returned in on-disk
+// order, without "." and "..".
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var entries []fs.DirEntry
+	for n <= 0 || len(entries) < n {
+		dirent, err := d.it.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, err
+		}
+		if name := dirent.Name(); name == "." || name == ".." {
+			continue
+		}
+		entries = append(entries, newDirEntry(d.fsR, dirent))
+	}
+
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
@@ -0,0 +1,117 @@
+package ext
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/testimage"
+	"github.com/asalih/go-ext/syserror"
+)
+
+func TestDirFileReadDirPaging(t *testing.T) {
+	forEachImage(t, func(t *testing.T, fsys *FileSystem, b *testimage.Builder, entries map[string]testimage.Entry) {
+		all, err := fsys.ReadDir("htree")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := fsys.Open("htree")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		dir, ok := f.(fs.ReadDirFile)
+		if !ok {
+			t.Fatalf("Open returned %T for a directory", f)
+		}
+
+		var paged []fs.DirEntry
+		for {
+			page, err := dir.ReadDir(7)
+			if err == io.EOF {
+				if len(page) != 0 {
+					t.Errorf("ReadDir returned %d entries with io.EOF", len(page))
+				}
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) == 0 || len(page) > 7 {
+				t.Fatalf("ReadDir(7) returned %d entries", len(page))
+			}
+			paged = append(paged, page...)
+		}
+
+		// Pages come in on-disk order, FileSystem.ReadDir sorts the same
+		// entries by name.
+		if len(paged) != len(all) || len(paged) != htreeEntries {
+			t.Fatalf("paged through %d entries, ReadDir returned %d, want %d", len(paged), len(all), htreeEntries)
+		}
+		sort.Slice(paged, func(i, j int) bool { return paged[i].Name() < paged[j].Name() })
+		for i := range paged {
+			if paged[i].Name() != all[i].Name() {
+				t.Fatalf("entry %d is %q, ReadDir returned %q", i, paged[i].Name(), all[i].Name())
+			}
+			if paged[i].Type() != 0 {
+				t.Errorf("%s has type %v", paged[i].Name(), paged[i].Type())
+			}
+		}
+
+		// An exhausted directory returns nothing more.
+		if rest, err := dir.ReadDir(-1); len(rest) != 0 || err != nil {
+			t.Errorf("ReadDir(-1) at the end returned %d entries, %v", len(rest), err)
+		}
+	})
+}
+
+func TestDirFileReadDirAll(t *testing.T) {
+	fsys, _ := newConcurrentFS(t)
+
+	f, err := fsys.Open(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.IsDir() {
+		t.Fatalf("Stat of the root directory returned %v, %v", info, err)
+	}
+	if _, err := f.Read(make([]byte, 1)); !errors.Is(err, syserror.EISDIR) {
+		t.Errorf("Read of a directory returned %v, want %v", err, syserror.EISDIR)
+	}
+
+	entries, err := f.(fs.ReadDirFile).ReadDir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := fsys.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Errorf("ReadDir(-1) returned %d entries, want %d", len(entries), len(want))
+	}
+	for _, e := range entries {
+		if e.Name() == "." || e.Name() == ".." {
+			t.Errorf("ReadDir returned %q", e.Name())
+		}
+	}
+}
+
+func TestOpenPathErrors(t *testing.T) {
+	fsys, _ := newConcurrentFS(t)
+
+	for _, name := range []string{"missing", "a.txt/below", "dir/missing/deep.txt"} {
+		if _, err := fsys.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Open(%q) returned %v, want %v", name, err, fs.ErrNotExist)
+		}
+	}
+	if _, err := fsys.ReadDir("a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadDir of a file returned %v, want %v", err, fs.ErrNotExist)
+	}
+}
@@ -1,76 +1,161 @@
 package ext
 
 import (
+	"io"
+
 	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/syserror"
+	"golang.org/x/xerrors"
 )
 
-type directoryEntries map[string]disklayout.Dirent
-
-// directory represents a directory inode. It holds the childList in memory.
+// directory represents a directory inode. Its dirents are not kept in memory
+// but streamed from disk by a direntIterator whenever they are needed, so that
+// huge directories cost no more memory than small ones.
 type directory struct {
 	inode inode
 
-	// childMap maps the child's filename to the dirent structure stored in
-	// childList. This adds some data replication but helps in faster path
-	// traversal. For consistency, key == childMap[key].diskDirent.FileName().
-	// Immutable.
-	childMap directoryEntries
+	// data maps the directory blocks. Immutable.
+	data *regularFile
+
+	// newDirent tells whether dirents hold a file type. Immutable.
+	newDirent bool
 }
 
 // newDirectory is the directory constructor.
 func newDirectory(args inodeArgs, newDirent bool) (*directory, error) {
 	file := &directory{
-		childMap: make(directoryEntries),
+		newDirent: newDirent,
 	}
 	file.inode.init(args, file)
 
-	// Initialize childList by reading dirents from the underlying file.
-	if args.diskInode.Flags().Index {
-		// TODO(b/134676337): Support hash tree directories. Currently only the '.'
-		// and '..' entries are read in.
-
-		// Users cannot navigate this hash tree directory yet.
-		// log.Warningf("hash tree directory being used which is unsupported")
-		return file, nil
-	}
-
 	// The dirents are organized in a linear array in the file data.
-	// Extract the file data and decode the dirents.
+	//
+	// Hash tree directories need no special casing: the htree root hides its
+	// index behind the ".." record and interior nodes are a single unused
+	// dirent spanning the block, so a linear scan sees every leaf entry.
 	regFile, err := newRegularFile(args)
 	if err != nil {
 		return nil, err
 	}
+	file.data = regFile
+
+	return file, nil
+}
+
+// dirents returns an iterator over the dirents in use in d, in on-disk order,
+// reading the directory blocks through fsR.
+func (d *directory) dirents(fsR *FileSystem) *direntIterator {
+	return &direntIterator{
+		r:         d.data.reader(fsR),
+		size:      d.inode.diskInode.Size(),
+		blkSize:   d.inode.blkSize,
+		newDirent: d.newDirent,
+		names:     d.inode.crypt,
+	}
+}
+
+// direntIterator decodes the linear array of dirents of a directory one block
+// at a time. Records which do not fit within their block or their own record
+// length are reported as corruption. It is not safe for concurrent use.
+type direntIterator struct {
+	r         io.ReaderAt
+	size      uint64
+	blkSize   uint64
+	newDirent bool
+
+	// names presents the names of an encrypted directory. It is nil for
+	// unencrypted directories.
+	names *fileCrypt
+
+	// blk holds the directory block starting at blkOff. off is the offset of
+	// the next dirent in the directory.
+	blk    []byte
+	blkOff uint64
+	off    uint64
+
+	// scratch is used to unmarshal dirents, which may be shorter than
+	// disklayout.DirentSize at the end of a block.
+	scratch []byte
+}
 
-	// buf is used as scratch space for reading in dirents from disk and
-	// unmarshalling them into dirent structs.
-	buf := make([]byte, disklayout.DirentSize)
-	size := args.diskInode.Size()
-	for off, inc := uint64(0), uint64(0); off < size; off += inc {
-		toRead := size - off
-		if toRead > disklayout.DirentSize {
-			toRead = disklayout.DirentSize
+// next returns the next dirent in use, or io.EOF past the last one.
+func (it *direntIterator) next() (disklayout.Dirent, error) {
+	for it.off < it.size {
+		if it.blk == nil || it.off >= it.blkOff+uint64(len(it.blk)) {
+			if err := it.readBlock(); err != nil {
+				return nil, err
+			}
 		}
-		if n, err := regFile.impl.ReadAt(buf[:toRead], int64(off)); uint64(n) < toRead {
-			return nil, err
+
+		rest := it.blk[it.off-it.blkOff:]
+		if it.scratch == nil {
+			it.scratch = make([]byte, disklayout.DirentSize)
 		}
+		// Clear whatever the previous dirent left beyond the bytes copied.
+		zero(it.scratch[copy(it.scratch, rest):])
 
 		var curDirent disklayout.Dirent
-		if newDirent {
+		if it.newDirent {
 			curDirent = &disklayout.DirentNew{}
 		} else {
 			curDirent = &disklayout.DirentOld{}
 		}
-		curDirent.UnmarshalBytes(buf)
+		if err := curDirent.UnmarshalBytes(it.scratch); err != nil {
+			return nil, err
+		}
 
-		if curDirent.Inode() != 0 && len(curDirent.Name()) != 0 {
-			// Inode number and name length fields being set to 0 is used to indicate
-			// an unused dirent.
-			file.childMap[curDirent.Name()] = curDirent
+		recLen := uint64(curDirent.RecordSize())
+		if recLen < disklayout.DirentHeaderSize || recLen%4 != 0 || recLen > uint64(len(rest)) {
+			return nil, xerrors.Errorf("dirent at offset %d has record length %d: %w", it.off, recLen, syserror.EFSCORRUPTED)
+		}
+		if nameLen := uint64(curDirent.NameLen()); nameLen > disklayout.MaxFileName || disklayout.DirentHeaderSize+nameLen > recLen {
+			return nil, xerrors.Errorf("dirent at offset %d has name length %d: %w", it.off, nameLen, syserror.EFSCORRUPTED)
 		}
 
 		// The next dirent is placed exactly after this dirent record on disk.
-		inc = uint64(curDirent.RecordSize())
+		it.off += recLen
+
+		// Inode number and name length fields being set to 0 is used to
+		// indicate an unused dirent.
+		if curDirent.Inode() != 0 && curDirent.NameLen() != 0 {
+			if name := curDirent.Name(); it.names != nil && name != "." && name != ".." {
+				return &namedDirent{Dirent: curDirent, name: it.names.name([]byte(name))}, nil
+			}
+			return curDirent, nil
+		}
 	}
+	return nil, io.EOF
+}
 
-	return file, nil
+// readBlock reads the directory block holding offset it.off, or the rest of
+// the directory if it ends before the block does.
+func (it *direntIterator) readBlock() error {
+	it.blkOff = it.off - it.off%it.blkSize
+	n := it.blkSize
+	if it.blkOff+n > it.size {
+		n = it.size - it.blkOff
+	}
+	if it.blk == nil {
+		it.blk = make([]byte, it.blkSize)
+	}
+	it.blk = it.blk[:n]
+	if read, err := it.r.ReadAt(it.blk, int64(it.blkOff)); uint64(read) < n {
+		if err == nil || err == io.EOF {
+			err = syserror.EIO
+		}
+		return err
+	}
+	return nil
+}
+
+// namedDirent is a dirent of an encrypted directory, named by its plaintext
+// or no-key name instead of the ciphertext stored on disk.
+type namedDirent struct {
+	disklayout.Dirent
+	name string
+}
+
+// Name implements disklayout.Dirent.Name.
+func (d *namedDirent) Name() string {
+	return d.name
 }
@@ -2,6 +2,16 @@ package disklayout
 
 import "github.com/asalih/go-ext/common"
 
+const (
+	// BgDesc32Size is the size of the block group descriptor without the
+	// 64-bit feature.
+	BgDesc32Size = 32
+
+	// BgDesc64Size is the minimum size of the block group descriptor when the
+	// 64-bit feature is set.
+	BgDesc64Size = 64
+)
+
 // BlockGroup represents a Linux ext block group descriptor. An ext file system
 // is split into a series of block groups. This provides an access layer to
 // information needed to access and use a block group.
@@ -10,7 +20,7 @@ import "github.com/asalih/go-ext/common"
 //   - The block group descriptor table is always placed in the blocks
 //     immediately after the block containing the superblock.
 //   - The 1st block group descriptor in the original table is in the
-//      (sb.FirstDataBlock() + 1)th block.
+//     (sb.FirstDataBlock() + 1)th block.
 //   - See SuperBlock docs to see where the block group descriptor table is
 //     replicated.
 //   - sb.BgDescSize() must be used as the block group descriptor entry size
@@ -10,6 +10,10 @@ const (
 
 	// DirentSize is the size of ext dirent structures.
 	DirentSize = 263
+
+	// DirentHeaderSize is the size of the fixed part of a dirent which precedes
+	// the file name.
+	DirentHeaderSize = 8
 )
 
 var (
@@ -48,6 +52,10 @@ type Dirent interface {
 	// the current dirent. Must be a multiple of 4.
 	RecordSize() uint16
 
+	// NameLen returns the length of the file name as recorded on disk. A
+	// corrupted dirent may report more than MaxFileName bytes.
+	NameLen() uint16
+
 	// FileName returns the name of the file. Can be at most 255 is length.
 	Name() string
 
@@ -42,6 +42,9 @@ func (d *DirentNew) Inode() uint32 { return d.InodeNumber }
 // RecordSize implements Dirent.RecordSize.
 func (d *DirentNew) RecordSize() uint16 { return d.RecordLength }
 
+// NameLen implements Dirent.NameLen.
+func (d *DirentNew) NameLen() uint16 { return uint16(d.NameLength) }
+
 // Name implements Dirent.FileName.
 func (d *DirentNew) Name() string {
 	return string(d.FileNameRaw[:d.NameLength])
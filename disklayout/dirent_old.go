@@ -18,7 +18,7 @@ type DirentOld struct {
 	InodeNumber  uint32            `struc:"uint32,little"`
 	RecordLength uint16            `struc:"uint16,little"`
 	NameLength   uint16            `struc:"uint16,little"`
-	FileNameRaw  [MaxFileName]byte `struc:"[]byte"`
+	FileNameRaw  [MaxFileName]byte `struc:"[255]byte"`
 }
 
 // Compiles only if DirentOld implements Dirent.
@@ -38,9 +38,16 @@ func (d *DirentOld) Inode() uint32 { return d.InodeNumber }
 // RecordSize implements Dirent.RecordSize.
 func (d *DirentOld) RecordSize() uint16 { return d.RecordLength }
 
+// NameLen implements Dirent.NameLen.
+func (d *DirentOld) NameLen() uint16 { return d.NameLength }
+
 // FileName implements Dirent.FileName.
 func (d *DirentOld) Name() string {
-	return string(d.FileNameRaw[:d.NameLength])
+	nameLen := int(d.NameLength)
+	if nameLen > MaxFileName {
+		nameLen = MaxFileName
+	}
+	return string(d.FileNameRaw[:nameLen])
 }
 
 // FileType implements Dirent.FileType.
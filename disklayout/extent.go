@@ -30,6 +30,10 @@ const (
 
 	// ExtentMagic is the magic number which must be present in the header.
 	ExtentMagic = 0xf30a
+
+	// MaxExtentTreeHeight is the maximum height of an extent tree. This
+	// emulates EXT4_MAX_EXTENT_DEPTH in fs/ext4/ext4_extents.h.
+	MaxExtentTreeHeight = 5
 )
 
 // ExtentEntryPair couples an in-memory ExtendNode with the ExtentEntry that
@@ -134,7 +138,11 @@ func (ei *ExtentIdx) UnmarshalBytes(src []byte) error {
 // Extent represents the ext4_extent struct in ext4. Only present in leaf
 // nodes. Sorted in ascending order based on FirstFileBlock since Linux does a
 // binary search on this. This points to an array of data blocks containing the
-// file data. It covers `Length` data blocks starting from `StartBlock`.
+// file data. It covers Len() data blocks starting from `StartBlock`.
+//
+// Length above ExtentInitMaxLen marks an unwritten extent, whose blocks are
+// allocated, e.g. by fallocate(2), but read as zeros. Its length is then
+// Length - ExtentInitMaxLen.
 //
 // +marshal
 type Extent struct {
@@ -155,6 +163,23 @@ func (e *Extent) UnmarshalBytes(src []byte) error {
 	return common.UnmarshalBytes(e, src)
 }
 
+// ExtentInitMaxLen is the maximum length of an initialized extent.
+const ExtentInitMaxLen = 1 << 15
+
+// Len returns the number of blocks the extent covers.
+func (e *Extent) Len() uint16 {
+	if e.Length > ExtentInitMaxLen {
+		return e.Length - ExtentInitMaxLen
+	}
+	return e.Length
+}
+
+// Unwritten reports whether the extent is unwritten, so that its blocks read
+// as zeros.
+func (e *Extent) Unwritten() bool {
+	return e.Length > ExtentInitMaxLen
+}
+
 // FileBlock implements ExtentEntry.FileBlock.
 func (e *Extent) FileBlock() uint32 {
 	return e.FirstFileBlock
@@ -0,0 +1,70 @@
+package disklayout
+
+import (
+	"testing"
+
+	"github.com/asalih/go-ext/common"
+)
+
+// unmarshalTargets returns one fresh value of every on-disk structure.
+func unmarshalTargets() []common.Unmarshal {
+	return []common.Unmarshal{
+		&SuperBlockOld{},
+		&SuperBlock32Bit{},
+		&SuperBlock64Bit{},
+		&BlockGroup32Bit{},
+		&BlockGroup64Bit{},
+		&InodeOld{},
+		&InodeNew{},
+		&DirentOld{},
+		&DirentNew{},
+		&ExtentHeader{},
+		&ExtentIdx{},
+		&Extent{},
+	}
+}
+
+func FuzzUnmarshalBytes(f *testing.F) {
+	f.Add(make([]byte, 1024))
+	f.Add([]byte{2, 0, 0, 0, 12, 0, 1, 2, '.', 0, 0, 0})
+	f.Add([]byte{0x0a, 0xf3, 1, 0, 4, 0, 0, 0, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, v := range unmarshalTargets() {
+			// UnmarshalBytes requires at least SizeBytes() of input.
+			if len(data) < v.SizeBytes() {
+				continue
+			}
+			if err := v.UnmarshalBytes(data); err != nil {
+				continue
+			}
+
+			switch v := v.(type) {
+			case SuperBlock:
+				_ = v.BlockSize()
+				_ = v.ClusterSize()
+				_ = v.BlocksCount()
+				_ = v.IncompatibleFeatures()
+				_ = v.ExtType()
+			case BlockGroup:
+				_ = v.InodeTable()
+				_ = v.Flags()
+			case Inode:
+				_ = v.Mode()
+				_ = v.Size()
+				_ = v.AccessTime()
+				_ = v.ChangeTime()
+				_ = v.ModificationTime()
+				_ = v.Flags()
+			case Dirent:
+				if name := v.Name(); len(name) > MaxFileName {
+					t.Fatalf("dirent name is %d bytes long", len(name))
+				}
+				_, _ = v.FileType()
+			case ExtentEntry:
+				_ = v.FileBlock()
+				_ = v.PhysicalBlock()
+			}
+		}
+	})
+}
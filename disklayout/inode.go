@@ -79,6 +79,10 @@ type Inode interface {
 	// actually overwritten.
 	DeletionTime() time.Time
 
+	// BirthTime returns the creation time and whether the inode records one.
+	// Only ext4 inodes with room for the extra fields do.
+	BirthTime() (time.Time, bool)
+
 	// LinksCount returns the number of hard links to this inode.
 	//
 	// Normally there is an upper limit on the number of hard links:
@@ -134,6 +138,9 @@ const (
 	// updated.
 	InNoAccessTime = 0x80
 
+	// InEncrypt indicates that this inode is encrypted with fscrypt.
+	InEncrypt = 0x800
+
 	// InIndex indicates that this directory has hashed indexes.
 	InIndex = 0x1000
 
@@ -173,6 +180,7 @@ type InodeFlags struct {
 	Append       bool
 	NoDump       bool
 	NoAccessTime bool
+	Encrypt      bool
 	Index        bool
 	JournalData  bool
 	DirSync      bool
@@ -203,6 +211,9 @@ func (f InodeFlags) ToInt() uint32 {
 	if f.NoAccessTime {
 		res |= InNoAccessTime
 	}
+	if f.Encrypt {
+		res |= InEncrypt
+	}
 	if f.Index {
 		res |= InIndex
 	}
@@ -243,6 +254,7 @@ func InodeFlagsFromInt(f uint32) InodeFlags {
 		Append:       f&InAppend > 0,
 		NoDump:       f&InNoDump > 0,
 		NoAccessTime: f&InNoAccessTime > 0,
+		Encrypt:      f&InEncrypt > 0,
 		Index:        f&InIndex > 0,
 		JournalData:  f&InJournalData > 0,
 		DirSync:      f&InDirSync > 0,
@@ -95,3 +95,16 @@ func (in *InodeNew) AccessTime() time.Time {
 
 	return in.InodeOld.AccessTime()
 }
+
+// BirthTime implements Inode.BirthTime.
+func (in *InodeNew) BirthTime() (time.Time, bool) {
+	// The creation time needs ExtraInodeSize to cover inode.CreationTime, its
+	// nanoseconds and epoch bits inode.CreationTimeExtra as well.
+	switch {
+	case in.ExtraInodeSize >= 24:
+		return fromExtraTime(int32(in.CreationTime), in.CreationTimeExtra), true
+	case in.ExtraInodeSize >= 20:
+		return time.Unix(int64(int32(in.CreationTime)), 0), true
+	}
+	return time.Time{}, false
+}
@@ -105,6 +105,11 @@ func (in *InodeOld) DeletionTime() time.Time {
 	return time.Unix(int64(in.DeletionTimeRaw), 0)
 }
 
+// BirthTime implements Inode.BirthTime.
+func (in *InodeOld) BirthTime() (time.Time, bool) {
+	return time.Time{}, false
+}
+
 // LinksCount implements Inode.LinksCount.
 func (in *InodeOld) LinksCount() uint16 { return in.LinksCountRaw }
 
@@ -5,6 +5,12 @@ import "github.com/asalih/go-ext/common"
 const (
 	// SbOffset is the absolute offset at which the superblock is placed.
 	SbOffset = 1024
+
+	// MinBlockSize is the smallest data block size an ext fs can have.
+	MinBlockSize = 1024
+
+	// MaxBlockSize is the largest data block size Linux can mount.
+	MaxBlockSize = 65536
 )
 
 // SuperBlock should be implemented by structs representing the ext superblock.
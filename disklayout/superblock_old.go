@@ -92,7 +92,7 @@ func (sb *SuperBlockOld) InodeSize() uint16 { return OldInodeSize }
 func (sb *SuperBlockOld) InodesPerGroup() uint32 { return sb.InodesPerGroupRaw }
 
 // BgDescSize implements SuperBlock.BgDescSize.
-func (sb *SuperBlockOld) BgDescSize() uint16 { return 32 }
+func (sb *SuperBlockOld) BgDescSize() uint16 { return BgDesc32Size }
 
 // CompatibleFeatures implements SuperBlock.CompatibleFeatures.
 func (sb *SuperBlockOld) CompatibleFeatures() CompatFeatures { return CompatFeatures{} }
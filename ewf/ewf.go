@@ -0,0 +1,388 @@
+// Package ewf reads Expert Witness Compression Format (EWF) images, the E01
+// files written by EnCase, FTK Imager and ewfacquire. The media stored in an
+// image, possibly split over segment files E01, E02 and so on, is exposed as
+// an io.ReaderAt which can be passed to ext.NewFS or partition.Read.
+//
+// Chunks are decompressed on demand and kept in an LRU cache. The hashes
+// recorded at acquisition can be checked with Image.Verify.
+package ewf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"io"
+	"sort"
+
+	"github.com/asalih/go-ext/internal/ioutil"
+	"github.com/asalih/go-ext/internal/lru"
+	"golang.org/x/xerrors"
+)
+
+// DefaultChunkCacheSize is the memory limit, in bytes, of the cache of
+// decompressed chunks an Image uses unless configured otherwise with
+// WithChunkCacheSize.
+const DefaultChunkCacheSize = 16 << 20
+
+var (
+	// ErrNotEWF is returned for files which are not EWF segment files.
+	ErrNotEWF = errors.New("ewf: not an EWF image")
+
+	// ErrNoHash is returned by Image.Verify for images which record no hash.
+	ErrNoHash = errors.New("ewf: image records no hash")
+
+	// ErrHashMismatch is returned by Image.Verify when the media does not
+	// match the hashes recorded at acquisition.
+	ErrHashMismatch = errors.New("ewf: hash mismatch")
+)
+
+// Option configures an Image.
+type Option func(*options)
+
+type options struct {
+	chunkCacheSize int64
+}
+
+// WithChunkCacheSize sets the memory limit, in bytes, of the LRU cache of
+// decompressed chunks. A size of zero or less disables the cache.
+func WithChunkCacheSize(size int64) Option {
+	return func(o *options) {
+		o.chunkCacheSize = size
+	}
+}
+
+// Image is an EWF image. It is safe for concurrent use.
+type Image struct {
+	// BytesPerSector and SectorCount describe the acquired media.
+	BytesPerSector uint32
+	SectorCount    uint64
+
+	// ChunkSize is the size of the chunks the media is compressed in.
+	ChunkSize int64
+
+	// Header holds the case information of the image by its EWF key, such as
+	// "c" for the case number, "e" for the examiner or "a" for the
+	// description. It is nil if the image has no readable header.
+	Header map[string]string
+
+	// MD5 and SHA1 are the hashes of the media recorded at acquisition, or
+	// nil.
+	MD5  []byte
+	SHA1 []byte
+
+	size     int64
+	segments []io.ReaderAt
+	closers  []io.Closer
+	chunks   []chunkLocation
+	cache    *lru.Cache[int, []byte]
+}
+
+// chunkLocation is where a chunk is stored.
+type chunkLocation struct {
+	segment      int
+	offset, size int64
+	compressed   bool
+}
+
+// New reads the EWF image made of segments, the segment files in any order.
+func New(segments []io.ReaderAt, opts ...Option) (*Image, error) {
+	o := options{chunkCacheSize: DefaultChunkCacheSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(segments) == 0 {
+		return nil, errors.New("ewf: no segment files")
+	}
+
+	type numbered struct {
+		number int
+		r      io.ReaderAt
+	}
+	sorted := make([]numbered, len(segments))
+	for i, r := range segments {
+		n, err := readSegmentNumber(r)
+		if err != nil {
+			return nil, xerrors.Errorf("ewf: segment file %d: %w", i, err)
+		}
+		sorted[i] = numbered{number: n, r: r}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].number < sorted[j].number
+	})
+
+	img := &Image{}
+	var vol *volume
+	for i, s := range sorted {
+		if s.number != i+1 {
+			return nil, xerrors.Errorf("ewf: segment %d is missing", i+1)
+		}
+		img.segments = append(img.segments, s.r)
+		done, err := img.readSegment(i, &vol)
+		if err != nil {
+			return nil, xerrors.Errorf("ewf: segment %d: %w", s.number, err)
+		}
+		if done != (i == len(sorted)-1) {
+			if done {
+				return nil, xerrors.Errorf("ewf: segment %d ends the image, but there are %d", s.number, len(sorted))
+			}
+			return nil, xerrors.Errorf("ewf: segments after %d are missing", s.number)
+		}
+	}
+
+	if vol == nil {
+		return nil, errors.New("ewf: no volume section")
+	}
+	img.BytesPerSector = vol.bytesPerSector
+	img.SectorCount = vol.sectorCount
+	img.ChunkSize = int64(vol.sectorsPerChunk) * int64(vol.bytesPerSector)
+	img.size = int64(vol.sectorCount) * int64(vol.bytesPerSector)
+	if vol.chunkCount != 0 && int(vol.chunkCount) != len(img.chunks) {
+		return nil, xerrors.Errorf("ewf: volume has %d chunks, tables list %d", vol.chunkCount, len(img.chunks))
+	}
+	if img.size < 0 || img.size > int64(len(img.chunks))*img.ChunkSize {
+		return nil, xerrors.Errorf("ewf: media of %d bytes does not fit in %d chunks", img.size, len(img.chunks))
+	}
+	if o.chunkCacheSize > 0 {
+		img.cache = lru.New[int](o.chunkCacheSize, lru.Bytes)
+	}
+	return img, nil
+}
+
+// readSegment reads the sections of segment file seg, and returns whether it
+// is the last segment of the image.
+func (img *Image) readSegment(seg int, vol **volume) (bool, error) {
+	r := img.segments[seg]
+	offset := int64(fileHeaderSize)
+	// sectorsEnd is the end of the last sectors section, where the chunks of
+	// the next table end.
+	sectorsEnd := int64(-1)
+	// tableErr is the error of a damaged table section, which is forgiven if
+	// its table2 backup is intact. tableOK reports that the last table was
+	// read and its backup can be skipped.
+	var tableErr error
+	tableOK := false
+	headerFrom2 := false
+
+	for i := 0; i < maxSections; i++ {
+		s, err := readSection(r, offset)
+		if err != nil {
+			return false, err
+		}
+
+		switch s.typ {
+		case "header", "header2":
+			if img.Header != nil && (headerFrom2 || s.typ == "header") {
+				break
+			}
+			data, err := readSectionData(r, s, maxHeaderSize)
+			if err != nil {
+				return false, err
+			}
+			// Case information is informational; damaged headers do not
+			// prevent reading the media.
+			if header, err := parseHeader(data, s.typ == "header2"); err == nil {
+				img.Header = header
+				headerFrom2 = s.typ == "header2"
+			}
+		case "volume", "disk":
+			if *vol != nil {
+				break
+			}
+			data, err := readSectionData(r, s, 1<<16)
+			if err != nil {
+				return false, err
+			}
+			if *vol, err = parseVolume(data); err != nil {
+				return false, err
+			}
+		case "sectors":
+			if tableErr != nil {
+				return false, tableErr
+			}
+			sectorsEnd = s.offset + s.size
+			tableOK = false
+		case "table", "table2":
+			if s.typ == "table2" && tableOK {
+				break
+			}
+			data, err := readSectionData(r, s, tableHeaderSize+4*maxTableEntries+4)
+			if err != nil {
+				return false, err
+			}
+			// Before sectors sections existed, the chunks followed the
+			// offsets in the table section itself.
+			end := sectorsEnd
+			if end < 0 {
+				end = s.offset + s.size
+			}
+			chunks, err := parseTable(data, seg, end)
+			if err != nil {
+				if s.typ == "table2" && tableErr != nil {
+					return false, tableErr
+				}
+				tableErr = xerrors.Errorf("section %q at %d: %w", s.typ, s.offset, err)
+				break
+			}
+			img.chunks = append(img.chunks, chunks...)
+			tableErr = nil
+			tableOK = true
+		case "hash":
+			data, err := readSectionData(r, s, 1<<10)
+			if err != nil {
+				return false, err
+			}
+			if len(data) >= 36 && adler32.Checksum(data[:32]) == binary.LittleEndian.Uint32(data[32:]) && img.MD5 == nil {
+				img.MD5 = data[:16]
+			}
+		case "digest":
+			data, err := readSectionData(r, s, 1<<10)
+			if err != nil {
+				return false, err
+			}
+			if len(data) >= 80 && adler32.Checksum(data[:76]) == binary.LittleEndian.Uint32(data[76:]) {
+				img.MD5, img.SHA1 = nonZero(data[:16]), nonZero(data[16:36])
+			}
+		case "next", "done":
+			if tableErr != nil {
+				return false, tableErr
+			}
+			return s.typ == "done", nil
+		}
+
+		if s.next <= offset {
+			return false, xerrors.Errorf("section %q at %d does not lead to a later section", s.typ, s.offset)
+		}
+		offset = s.next
+	}
+	return false, xerrors.Errorf("more than %d sections", maxSections)
+}
+
+// nonZero returns b, or nil if it is all zeros.
+func nonZero(b []byte) []byte {
+	for _, c := range b {
+		if c != 0 {
+			return b
+		}
+	}
+	return nil
+}
+
+// Size returns the size of the media in bytes.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("ewf: negative offset")
+	}
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		if pos >= img.size {
+			return read, io.EOF
+		}
+		data, err := img.chunk(int(pos / img.ChunkSize))
+		if err != nil {
+			return read, err
+		}
+		read += copy(p[read:], data[pos%img.ChunkSize:])
+	}
+	return read, nil
+}
+
+// chunk returns the content of chunk i, which is shorter than ChunkSize for
+// the last chunk of the media.
+func (img *Image) chunk(i int) ([]byte, error) {
+	if img.cache != nil {
+		if data, ok := img.cache.Get(i); ok {
+			return data, nil
+		}
+	}
+	data, err := img.readChunk(i)
+	if err != nil {
+		return nil, err
+	}
+	if img.cache != nil {
+		img.cache.Add(i, data)
+	}
+	return data, nil
+}
+
+// readChunk reads and decompresses chunk i.
+func (img *Image) readChunk(i int) ([]byte, error) {
+	loc := img.chunks[i]
+	want := img.ChunkSize
+	if rest := img.size - int64(i)*img.ChunkSize; rest < want {
+		want = rest
+	}
+	// Compressed chunks larger than their content are stored uncompressed
+	// instead, so a chunk never takes much more than ChunkSize.
+	if loc.size > 2*img.ChunkSize+1024 {
+		return nil, xerrors.Errorf("ewf: chunk %d is stored in %d bytes", i, loc.size)
+	}
+	raw := make([]byte, loc.size)
+	if err := ioutil.ReadFull(img.segments[loc.segment], raw, loc.offset); err != nil {
+		return nil, xerrors.Errorf("ewf: failed to read chunk %d: %w", i, err)
+	}
+
+	if loc.compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, xerrors.Errorf("ewf: chunk %d: %w", i, err)
+		}
+		data := make([]byte, want)
+		if _, err := io.ReadFull(zr, data); err != nil {
+			return nil, xerrors.Errorf("ewf: chunk %d: %w", i, err)
+		}
+		return data, nil
+	}
+
+	// Uncompressed chunks are followed by their Adler-32 checksum.
+	n := int64(len(raw)) - 4
+	if n < want {
+		return nil, xerrors.Errorf("ewf: chunk %d is truncated to %d bytes", i, len(raw))
+	}
+	if adler32.Checksum(raw[:n]) != binary.LittleEndian.Uint32(raw[n:]) {
+		return nil, xerrors.Errorf("ewf: chunk %d: checksum mismatch", i)
+	}
+	return raw[:want], nil
+}
+
+// Verify reads the whole media and compares it with the MD5 and SHA-1 hashes
+// recorded at acquisition. It returns ErrNoHash if the image records none
+// and an error wrapping ErrHashMismatch if they do not match.
+func (img *Image) Verify() error {
+	if img.MD5 == nil && img.SHA1 == nil {
+		return ErrNoHash
+	}
+	m, s := md5.New(), sha1.New()
+	if _, err := io.Copy(io.MultiWriter(m, s), io.NewSectionReader(img, 0, img.size)); err != nil {
+		return err
+	}
+	if img.MD5 != nil && !bytes.Equal(m.Sum(nil), img.MD5) {
+		return xerrors.Errorf("MD5 %x, recorded %x: %w", m.Sum(nil), img.MD5, ErrHashMismatch)
+	}
+	if img.SHA1 != nil && !bytes.Equal(s.Sum(nil), img.SHA1) {
+		return xerrors.Errorf("SHA-1 %x, recorded %x: %w", s.Sum(nil), img.SHA1, ErrHashMismatch)
+	}
+	return nil
+}
+
+// Close closes the segment files opened by Open. It does nothing for images
+// created by New.
+func (img *Image) Close() error {
+	var err error
+	for _, c := range img.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	img.closers = nil
+	return err
+}
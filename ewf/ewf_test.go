@@ -0,0 +1,346 @@
+package ewf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	ext "github.com/asalih/go-ext"
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+const (
+	testSectorsPerChunk = 8
+	testChunkSize       = testSectorsPerChunk * 512
+)
+
+// segmentWriter builds a segment file section by section.
+type segmentWriter struct {
+	buf []byte
+}
+
+func newSegmentWriter(number int) *segmentWriter {
+	w := &segmentWriter{buf: append([]byte(nil), evfSignature...)}
+	w.buf = append(w.buf, 1, byte(number), byte(number>>8), 0, 0)
+	return w
+}
+
+// section appends a section holding data and returns the offset of data.
+func (w *segmentWriter) section(typ string, data []byte) int {
+	offset := len(w.buf)
+	desc := make([]byte, sectionDescriptorSize)
+	copy(desc, typ)
+	size := sectionDescriptorSize + len(data)
+	next := offset + size
+	if typ == "next" || typ == "done" {
+		next = offset
+	}
+	binary.LittleEndian.PutUint64(desc[16:], uint64(next))
+	binary.LittleEndian.PutUint64(desc[24:], uint64(size))
+	binary.LittleEndian.PutUint32(desc[72:], adler32.Checksum(desc[:72]))
+	w.buf = append(w.buf, desc...)
+	w.buf = append(w.buf, data...)
+	return offset + sectionDescriptorSize
+}
+
+func withChecksum(b []byte) []byte {
+	return binary.LittleEndian.AppendUint32(b, adler32.Checksum(b))
+}
+
+func compress(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// writeEWF returns the segment files of an image of media, with
+// chunksPerSegment chunks in every segment. Even chunks are compressed.
+func writeEWF(media []byte, chunksPerSegment int) [][]byte {
+	chunks := (len(media) + testChunkSize - 1) / testChunkSize
+	var segments [][]byte
+	for first, n := 0, 1; first < chunks; first, n = first+chunksPerSegment, n+1 {
+		w := newSegmentWriter(n)
+		if n == 1 {
+			text := "1\nmain\nc\tn\ta\te\tt\tav\tov\tm\tu\tp\tr\n" +
+				"case 7\tEV1\tsuspect disk\tJ. Doe\t\t6.1\tLinux\t2024 1 1 0 0 0\t2024 1 1 0 0 0\t0\tb\n\n"
+			w.section("header", compress([]byte(text)))
+			vol := make([]byte, 1048)
+			binary.LittleEndian.PutUint32(vol[4:], uint32(chunks))
+			binary.LittleEndian.PutUint32(vol[8:], testSectorsPerChunk)
+			binary.LittleEndian.PutUint32(vol[12:], 512)
+			binary.LittleEndian.PutUint64(vol[16:], uint64(len(media)/512))
+			w.section("volume", withChecksum(vol))
+		}
+
+		last := first + chunksPerSegment
+		if last > chunks {
+			last = chunks
+		}
+		var data []byte
+		var offsets []uint32
+		for i := first; i < last; i++ {
+			chunk := media[i*testChunkSize:]
+			if len(chunk) > testChunkSize {
+				chunk = chunk[:testChunkSize]
+			}
+			entry := uint32(len(data))
+			if i%2 == 0 {
+				entry |= 0x80000000
+				data = append(data, compress(chunk)...)
+			} else {
+				data = append(data, withChecksum(append([]byte(nil), chunk...))...)
+			}
+			offsets = append(offsets, entry)
+		}
+		base := w.section("sectors", data)
+
+		table := make([]byte, 20)
+		binary.LittleEndian.PutUint32(table, uint32(len(offsets)))
+		binary.LittleEndian.PutUint64(table[8:], uint64(base))
+		table = withChecksum(table)
+		var entries []byte
+		for _, e := range offsets {
+			entries = binary.LittleEndian.AppendUint32(entries, e)
+		}
+		table = append(table, withChecksum(entries)...)
+		w.section("table", table)
+		w.section("table2", table)
+
+		if last == chunks {
+			m, s := md5.Sum(media), sha1.Sum(media)
+			w.section("digest", withChecksum(append(append(append([]byte(nil), m[:]...), s[:]...), make([]byte, 40)...)))
+			w.section("hash", withChecksum(append(m[:], make([]byte, 16)...)))
+			w.section("done", nil)
+		} else {
+			w.section("next", nil)
+		}
+		segments = append(segments, w.buf)
+	}
+	return segments
+}
+
+func testMedia(size int) []byte {
+	media := make([]byte, size)
+	rng := rand.New(rand.NewSource(int64(size)))
+	// Half random, half compressible.
+	rng.Read(media[:size/2])
+	return media
+}
+
+func readers(segments [][]byte) []io.ReaderAt {
+	var rs []io.ReaderAt
+	for _, s := range segments {
+		rs = append(rs, bytes.NewReader(s))
+	}
+	return rs
+}
+
+func TestImageRead(t *testing.T) {
+	// 10 full chunks and a partial one, in three segments given out of order.
+	media := testMedia(10*testChunkSize + 5*512)
+	segments := writeEWF(media, 4)
+	if len(segments) != 3 {
+		t.Fatalf("wrote %d segments", len(segments))
+	}
+	img, err := New(readers([][]byte{segments[2], segments[0], segments[1]}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Size() != int64(len(media)) || img.ChunkSize != testChunkSize || img.BytesPerSector != 512 {
+		t.Errorf("got size %d, chunk size %d, sector size %d", img.Size(), img.ChunkSize, img.BytesPerSector)
+	}
+	if img.Header["c"] != "case 7" || img.Header["e"] != "J. Doe" {
+		t.Errorf("Header = %v", img.Header)
+	}
+
+	got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil || !bytes.Equal(got, media) {
+		t.Fatalf("read %d bytes with %v, mismatch", len(got), err)
+	}
+	for _, off := range []int64{0, 100, testChunkSize - 1, 4*testChunkSize - 10, int64(len(media)) - 700} {
+		buf := make([]byte, 1000)
+		n, err := img.ReadAt(buf, off)
+		want := media[off:]
+		if len(want) > len(buf) {
+			want = want[:len(buf)]
+		}
+		if n != len(want) || !bytes.Equal(buf[:n], want) || (n < len(buf)) != (err == io.EOF) {
+			t.Errorf("ReadAt(%d) returned %d, %v", off, n, err)
+		}
+	}
+
+	if err := img.Verify(); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	img.MD5[0] ^= 1
+	if err := img.Verify(); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("Verify with a wrong hash returned %v", err)
+	}
+}
+
+func TestImageDamage(t *testing.T) {
+	media := testMedia(6 * testChunkSize)
+	for name, tc := range map[string]struct {
+		damage func(segments [][]byte)
+		ok     bool
+	}{
+		"missing segment": {func(s [][]byte) { s[1] = s[2] }, false},
+		"table":           {func(s [][]byte) { damageSection(s[0], "table") }, true},
+		"table2":          {func(s [][]byte) { damageSection(s[0], "table2") }, true},
+		"both tables": {func(s [][]byte) {
+			damageSection(s[0], "table")
+			damageSection(s[0], "table2")
+		}, false},
+		"volume":     {func(s [][]byte) { damageSection(s[0], "volume") }, false},
+		"descriptor": {func(s [][]byte) { s[0][fileHeaderSize+3]++ }, false},
+	} {
+		segments := writeEWF(media, 2)
+		tc.damage(segments)
+		img, err := New(readers(segments))
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%s: damaged image was accepted", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if err := img.Verify(); err != nil {
+			t.Errorf("%s: Verify: %v", name, err)
+		}
+	}
+
+	// A damaged uncompressed chunk fails to read.
+	segments := writeEWF(media, 10)
+	img, err := New(readers(segments))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := img.chunks[1]
+	segments[0][loc.offset+10]++
+	if _, err := img.ReadAt(make([]byte, 10), testChunkSize); err == nil {
+		t.Error("damaged chunk was read")
+	}
+
+	if _, err := New(readers([][]byte{make([]byte, 100)})); !errors.Is(err, ErrNotEWF) {
+		t.Errorf("New of a raw file returned %v, want %v", err, ErrNotEWF)
+	}
+}
+
+// damageSection changes a byte in the content of the first section of type
+// typ.
+func damageSection(segment []byte, typ string) {
+	offset := int64(fileHeaderSize)
+	for {
+		s, err := readSection(bytes.NewReader(segment), offset)
+		if err != nil || s.next == offset {
+			panic("section not found")
+		}
+		if s.typ == typ {
+			segment[s.dataOffset()+s.dataSize()-6]++
+			return
+		}
+		offset = s.next
+	}
+}
+
+// countingReaderAt counts the reads of r.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads atomic.Int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads.Add(1)
+	return c.r.ReadAt(p, off)
+}
+
+func TestChunkCache(t *testing.T) {
+	media := testMedia(4 * testChunkSize)
+	for _, size := range []int64{DefaultChunkCacheSize, 0} {
+		seg := &countingReaderAt{r: bytes.NewReader(writeEWF(media, 4)[0])}
+		img, err := New([]io.ReaderAt{seg}, WithChunkCacheSize(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 100)
+		img.ReadAt(buf, 2*testChunkSize)
+		before := seg.reads.Load()
+		img.ReadAt(buf, 2*testChunkSize+200)
+		if cached := seg.reads.Load() == before; cached != (size > 0) {
+			t.Errorf("cache size %d: second read of a chunk reached the segment file: %v", size, !cached)
+		}
+	}
+}
+
+func TestSegmentName(t *testing.T) {
+	for _, tc := range []struct {
+		first string
+		n     int
+		want  string
+	}{
+		{"disk.E01", 1, "disk.E01"},
+		{"disk.E01", 2, "disk.E02"},
+		{"disk.E01", 99, "disk.E99"},
+		{"disk.E01", 100, "disk.EAA"},
+		{"disk.e01", 101, "disk.eab"},
+		{"disk.E01", 99 + 26*26, "disk.EZZ"},
+		{"disk.E01", 100 + 26*26, "disk.FAA"},
+		{"/a/b.s01", 3, "/a/b.s03"},
+	} {
+		if got, err := SegmentName(tc.first, tc.n); err != nil || got != tc.want {
+			t.Errorf("SegmentName(%q, %d) = %q, %v, want %q", tc.first, tc.n, got, err, tc.want)
+		}
+	}
+	if _, err := SegmentName("disk.E01", maxSegments+1); err == nil {
+		t.Error("SegmentName past ZZZ succeeded")
+	}
+}
+
+func TestOpenFileSystem(t *testing.T) {
+	b := testimage.New(testimage.Ext4())
+	b.File("evidence.txt", []byte("acquired"))
+	img := b.MustBuild()
+
+	dir := t.TempDir()
+	for i, s := range writeEWF(img, 400) {
+		name, _ := SegmentName(filepath.Join(dir, "disk.E01"), i+1)
+		if err := os.WriteFile(name, s, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ewfImg, err := Open(filepath.Join(dir, "disk.E01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ewfImg.Close()
+	if len(ewfImg.segments) < 2 {
+		t.Errorf("image opened with %d segments", len(ewfImg.segments))
+	}
+
+	fsys, err := ext.NewFS(ewfImg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile(fsys, "evidence.txt"); err != nil || string(data) != "acquired" {
+		t.Errorf("ReadFile returned %q, %v", data, err)
+	}
+	if err := ewfImg.Verify(); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package ewf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/asalih/go-ext/internal/ioutil"
+	"golang.org/x/xerrors"
+)
+
+const (
+	fileHeaderSize = 13
+
+	// sectionDescriptorSize is the size of the descriptor starting every
+	// section.
+	sectionDescriptorSize = 76
+
+	// tableHeaderSize is the size of the header of table sections, before the
+	// chunk offsets.
+	tableHeaderSize = 24
+
+	// maxTableEntries bounds the number of chunk offsets of a table section.
+	maxTableEntries = 1 << 20
+
+	// maxSections bounds the number of sections of a segment file.
+	maxSections = 1 << 16
+
+	// maxHeaderSize bounds the decompressed size of header sections.
+	maxHeaderSize = 1 << 20
+)
+
+var (
+	evfSignature  = []byte("EVF\x09\x0d\x0a\xff\x00")
+	lvfSignature  = []byte("LVF\x09\x0d\x0a\xff\x00")
+	evf2Signature = []byte("EVF2\x0d\x0a\x81\x00")
+)
+
+// section is a section of a segment file.
+type section struct {
+	typ string
+	// offset is the offset of the section descriptor in the segment file, and
+	// size the size of the section, descriptor included.
+	offset int64
+	size   int64
+	next   int64
+}
+
+// dataOffset returns the offset of the section content.
+func (s *section) dataOffset() int64 {
+	return s.offset + sectionDescriptorSize
+}
+
+// dataSize returns the size of the section content.
+func (s *section) dataSize() int64 {
+	return s.size - sectionDescriptorSize
+}
+
+// readSegmentNumber reads the file header of a segment file and returns its
+// segment number.
+func readSegmentNumber(r io.ReaderAt) (int, error) {
+	hdr := make([]byte, fileHeaderSize)
+	if err := ioutil.ReadFull(r, hdr, 0); err != nil {
+		return 0, xerrors.Errorf("failed to read file header: %w", err)
+	}
+	switch {
+	case bytes.Equal(hdr[:8], evfSignature):
+	case bytes.Equal(hdr[:8], lvfSignature):
+		return 0, errors.New("logical evidence files (L01) are not supported")
+	case bytes.Equal(hdr[:8], evf2Signature):
+		return 0, errors.New("EWF2 (Ex01) files are not supported")
+	default:
+		return 0, ErrNotEWF
+	}
+	return int(binary.LittleEndian.Uint16(hdr[9:])), nil
+}
+
+// readSection reads the section descriptor at offset.
+func readSection(r io.ReaderAt, offset int64) (*section, error) {
+	desc := make([]byte, sectionDescriptorSize)
+	if err := ioutil.ReadFull(r, desc, offset); err != nil {
+		return nil, xerrors.Errorf("failed to read section descriptor at %d: %w", offset, err)
+	}
+	if adler32.Checksum(desc[:72]) != binary.LittleEndian.Uint32(desc[72:]) {
+		return nil, xerrors.Errorf("section descriptor at %d: checksum mismatch", offset)
+	}
+	s := &section{
+		typ:    string(bytes.TrimRight(desc[:16], "\x00")),
+		offset: offset,
+		next:   int64(binary.LittleEndian.Uint64(desc[16:])),
+		size:   int64(binary.LittleEndian.Uint64(desc[24:])),
+	}
+	// The last section of a segment, "next" or "done", points at itself and
+	// may record a size of zero.
+	if s.typ == "next" || s.typ == "done" {
+		return s, nil
+	}
+	if s.size < sectionDescriptorSize || s.next < offset+sectionDescriptorSize {
+		return nil, xerrors.Errorf("section %q at %d has an invalid size %d or next offset %d", s.typ, offset, s.size, s.next)
+	}
+	return s, nil
+}
+
+// readSectionData reads the content of s.
+func readSectionData(r io.ReaderAt, s *section, limit int64) ([]byte, error) {
+	if s.dataSize() > limit {
+		return nil, xerrors.Errorf("section %q at %d is too large: %d bytes", s.typ, s.offset, s.dataSize())
+	}
+	data := make([]byte, s.dataSize())
+	if err := ioutil.ReadFull(r, data, s.dataOffset()); err != nil {
+		return nil, xerrors.Errorf("failed to read section %q at %d: %w", s.typ, s.offset, err)
+	}
+	return data, nil
+}
+
+// volume is the media geometry recorded in the volume or disk section.
+type volume struct {
+	chunkCount      uint32
+	sectorsPerChunk uint32
+	bytesPerSector  uint32
+	sectorCount     uint64
+}
+
+// parseVolume parses a volume or disk section. EnCase writes 1052 byte
+// sections; the 94 byte SMART layout records a 32-bit sector count.
+func parseVolume(data []byte) (*volume, error) {
+	le := binary.LittleEndian
+	var v volume
+	switch {
+	case len(data) >= 1052:
+		if adler32.Checksum(data[:1048]) != le.Uint32(data[1048:]) {
+			return nil, errors.New("volume section: checksum mismatch")
+		}
+		v.sectorCount = le.Uint64(data[16:])
+	case len(data) >= 94:
+		if adler32.Checksum(data[:90]) != le.Uint32(data[90:]) {
+			return nil, errors.New("volume section: checksum mismatch")
+		}
+		v.sectorCount = uint64(le.Uint32(data[16:]))
+	default:
+		return nil, xerrors.Errorf("volume section of %d bytes is too short", len(data))
+	}
+	v.chunkCount = le.Uint32(data[4:])
+	v.sectorsPerChunk = le.Uint32(data[8:])
+	v.bytesPerSector = le.Uint32(data[12:])
+	if v.bytesPerSector == 0 || v.sectorsPerChunk == 0 || uint64(v.sectorsPerChunk)*uint64(v.bytesPerSector) > 1<<28 {
+		return nil, xerrors.Errorf("invalid chunk geometry: %d sectors of %d bytes", v.sectorsPerChunk, v.bytesPerSector)
+	}
+	return &v, nil
+}
+
+// parseTable parses the chunk offsets of a table or table2 section. The
+// chunks are stored from the first offset up to end, which is the end of the
+// sectors section holding them.
+func parseTable(data []byte, seg int, end int64) ([]chunkLocation, error) {
+	le := binary.LittleEndian
+	if len(data) < tableHeaderSize {
+		return nil, errors.New("table section is too short")
+	}
+	if adler32.Checksum(data[:20]) != le.Uint32(data[20:]) {
+		return nil, errors.New("table header: checksum mismatch")
+	}
+	count := int(le.Uint32(data))
+	base := int64(le.Uint64(data[8:]))
+	if count > maxTableEntries || tableHeaderSize+4*count > len(data) {
+		return nil, xerrors.Errorf("table of %d entries does not fit in its section", count)
+	}
+	entries := data[tableHeaderSize : tableHeaderSize+4*count]
+	// EnCase 6 and later follow the offsets with their checksum.
+	if rest := data[tableHeaderSize+4*count:]; len(rest) >= 4 {
+		if adler32.Checksum(entries) != le.Uint32(rest) {
+			return nil, errors.New("table entries: checksum mismatch")
+		}
+	}
+
+	chunks := make([]chunkLocation, count)
+	for i := range chunks {
+		e := le.Uint32(entries[4*i:])
+		chunks[i] = chunkLocation{
+			segment:    seg,
+			offset:     base + int64(e&0x7fffffff),
+			compressed: e&0x80000000 != 0,
+		}
+	}
+	for i := range chunks {
+		next := end
+		if i+1 < len(chunks) {
+			next = chunks[i+1].offset
+		}
+		chunks[i].size = next - chunks[i].offset
+		if chunks[i].size <= 0 {
+			return nil, xerrors.Errorf("chunk %d of table has an invalid size %d", i, chunks[i].size)
+		}
+	}
+	return chunks, nil
+}
+
+// parseHeader parses a header or header2 section: zlib compressed, tab
+// separated case information, in UTF-16 for header2.
+func parseHeader(data []byte, utf16Text bool) (map[string]string, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, xerrors.Errorf("header section: %w", err)
+	}
+	text, err := io.ReadAll(io.LimitReader(zr, maxHeaderSize))
+	if err != nil {
+		return nil, xerrors.Errorf("header section: %w", err)
+	}
+
+	s := string(text)
+	if utf16Text {
+		if len(text) >= 2 && text[0] == 0xff && text[1] == 0xfe {
+			text = text[2:]
+		}
+		u := make([]uint16, len(text)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(text[2*i:])
+		}
+		s = string(utf16.Decode(u))
+	}
+
+	// The first two lines are the number of categories and the category
+	// name, "main". The keys and their values follow.
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	if len(lines) < 4 {
+		return nil, errors.New("header section: too few lines")
+	}
+	keys := strings.Split(lines[2], "\t")
+	values := strings.Split(lines[3], "\t")
+	header := make(map[string]string, len(keys))
+	for i, key := range keys {
+		if i < len(values) && key != "" {
+			header[key] = values[i]
+		}
+	}
+	return header, nil
+}
@@ -0,0 +1,92 @@
+package ewf
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// maxSegments is the number of segment file names available: E01 to E99,
+// then EAA to ZZZ.
+const maxSegments = 99 + 22*26*26
+
+// SegmentName returns the name of segment n, counted from 1, of the image
+// whose first segment file is first. Segments 1 to 99 use the extension of
+// first with the number replaced, such as E01 to E99; later ones continue
+// with letters, EAA to EZZ and then FAA onwards. The case of the extension is
+// kept.
+func SegmentName(first string, n int) (string, error) {
+	ext := filepath.Ext(first)
+	if len(ext) != 4 || n < 1 || n > maxSegments {
+		return "", xerrors.Errorf("ewf: no segment %d for %s", n, first)
+	}
+	lower := ext[1] >= 'a' && ext[1] <= 'z'
+	start := ext[1] &^ 0x20
+	var suffix []byte
+	if n <= 99 {
+		suffix = []byte{start, '0' + byte(n/10), '0' + byte(n%10)}
+	} else {
+		k := n - 100
+		suffix = []byte{start + byte(k/(26*26)), 'A' + byte(k/26%26), 'A' + byte(k%26)}
+		if suffix[0] > 'Z' {
+			return "", xerrors.Errorf("ewf: no segment %d for %s", n, first)
+		}
+	}
+	s := string(suffix)
+	if lower {
+		s = strings.ToLower(s)
+	}
+	return first[:len(first)-3] + s, nil
+}
+
+// Open opens the EWF image whose first segment file is name, such as
+// image.E01, along with the segment files following it. The image must be
+// closed to close the files.
+func Open(name string, opts ...Option) (*Image, error) {
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, f)
+	for n := 2; n <= maxSegments; n++ {
+		next, err := SegmentName(name, n)
+		if err != nil {
+			break
+		}
+		f, err := os.Open(next)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	segments := make([]io.ReaderAt, len(files))
+	for i, f := range files {
+		segments[i] = f
+	}
+	img, err := New(segments, opts...)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	for _, f := range files {
+		img.closers = append(img.closers, f)
+	}
+	return img, nil
+}
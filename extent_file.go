@@ -2,10 +2,12 @@ package ext
 
 import (
 	"io"
+	"math"
 	"sort"
 
 	"github.com/asalih/go-ext/disklayout"
 	"github.com/asalih/go-ext/syserror"
+	"golang.org/x/xerrors"
 )
 
 // extentFile is a type of regular file which uses extents to store file data.
@@ -29,7 +31,7 @@ func newExtentFile(args inodeArgs) (*extentFile, error) {
 	file := &extentFile{}
 	file.regFile.impl = file
 	file.regFile.inode.init(args, &file.regFile)
-	err := file.buildExtTree()
+	err := file.buildExtTree(args.fs)
 	if err != nil {
 		return nil, err
 	}
@@ -42,16 +44,14 @@ func newExtentFile(args inodeArgs) (*extentFile, error) {
 // disk.
 //
 // Precondition: inode flag InExtents must be set.
-func (f *extentFile) buildExtTree() error {
+func (f *extentFile) buildExtTree(fsR *FileSystem) error {
 	rootNodeData := f.regFile.inode.diskInode.Data()
 
 	f.root.Header.UnmarshalBytes(rootNodeData[:disklayout.ExtentHeaderSize])
 
 	// Root node can not have more than 4 entries: 60 bytes = 1 header + 4 entries.
-	if f.root.Header.NumEntries > 4 {
-		// read(2) specifies that EINVAL should be returned if the file is unsuitable
-		// for reading.
-		return syserror.EINVAL
+	if err := checkExtentHeader(&f.root.Header, 4); err != nil {
+		return err
 	}
 
 	f.root.Entries = make([]disklayout.ExtentEntryPair, f.root.Header.NumEntries)
@@ -67,12 +67,15 @@ func (f *extentFile) buildExtTree() error {
 		curEntry.UnmarshalBytes(rootNodeData[off : off+disklayout.ExtentEntrySize])
 		f.root.Entries[i].Entry = curEntry
 	}
+	if err := checkExtentEntries(f.root.Entries); err != nil {
+		return err
+	}
 
 	// If this node is internal, perform DFS.
 	if f.root.Header.Height > 0 {
 		for i := uint16(0); i < f.root.Header.NumEntries; i++ {
 			var err error
-			if f.root.Entries[i].Node, err = f.buildExtTreeFromDisk(f.root.Entries[i].Entry); err != nil {
+			if f.root.Entries[i].Node, err = f.buildExtTreeFromDisk(fsR, f.root.Entries[i].Entry, f.root.Header.Height-1); err != nil {
 				return err
 			}
 		}
@@ -83,17 +86,30 @@ func (f *extentFile) buildExtTree() error {
 
 // buildExtTreeFromDisk reads the extent tree nodes from disk and recursively
 // builds the tree. Performs a simple DFS. It returns the ExtentNode pointed to
-// by the ExtentEntry.
-func (f *extentFile) buildExtTreeFromDisk(entry disklayout.ExtentEntry) (*disklayout.ExtentNode, error) {
-	var header disklayout.ExtentHeader
-	off := entry.PhysicalBlock() * f.regFile.inode.blkSize
-	err := readFromDisk(f.regFile.inode.fsR.dev, int64(off), &header)
+// by the ExtentEntry. height is the height the child node must have, which
+// keeps a corrupted tree from pointing back at one of its ancestors.
+func (f *extentFile) buildExtTreeFromDisk(fsR *FileSystem, entry disklayout.ExtentEntry, height uint16) (*disklayout.ExtentNode, error) {
+	// The whole node fits in one block, which is parsed from memory.
+	blk, err := fsR.meta.block(entry.PhysicalBlock())
 	if err != nil {
 		return nil, err
 	}
 
+	var header disklayout.ExtentHeader
+	if err := header.UnmarshalBytes(blk[:disklayout.ExtentHeaderSize]); err != nil {
+		return nil, err
+	}
+
+	maxEntries := (f.regFile.inode.blkSize - disklayout.ExtentHeaderSize) / disklayout.ExtentEntrySize
+	if err := checkExtentHeader(&header, uint16(maxEntries)); err != nil {
+		return nil, err
+	}
+	if header.Height != height {
+		return nil, xerrors.Errorf("extent node at block %d has height %d, want %d: %w", entry.PhysicalBlock(), header.Height, height, syserror.EFSCORRUPTED)
+	}
+
 	entries := make([]disklayout.ExtentEntryPair, header.NumEntries)
-	for i, off := uint16(0), off+disklayout.ExtentEntrySize; i < header.NumEntries; i, off = i+1, off+disklayout.ExtentEntrySize {
+	for i, off := uint16(0), disklayout.ExtentEntrySize; i < header.NumEntries; i, off = i+1, off+disklayout.ExtentEntrySize {
 		var curEntry disklayout.ExtentEntry
 		if header.Height == 0 {
 			// Leaf node.
@@ -103,18 +119,20 @@ func (f *extentFile) buildExtTreeFromDisk(entry disklayout.ExtentEntry) (*diskla
 			curEntry = &disklayout.ExtentIdx{}
 		}
 
-		err := readFromDisk(f.regFile.inode.fsR.dev, int64(off), curEntry)
-		if err != nil {
+		if err := curEntry.UnmarshalBytes(blk[off : off+disklayout.ExtentEntrySize]); err != nil {
 			return nil, err
 		}
 		entries[i].Entry = curEntry
 	}
+	if err := checkExtentEntries(entries); err != nil {
+		return nil, err
+	}
 
 	// If this node is internal, perform DFS.
 	if header.Height > 0 {
 		for i := uint16(0); i < header.NumEntries; i++ {
 			var err error
-			entries[i].Node, err = f.buildExtTreeFromDisk(entries[i].Entry)
+			entries[i].Node, err = f.buildExtTreeFromDisk(fsR, entries[i].Entry, header.Height-1)
 			if err != nil {
 				return nil, err
 			}
@@ -124,8 +142,39 @@ func (f *extentFile) buildExtTreeFromDisk(entry disklayout.ExtentEntry) (*diskla
 	return &disklayout.ExtentNode{Header: header, Entries: entries}, nil
 }
 
+// checkExtentHeader validates an extent node header. maxEntries is the number
+// of entries that fit in the space holding the node.
+func checkExtentHeader(header *disklayout.ExtentHeader, maxEntries uint16) error {
+	if header.Magic != disklayout.ExtentMagic {
+		return xerrors.Errorf("invalid extent header magic %#x: %w", header.Magic, syserror.EFSCORRUPTED)
+	}
+	if header.NumEntries > maxEntries {
+		return xerrors.Errorf("extent node has %d entries, at most %d fit: %w", header.NumEntries, maxEntries, syserror.EFSCORRUPTED)
+	}
+	if header.Height > disklayout.MaxExtentTreeHeight {
+		return xerrors.Errorf("extent tree height %d too large: %w", header.Height, syserror.EFSCORRUPTED)
+	}
+	return nil
+}
+
+// checkExtentEntries verifies that the entries of a node are sorted by file
+// block, which the binary search in read relies on.
+func checkExtentEntries(entries []disklayout.ExtentEntryPair) error {
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Entry.FileBlock() <= entries[i-1].Entry.FileBlock() {
+			return xerrors.Errorf("extent entries out of order: %w", syserror.EFSCORRUPTED)
+		}
+	}
+	return nil
+}
+
 // ReadAt implements io.ReaderAt.ReadAt.
 func (f *extentFile) ReadAt(dst []byte, off int64) (int, error) {
+	return f.readAt(f.regFile.inode.fsR, dst, off)
+}
+
+// readAt implements fileReader.readAt.
+func (f *extentFile) readAt(fsR *FileSystem, dst []byte, off int64) (int, error) {
 	if len(dst) == 0 {
 		return 0, nil
 	}
@@ -134,11 +183,17 @@ func (f *extentFile) ReadAt(dst []byte, off int64) (int, error) {
 		return 0, syserror.EINVAL
 	}
 
-	if uint64(off) >= f.regFile.inode.diskInode.Size() {
+	size := f.regFile.dataSize()
+	if uint64(off) >= size {
 		return 0, io.EOF
 	}
 
-	n, err := f.read(&f.root, uint64(off), dst)
+	toRead := dst
+	if uint64(len(toRead)) > size-uint64(off) {
+		toRead = toRead[:size-uint64(off)]
+	}
+
+	n, err := f.read(fsR, &f.root, uint64(off), toRead)
 	if n < len(dst) && err == nil {
 		err = io.EOF
 	}
@@ -146,33 +201,58 @@ func (f *extentFile) ReadAt(dst []byte, off int64) (int, error) {
 }
 
 // read is the recursive step of extentFile.ReadAt which traverses the extent
-// tree from the node passed and reads file data.
-func (f *extentFile) read(node *disklayout.ExtentNode, off uint64, dst []byte) (int, error) {
-	// Perform a binary search for the node covering bytes starting at r.fileOff.
-	// A highly fragmented filesystem can have upto 340 entries and so linear
-	// search should be avoided. Finds the first entry which does not cover the
-	// file block we want and subtracts 1 to get the desired index.
-	fileBlk := uint32(off / f.regFile.inode.blkSize)
+// tree from the node passed and reads file data. File blocks which are not
+// covered by any extent are holes and read as zeroes.
+func (f *extentFile) read(fsR *FileSystem, node *disklayout.ExtentNode, off uint64, dst []byte) (int, error) {
+	blkSize := f.regFile.inode.blkSize
 	n := len(node.Entries)
-	found := sort.Search(n, func(i int) bool {
-		return node.Entries[i].Entry.FileBlock() > fileBlk
-	}) - 1
-
-	// We should be in this recursive step only if the data we want exists under
-	// the current node.
-	if found < 0 {
-		panic("searching for a file block in an extent entry which does not cover it")
-	}
 
 	read := 0
-	toRead := len(dst)
-	var curR int
-	var err error
-	for i := found; i < n && read < toRead; i++ {
-		if node.Header.Height == 0 {
-			curR, err = f.readFromExtent(node.Entries[i].Entry.(*disklayout.Extent), off, dst[read:])
-		} else {
-			curR, err = f.read(node.Entries[i].Node, off, dst[read:])
+	for read < len(dst) {
+		// Perform a binary search for the node covering bytes starting at off.
+		// A highly fragmented filesystem can have upto 340 entries and so linear
+		// search should be avoided. Finds the first entry which does not cover the
+		// file block we want and subtracts 1 to get the desired index.
+		fileBlk := off / blkSize
+		found := sort.Search(n, func(i int) bool {
+			return uint64(node.Entries[i].Entry.FileBlock()) > fileBlk
+		}) - 1
+
+		// end is the offset at which the next entry starts. The entry found
+		// covers at most the file data before it.
+		end := uint64(math.MaxUint64)
+		if found+1 < n {
+			end = uint64(node.Entries[found+1].Entry.FileBlock()) * blkSize
+		}
+		want := dst[read:]
+		if uint64(len(want)) > end-off {
+			want = want[:end-off]
+		}
+
+		var curR int
+		var err error
+		switch {
+		case found < 0:
+			// Hole before the first entry.
+			curR = zero(want)
+		case node.Header.Height > 0:
+			curR, err = f.read(fsR, node.Entries[found].Node, off, want)
+		default:
+			ex := node.Entries[found].Entry.(*disklayout.Extent)
+			if exEnd := (uint64(ex.FileBlock()) + uint64(ex.Len())) * blkSize; off < exEnd {
+				if uint64(len(want)) > exEnd-off {
+					want = want[:exEnd-off]
+				}
+				if ex.Unwritten() {
+					// Allocated but never written, like a hole.
+					curR = zero(want)
+				} else {
+					curR, err = f.readFromExtent(fsR, ex, off, want)
+				}
+			} else {
+				// Hole between this extent and the next one.
+				curR = zero(want)
+			}
 		}
 
 		read += curR
@@ -195,31 +275,58 @@ func (f *extentFile) read(node *disklayout.ExtentNode, off uint64, dst []byte) (
 //
 // A subsequent call to extentReader.Read should continue reading from where we
 // left off as expected.
-func (f *extentFile) readFromExtent(ex *disklayout.Extent, off uint64, dst []byte) (int, error) {
-	curFileBlk := uint32(off / f.regFile.inode.blkSize)
-	exFirstFileBlk := ex.FileBlock()
-	exLastFileBlk := exFirstFileBlk + uint32(ex.Length) // This is exclusive.
+func (f *extentFile) readFromExtent(fsR *FileSystem, ex *disklayout.Extent, off uint64, dst []byte) (int, error) {
+	blkSize := f.regFile.inode.blkSize
+	curFileBlk := off / blkSize
+	exFirstFileBlk := uint64(ex.FileBlock())
+	exLastFileBlk := exFirstFileBlk + uint64(ex.Len()) // This is exclusive.
 
 	// We should be in this recursive step only if the data we want exists under
 	// the current extent.
 	if curFileBlk < exFirstFileBlk || exLastFileBlk <= curFileBlk {
-		panic("searching for a file block in an extent which does not cover it")
+		return 0, syserror.EIO
 	}
 
-	curPhyBlk := uint64(curFileBlk-exFirstFileBlk) + ex.PhysicalBlock()
-	readStart := curPhyBlk*f.regFile.inode.blkSize + (off % f.regFile.inode.blkSize)
-
-	endPhyBlk := ex.PhysicalBlock() + uint64(ex.Length)
-	extentEnd := endPhyBlk * f.regFile.inode.blkSize // This is exclusive.
+	curPhyBlk := curFileBlk - exFirstFileBlk + ex.PhysicalBlock()
+	readStart := curPhyBlk*blkSize + (off % blkSize)
 
-	toRead := int(extentEnd - readStart)
-	if len(dst) < toRead {
-		toRead = len(dst)
+	toRead := (exLastFileBlk-curFileBlk)*blkSize - (off % blkSize)
+	if uint64(len(dst)) < toRead {
+		toRead = uint64(len(dst))
 	}
 
-	n, _ := f.regFile.inode.fsR.dev.ReadAt(dst[:toRead], int64(readStart))
-	if n < toRead {
-		return n, syserror.EIO
+	n, err := f.regFile.inode.dataReader(fsR).ReadAt(dst[:toRead], int64(readStart))
+	if uint64(n) < toRead {
+		if err == nil || err == io.EOF {
+			err = syserror.EIO
+		}
+		return n, err
 	}
 	return n, nil
 }
+
+// dataRanges appends the file ranges covered by the extents below node to
+// ranges. Unwritten extents read as zeroes and are left out like holes.
+func (f *extentFile) dataRanges(node *disklayout.ExtentNode, ranges []dataRange) []dataRange {
+	blkSize := f.regFile.inode.blkSize
+	for _, e := range node.Entries {
+		if node.Header.Height > 0 {
+			ranges = f.dataRanges(e.Node, ranges)
+			continue
+		}
+		ex := e.Entry.(*disklayout.Extent)
+		if ex.Unwritten() {
+			continue
+		}
+		ranges = append(ranges, dataRange{off: uint64(ex.FileBlock()) * blkSize, length: uint64(ex.Len()) * blkSize})
+	}
+	return ranges
+}
+
+// zero fills dst with zeroes and returns its length.
+func zero(dst []byte) int {
+	for i := range dst {
+		dst[i] = 0
+	}
+	return len(dst)
+}
@@ -0,0 +1,275 @@
+package ext
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrUnsafeName is reported by Extract for files whose name could escape the
+// destination directory on the host, such as names holding a path
+// separator. Such files and the content of such directories are skipped.
+var ErrUnsafeName = errors.New("ext: unsafe file name")
+
+// errNodeUnsupported is reported for device nodes, fifos and sockets on
+// platforms Extract cannot create them on.
+var errNodeUnsupported = errors.New("ext: cannot create special files on this platform")
+
+// ExtractFunc is the type of the function called by FileSystem.Extract for
+// every file and directory once it has been extracted, or in a dry run once
+// it would have been. path is the name of the file in the filesystem and
+// target where it is extracted to.
+//
+// err is set if the file could not be extracted, and d is nil if root could
+// not be looked up, as with fs.WalkDir. Returning nil skips the file,
+// and the content of a directory, and goes on with the extraction; returning
+// an error stops it. Returning fs.SkipDir or fs.SkipAll behaves as for
+// fs.WalkDir.
+type ExtractFunc func(path, target string, d fs.DirEntry, err error) error
+
+// ExtractOption configures a FileSystem.Extract.
+type ExtractOption func(*extractOptions)
+
+type extractOptions struct {
+	dryRun bool
+	fn     ExtractFunc
+}
+
+// WithDryRun makes Extract check and report every file without writing
+// anything to the host.
+func WithDryRun(enabled bool) ExtractOption {
+	return func(o *extractOptions) {
+		o.dryRun = enabled
+	}
+}
+
+// WithExtractFunc sets the function Extract reports files to. Without it,
+// Extract stops at the first file it fails to extract.
+func WithExtractFunc(fn ExtractFunc) ExtractOption {
+	return func(o *extractOptions) {
+		o.fn = fn
+	}
+}
+
+// Extract copies the file or directory tree root to dest on the host.
+// A directory root is extracted as dest, which may already exist, and a file
+// root as a file named dest.
+//
+// Regular files, directories and symlinks are recreated, as are device
+// nodes, fifos and sockets on Linux. Files sharing an inode are extracted as
+// hard links to the first of them. The permissions, access and modification
+// times and extended attributes are restored, and so are the owner and group
+// when the process is allowed to; extended attributes the host filesystem or
+// the process privileges do not allow are skipped.
+//
+// Extract never writes outside dest: files are created exclusively, so that
+// they are never written through symlinks or over existing files, and files
+// whose names are unsafe are reported with ErrUnsafeName.
+func (f *FileSystem) Extract(ctx context.Context, root, dest string, opts ...ExtractOption) error {
+	f = f.withContext(ctx)
+	var o extractOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	report := o.fn
+	if report == nil {
+		report = func(_, _ string, _ fs.DirEntry, err error) error {
+			return err
+		}
+	}
+
+	root = path.Clean(root)
+	x := &extractor{
+		fsys:    f,
+		dryRun:  o.dryRun,
+		targets: map[string]string{root: dest},
+		links:   make(map[uint64]string),
+	}
+	err := fs.WalkDir(f, root, func(name string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		target, ok := x.targets[name]
+		if !ok {
+			target = ""
+			if parent, ok := x.targets[path.Dir(name)]; ok && safeName(d.Name()) {
+				target = filepath.Join(parent, d.Name())
+			} else if err == nil {
+				err = xerrors.Errorf("%q: %w", d.Name(), ErrUnsafeName)
+			}
+		}
+		if err == nil {
+			err = x.extract(name, target, d)
+		}
+		if err != nil {
+			err = report(name, target, d, err)
+			if err == nil && d != nil && d.IsDir() {
+				err = fs.SkipDir
+			}
+			return err
+		}
+		return report(name, target, d, nil)
+	})
+
+	// Directory metadata is restored last, deepest first, since extracting
+	// their content changes their times and may need write permission.
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		dir := x.dirs[i]
+		mdErr := x.setMetadata(dir.target, dir.name, dir.info)
+		if mdErr != nil && err == nil {
+			err = report(dir.name, dir.target, fs.FileInfoToDirEntry(dir.info), mdErr)
+		}
+	}
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+// safeName reports whether name can be extracted without leaving its parent
+// directory on any host.
+func safeName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\\\x00") && !strings.ContainsRune(name, filepath.Separator) &&
+		filepath.VolumeName(name) == ""
+}
+
+// extractor holds the state of an Extract.
+type extractor struct {
+	fsys   *FileSystem
+	dryRun bool
+
+	// targets maps the extracted directories to their host path.
+	targets map[string]string
+
+	// links maps the inode numbers of extracted files with several links to
+	// their host path.
+	links map[uint64]string
+
+	// dirs are the extracted directories, parents first.
+	dirs []extractedDir
+}
+
+type extractedDir struct {
+	name   string
+	target string
+	info   fs.FileInfo
+}
+
+// extract extracts the file name, whose entry is d, to target.
+func (x *extractor) extract(name, target string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*Statx)
+	if !ok {
+		return xerrors.Errorf("%s has no inode metadata", name)
+	}
+
+	if d.IsDir() {
+		if !x.dryRun {
+			if err := x.mkdir(target, len(x.dirs) == 0); err != nil {
+				return err
+			}
+		}
+		x.targets[name] = target
+		x.dirs = append(x.dirs, extractedDir{name: name, target: target, info: info})
+		return nil
+	}
+
+	if st.Nlink > 1 {
+		if first, ok := x.links[st.Ino]; ok {
+			if x.dryRun {
+				return nil
+			}
+			return os.Link(first, target)
+		}
+	}
+	if x.dryRun {
+		if st.Nlink > 1 {
+			x.links[st.Ino] = target
+		}
+		return nil
+	}
+
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		err = x.copyFile(name, target)
+	case mode&fs.ModeSymlink != 0:
+		var link []byte
+		if link, err = fs.ReadFile(x.fsys, name); err == nil {
+			err = os.Symlink(string(link), target)
+		}
+	default:
+		err = mknod(target, st)
+	}
+	if err != nil {
+		return err
+	}
+	if st.Nlink > 1 {
+		x.links[st.Ino] = target
+	}
+	return x.setMetadata(target, name, info)
+}
+
+// mkdir creates the directory target. The extraction root, and its parents,
+// may already exist.
+func (x *extractor) mkdir(target string, root bool) error {
+	if root {
+		return os.MkdirAll(target, 0o700)
+	}
+	return os.Mkdir(target, 0o700)
+}
+
+func (x *extractor) copyFile(name, target string) error {
+	src, err := x.fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return xerrors.Errorf("failed to copy %s: %w", name, err)
+	}
+	return dst.Close()
+}
+
+// setMetadata restores the extended attributes, ownership, permissions and
+// times of the file name on target.
+func (x *extractor) setMetadata(target, name string, info fs.FileInfo) error {
+	if x.dryRun {
+		return nil
+	}
+	st := info.Sys().(*Statx)
+	attrs, err := x.fsys.Xattrs(name)
+	if err != nil {
+		return err
+	}
+	if err := setXattrs(target, attrs); err != nil {
+		return err
+	}
+	if err := lchown(target, st.UID, st.GID); err != nil {
+		return err
+	}
+	symlink := info.Mode()&fs.ModeSymlink != 0
+	if !symlink {
+		// After chown, which clears the set-user-ID and set-group-ID bits.
+		mode := info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	}
+	return setTimes(target, st.Atime, st.Mtime, symlink)
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package ext
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// mknod creates the device node, fifo or socket described by st at target.
+func mknod(target string, st *Statx) error {
+	dev := unix.Mkdev(st.RdevMajor, st.RdevMinor)
+	if err := unix.Mknod(target, uint32(st.Mode), int(dev)); err != nil {
+		return &fs.PathError{Op: "mknod", Path: target, Err: err}
+	}
+	return nil
+}
+
+// lchown sets the owner and group of target, if the process may.
+func lchown(target string, uid, gid uint32) error {
+	err := os.Lchown(target, int(uid), int(gid))
+	if errors.Is(err, fs.ErrPermission) {
+		return nil
+	}
+	return err
+}
+
+// setXattrs sets the extended attributes of target. Attributes the host
+// filesystem does not support or the process may not set are skipped.
+func setXattrs(target string, attrs map[string][]byte) error {
+	for name, value := range attrs {
+		err := unix.Lsetxattr(target, name, value, 0)
+		switch {
+		case err == nil, errors.Is(err, unix.ENOTSUP), errors.Is(err, unix.EPERM), errors.Is(err, unix.EACCES):
+		default:
+			return &fs.PathError{Op: "setxattr " + name, Path: target, Err: err}
+		}
+	}
+	return nil
+}
+
+// setTimes sets the access and modification times of target, without
+// following it if it is a symlink.
+func setTimes(target string, atime, mtime time.Time, symlink bool) error {
+	var ts [2]unix.Timespec
+	var err error
+	if ts[0], err = unix.TimeToTimespec(atime); err != nil {
+		return err
+	}
+	if ts[1], err = unix.TimeToTimespec(mtime); err != nil {
+		return err
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, ts[:], unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &fs.PathError{Op: "utimensat", Path: target, Err: err}
+	}
+	return nil
+}
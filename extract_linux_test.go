@@ -0,0 +1,55 @@
+package ext
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/testimage"
+	"golang.org/x/sys/unix"
+)
+
+func TestExtractXattrs(t *testing.T) {
+	fsys := extractImage(t, testimage.Entry{Name: "a.txt", Mode: 0644, Data: []byte("a"), Xattrs: map[string][]byte{
+		"user.comment": []byte("restored"),
+	}})
+	dest := t.TempDir()
+	if err := fsys.Extract(context.Background(), "/", dest); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := unix.Lgetxattr(filepath.Join(dest, "a.txt"), "user.comment", buf)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("the temporary directory does not support user extended attributes")
+	}
+	if err != nil || !bytes.Equal(buf[:n], []byte("restored")) {
+		t.Errorf("user.comment is %q, %v", buf[:n], err)
+	}
+}
+
+func TestExtractDevices(t *testing.T) {
+	fsys := extractImage(t,
+		testimage.Entry{Name: "null", Mode: fs.ModeDevice | fs.ModeCharDevice | 0666, Major: 1, Minor: 3},
+		testimage.Entry{Name: "nvme", Mode: fs.ModeDevice | 0660, Major: 259, Minor: 70000},
+	)
+	dest := t.TempDir()
+	if err := fsys.Extract(context.Background(), "/", dest); errors.Is(err, fs.ErrPermission) {
+		t.Skip("creating device nodes needs CAP_MKNOD")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]uint64{"null": unix.Mkdev(1, 3), "nvme": unix.Mkdev(259, 70000)} {
+		var st unix.Stat_t
+		if err := unix.Lstat(filepath.Join(dest, name), &st); err != nil {
+			t.Fatal(err)
+		}
+		if uint64(st.Rdev) != want {
+			t.Errorf("%s has device %d,%d, want %d,%d", name, unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)), unix.Major(want), unix.Minor(want))
+		}
+	}
+}
@@ -0,0 +1,43 @@
+//go:build !linux
+
+package ext
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"runtime"
+	"time"
+)
+
+// mknod fails: special files are only extracted on Linux.
+func mknod(target string, st *Statx) error {
+	return &fs.PathError{Op: "mknod", Path: target, Err: errNodeUnsupported}
+}
+
+// lchown sets the owner and group of target, if the platform has them and
+// the process may.
+func lchown(target string, uid, gid uint32) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	err := os.Lchown(target, int(uid), int(gid))
+	if errors.Is(err, fs.ErrPermission) {
+		return nil
+	}
+	return err
+}
+
+// setXattrs does nothing: extended attributes are only restored on Linux.
+func setXattrs(target string, attrs map[string][]byte) error {
+	return nil
+}
+
+// setTimes sets the access and modification times of target. Those of
+// symlinks are left alone.
+func setTimes(target string, atime, mtime time.Time, symlink bool) error {
+	if symlink {
+		return nil
+	}
+	return os.Chtimes(target, atime, mtime)
+}
@@ -0,0 +1,223 @@
+package ext
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+// extractImage builds an image from entries and returns its FileSystem.
+func extractImage(t *testing.T, entries ...testimage.Entry) *FileSystem {
+	t.Helper()
+	b := testimage.New(testimage.Ext4())
+	for _, e := range entries {
+		b.Add(e)
+	}
+	fsys, err := NewFS(bytes.NewReader(b.MustBuild()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+// skipSpecialFiles is an ExtractFunc which tolerates failing to create
+// special files without the privileges or platform support to.
+func skipSpecialFiles(path, target string, d fs.DirEntry, err error) error {
+	if err != nil && d.Type()&(fs.ModeDevice|fs.ModeNamedPipe|fs.ModeSocket) != 0 &&
+		(errors.Is(err, fs.ErrPermission) || errors.Is(err, errNodeUnsupported)) {
+		return nil
+	}
+	return err
+}
+
+func TestExtract(t *testing.T) {
+	var entries []testimage.Entry
+	for _, e := range testEntries() {
+		entries = append(entries, e)
+	}
+	mtime := time.Date(2021, time.March, 4, 5, 6, 7, 800000000, time.UTC)
+	entries = append(entries,
+		testimage.Entry{Name: "ro", Mode: fs.ModeDir | 0555, Mtime: mtime},
+		testimage.Entry{Name: "ro/file", Mode: 0444, Data: []byte("read only"), Mtime: mtime},
+	)
+	fsys := extractImage(t, entries...)
+
+	dest := filepath.Join(t.TempDir(), "out")
+	if err := fsys.Extract(context.Background(), "/", dest, WithExtractFunc(skipSpecialFiles)); err != nil {
+		t.Fatal(err)
+	}
+	// Let the temporary directory be removed.
+	defer os.Chmod(filepath.Join(dest, "ro"), 0o755)
+
+	for _, tc := range []struct {
+		name string
+		data string
+		perm fs.FileMode
+	}{
+		{"a.txt", "hello, world\n", 0644},
+		{"dir/sub/deep.txt", "deep", 0400},
+		{"ro/file", "read only", 0444},
+	} {
+		target := filepath.Join(dest, filepath.FromSlash(tc.name))
+		if data, err := os.ReadFile(target); err != nil || string(data) != tc.data {
+			t.Errorf("%s holds %q, %v", tc.name, data, err)
+		}
+		if info, err := os.Stat(target); err != nil || info.Mode().Perm() != tc.perm {
+			t.Errorf("%s has mode %v, %v; want %v", tc.name, info.Mode(), err, tc.perm)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "big.bin")); err != nil || !bytes.Equal(data, testEntries()["big.bin"].Data) {
+		t.Errorf("big.bin differs: %v", err)
+	}
+
+	if target, err := os.Readlink(filepath.Join(dest, "link")); err != nil || target != "a.txt" {
+		t.Errorf("link points to %q, %v", target, err)
+	}
+	a, errA := os.Stat(filepath.Join(dest, "a.txt"))
+	hard, errHard := os.Stat(filepath.Join(dest, "hard.txt"))
+	if errA != nil || errHard != nil || !os.SameFile(a, hard) {
+		t.Errorf("hard.txt is not a hard link to a.txt: %v, %v", errA, errHard)
+	}
+	if info, err := os.Lstat(filepath.Join(dest, "dev", "fifo")); err == nil && info.Mode().Type() != fs.ModeNamedPipe {
+		t.Errorf("dev/fifo has mode %v", info.Mode())
+	}
+
+	// Directory times are restored after their content is written.
+	for _, name := range []string{"ro", "ro/file"} {
+		info, err := os.Stat(filepath.Join(dest, name))
+		if err != nil || !info.ModTime().Equal(mtime) {
+			t.Errorf("%s has mtime %v, %v; want %v", name, info.ModTime(), err, mtime)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dest, "ro")); err != nil || info.Mode().Perm() != 0555 {
+		t.Errorf("ro has mode %v, %v", info.Mode(), err)
+	}
+}
+
+func TestExtractFile(t *testing.T) {
+	fsys := extractImage(t, testimage.Entry{Name: "dir/a.txt", Mode: 0640, Data: []byte("single")})
+	dest := filepath.Join(t.TempDir(), "copy.txt")
+	if err := fsys.Extract(context.Background(), "dir/a.txt", dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(dest); err != nil || string(data) != "single" {
+		t.Errorf("copy.txt holds %q, %v", data, err)
+	}
+}
+
+func TestExtractUnsafeNames(t *testing.T) {
+	fsys := extractImage(t,
+		testimage.Entry{Name: `..\escape`, Mode: 0644, Data: []byte("outside")},
+		testimage.Entry{Name: `evil\dir/file`, Mode: 0644, Data: []byte("outside")},
+		testimage.Entry{Name: "ok.txt", Mode: 0644, Data: []byte("inside")},
+	)
+	tmp := t.TempDir()
+	dest := filepath.Join(tmp, "out")
+
+	if err := fsys.Extract(context.Background(), "/", dest); !errors.Is(err, ErrUnsafeName) {
+		t.Fatalf("Extract returned %v, want ErrUnsafeName", err)
+	}
+
+	var unsafe []string
+	err := fsys.Extract(context.Background(), "/", filepath.Join(tmp, "out2"), WithExtractFunc(func(path, target string, d fs.DirEntry, err error) error {
+		if errors.Is(err, ErrUnsafeName) {
+			unsafe = append(unsafe, path)
+			return nil
+		}
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(unsafe)
+	if len(unsafe) != 2 || unsafe[0] != `/..\escape` || unsafe[1] != `/evil\dir` {
+		t.Errorf("reported unsafe names %q", unsafe)
+	}
+	if data, err := os.ReadFile(filepath.Join(tmp, "out2", "ok.txt")); err != nil || string(data) != "inside" {
+		t.Errorf("ok.txt holds %q, %v", data, err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmp, "escape")); err == nil {
+		t.Errorf("a file was extracted outside of the destination")
+	}
+}
+
+func TestExtractMissingRoot(t *testing.T) {
+	fsys := extractImage(t, testimage.Entry{Name: "a.txt", Mode: 0644, Data: []byte("a")})
+	dest := filepath.Join(t.TempDir(), "out")
+	if err := fsys.Extract(context.Background(), "missing", dest); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Extract returned %v, want fs.ErrNotExist", err)
+	}
+
+	var reported []string
+	err := fsys.Extract(context.Background(), "missing", dest, WithExtractFunc(func(path, target string, d fs.DirEntry, err error) error {
+		if d != nil || !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s reported with entry %v and error %v", path, d, err)
+		}
+		reported = append(reported, path)
+		return nil
+	}))
+	if err != nil {
+		t.Errorf("Extract returned %v after the error was skipped", err)
+	}
+	if len(reported) != 1 || reported[0] != "missing" {
+		t.Errorf("reported %q", reported)
+	}
+	if _, err := os.Lstat(dest); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Extract created %s: %v", dest, err)
+	}
+}
+
+func TestExtractNoOverwrite(t *testing.T) {
+	fsys := extractImage(t, testimage.Entry{Name: "a.txt", Mode: 0644, Data: []byte("image")})
+	dest := t.TempDir()
+	target := filepath.Join(dest, "a.txt")
+	if err := os.WriteFile(target, []byte("host"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Extract(context.Background(), "/", dest); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Extract returned %v, want fs.ErrExist", err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "host" {
+		t.Errorf("existing file was overwritten with %q", data)
+	}
+}
+
+func TestExtractDryRun(t *testing.T) {
+	fsys := extractImage(t,
+		testimage.Entry{Name: "dir/a.txt", Mode: 0644, Data: []byte("a")},
+		testimage.Entry{Name: "dir/b.txt", Link: "dir/a.txt"},
+	)
+	dest := filepath.Join(t.TempDir(), "out")
+	targets := make(map[string]string)
+	err := fsys.Extract(context.Background(), "dir", dest, WithDryRun(true), WithExtractFunc(func(path, target string, d fs.DirEntry, err error) error {
+		targets[path] = target
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"dir":       dest,
+		"dir/a.txt": filepath.Join(dest, "a.txt"),
+		"dir/b.txt": filepath.Join(dest, "b.txt"),
+	}
+	if len(targets) != len(want) {
+		t.Errorf("reported %v, want %v", targets, want)
+	}
+	for path, target := range want {
+		if targets[path] != target {
+			t.Errorf("%s reported with target %q, want %q", path, targets[path], target)
+		}
+	}
+	if _, err := os.Lstat(dest); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("dry run created %s: %v", dest, err)
+	}
+}
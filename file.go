@@ -4,36 +4,73 @@ import (
 	"errors"
 	"io"
 	"io/fs"
+	"sync"
 	"time"
 )
 
+// file is an open regular file or symlink. It is safe for concurrent use;
+// ReadAt calls do not serialize, while Read and Seek share the file position.
 type file struct {
+	// fsR is the FileSystem, possibly a context-bound view, the file was
+	// opened through. fsR and info are immutable.
+	fsR  *FileSystem
 	info *fileInfo
 
+	// mu protects position.
+	mu       sync.Mutex
 	position int64
 }
 
 type fileInfo struct {
 	*inode
+
+	// name is the name the inode was looked up by.
+	name string
 }
 
+// Statx is the inode metadata returned by the Sys method of the fs.FileInfo
+// of a file. Mask tells which of the statx(2) fields are set; the ext specific
+// fields which follow are always set.
 type Statx struct {
-	Mask      uint32
-	Blksize   uint32
-	Nlink     uint32
-	UID       uint32
-	GID       uint32
-	Mode      uint16
-	Ino       uint64
-	Size      uint64
-	Blocks    uint64
-	Atime     time.Time
-	Ctime     time.Time
-	Mtime     time.Time
+	Mask    uint32
+	Blksize uint32
+	Nlink   uint32
+	UID     uint32
+	GID     uint32
+	Mode    uint16
+	Ino     uint64
+	Size    uint64
+
+	// Blocks is the number of 512 byte sectors allocated to the file,
+	// metadata blocks included.
+	Blocks uint64
+	Atime  time.Time
+	Ctime  time.Time
+	Mtime  time.Time
+
+	// Btime is the creation time. It is zero, and STATX_BTIME not in Mask,
+	// for inodes too small to record it.
+	Btime time.Time
+
+	// RdevMajor and RdevMinor are the device numbers of device nodes.
 	RdevMajor uint32
 	RdevMinor uint32
 	DevMajor  uint32
 	DevMinor  uint32
+
+	// Dtime is the deletion time of inodes without links, and zero for
+	// others. Inodes on the orphan list hold the number of the next orphan
+	// in i_dtime instead, so that it is meaningless for unlinked files which
+	// were still open when the filesystem was last mounted.
+	Dtime      time.Time
+	Generation uint32
+
+	// Flags holds the inode flags, such as disklayout.InImmutable.
+	Flags uint32
+
+	// ProjectID is the project quota ID, zero for inodes too small to
+	// record it.
+	ProjectID uint32
 }
 
 func (f *fileInfo) Name() string {
@@ -45,11 +82,11 @@ func (f *fileInfo) Size() int64 {
 }
 
 func (f *fileInfo) Mode() fs.FileMode {
-	return f.Type()
+	return f.diskInode.Mode().FSMode()
 }
 
 func (f *fileInfo) ModTime() time.Time {
-	return f.diskInode.ChangeTime()
+	return f.diskInode.ModificationTime()
 }
 
 func (f *fileInfo) IsDir() bool {
@@ -66,65 +103,45 @@ func (f *file) Stat() (fs.FileInfo, error) {
 	return f.info, nil
 }
 
-func (f *file) Read(b []byte) (int, error) {
-	var rdr io.ReaderAt
-	if f.info.inode.isSymlink() {
-		sl, ok := f.info.inode.impl.(*symlink)
-		if !ok {
-			return 0, fs.ErrInvalid
-		}
-		rdr = sl
-
-	} else if f.info.inode.isRegular() {
-		rf, ok := f.info.inode.impl.(*regularFile)
-		if !ok {
-			return 0, fs.ErrInvalid
-		}
-		rdr = rf.impl
-	} else {
-		return 0, fs.ErrInvalid
-	}
-
-	sz := f.info.Size()
-	toRead := len(b)
-	if f.position+int64(toRead) > sz {
-		toRead = int(sz - f.position)
+// reader returns the reader holding the file content.
+func (f *file) reader() (io.ReaderAt, error) {
+	switch impl := f.info.inode.impl.(type) {
+	case *symlink:
+		return impl, nil
+	case *regularFile:
+		return impl.reader(f.fsR), nil
+	default:
+		return nil, fs.ErrInvalid
 	}
+}
 
-	n, err := rdr.ReadAt(b[:toRead], f.position)
-	if err != nil {
-		return n, err
-	}
-	if toRead != len(b) {
-		err = io.EOF
-	}
+// Read implements io.Reader.Read.
+func (f *file) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
+	n, err := f.ReadAt(b, f.position)
 	f.position += int64(n)
 	return n, err
 }
 
+// ReadAt implements io.ReaderAt.ReadAt. It does not use or change the file
+// position, so it may be called concurrently.
 func (f *file) ReadAt(p []byte, off int64) (n int, err error) {
-	var rdr io.ReaderAt
-	if f.info.inode.isSymlink() {
-		sl, ok := f.info.inode.impl.(*symlink)
-		if !ok {
-			return 0, fs.ErrInvalid
-		}
-		rdr = sl
-
-	} else if f.info.inode.isRegular() {
-		rf, ok := f.info.inode.impl.(*regularFile)
-		if !ok {
-			return 0, fs.ErrInvalid
-		}
-		rdr = rf.impl
-	} else {
+	rdr, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	if off < 0 {
 		return 0, fs.ErrInvalid
 	}
 
 	sz := f.info.Size()
+	if off >= sz {
+		return 0, io.EOF
+	}
 	toRead := len(p)
-	if f.position+int64(toRead) > sz {
+	if off+int64(toRead) > sz {
 		toRead = int(sz - off)
 	}
 
@@ -145,8 +162,10 @@ func (f *file) Close() error {
 
 // Seek implements vfs.FileDescriptionImpl.Seek.
 func (f *file) Seek(offset int64, whence int) (ret int64, err error) {
-	var newPos int64
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
+	var newPos int64
 	switch whence {
 	case io.SeekStart:
 		newPos = offset
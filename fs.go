@@ -5,7 +5,7 @@ import (
 	"io"
 	"io/fs"
 	"path"
-	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/asalih/go-ext/common"
@@ -15,11 +15,29 @@ import (
 )
 
 // FileSystem is implemented io/fs interface
+//
+// A FileSystem is safe for concurrent use by multiple goroutines, and so are
+// the files it opens, provided the underlying io.ReaderAt supports concurrent
+// ReadAt calls as io.ReaderAt requires.
 type FileSystem struct {
 	dev io.ReaderAt
 
+	// meta reads metadata blocks from dev through the block cache.
+	meta *blockReader
+
 	sb  disklayout.SuperBlock
 	bgs []disklayout.BlockGroup
+
+	// inodes caches parsed inodes by inode number.
+	inodes *inodeCache
+
+	// keys holds the fscrypt master keys. It is nil if none were given.
+	keys *keyring
+
+	// base is the FileSystem this is a context-bound view of, with dev and
+	// meta reading through the context. It is nil for FileSystems returned
+	// by NewFS.
+	base *FileSystem
 }
 
 func Check(r io.ReaderAt) (disklayout.ExtType, error) {
@@ -36,7 +54,12 @@ func Check(r io.ReaderAt) (disklayout.ExtType, error) {
 }
 
 // NewFS is created io/fs.FS for ext4 filesystem
-func NewFS(r io.ReaderAt) (*FileSystem, error) {
+func NewFS(r io.ReaderAt, opts ...Option) (*FileSystem, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	sb, err := readSuperBlock(r)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to parse super block: %w", err)
@@ -46,15 +69,24 @@ func NewFS(r io.ReaderAt) (*FileSystem, error) {
 		return nil, err
 	}
 
-	bgs, err := readBlockGroups(r, sb)
+	keys, err := newKeyring(o.encryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := newBlockReader(r, sb.BlockSize(), o.newBlockCache(), o.metadataReadahead)
+	bgs, err := readBlockGroups(meta, sb)
 	if err != nil {
 		return nil, err
 	}
 
 	fs := &FileSystem{
-		dev: r,
-		sb:  sb,
-		bgs: bgs,
+		dev:    r,
+		meta:   meta,
+		sb:     sb,
+		bgs:    bgs,
+		inodes: newInodeCache(o.inodeCacheSize),
+		keys:   keys,
 	}
 
 	return fs, nil
@@ -72,12 +104,46 @@ func isCompatible(sb disklayout.SuperBlock) error {
 	if incompatFeatures.MMP {
 		return errors.New("ext fs: multiple mount protection is not supported")
 	}
-	if incompatFeatures.Encrypted {
-		return errors.New("ext fs: encrypted inodes not supported")
-	}
 	if incompatFeatures.InlineData {
 		return errors.New("ext fs: inline files not supported")
 	}
+	return checkSuperBlock(sb)
+}
+
+// checkSuperBlock rejects superblocks whose geometry would make the rest of
+// the filesystem unreadable, mirroring the sanity checks ext4_fill_super
+// performs before trusting any of these values.
+func checkSuperBlock(sb disklayout.SuperBlock) error {
+	blkSize := sb.BlockSize()
+	if blkSize < disklayout.MinBlockSize || blkSize > disklayout.MaxBlockSize {
+		return xerrors.Errorf("ext fs: invalid block size %d: %w", blkSize, syserror.EFSCORRUPTED)
+	}
+
+	inodeSize := uint64(sb.InodeSize())
+	if inodeSize < disklayout.OldInodeSize || inodeSize > blkSize || inodeSize&(inodeSize-1) != 0 {
+		return xerrors.Errorf("ext fs: invalid inode size %d: %w", inodeSize, syserror.EFSCORRUPTED)
+	}
+
+	if sb.IncompatibleFeatures().Is64Bit && sb.BgDescSize() < disklayout.BgDesc64Size {
+		return xerrors.Errorf("ext fs: invalid group descriptor size %d: %w", sb.BgDescSize(), syserror.EFSCORRUPTED)
+	}
+
+	// With bigalloc the block bitmap tracks clusters, so a group may span more
+	// blocks than there are bits in one bitmap block.
+	bitsPerBlock := blkSize * 8
+	if sb.BlocksPerGroup() == 0 || (!sb.ReadOnlyCompatibleFeatures().Bigalloc && uint64(sb.BlocksPerGroup()) > bitsPerBlock) {
+		return xerrors.Errorf("ext fs: invalid blocks per group %d: %w", sb.BlocksPerGroup(), syserror.EFSCORRUPTED)
+	}
+	if sb.InodesPerGroup() == 0 || uint64(sb.InodesPerGroup()) > bitsPerBlock {
+		return xerrors.Errorf("ext fs: invalid inodes per group %d: %w", sb.InodesPerGroup(), syserror.EFSCORRUPTED)
+	}
+
+	if sb.BlocksCount() <= uint64(sb.FirstDataBlock()) {
+		return xerrors.Errorf("ext fs: invalid blocks count %d: %w", sb.BlocksCount(), syserror.EFSCORRUPTED)
+	}
+	if blockGroupsCount(sb)*uint64(sb.InodesPerGroup()) != uint64(sb.InodesCount()) {
+		return xerrors.Errorf("ext fs: inodes count %d does not match group count: %w", sb.InodesCount(), syserror.EFSCORRUPTED)
+	}
 	return nil
 }
 
@@ -85,12 +151,45 @@ func (f *FileSystem) SuperBlock() disklayout.SuperBlock {
 	return f.sb
 }
 
+// InodeCacheStats returns the hit and miss counts of the inode cache.
+func (f *FileSystem) InodeCacheStats() CacheStats {
+	return f.inodes.stats()
+}
+
+// BlockCacheStats returns the statistics of the metadata block cache. They are
+// all zero if the block cache is disabled.
+func (f *FileSystem) BlockCacheStats() CacheStats {
+	if f.meta.cache == nil {
+		return CacheStats{}
+	}
+	return f.meta.cache.Stats()
+}
+
+// getInode returns inode inodeNum, reading it from disk only if it is not
+// cached already.
+func (f *FileSystem) getInode(inodeNum uint32) (*inode, error) {
+	if in, ok := f.inodes.get(inodeNum); ok {
+		return in, nil
+	}
+	in, err := newInode(f, inodeNum)
+	if err != nil {
+		return nil, err
+	}
+	return f.inodes.add(in), nil
+}
+
+// ReadDir implements fs.ReadDirFS.ReadDir. The entries are sorted by name, as
+// fs.ReadDir requires; reading a directory opened with Open returns them in
+// on-disk order instead.
 func (f *FileSystem) ReadDir(path string) ([]fs.DirEntry, error) {
 	dirEntries, err := f.readDirEntry(path)
 	if err != nil {
 		return nil, err
 	}
 
+	sort.Slice(dirEntries, func(i, j int) bool {
+		return dirEntries[i].Name() < dirEntries[j].Name()
+	})
 	return dirEntries, nil
 }
 
@@ -100,43 +199,25 @@ func (f *FileSystem) Open(name string) (fs.File, error) {
 		return nil, fs.ErrInvalid
 	}
 
-	dirName, fileName := filepath.Split(name)
-	dirEntries, err := f.readDirEntry(dirName)
+	info, err := f.lookupPath(name)
 	if err != nil {
 		return nil, err
 	}
-
-	for _, entry := range dirEntries {
-		if entry.IsDir() || entry.Name() != fileName {
-			continue
-		}
-
-		inode, ok := entry.(*inode)
-		if !ok {
-			return nil, xerrors.Errorf("unspecified error, entry is not dir entry %+v", entry)
-		}
-
-		if inode.isRefInode() {
-			return nil, errors.New("must be file or symlink")
-		}
-
-		return &file{
-			info: &fileInfo{inode: inode},
-		}, nil
+	if info.isDir() {
+		return newDirFile(f, info), nil
+	}
+	if info.isRefInode() {
+		return nil, errors.New("must be file or symlink")
 	}
-	return nil, fs.ErrNotExist
+
+	return &file{
+		fsR:  f,
+		info: info,
+	}, nil
 }
 
 func (f *FileSystem) Stat(name string) (fs.FileInfo, error) {
-	fi, err := f.Open(name)
-	if err != nil {
-		info, err := f.ReadDirInfo(name)
-		if err != nil {
-			return nil, xerrors.Errorf("failed to read dir info: %w", err)
-		}
-		return info, nil
-	}
-	info, err := fi.Stat()
+	info, err := f.lookupPath(name)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to stat file: %w", err)
 	}
@@ -144,121 +225,111 @@ func (f *FileSystem) Stat(name string) (fs.FileInfo, error) {
 }
 
 func (f *FileSystem) ReadDirInfo(name string) (fs.FileInfo, error) {
-	if name == "/" {
-		inode, err := newInode(f, disklayout.RootDirInode)
-		inode.name = "/"
-		if err != nil {
-			return nil, xerrors.Errorf("failed to parse root inode: %w", err)
-		}
-		return &fileInfo{
-			inode: inode,
-		}, nil
-	}
-	name = strings.TrimRight(name, "/")
-	dirs, dir := path.Split(name)
-	dirEntries, err := f.readDirEntry(dirs)
+	info, err := f.lookupPath(name)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to read dir entry: %w", err)
+		return nil, xerrors.Errorf("failed to read dir info: %w", err)
 	}
-	for _, entry := range dirEntries {
-		if entry.Name() == strings.Trim(dir, "/") {
-			return entry.Info()
-		}
-	}
-	return nil, fs.ErrNotExist
+	return info, nil
 }
 
-func (f *FileSystem) readDirEntry(name string) ([]fs.DirEntry, error) {
-	rootEntries, err := f.listEntries(disklayout.RootDirInode)
+// lookupPath resolves name one component at a time from the root directory.
+// Symlinks are not followed. The root directory is named "/".
+func (f *FileSystem) lookupPath(name string) (*fileInfo, error) {
+	root, err := f.getInode(disklayout.RootDirInode)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to list file infos: %w", err)
-	}
-
-	var currentIno *inode
-	name = strings.ReplaceAll(filepath.Clean(name), "\\", "/")
-	dirs := strings.Split(strings.Trim(name, "/"), "/")
-	if len(dirs) == 1 && dirs[0] == "." || dirs[0] == "" {
-		var dirEntries []fs.DirEntry
-		for _, sino := range rootEntries {
-			if sino.Name() == "." || sino.Name() == ".." {
-				continue
-			}
-			dirEntries = append(dirEntries, sino)
-		}
-		return dirEntries, nil
-	}
-
-	for i, dir := range dirs {
-		found := false
-		for _, fileInfo := range rootEntries {
-			if fileInfo.Name() != dir {
-				continue
-			}
-			if !fileInfo.IsDir() {
-				return nil, xerrors.Errorf("%s is file, directory: %w", fileInfo.Name(), fs.ErrNotExist)
-			}
-			found = true
-			currentIno = fileInfo
-			break
-		}
+		return nil, xerrors.Errorf("failed to parse root inode: %w", err)
+	}
+	info := &fileInfo{inode: root, name: "/"}
 
-		if !found {
-			return nil, fs.ErrNotExist
+	name = path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+	for _, component := range strings.Split(name, "/") {
+		if component == "" {
+			continue
 		}
-
-		rootEntries, err = f.listInoEntries(currentIno)
+		if !info.isDir() {
+			return nil, xerrors.Errorf("%s is not a directory: %w", info.name, fs.ErrNotExist)
+		}
+		entry, err := f.lookup(info.inode, component)
 		if err != nil {
-			return nil, xerrors.Errorf("failed to list directory entries inode(%d): %w", currentIno, err)
+			return nil, err
 		}
-		if i != len(dirs)-1 {
-			continue
+		in, err := entry.getInode()
+		if err != nil {
+			return nil, err
 		}
+		info = &fileInfo{inode: in, name: entry.name}
+	}
+	return info, nil
+}
 
-		var dirEntries []fs.DirEntry
-		for _, fileInfo := range rootEntries {
-			// Skip current directory and parent directory
-			// infinit loop in walkDir
-			if fileInfo.Name() == "." || fileInfo.Name() == ".." {
-				continue
-			}
+// lookup returns the entry named name in directory dir, streaming its dirents
+// until it is found. Entries of encrypted directories are matched by the name
+// they are listed with.
+func (f *FileSystem) lookup(dir *inode, name string) (*dirEntry, error) {
+	d, ok := dir.impl.(*directory)
+	if !ok {
+		return nil, xerrors.Errorf("inode is not dir: %d", dir.inodeNum)
+	}
 
-			dirEntries = append(dirEntries, fileInfo)
+	it := d.dirents(f)
+	for {
+		dirent, err := it.next()
+		if err == io.EOF {
+			return nil, fs.ErrNotExist
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read directory inode(%d): %w", dir.inodeNum, err)
+		}
+		if dirent.Name() == name {
+			return newDirEntry(f, dirent), nil
 		}
-		return dirEntries, nil
 	}
-	return nil, fs.ErrNotExist
 }
 
-func (f *FileSystem) listEntries(ino uint32) ([]*inode, error) {
-	in, err := newInode(f, ino)
+func (f *FileSystem) readDirEntry(name string) ([]fs.DirEntry, error) {
+	info, err := f.lookupPath(name)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to get inode: %w", err)
+		return nil, err
+	}
+	if !info.isDir() {
+		return nil, xerrors.Errorf("%s is not a directory: %w", info.name, fs.ErrNotExist)
 	}
 
-	return f.listInoEntries(in)
+	entries, err := f.listInoEntries(info.inode)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to list directory entries inode(%d): %w", info.inodeNum, err)
+	}
+	dirEntries := make([]fs.DirEntry, len(entries))
+	for i, entry := range entries {
+		dirEntries[i] = entry
+	}
+	return dirEntries, nil
 }
 
-func (f *FileSystem) listInoEntries(in *inode) ([]*inode, error) {
+// listInoEntries returns the entries of directory in, in on-disk order and
+// without "." and "..".
+func (f *FileSystem) listInoEntries(in *inode) ([]*dirEntry, error) {
 	dir, ok := in.impl.(*directory)
 	if !ok {
 		return nil, xerrors.Errorf("inode is not dir: %d", in.inodeNum)
 	}
 
-	inodes := make([]*inode, 0)
-	for name, d := range dir.childMap {
-		if d.Inode() == 0 || name == "." || name == ".." {
-			continue
+	var entries []*dirEntry
+	it := dir.dirents(f)
+	for {
+		d, err := it.next()
+		if err == io.EOF {
+			return entries, nil
 		}
-
-		// ft, _ := d.FileType()
-		entry, err := newInode(f, d.Inode())
 		if err != nil {
 			return nil, err
 		}
+		// Skip current directory and parent directory
+		// infinit loop in walkDir
+		if name := d.Name(); name == "." || name == ".." {
+			continue
+		}
 
-		entry.name = name
-		inodes = append(inodes, entry)
+		entries = append(entries, newDirEntry(f, d))
 	}
-
-	return inodes, nil
 }
@@ -0,0 +1,380 @@
+package ext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/internal/testimage"
+	"github.com/asalih/go-ext/linux"
+)
+
+// imageConfigs are the layouts every reader test runs against.
+var imageConfigs = []struct {
+	name string
+	opts testimage.Options
+}{
+	{"ext2", testimage.Ext2()},
+	{"ext2-nofiletype", testimage.Options{BlockSize: 1024, InodeSize: 128, NoFileType: true}},
+	{"ext3", testimage.Ext3()},
+	{"ext3-4k", testimage.Options{BlockSize: 4096, Journal: true, DirIndex: true}},
+	{"ext4", testimage.Ext4()},
+	{"ext4-1k", testimage.Options{BlockSize: 1024, Extents: true, DirIndex: true}},
+	{"ext4-2k-32bit", testimage.Options{BlockSize: 2048, Extents: true, Journal: true}},
+	{"multi-group-extents", testimage.Options{BlockSize: 1024, BlocksPerGroup: 256, Extents: true, Is64Bit: true}},
+	{"multi-group-blockmap", testimage.Options{BlockSize: 1024, InodeSize: 128, BlocksPerGroup: 512}},
+}
+
+// htreeEntries is the number of files in the "htree" directory. It spans
+// several blocks even with 4k blocks.
+const htreeEntries = 150
+
+// testEntries returns the content of every test image, keyed by path.
+func testEntries() map[string]testimage.Entry {
+	big := make([]byte, 300*1024+123)
+	for i := range big {
+		big[i] = byte(i * 7 / 5)
+	}
+
+	// Scattered blocks of data followed by a trailing hole make a file with
+	// more extents than fit in the inode.
+	sparse := make([]byte, 64*4096)
+	for off := 0; off < len(sparse); off += 9000 {
+		copy(sparse[off:], "data")
+	}
+
+	entries := []testimage.Entry{
+		{Name: "a.txt", Mode: 0644, Data: []byte("hello, world\n"), UID: 1000, GID: 100},
+		{Name: "empty", Mode: 0600},
+		{Name: "big.bin", Mode: 0644, Data: big},
+		{Name: "sparse.bin", Mode: 0644, Data: sparse, Sparse: true, Size: int64(len(sparse)) + 1<<20},
+		{Name: "dir/sub/deep.txt", Mode: 0400, Data: []byte("deep")},
+		{Name: "link", Mode: fs.ModeSymlink | 0777, Target: "a.txt"},
+		{Name: "longlink", Mode: fs.ModeSymlink | 0777, Target: string(bytes.Repeat([]byte("long/"), 30))},
+		{Name: "hard.txt", Link: "a.txt"},
+		{Name: "xattr.txt", Mode: 0644, Data: []byte("attributes"), Xattrs: map[string][]byte{
+			"user.comment": []byte("in the inode when it fits"),
+			"user.large":   bytes.Repeat([]byte("x"), 300),
+		}},
+		{Name: "dev/null", Mode: fs.ModeDevice | fs.ModeCharDevice | 0666, Major: 1, Minor: 3},
+		{Name: "dev/fifo", Mode: fs.ModeNamedPipe | 0600},
+	}
+	for i := 0; i < htreeEntries; i++ {
+		name := fmt.Sprintf("htree/entry-with-a-longer-name-%04d", i)
+		entries = append(entries, testimage.Entry{Name: name, Mode: 0644, Data: []byte(name)})
+	}
+
+	m := make(map[string]testimage.Entry)
+	for _, e := range entries {
+		m[e.Name] = e
+	}
+	return m
+}
+
+// forEachImage builds an image from testEntries for every configuration and
+// runs fn on it as a subtest.
+func forEachImage(t *testing.T, fn func(t *testing.T, fsys *FileSystem, b *testimage.Builder, entries map[string]testimage.Entry)) {
+	entries := testEntries()
+	for _, cfg := range imageConfigs {
+		cfg := cfg
+		t.Run(cfg.name, func(t *testing.T) {
+			b := testimage.New(cfg.opts)
+			for _, e := range entries {
+				b.Add(e)
+			}
+			img, err := b.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fsys, err := NewFS(bytes.NewReader(img))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fn(t, fsys, b, entries)
+		})
+	}
+}
+
+func TestImageWalk(t *testing.T) {
+	forEachImage(t, func(t *testing.T, fsys *FileSystem, _ *testimage.Builder, entries map[string]testimage.Entry) {
+		want := []string{"lost+found", "dev", "dir", "dir/sub", "htree"}
+		for name := range entries {
+			want = append(want, name)
+		}
+		sort.Strings(want)
+
+		var got []string
+		err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != "." {
+				got = append(got, path)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("walked %d paths, want %d:\n got %v\nwant %v", len(got), len(want), got, want)
+		}
+	})
+}
+
+func TestImageReadFile(t *testing.T) {
+	forEachImage(t, func(t *testing.T, fsys *FileSystem, _ *testimage.Builder, entries map[string]testimage.Entry) {
+		for name, e := range entries {
+			if e.Link != "" {
+				e = entries[e.Link]
+			}
+			var want []byte
+			switch e.Mode.Type() {
+			case 0:
+				want = e.Data
+				if e.Size > int64(len(want)) {
+					want = append(append([]byte(nil), want...), make([]byte, e.Size-int64(len(want)))...)
+				}
+			case fs.ModeSymlink:
+				// Reading a symlink yields its target.
+				want = []byte(e.Target)
+			default:
+				continue
+			}
+
+			got, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				t.Errorf("ReadFile(%q): %v", name, err)
+				continue
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("ReadFile(%q) returned %d bytes which differ from the %d written", name, len(got), len(want))
+			}
+		}
+	})
+}
+
+func TestImageStat(t *testing.T) {
+	forEachImage(t, func(t *testing.T, fsys *FileSystem, b *testimage.Builder, entries map[string]testimage.Entry) {
+		for name, e := range entries {
+			nlink := uint32(1)
+			if e.Link != "" || name == "a.txt" {
+				nlink = 2
+				e = entries["a.txt"]
+			}
+
+			info, err := fsys.Stat(name)
+			if err != nil {
+				t.Errorf("Stat(%q): %v", name, err)
+				continue
+			}
+			st, ok := info.Sys().(*Statx)
+			if !ok {
+				t.Fatalf("Stat(%q).Sys() is %T", name, info.Sys())
+			}
+
+			wantSize := uint64(len(e.Data))
+			if e.Size > int64(wantSize) {
+				wantSize = uint64(e.Size)
+			}
+			if e.Mode.Type() == fs.ModeSymlink {
+				wantSize = uint64(len(e.Target))
+			}
+			if st.Size != wantSize {
+				t.Errorf("Stat(%q).Size = %d, want %d", name, st.Size, wantSize)
+			}
+			if st.Ino != uint64(b.Ino(name)) {
+				t.Errorf("Stat(%q).Ino = %d, want %d", name, st.Ino, b.Ino(name))
+			}
+			if st.Nlink != nlink {
+				t.Errorf("Stat(%q).Nlink = %d, want %d", name, st.Nlink, nlink)
+			}
+			if st.UID != e.UID || st.GID != e.GID {
+				t.Errorf("Stat(%q) owner = %d:%d, want %d:%d", name, st.UID, st.GID, e.UID, e.GID)
+			}
+			if perm := fs.FileMode(st.Mode & linux.PermissionsMask); perm != e.Mode.Perm() {
+				t.Errorf("Stat(%q) permissions = %v, want %v", name, perm, e.Mode.Perm())
+			}
+			if st.Mtime.Unix() != testimage.DefaultTime.Unix() {
+				t.Errorf("Stat(%q).Mtime = %v, want %v", name, st.Mtime, testimage.DefaultTime)
+			}
+		}
+
+		for _, dir := range []string{"dir", "dir/sub", "htree", "lost+found"} {
+			info, err := fsys.Stat(dir)
+			if err != nil {
+				t.Errorf("Stat(%q): %v", dir, err)
+				continue
+			}
+			if !info.IsDir() {
+				t.Errorf("Stat(%q) is not a directory", dir)
+			}
+		}
+	})
+}
+
+func TestStatx(t *testing.T) {
+	atime := time.Date(2021, time.May, 1, 0, 0, 0, 1, time.UTC)
+	mtime := time.Date(2021, time.May, 2, 0, 0, 0, 2, time.UTC)
+	ctime := time.Date(2021, time.May, 3, 0, 0, 0, 3, time.UTC)
+	btime := time.Date(2021, time.April, 30, 0, 0, 0, 4, time.UTC)
+	e := testimage.Entry{
+		Name: "f", Mode: 0644, Data: make([]byte, 5000),
+		Atime: atime, Mtime: mtime, Ctime: ctime, Crtime: btime,
+		Generation: 77, ProjectID: 42, Flags: disklayout.InNoDump,
+	}
+
+	b := testimage.New(testimage.Ext4())
+	b.Add(e)
+	fsys, err := NewFS(bytes.NewReader(b.MustBuild()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fsys.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("ModTime() = %v, want %v", info.ModTime(), mtime)
+	}
+	st := info.Sys().(*Statx)
+	for _, tc := range []struct {
+		name      string
+		got, want time.Time
+	}{
+		{"Atime", st.Atime, atime},
+		{"Mtime", st.Mtime, mtime},
+		{"Ctime", st.Ctime, ctime},
+		{"Btime", st.Btime, btime},
+	} {
+		if !tc.got.Equal(tc.want) {
+			t.Errorf("%s = %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+	if st.Mask&linux.STATX_BTIME == 0 || st.Mask&linux.STATX_BLOCKS == 0 {
+		t.Errorf("Mask = %#x lacks STATX_BTIME or STATX_BLOCKS", st.Mask)
+	}
+	// Two 4k blocks.
+	if st.Blocks != 16 {
+		t.Errorf("Blocks = %d, want 16", st.Blocks)
+	}
+	if !st.Dtime.IsZero() || st.Generation != 77 || st.ProjectID != 42 || st.Flags&disklayout.InNoDump == 0 {
+		t.Errorf("Dtime %v, Generation %d, ProjectID %d, Flags %#x", st.Dtime, st.Generation, st.ProjectID, st.Flags)
+	}
+
+	// 128 byte inodes have no creation time, nanoseconds nor project.
+	b = testimage.New(testimage.Ext2())
+	b.Add(e)
+	fsys, err = NewFS(bytes.NewReader(b.MustBuild()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = fsys.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st = info.Sys().(*Statx)
+	if !st.Btime.IsZero() || st.Mask&linux.STATX_BTIME != 0 || st.ProjectID != 0 || !st.Mtime.Equal(mtime.Truncate(time.Second)) {
+		t.Errorf("ext2 inode has Btime %v, Mask %#x, ProjectID %d, Mtime %v", st.Btime, st.Mask, st.ProjectID, st.Mtime)
+	}
+	// Five 1k blocks.
+	if st.Blocks != 10 {
+		t.Errorf("Blocks = %d, want 10", st.Blocks)
+	}
+}
+
+// otherInode is an implementation of disklayout.Inode other than InodeOld
+// and InodeNew.
+type otherInode struct {
+	disklayout.Inode
+}
+
+func TestStatxDtime(t *testing.T) {
+	b := testimage.New(testimage.Ext4())
+	b.File("f", make([]byte, 5000))
+	fsys, err := NewFS(bytes.NewReader(b.MustBuild()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := fsys.getInode(b.Ino("f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := *in.diskInode.(*disklayout.InodeNew)
+	stat := func(diskInode disklayout.Inode) Statx {
+		var st Statx
+		(&inode{fsR: fsys, inodeNum: in.inodeNum, diskInode: diskInode}).statTo(&st)
+		return st
+	}
+
+	// Inodes on the orphan list, here for truncation, keep their links and
+	// hold the next orphan in i_dtime.
+	raw.DeletionTimeRaw = 12
+	if st := stat(&raw); !st.Dtime.IsZero() {
+		t.Errorf("linked inode has Dtime %v", st.Dtime)
+	}
+	raw.LinksCountRaw = 0
+	if st := stat(&raw); !st.Dtime.Equal(time.Unix(12, 0)) {
+		t.Errorf("deleted inode has Dtime %v, want %v", st.Dtime, time.Unix(12, 0))
+	}
+
+	// Other implementations of disklayout.Inode lack the raw fields.
+	if st := stat(otherInode{&raw}); st.Blocks != 0 || !st.Dtime.IsZero() || st.Size != 5000 {
+		t.Errorf("otherInode has Blocks %d, Dtime %v, Size %d", st.Blocks, st.Dtime, st.Size)
+	}
+	if blk := xattrBlock(fsys.sb, otherInode{&raw}); blk != 0 {
+		t.Errorf("xattrBlock(otherInode) = %d, want 0", blk)
+	}
+}
+
+func TestStatxHugeFile(t *testing.T) {
+	b := testimage.New(testimage.Ext4())
+	b.Add(testimage.Entry{Name: "f", Mode: 0644, Data: make([]byte, 5000), Flags: disklayout.InHugeFile})
+	img := b.MustBuild()
+	blocks := func() uint64 {
+		t.Helper()
+		fsys, err := NewFS(bytes.NewReader(img))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := fsys.Stat("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Sys().(*Statx).Blocks
+	}
+
+	// Without the huge_file feature the flag is ignored.
+	if got := blocks(); got != 16 {
+		t.Errorf("Blocks = %d without huge_file, want 16", got)
+	}
+	// With it the count, 16 as written, is in 4k blocks.
+	off := disklayout.SbOffset + 0x64
+	binary.LittleEndian.PutUint32(img[off:], binary.LittleEndian.Uint32(img[off:])|disklayout.SbHugeFile)
+	if got := blocks(); got != 16*8 {
+		t.Errorf("Blocks = %d with huge_file, want %d", got, 16*8)
+	}
+}
+
+func TestImageHtreeReadDir(t *testing.T) {
+	forEachImage(t, func(t *testing.T, fsys *FileSystem, _ *testimage.Builder, _ map[string]testimage.Entry) {
+		entries, err := fsys.ReadDir("htree")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != htreeEntries {
+			t.Errorf("ReadDir returned %d entries, want %d", len(entries), htreeEntries)
+		}
+		// Indexed directories hold their entries in hash order.
+		if !sort.SliceIsSorted(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() }) {
+			t.Error("ReadDir entries are not sorted by name")
+		}
+	})
+}
@@ -0,0 +1,553 @@
+package ext
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/linux"
+	"github.com/asalih/go-ext/syserror"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/xts"
+	"golang.org/x/xerrors"
+)
+
+// ErrNoKey is returned when reading the contents of an encrypted file whose
+// master key was not given to NewFS.
+var ErrNoKey = errors.New("ext fs: encryption key not available")
+
+// fscrypt encryption modes.
+const (
+	EncryptionModeAES256XTS = 1
+	EncryptionModeAES256CTS = 4
+	EncryptionModeAES128CBC = 5
+	EncryptionModeAES128CTS = 6
+)
+
+// fscrypt policy flags.
+const (
+	// EncryptionPolicyPadMask selects the file name padding: 4 << (flags &
+	// EncryptionPolicyPadMask) bytes.
+	EncryptionPolicyPadMask = 0x03
+
+	// EncryptionPolicyDirectKey uses the master key for every file.
+	EncryptionPolicyDirectKey = 0x04
+
+	// EncryptionPolicyIVInoLblk64 derives one key per mode and puts the
+	// inode number in the IVs.
+	EncryptionPolicyIVInoLblk64 = 0x08
+
+	// EncryptionPolicyIVInoLblk32 is the 32-bit IV variant of
+	// EncryptionPolicyIVInoLblk64 for eMMC inline encryption hardware.
+	EncryptionPolicyIVInoLblk32 = 0x10
+)
+
+const (
+	// encryptionContextV1Size and encryptionContextV2Size are the sizes of
+	// struct fscrypt_context_v1 and fscrypt_context_v2.
+	encryptionContextV1Size = 28
+	encryptionContextV2Size = 40
+
+	// hkdfContext* select the keys derived from v2 master keys.
+	hkdfContextKeyIdentifier  = 1
+	hkdfContextPerFileEncKey  = 2
+	hkdfContextIVInoLblk64Key = 4
+
+	// noKeyNameBytes is the number of ciphertext bytes a no-key name holds
+	// before it falls back to a hash of the rest.
+	noKeyNameBytes = 149
+)
+
+// EncryptionPolicy is the fscrypt policy of an encrypted inode, decoded from
+// its encryption context.
+type EncryptionPolicy struct {
+	// Version is the policy version, 1 or 2.
+	Version int
+
+	ContentsMode  uint8
+	FilenamesMode uint8
+	Flags         uint8
+
+	// LogDataUnitSize is the log2 of the size contents are encrypted in, or
+	// 0 for the filesystem block size. Only v2 policies set it.
+	LogDataUnitSize uint8
+
+	// KeyDescriptor identifies the master key of a v1 policy.
+	KeyDescriptor [8]byte
+
+	// KeyIdentifier identifies the master key of a v2 policy.
+	KeyIdentifier [16]byte
+
+	// Nonce is the per-file nonce file keys are derived with.
+	Nonce [16]byte
+}
+
+// parseEncryptionContext decodes an fscrypt_context_v1 or v2.
+func parseEncryptionContext(ctx []byte) (*EncryptionPolicy, error) {
+	if len(ctx) == 0 {
+		return nil, xerrors.Errorf("empty encryption context: %w", syserror.EFSCORRUPTED)
+	}
+	p := &EncryptionPolicy{Version: int(ctx[0])}
+	switch {
+	case p.Version == 1 && len(ctx) == encryptionContextV1Size:
+		copy(p.KeyDescriptor[:], ctx[4:12])
+		copy(p.Nonce[:], ctx[12:28])
+	case p.Version == 2 && len(ctx) == encryptionContextV2Size:
+		p.LogDataUnitSize = ctx[4]
+		copy(p.KeyIdentifier[:], ctx[8:24])
+		copy(p.Nonce[:], ctx[24:40])
+	default:
+		return nil, xerrors.Errorf("encryption context version %d has %d bytes: %w", p.Version, len(ctx), syserror.EFSCORRUPTED)
+	}
+	p.ContentsMode, p.FilenamesMode, p.Flags = ctx[1], ctx[2], ctx[3]
+	return p, nil
+}
+
+// check returns an error if files under p can not be decrypted.
+func (p *EncryptionPolicy) check() error {
+	switch {
+	case p.Flags&(EncryptionPolicyDirectKey|EncryptionPolicyIVInoLblk32) != 0:
+		return xerrors.Errorf("ext fs: encryption policy flags %#x are not supported", p.Flags)
+	case p.Version == 1 && p.Flags&EncryptionPolicyIVInoLblk64 != 0:
+		return xerrors.Errorf("ext fs: invalid v1 encryption policy flags %#x: %w", p.Flags, syserror.EFSCORRUPTED)
+	}
+	switch {
+	case p.ContentsMode == EncryptionModeAES256XTS && p.FilenamesMode == EncryptionModeAES256CTS:
+	case p.ContentsMode == EncryptionModeAES128CBC && p.FilenamesMode == EncryptionModeAES128CTS:
+	default:
+		return xerrors.Errorf("ext fs: encryption modes %d/%d are not supported", p.ContentsMode, p.FilenamesMode)
+	}
+	return nil
+}
+
+// modeKeySize returns the size of the keys of a supported encryption mode.
+func modeKeySize(mode uint8) int {
+	switch mode {
+	case EncryptionModeAES256XTS:
+		return 64
+	case EncryptionModeAES256CTS:
+		return 32
+	default:
+		return 16
+	}
+}
+
+// keyring holds the master keys given to NewFS by the policy fields which
+// identify them.
+type keyring struct {
+	v1 map[[8]byte][]byte
+	v2 map[[16]byte][]byte
+}
+
+func newKeyring(keys []encryptionKey) (*keyring, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	kr := &keyring{
+		v1: make(map[[8]byte][]byte),
+		v2: make(map[[16]byte][]byte),
+	}
+	for _, k := range keys {
+		if len(k.key) == 0 || len(k.key) > 64 {
+			return nil, xerrors.Errorf("ext fs: encryption key has %d bytes", len(k.key))
+		}
+		if k.descriptor != nil {
+			kr.v1[*k.descriptor] = k.key
+			continue
+		}
+		kr.v1[keyDescriptor(k.key)] = k.key
+		if len(k.key) >= 16 {
+			id, err := keyIdentifier(k.key)
+			if err != nil {
+				return nil, err
+			}
+			kr.v2[id] = k.key
+		}
+	}
+	return kr, nil
+}
+
+// keyDescriptor returns the descriptor fscrypt and e4crypt give a v1 master
+// key: the first 8 bytes of its double SHA-512.
+func keyDescriptor(key []byte) [8]byte {
+	h := sha512.Sum512(key)
+	h = sha512.Sum512(h[:])
+	var d [8]byte
+	copy(d[:], h[:])
+	return d
+}
+
+// keyIdentifier returns the identifier the kernel derives for a v2 master
+// key.
+func keyIdentifier(key []byte) ([16]byte, error) {
+	var id [16]byte
+	err := hkdfExpand(key, hkdfContextKeyIdentifier, nil, id[:])
+	return id, err
+}
+
+// hkdfExpand fills out with the HKDF-SHA512 output the kernel derives from a
+// v2 master key for the given context and info.
+func hkdfExpand(master []byte, context byte, info []byte, out []byte) error {
+	full := append([]byte("fscrypt\x00"), context)
+	full = append(full, info...)
+	if _, err := io.ReadFull(hkdf.New(sha512.New, master, nil, full), out); err != nil {
+		return xerrors.Errorf("ext fs: failed to derive encryption key: %w", err)
+	}
+	return nil
+}
+
+// fileKey derives the key of a file using mode under policy p. uuid is the
+// filesystem UUID, which keys of IV_INO_LBLK_64 policies depend on.
+func (kr *keyring) fileKey(p *EncryptionPolicy, mode uint8, uuid [16]byte) ([]byte, error) {
+	size := modeKeySize(mode)
+	key := make([]byte, size)
+	if p.Version == 1 {
+		var master []byte
+		if kr != nil {
+			master = kr.v1[p.KeyDescriptor]
+		}
+		if master == nil {
+			return nil, xerrors.Errorf("master key descriptor %x: %w", p.KeyDescriptor, ErrNoKey)
+		}
+		if len(master) < size {
+			return nil, xerrors.Errorf("ext fs: master key %x has %d bytes, want %d", p.KeyDescriptor, len(master), size)
+		}
+		// v1 file keys are the master key encrypted with AES-128-ECB keyed
+		// by the nonce.
+		b, err := aes.NewCipher(p.Nonce[:])
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < size; i += aes.BlockSize {
+			b.Encrypt(key[i:], master[i:])
+		}
+		return key, nil
+	}
+
+	var master []byte
+	if kr != nil {
+		master = kr.v2[p.KeyIdentifier]
+	}
+	if master == nil {
+		return nil, xerrors.Errorf("master key identifier %x: %w", p.KeyIdentifier, ErrNoKey)
+	}
+	var err error
+	if p.Flags&EncryptionPolicyIVInoLblk64 != 0 {
+		err = hkdfExpand(master, hkdfContextIVInoLblk64Key, append([]byte{mode}, uuid[:]...), key)
+	} else {
+		err = hkdfExpand(master, hkdfContextPerFileEncKey, p.Nonce[:], key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// fileCrypt decrypts the contents or names of an encrypted inode: the
+// contents of regular files, the entry names of directories and the target
+// of symlinks.
+type fileCrypt struct {
+	// policy is nil if the encryption context could not be read.
+	policy *EncryptionPolicy
+	ino    uint32
+
+	// dataUnit is the size contents are encrypted in.
+	dataUnit uint64
+
+	// err tells why the inode can not be decrypted, e.g. ErrNoKey. The
+	// ciphers are only set if it is nil.
+	err   error
+	block cipher.Block
+	xts   *xts.Cipher
+	essiv cipher.Block
+}
+
+// newFileCrypt sets up the decryption of the encrypted inode inodeNum whose
+// record is at inodeOff. Failures are recorded in the fileCrypt rather than
+// returned, so that the inode can still be listed.
+func newFileCrypt(fsR *FileSystem, inodeNum uint32, inodeOff uint64, diskInode disklayout.Inode) *fileCrypt {
+	c := &fileCrypt{ino: inodeNum, dataUnit: fsR.sb.BlockSize()}
+	attrs, err := readXattrs(fsR, inodeOff, diskInode)
+	if err != nil {
+		c.err = xerrors.Errorf("failed to read encryption context of inode %d: %w", inodeNum, err)
+		return c
+	}
+	ctx, ok := findXattr(attrs, xattrIndexEncryption, xattrEncryptionContext)
+	if !ok {
+		c.err = xerrors.Errorf("encrypted inode %d has no encryption context: %w", inodeNum, syserror.EFSCORRUPTED)
+		return c
+	}
+	if c.policy, err = parseEncryptionContext(ctx); err != nil {
+		c.err = err
+		return c
+	}
+	if err := c.policy.check(); err != nil {
+		c.err = err
+		return c
+	}
+	if log := c.policy.LogDataUnitSize; log != 0 {
+		if log < 9 || uint64(1)<<log > c.dataUnit {
+			c.err = xerrors.Errorf("encryption data unit size 2^%d: %w", log, syserror.EFSCORRUPTED)
+			return c
+		}
+		c.dataUnit = 1 << log
+	}
+
+	mode := c.policy.FilenamesMode
+	if diskInode.Mode().FileType() == linux.ModeRegular {
+		mode = c.policy.ContentsMode
+	}
+	key, err := fsR.keys.fileKey(c.policy, mode, fsUUID(fsR.sb))
+	if err != nil {
+		c.err = err
+		return c
+	}
+	if err := c.setKey(mode, key); err != nil {
+		c.err = err
+	}
+	return c
+}
+
+func (c *fileCrypt) setKey(mode uint8, key []byte) error {
+	var err error
+	switch mode {
+	case EncryptionModeAES256XTS:
+		c.xts, err = xts.NewCipher(aes.NewCipher, key)
+	case EncryptionModeAES128CBC:
+		// ESSIV encrypts the IVs with the SHA-256 of the key.
+		salt := sha256.Sum256(key)
+		if c.essiv, err = aes.NewCipher(salt[:]); err == nil {
+			c.block, err = aes.NewCipher(key)
+		}
+	default:
+		c.block, err = aes.NewCipher(key)
+	}
+	return err
+}
+
+// fsUUID returns the UUID of the filesystem.
+func fsUUID(sb disklayout.SuperBlock) [16]byte {
+	switch s := sb.(type) {
+	case *disklayout.SuperBlock32Bit:
+		return s.UUID
+	case *disklayout.SuperBlock64Bit:
+		return s.UUID
+	}
+	return [16]byte{}
+}
+
+// iv returns the IV of data unit index. Names use index 0.
+func (c *fileCrypt) iv(index uint64) uint64 {
+	if c.policy.Flags&EncryptionPolicyIVInoLblk64 != 0 {
+		index |= uint64(c.ino) << 32
+	}
+	return index
+}
+
+// decryptBlock decrypts in place the file block lblk. Blocks which are all
+// zeroes are holes, or were never written, and are left as they are.
+func (c *fileCrypt) decryptBlock(blk []byte, lblk uint64) error {
+	if c.err != nil {
+		return c.err
+	}
+	if isZeroBlock(blk) {
+		return nil
+	}
+	units := uint64(len(blk)) / c.dataUnit
+	for i := uint64(0); i < units; i++ {
+		unit := blk[i*c.dataUnit : (i+1)*c.dataUnit]
+		iv := c.iv(lblk*units + i)
+		if c.xts != nil {
+			c.xts.Decrypt(unit, unit, iv)
+			continue
+		}
+		var ivBlock [aes.BlockSize]byte
+		binary.LittleEndian.PutUint64(ivBlock[:], iv)
+		c.essiv.Encrypt(ivBlock[:], ivBlock[:])
+		cipher.NewCBCDecrypter(c.block, ivBlock[:]).CryptBlocks(unit, unit)
+	}
+	return nil
+}
+
+func isZeroBlock(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// name returns how an encrypted directory entry name is presented: its
+// plaintext if the key is available and the no-key name otherwise.
+func (c *fileCrypt) name(ciphertext []byte) string {
+	if c.err == nil {
+		if name, err := c.decryptName(ciphertext); err == nil && len(name) > 0 {
+			return string(name)
+		}
+	}
+	return noKeyName(ciphertext)
+}
+
+// decryptName decrypts a file name with AES-CBC-CTS and strips its NUL
+// padding.
+func (c *fileCrypt) decryptName(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, xerrors.Errorf("encrypted name of %d bytes: %w", len(ciphertext), syserror.EFSCORRUPTED)
+	}
+	var iv [aes.BlockSize]byte
+	binary.LittleEndian.PutUint64(iv[:], c.iv(0))
+	name := decryptCTS(c.block, iv[:], ciphertext)
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return name, nil
+}
+
+// symlinkTarget decodes the target of an encrypted symlink, stored as a
+// fscrypt_symlink_data: the ciphertext length followed by the ciphertext.
+func (c *fileCrypt) symlinkTarget(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", xerrors.Errorf("encrypted symlink of %d bytes: %w", len(data), syserror.EFSCORRUPTED)
+	}
+	n := int(binary.LittleEndian.Uint16(data))
+	if n == 0 || 2+n > len(data) {
+		return "", xerrors.Errorf("encrypted symlink target of %d bytes in %d: %w", n, len(data), syserror.EFSCORRUPTED)
+	}
+	return c.name(data[2 : 2+n]), nil
+}
+
+// noKeyName returns the name the kernel presents an encrypted name by when
+// the key is not available: the unpadded base64url encoding of a struct
+// fscrypt_nokey_name. Its directory hash is left zero, as in listings of
+// unindexed directories, and long names end in a SHA-256 of their tail.
+func noKeyName(ciphertext []byte) string {
+	raw := make([]byte, 8, 8+noKeyNameBytes+sha256.Size)
+	if len(ciphertext) <= noKeyNameBytes {
+		raw = append(raw, ciphertext...)
+	} else {
+		sum := sha256.Sum256(ciphertext[noKeyNameBytes:])
+		raw = append(append(raw, ciphertext[:noKeyNameBytes]...), sum[:]...)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decryptCTS decrypts ciphertext with CBC and ciphertext stealing in the CS3
+// variant, where the last two blocks are swapped.
+func decryptCTS(b cipher.Block, iv []byte, ciphertext []byte) []byte {
+	bs := b.BlockSize()
+	out := make([]byte, len(ciphertext))
+	if len(ciphertext) == bs {
+		cipher.NewCBCDecrypter(b, iv).CryptBlocks(out, ciphertext)
+		return out
+	}
+
+	// tail is the length of the last, possibly partial, block.
+	tail := len(ciphertext) % bs
+	if tail == 0 {
+		tail = bs
+	}
+	head := len(ciphertext) - bs - tail
+	prev := iv
+	if head > 0 {
+		cipher.NewCBCDecrypter(b, iv).CryptBlocks(out[:head], ciphertext[:head])
+		prev = ciphertext[head-bs : head]
+	}
+
+	// The full block stored second to last is the encryption of the last
+	// plaintext block padded with the tail of the previous ciphertext block.
+	last := ciphertext[head+bs:]
+	d := make([]byte, bs)
+	b.Decrypt(d, ciphertext[head:head+bs])
+	for i := 0; i < tail; i++ {
+		out[head+bs+i] = d[i] ^ last[i]
+	}
+	copy(d, last)
+	b.Decrypt(d, d)
+	for i := 0; i < bs; i++ {
+		out[head+i] = d[i] ^ prev[i]
+	}
+	return out
+}
+
+// EncryptionPolicy returns the fscrypt policy of the named file, or nil if
+// it is not encrypted.
+func (f *FileSystem) EncryptionPolicy(name string) (*EncryptionPolicy, error) {
+	info, err := f.lookupPath(name)
+	if err != nil {
+		return nil, err
+	}
+	c := info.inode.crypt
+	if c == nil {
+		return nil, nil
+	}
+	if c.policy == nil {
+		return nil, c.err
+	}
+	p := *c.policy
+	return &p, nil
+}
+
+// cryptReader decrypts the contents of an encrypted regular file read by r.
+// The underlying reader maps whole blocks, since ciphertext is always read
+// and decrypted in full blocks.
+type cryptReader struct {
+	rf *regularFile
+	r  fileReader
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (c *cryptReader) ReadAt(dst []byte, off int64) (int, error) {
+	return c.readAt(c.rf.inode.fsR, dst, off)
+}
+
+// readAt implements fileReader.readAt.
+func (c *cryptReader) readAt(fsR *FileSystem, dst []byte, off int64) (int, error) {
+	if len(dst) == 0 {
+		return 0, nil
+	}
+	if off < 0 {
+		return 0, syserror.EINVAL
+	}
+	size := c.rf.inode.diskInode.Size()
+	if uint64(off) >= size {
+		return 0, io.EOF
+	}
+	crypt := c.rf.inode.crypt
+	if crypt.err != nil {
+		return 0, crypt.err
+	}
+
+	toRead := dst
+	if uint64(len(toRead)) > size-uint64(off) {
+		toRead = toRead[:size-uint64(off)]
+	}
+	blkSize := c.rf.inode.blkSize
+	start := uint64(off) / blkSize * blkSize
+	end := (uint64(off) + uint64(len(toRead)) + blkSize - 1) / blkSize * blkSize
+	buf := make([]byte, end-start)
+	if n, err := c.r.readAt(fsR, buf, int64(start)); uint64(n) < end-start {
+		if err == nil || err == io.EOF {
+			err = syserror.EIO
+		}
+		return 0, err
+	}
+	for i := uint64(0); i < end-start; i += blkSize {
+		if err := crypt.decryptBlock(buf[i:i+blkSize], (start+i)/blkSize); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(toRead, buf[uint64(off)-start:])
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,396 @@
+package ext
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/testimage"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/xts"
+)
+
+// testPolicy encrypts the entries of a test image the way the kernel does
+// under one fscrypt policy.
+type testPolicy struct {
+	version             int
+	contents, filenames uint8
+	flags               uint8
+	master              []byte
+
+	// uuid is the filesystem UUID, which IV_INO_LBLK_64 keys depend on.
+	uuid [16]byte
+}
+
+// encryption returns the testimage hooks of a file with the given nonce.
+func (p *testPolicy) encryption(t *testing.T, nonce byte) *testimage.Encryption {
+	var n [16]byte
+	for i := range n {
+		n[i] = nonce + byte(i)
+	}
+
+	var ctx []byte
+	if p.version == 1 {
+		h := sha512.Sum512(p.master)
+		h = sha512.Sum512(h[:])
+		ctx = append([]byte{1, p.contents, p.filenames, p.flags}, h[:8]...)
+	} else {
+		ctx = []byte{2, p.contents, p.filenames, p.flags, 0, 0, 0, 0}
+		ctx = append(ctx, p.hkdf(t, 1, nil, 16)...)
+	}
+	ctx = append(ctx, n[:]...)
+
+	iv := func(ino uint32, index uint64) uint64 {
+		if p.flags&EncryptionPolicyIVInoLblk64 != 0 {
+			index |= uint64(ino) << 32
+		}
+		return index
+	}
+	return &testimage.Encryption{
+		Context: ctx,
+		EncryptName: func(ino uint32, name []byte) []byte {
+			b, err := aes.NewCipher(p.fileKey(t, p.filenames, n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pad := 4 << (p.flags & EncryptionPolicyPadMask)
+			size := (len(name) + pad - 1) / pad * pad
+			if size < aes.BlockSize {
+				size = aes.BlockSize
+			}
+			padded := make([]byte, size)
+			copy(padded, name)
+			var ivBlock [16]byte
+			binary.LittleEndian.PutUint64(ivBlock[:], iv(ino, 0))
+			return encryptCTS(b, ivBlock[:], padded)
+		},
+		EncryptBlock: func(ino uint32, lblk uint64, block []byte) {
+			key := p.fileKey(t, p.contents, n)
+			if p.contents == EncryptionModeAES256XTS {
+				c, err := xts.NewCipher(aes.NewCipher, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.Encrypt(block, block, iv(ino, lblk))
+				return
+			}
+			salt := sha256.Sum256(key)
+			essiv, _ := aes.NewCipher(salt[:])
+			b, _ := aes.NewCipher(key)
+			var ivBlock [16]byte
+			binary.LittleEndian.PutUint64(ivBlock[:], iv(ino, lblk))
+			essiv.Encrypt(ivBlock[:], ivBlock[:])
+			cipher.NewCBCEncrypter(b, ivBlock[:]).CryptBlocks(block, block)
+		},
+	}
+}
+
+// fileKey derives a file key the way the kernel does.
+func (p *testPolicy) fileKey(t *testing.T, mode uint8, nonce [16]byte) []byte {
+	size := map[uint8]int{1: 64, 4: 32, 5: 16, 6: 16}[mode]
+	switch {
+	case p.version == 1:
+		b, err := aes.NewCipher(nonce[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := make([]byte, size)
+		for i := 0; i < size; i += 16 {
+			b.Encrypt(key[i:], p.master[i:])
+		}
+		return key
+	case p.flags&EncryptionPolicyIVInoLblk64 != 0:
+		return p.hkdf(t, 4, append([]byte{mode}, p.uuid[:]...), size)
+	default:
+		return p.hkdf(t, 2, nonce[:], size)
+	}
+}
+
+func (p *testPolicy) hkdf(t *testing.T, context byte, info []byte, size int) []byte {
+	out := make([]byte, size)
+	r := hkdf.New(sha512.New, p.master, nil, append([]byte("fscrypt\x00"+string(context)), info...))
+	if _, err := io.ReadFull(r, out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// encryptCTS encrypts plaintext with CBC-CS3, the inverse of decryptCTS.
+func encryptCTS(b cipher.Block, iv []byte, plaintext []byte) []byte {
+	out := make([]byte, len(plaintext))
+	if len(plaintext) == 16 {
+		cipher.NewCBCEncrypter(b, iv).CryptBlocks(out, plaintext)
+		return out
+	}
+	tail := len(plaintext) % 16
+	if tail == 0 {
+		tail = 16
+	}
+	head := len(plaintext) - 16 - tail
+	prev := iv
+	if head > 0 {
+		cipher.NewCBCEncrypter(b, iv).CryptBlocks(out[:head], plaintext[:head])
+		prev = out[head-16 : head]
+	}
+	e := make([]byte, 16)
+	for i := range e {
+		e[i] = plaintext[head+i] ^ prev[i]
+	}
+	b.Encrypt(e, e)
+	last := make([]byte, 16)
+	copy(last, plaintext[head+16:])
+	for i := range last {
+		last[i] ^= e[i]
+	}
+	b.Encrypt(out[head:], last)
+	copy(out[head+16:], e[:tail])
+	return out
+}
+
+// imageUUID returns the UUID testimage gives every filesystem.
+func imageUUID(t *testing.T) [16]byte {
+	fsys, err := NewFS(bytes.NewReader(testimage.New(testimage.Ext4()).MustBuild()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsUUID(fsys.SuperBlock())
+}
+
+var testPolicies = []struct {
+	name   string
+	policy testPolicy
+}{
+	{"v1-aes256", testPolicy{version: 1, contents: 1, filenames: 4}},
+	{"v1-aes128", testPolicy{version: 1, contents: 5, filenames: 6, flags: 2}},
+	{"v2-aes256", testPolicy{version: 2, contents: 1, filenames: 4, flags: 3}},
+	{"v2-aes128", testPolicy{version: 2, contents: 5, filenames: 6}},
+	{"v2-iv-ino-lblk-64", testPolicy{version: 2, contents: 1, filenames: 4, flags: EncryptionPolicyIVInoLblk64}},
+}
+
+// encryptedImage builds an image with an encrypted home directory.
+func encryptedImage(t *testing.T, opts testimage.Options, p *testPolicy) ([]byte, map[string][]byte) {
+	data := make([]byte, 3*int(opts.BlockSize)+100)
+	for i := range data {
+		data[i] = byte(i*13 + 1)
+	}
+	sparse := make([]byte, 4*int(opts.BlockSize))
+	copy(sparse[2*opts.BlockSize:], "after the hole")
+	files := map[string][]byte{
+		"home/secret.txt": []byte("the secret\n"),
+		"home/data.bin":   data,
+		"home/sparse.bin": sparse,
+		"home/sub/" + strings.Repeat("long-name-", 20): []byte("long"),
+	}
+
+	b := testimage.New(opts)
+	b.Add(testimage.Entry{Name: "home", Mode: fs.ModeDir | 0700, Encryption: p.encryption(t, 0x10)})
+	b.Add(testimage.Entry{Name: "home/sub", Mode: fs.ModeDir | 0700, Encryption: p.encryption(t, 0x20)})
+	b.Add(testimage.Entry{Name: "plain.txt", Mode: 0644, Data: []byte("not encrypted")})
+	nonce := byte(0x30)
+	for name, content := range files {
+		b.Add(testimage.Entry{Name: name, Mode: 0600, Data: content, Sparse: true, Encryption: p.encryption(t, nonce)})
+		nonce += 0x10
+	}
+	b.Add(testimage.Entry{Name: "home/link", Mode: fs.ModeSymlink | 0777, Target: "secret.txt", Encryption: p.encryption(t, 0x90)})
+	b.Add(testimage.Entry{Name: "home/longlink", Mode: fs.ModeSymlink | 0777, Target: strings.Repeat("x/", 40), Encryption: p.encryption(t, 0xa0)})
+	return b.MustBuild(), files
+}
+
+func TestEncryptedWithKey(t *testing.T) {
+	uuid := imageUUID(t)
+	for _, tc := range testPolicies {
+		for _, cfg := range []struct {
+			name string
+			opts testimage.Options
+		}{
+			{"ext4", testimage.Ext4()},
+			{"blockmap-1k", testimage.Options{BlockSize: 1024}},
+		} {
+			t.Run(tc.name+"/"+cfg.name, func(t *testing.T) {
+				p := tc.policy
+				p.uuid = uuid
+				p.master = bytes.Repeat([]byte{0x5a, 0xc3}, 32)
+				img, files := encryptedImage(t, cfg.opts, &p)
+				fsys, err := NewFS(bytes.NewReader(img), WithEncryptionKey(p.master))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for name, want := range files {
+					got, err := fs.ReadFile(fsys, name)
+					if err != nil {
+						t.Fatalf("ReadFile(%q): %v", name, err)
+					}
+					if !bytes.Equal(got, want) {
+						t.Errorf("ReadFile(%q) = %d bytes, want %d", name, len(got), len(want))
+					}
+				}
+
+				entries, err := fsys.ReadDir("home")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for _, e := range entries {
+					names = append(names, e.Name())
+				}
+				sort.Strings(names)
+				want := []string{"data.bin", "link", "longlink", "secret.txt", "sparse.bin", "sub"}
+				if strings.Join(names, ",") != strings.Join(want, ",") {
+					t.Errorf("ReadDir(home) = %v, want %v", names, want)
+				}
+
+				for link, want := range map[string]string{"home/link": "secret.txt", "home/longlink": strings.Repeat("x/", 40)} {
+					got, err := fs.ReadFile(fsys, link)
+					if err != nil || string(got) != want {
+						t.Errorf("symlink %s = %q, %v, want %q", link, got, err, want)
+					}
+				}
+
+				policy, err := fsys.EncryptionPolicy("home/secret.txt")
+				if err != nil || policy == nil || policy.Version != p.version || policy.ContentsMode != p.contents {
+					t.Errorf("EncryptionPolicy = %+v, %v", policy, err)
+				}
+				if policy, err := fsys.EncryptionPolicy("plain.txt"); policy != nil || err != nil {
+					t.Errorf("EncryptionPolicy(plain.txt) = %+v, %v, want nil", policy, err)
+				}
+			})
+		}
+	}
+}
+
+func TestEncryptedWithoutKey(t *testing.T) {
+	for _, tc := range testPolicies {
+		t.Run(tc.name, func(t *testing.T) {
+			p := tc.policy
+			p.uuid = imageUUID(t)
+			p.master = bytes.Repeat([]byte{0x11}, 64)
+			img, _ := encryptedImage(t, testimage.Ext4(), &p)
+
+			for _, opts := range [][]Option{nil, {WithEncryptionKey(bytes.Repeat([]byte{0x22}, 64))}} {
+				fsys, err := NewFS(bytes.NewReader(img), opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// No-key names are the base64url of 8 zero bytes of directory
+				// hash and the ciphertext.
+				enc := p.encryption(t, 0x10)
+				entries, err := fsys.ReadDir("home")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) != 6 {
+					t.Fatalf("ReadDir(home) = %d entries, want 6", len(entries))
+				}
+				homeIno := homeInode(t, fsys)
+				secret := noKeyTestName(enc.EncryptName(homeIno, []byte("secret.txt")))
+				found := false
+				for _, e := range entries {
+					if e.Name() == secret {
+						found = true
+					}
+					if strings.Contains(e.Name(), "secret") {
+						t.Errorf("entry %q is not encrypted", e.Name())
+					}
+				}
+				if !found {
+					t.Fatalf("no-key name %q not listed", secret)
+				}
+
+				f, err := fsys.Open("home/" + secret)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.ReadAll(f); !errors.Is(err, ErrNoKey) {
+					t.Errorf("reading without key: %v, want ErrNoKey", err)
+				}
+
+				// Walking the whole tree works with no-key names.
+				count := 0
+				err = fs.WalkDir(fsys, "home", func(path string, d fs.DirEntry, err error) error {
+					count++
+					return err
+				})
+				if err != nil || count != 8 {
+					t.Errorf("WalkDir(home) = %d entries, %v", count, err)
+				}
+
+				if got, err := fs.ReadFile(fsys, "plain.txt"); err != nil || string(got) != "not encrypted" {
+					t.Errorf("plain.txt = %q, %v", got, err)
+				}
+			}
+		})
+	}
+}
+
+func homeInode(t *testing.T, fsys *FileSystem) uint32 {
+	info, err := fsys.Stat("home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint32(info.Sys().(*Statx).Ino)
+}
+
+func noKeyTestName(ciphertext []byte) string {
+	raw := append(make([]byte, 8), ciphertext...)
+	if len(ciphertext) > 149 {
+		sum := sha256.Sum256(ciphertext[149:])
+		raw = append(raw[:8+149], sum[:]...)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func TestNoKeyLongName(t *testing.T) {
+	ciphertext := bytes.Repeat([]byte{0xab}, 192)
+	name := noKeyName(ciphertext)
+	if name != noKeyTestName(ciphertext) {
+		t.Errorf("noKeyName = %q", name)
+	}
+	if raw, _ := base64.RawURLEncoding.DecodeString(name); len(raw) != 8+149+32 {
+		t.Errorf("no-key name holds %d bytes, want %d", len(raw), 8+149+32)
+	}
+}
+
+func TestDecryptCTS(t *testing.T) {
+	b, _ := aes.NewCipher(bytes.Repeat([]byte{7}, 32))
+	iv := bytes.Repeat([]byte{3}, 16)
+	for _, n := range []int{16, 17, 20, 31, 32, 33, 48, 255} {
+		plaintext := make([]byte, n)
+		for i := range plaintext {
+			plaintext[i] = byte(i + n)
+		}
+		ciphertext := encryptCTS(b, iv, plaintext)
+		if got := decryptCTS(b, iv, ciphertext); !bytes.Equal(got, plaintext) {
+			t.Errorf("%d bytes: decryptCTS = %x, want %x", n, got, plaintext)
+		}
+	}
+}
+
+func TestUnsupportedPolicy(t *testing.T) {
+	p := testPolicy{version: 2, contents: 1, filenames: 4, master: bytes.Repeat([]byte{1}, 64)}
+	enc := p.encryption(t, 0x10)
+	enc.Context[3] = EncryptionPolicyDirectKey
+	img := testimage.New(testimage.Ext4()).
+		Add(testimage.Entry{Name: "dir", Mode: fs.ModeDir | 0700, Encryption: enc}).
+		Add(testimage.Entry{Name: "dir/file", Mode: 0600, Data: []byte("data"), Encryption: p.encryption(t, 0x20)}).
+		MustBuild()
+	fsys, err := NewFS(bytes.NewReader(img), WithEncryptionKey(p.master))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fsys.ReadDir("dir")
+	if err != nil || len(entries) != 1 || entries[0].Name() == "file" {
+		t.Fatalf("ReadDir(dir) = %v, %v, want one no-key name", entries, err)
+	}
+}
@@ -0,0 +1,255 @@
+package ext
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/linux"
+)
+
+const (
+	// fuzzMaxEntries and fuzzMaxDepth bound the end-to-end walk. A corrupted
+	// image can make a directory contain one of its ancestors.
+	fuzzMaxEntries = 64
+	fuzzMaxDepth   = 8
+
+	// fuzzMaxRead bounds the number of bytes read from a single file.
+	fuzzMaxRead = 1 << 20
+)
+
+// seedImages returns the decompressed images under testdata. They are small
+// mke2fs generated filesystems covering ext2 without dirent file types, ext3
+// with block maps, and ext4 with extents in 1k and 64-bit 4k layouts.
+func seedImages(tb testing.TB) [][]byte {
+	tb.Helper()
+
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.img.gz"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var images [][]byte
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		img, err := io.ReadAll(zr)
+		f.Close()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		images = append(images, img)
+	}
+	return images
+}
+
+// fuzzInodeArgs builds the arguments of an inode whose i_block array is
+// iblock, living on a 1k block filesystem backed by disk.
+func fuzzInodeArgs(disk []byte, iblock []byte, mode uint16, flags uint32, size uint64) inodeArgs {
+	sb := &disklayout.SuperBlock32Bit{}
+	sb.MagicRaw = 0xef53
+	sb.RevLevel = uint32(disklayout.DynamicRev)
+	sb.InodeSizeRaw = 256
+	sb.InodesCountRaw = 1 << 16
+	sb.InodesPerGroupRaw = 1 << 16
+
+	diskInode := &disklayout.InodeNew{}
+	diskInode.ModeRaw = mode
+	diskInode.FlagsRaw = flags
+	diskInode.SizeLo = uint32(size)
+	diskInode.SizeHi = uint32(size >> 32)
+	copy(diskInode.DataRaw[:], iblock)
+
+	dev := bytes.NewReader(disk)
+	return inodeArgs{
+		fs:        &FileSystem{dev: dev, meta: newBlockReader(dev, sb.BlockSize(), nil, 0), sb: sb},
+		inodeNum:  disklayout.RootDirInode,
+		blkSize:   sb.BlockSize(),
+		diskInode: diskInode,
+	}
+}
+
+// withIBlock joins an i_block array, padded to its full 60 bytes, with the disk
+// behind it. It is the inverse of splitIBlock.
+func withIBlock(iblock []byte, disk []byte) []byte {
+	data := make([]byte, 60, 60+len(disk))
+	copy(data, iblock)
+	return append(data, disk...)
+}
+
+// splitIBlock splits fuzz input into an i_block array and the disk behind it.
+func splitIBlock(data []byte) ([]byte, []byte) {
+	if len(data) < 60 {
+		return data, nil
+	}
+	return data[:60], data[60:]
+}
+
+func FuzzReadSuperBlock(f *testing.F) {
+	for _, img := range seedImages(f) {
+		f.Add(img[:2048])
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sb, err := readSuperBlock(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		_ = isCompatible(sb)
+		_ = sb.ExtType()
+	})
+}
+
+func FuzzReadBlockGroups(f *testing.F) {
+	for _, img := range seedImages(f) {
+		f.Add(img[:8192])
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		sb, err := readSuperBlock(r)
+		if err != nil {
+			return
+		}
+		if err := isCompatible(sb); err != nil {
+			return
+		}
+		bgs, err := readBlockGroups(r, sb)
+		if err != nil {
+			return
+		}
+		if uint64(len(bgs)) != blockGroupsCount(sb) {
+			t.Fatalf("read %d block groups, want %d", len(bgs), blockGroupsCount(sb))
+		}
+	})
+}
+
+func FuzzNewDirectory(f *testing.F) {
+	// A single 1k block holding ".", ".." and "a" as an extent mapped directory.
+	block := make([]byte, 1024)
+	copy(block, []byte{2, 0, 0, 0, 12, 0, 1, 2, '.', 0, 0, 0})
+	copy(block[12:], []byte{2, 0, 0, 0, 12, 0, 2, 2, '.', '.', 0, 0})
+	copy(block[24:], []byte{12, 0, 0, 0, 0xe8, 3, 1, 1, 'a', 0, 0, 0})
+	iblock := []byte{
+		0x0a, 0xf3, 1, 0, 4, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0,
+	}
+	f.Add(withIBlock(iblock, block), true, true)
+	f.Add(withIBlock(nil, block), false, false)
+
+	f.Fuzz(func(t *testing.T, data []byte, extents, newDirent bool) {
+		iblock, disk := splitIBlock(data)
+		var flags uint32
+		if extents {
+			flags = disklayout.InExtents
+		}
+		args := fuzzInodeArgs(disk, iblock, linux.ModeDirectory, flags, uint64(len(disk)))
+
+		dir, err := newDirectory(args, newDirent)
+		if err != nil {
+			return
+		}
+		it := dir.dirents(args.fs)
+		for {
+			d, err := it.next()
+			if err != nil {
+				return
+			}
+			if len(d.Name()) != int(d.NameLen()) {
+				t.Fatalf("dirent %q has name length %d", d.Name(), d.NameLen())
+			}
+		}
+	})
+}
+
+func FuzzExtentTree(f *testing.F) {
+	// A depth 1 tree: the root index points at block 1 which holds a leaf
+	// mapping file block 0 to physical block 2.
+	iblock := []byte{
+		0x0a, 0xf3, 1, 0, 4, 0, 1, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0,
+	}
+	disk := make([]byte, 3*1024)
+	copy(disk[1024:], []byte{
+		0x0a, 0xf3, 1, 0, 84, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0,
+	})
+	copy(disk[2048:], "extent data")
+	f.Add(withIBlock(iblock, disk), uint32(11))
+
+	f.Fuzz(func(t *testing.T, data []byte, size uint32) {
+		iblock, disk := splitIBlock(data)
+		args := fuzzInodeArgs(disk, iblock, linux.ModeRegular, disklayout.InExtents, uint64(size%fuzzMaxRead))
+
+		file, err := newExtentFile(args)
+		if err != nil {
+			return
+		}
+		readAll(t, file, args.diskInode.Size())
+	})
+}
+
+func FuzzFileSystem(f *testing.F) {
+	for _, img := range seedImages(f) {
+		f.Add(img)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fsys, err := NewFS(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		entries := 0
+		_ = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if entries++; entries > fuzzMaxEntries {
+				return fs.SkipAll
+			}
+			if d.IsDir() && strings.Count(path, "/") >= fuzzMaxDepth {
+				return fs.SkipDir
+			}
+			if _, err := d.Info(); err != nil || d.IsDir() {
+				return nil
+			}
+
+			file, err := fsys.Open(path)
+			if err != nil {
+				return nil
+			}
+			defer file.Close()
+			_, _ = io.Copy(io.Discard, io.LimitReader(file, fuzzMaxRead))
+			return nil
+		})
+	})
+}
+
+// readAll reads the first size bytes of r in fixed size chunks.
+func readAll(t *testing.T, r io.ReaderAt, size uint64) {
+	t.Helper()
+
+	buf := make([]byte, 4096)
+	for off := uint64(0); off < size; off += uint64(len(buf)) {
+		n, err := r.ReadAt(buf, int64(off))
+		if n > len(buf) {
+			t.Fatalf("ReadAt returned %d bytes for a %d byte buffer", n, len(buf))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -4,5 +4,7 @@ go 1.20
 
 require (
 	github.com/lunixbochs/struc v0.0.0-20200707160740-784aaebc1d40
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0
 	golang.org/x/xerrors v0.0.0-20220907171357-04be3eba64a2
 )
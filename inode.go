@@ -1,10 +1,12 @@
 package ext
 
 import (
-	"io/fs"
+	"io"
 
 	"github.com/asalih/go-ext/disklayout"
 	"github.com/asalih/go-ext/linux"
+	"github.com/asalih/go-ext/syserror"
+	"golang.org/x/xerrors"
 )
 
 // inode represents an ext inode.
@@ -21,15 +23,13 @@ import (
 //	                   |-- extent file
 //	                   |-- block map file
 //
+// Inodes are immutable once constructed and shared by all readers through the
+// inode cache.
+//
 // +stateify savable
 type inode struct {
-	// name of entry
-	name string
-
-	// refs is a reference count. refs is accessed using atomic memory operations.
-	refs int64
-
-	// fsR is the containing filesystem.
+	// fsR is the containing filesystem. It is never a context-bound view, so
+	// that caching the inode does not capture a context.
 	fsR *FileSystem
 
 	// inodeNum is the inode number of this inode on disk. This is used to
@@ -42,42 +42,39 @@ type inode struct {
 	// diskInode gives us access to the inode struct on disk. Immutable.
 	diskInode disklayout.Inode
 
+	// crypt decrypts the inode if it is encrypted, and is nil otherwise.
+	// Immutable.
+	crypt *fileCrypt
+
 	// This is immutable. The first field of the implementations must have inode
 	// as the first field to ensure temporality.
 	impl interface{}
 }
 
-var _ fs.DirEntry = (*inode)(nil)
-
 type inodeArgs struct {
+	// fs is the FileSystem, possibly a context-bound view, the inode is read
+	// through.
 	fs        *FileSystem
 	inodeNum  uint32
 	blkSize   uint64
 	diskInode disklayout.Inode
+	crypt     *fileCrypt
 }
 
 // newInode is the inode constructor. Reads the inode off disk. Identifies
 // inodes based on the absolute inode number on disk.
 func newInode(fsR *FileSystem, inodeNum uint32) (*inode, error) {
-	if inodeNum == 0 {
-		panic("inode number 0 on ext filesystems is not possible")
+	if inodeNum == 0 || inodeNum > fsR.sb.InodesCount() {
+		return nil, xerrors.Errorf("inode number %d out of range: %w", inodeNum, syserror.EFSCORRUPTED)
 	}
 
-	inodeRecordSize := fsR.sb.InodeSize()
-	var diskInode disklayout.Inode
-	if inodeRecordSize == disklayout.OldInodeSize {
-		diskInode = &disklayout.InodeOld{}
-	} else {
-		diskInode = &disklayout.InodeNew{}
-	}
-
-	// Calculate where the inode is actually placed.
-	inodesPerGrp := fsR.sb.InodesPerGroup()
+	diskInode := newDiskInode(fsR.sb)
 	blkSize := fsR.sb.BlockSize()
-	inodeTableOff := fsR.bgs[getBGNum(inodeNum, inodesPerGrp)].InodeTable() * blkSize
-	inodeOff := inodeTableOff + uint64(uint32(inodeRecordSize)*getBGOff(inodeNum, inodesPerGrp))
-
-	if err := readFromDisk(fsR.dev, int64(inodeOff), diskInode); err != nil {
+	inodeOff, err := inodeOffset(fsR, inodeNum)
+	if err != nil {
+		return nil, err
+	}
+	if err := readFromDisk(fsR.meta, int64(inodeOff), diskInode); err != nil {
 		return nil, err
 	}
 
@@ -88,6 +85,12 @@ func newInode(fsR *FileSystem, inodeNum uint32) (*inode, error) {
 		blkSize:   blkSize,
 		diskInode: diskInode,
 	}
+	if diskInode.Flags().Encrypt {
+		switch diskInode.Mode().FileType() {
+		case linux.ModeRegular, linux.ModeDirectory, linux.ModeSymlink:
+			args.crypt = newFileCrypt(fsR, inodeNum, inodeOff, diskInode)
+		}
+	}
 
 	switch diskInode.Mode().FileType() {
 	case linux.ModeSymlink:
@@ -118,14 +121,46 @@ func newInode(fsR *FileSystem, inodeNum uint32) (*inode, error) {
 	}
 }
 
+// inodeOffset returns where the record of inode inodeNum is placed.
+func inodeOffset(fsR *FileSystem, inodeNum uint32) (uint64, error) {
+	inodesPerGrp := fsR.sb.InodesPerGroup()
+	bgNum := getBGNum(inodeNum, inodesPerGrp)
+	if uint64(bgNum) >= uint64(len(fsR.bgs)) {
+		return 0, xerrors.Errorf("inode %d in missing block group %d: %w", inodeNum, bgNum, syserror.EFSCORRUPTED)
+	}
+	inodeTableOff := fsR.bgs[bgNum].InodeTable() * fsR.sb.BlockSize()
+	return inodeTableOff + uint64(uint32(fsR.sb.InodeSize())*getBGOff(inodeNum, inodesPerGrp)), nil
+}
+
+// newDiskInode returns an empty on-disk inode structure of the version used
+// by sb.
+func newDiskInode(sb disklayout.SuperBlock) disklayout.Inode {
+	if sb.InodeSize() == disklayout.OldInodeSize {
+		return &disklayout.InodeOld{}
+	}
+	return &disklayout.InodeNew{}
+}
+
 func (in *inode) init(args inodeArgs, impl interface{}) {
-	in.fsR = args.fs
+	in.fsR = args.fs.root()
 	in.inodeNum = args.inodeNum
 	in.blkSize = args.blkSize
 	in.diskInode = args.diskInode
+	in.crypt = args.crypt
 	in.impl = impl
 }
 
+// dataReader returns the reader of fsR to fetch the data blocks of this inode
+// from. Directory and symlink blocks are metadata and go through the block
+// cache. Regular file data bypasses it so that bulk reads do not evict
+// metadata.
+func (in *inode) dataReader(fsR *FileSystem) io.ReaderAt {
+	if in.diskInode.Mode().FileType() == linux.ModeRegular {
+		return fsR.dev
+	}
+	return fsR.meta
+}
+
 func (in *inode) isDir() bool {
 	_, ok := in.impl.(*directory)
 	return ok
@@ -135,7 +170,7 @@ func (in *inode) isDir() bool {
 func (in *inode) statTo(stat *Statx) {
 	stat.Mask = linux.STATX_TYPE | linux.STATX_MODE | linux.STATX_NLINK |
 		linux.STATX_UID | linux.STATX_GID | linux.STATX_INO | linux.STATX_SIZE |
-		linux.STATX_ATIME | linux.STATX_CTIME | linux.STATX_MTIME
+		linux.STATX_ATIME | linux.STATX_CTIME | linux.STATX_MTIME | linux.STATX_BLOCKS
 	stat.Blksize = uint32(in.blkSize)
 	stat.Mode = uint16(in.diskInode.Mode())
 	stat.Nlink = uint32(in.diskInode.LinksCount())
@@ -146,26 +181,59 @@ func (in *inode) statTo(stat *Statx) {
 	stat.Atime = in.diskInode.AccessTime()
 	stat.Ctime = in.diskInode.ChangeTime()
 	stat.Mtime = in.diskInode.ModificationTime()
+	if btime, ok := in.diskInode.BirthTime(); ok {
+		stat.Btime = btime
+		stat.Mask |= linux.STATX_BTIME
+	}
+	if ref, ok := in.impl.(*refInode); ok {
+		stat.RdevMajor, stat.RdevMinor = ref.major, ref.minor
+	}
 	// stat.DevMajor = linux.UNNAMED_MAJOR
 	// stat.DevMinor = in.fsR.devMinor
-	// TODO(b/134676337): Set stat.Blocks which is the number of 512 byte blocks
-	// (including metadata blocks) required to represent this file.
-}
 
-func (i *inode) Name() string {
-	return i.name
-}
-
-func (i *inode) IsDir() bool {
-	return i.isDir()
+	if raw := oldInode(in.diskInode); raw != nil {
+		stat.Blocks = inodeBlocks(in.fsR.sb, raw)
+		stat.Generation = raw.Generation
+		stat.Flags = raw.FlagsRaw
+		// Live inodes on the orphan list hold the next orphan in i_dtime.
+		if raw.DeletionTimeRaw != 0 && raw.LinksCountRaw == 0 {
+			stat.Dtime = in.diskInode.DeletionTime()
+		}
+	}
+	if newIn, ok := in.diskInode.(*disklayout.InodeNew); ok && newIn.ExtraInodeSize >= projectIDEnd {
+		stat.ProjectID = newIn.ProjectID
+	}
 }
 
-func (i *inode) Type() fs.FileMode {
-	return i.diskInode.Mode().FSMode()
+// projectIDEnd is the end of InodeNew.ProjectID past the 128 bytes of
+// InodeOld, which InodeNew.ExtraInodeSize must cover for it to be set.
+const projectIDEnd = 32
+
+// oldInode returns the fields diskInode shares with ext2 inodes, or nil for
+// other implementations of disklayout.Inode.
+func oldInode(diskInode disklayout.Inode) *disklayout.InodeOld {
+	switch in := diskInode.(type) {
+	case *disklayout.InodeNew:
+		return &in.InodeOld
+	case *disklayout.InodeOld:
+		return in
+	}
+	return nil
 }
 
-func (i *inode) Info() (fs.FileInfo, error) {
-	return &fileInfo{inode: i}, nil
+// inodeBlocks returns the number of 512 byte sectors allocated to an inode.
+// Like the kernel, it uses the high bits of the count only if the filesystem
+// has the huge_file feature, which also lets inodes with the huge file flag
+// count in filesystem blocks instead.
+func inodeBlocks(sb disklayout.SuperBlock, in *disklayout.InodeOld) uint64 {
+	if !sb.ReadOnlyCompatibleFeatures().HugeFile {
+		return uint64(in.BlocksCountLo)
+	}
+	blocks := uint64(in.BlocksCountHi)<<32 | uint64(in.BlocksCountLo)
+	if in.FlagsRaw&disklayout.InHugeFile != 0 {
+		blocks *= sb.BlockSize() / 512
+	}
+	return blocks
 }
 
 // getBGNum returns the block group number that a given inode belongs to.
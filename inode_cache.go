@@ -0,0 +1,72 @@
+package ext
+
+import "github.com/asalih/go-ext/internal/lru"
+
+// DefaultInodeCacheSize is the number of inodes a FileSystem caches unless
+// configured otherwise with WithInodeCacheSize.
+const DefaultInodeCacheSize = 4096
+
+// CacheStats reports how effective a cache has been since the FileSystem was
+// created.
+type CacheStats struct {
+	// Hits and Misses count lookups served from and missed by the cache.
+	Hits   uint64
+	Misses uint64
+
+	// Evictions counts entries dropped to stay within Capacity.
+	Evictions uint64
+
+	// Len is the current number of entries and Capacity the maximum, for
+	// caches bounded by entry count.
+	Len      int
+	Capacity int
+
+	// Bytes is the memory held and MaxBytes the limit, for caches bounded
+	// by size.
+	Bytes    int64
+	MaxBytes int64
+}
+
+// inodeCache is a bounded LRU cache of parsed inodes keyed by inode number.
+// Cached inodes are shared between all callers, so they must not be mutated
+// once constructed. It is safe for concurrent use.
+type inodeCache struct {
+	// capacity is the maximum number of cached inodes. Zero disables the
+	// cache. Immutable.
+	capacity int
+
+	inodes *lru.Cache[uint32, *inode]
+}
+
+func newInodeCache(capacity int) *inodeCache {
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &inodeCache{
+		capacity: capacity,
+		inodes:   lru.New[uint32, *inode](int64(capacity), nil),
+	}
+}
+
+// get returns the cached inode inodeNum and marks it as recently used.
+func (c *inodeCache) get(inodeNum uint32) (*inode, bool) {
+	return c.inodes.Get(inodeNum)
+}
+
+// add caches in, evicting the least recently used inode if the cache is full.
+// If another goroutine cached the same inode first, that one is kept and
+// returned so every caller shares a single instance.
+func (c *inodeCache) add(in *inode) *inode {
+	return c.inodes.Add(in.inodeNum, in)
+}
+
+func (c *inodeCache) stats() CacheStats {
+	stats := c.inodes.Stats()
+	return CacheStats{
+		Hits:      stats.Hits,
+		Misses:    stats.Misses,
+		Evictions: stats.Evictions,
+		Len:       stats.Len,
+		Capacity:  c.capacity,
+	}
+}
@@ -0,0 +1,94 @@
+package ext
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+func TestInodeCacheEviction(t *testing.T) {
+	c := newInodeCache(2)
+	for _, ino := range []uint32{1, 2, 1, 3} {
+		if _, ok := c.get(ino); !ok {
+			c.add(&inode{inodeNum: ino})
+		}
+	}
+
+	// 2 was the least recently used inode when 3 was added.
+	if _, ok := c.get(2); ok {
+		t.Error("inode 2 was not evicted")
+	}
+	for _, ino := range []uint32{1, 3} {
+		if _, ok := c.get(ino); !ok {
+			t.Errorf("inode %d was evicted", ino)
+		}
+	}
+
+	want := CacheStats{Hits: 3, Misses: 4, Evictions: 1, Len: 2, Capacity: 2}
+	if got := c.stats(); got != want {
+		t.Errorf("stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestInodeCacheAddKeepsFirst(t *testing.T) {
+	c := newInodeCache(4)
+	first := c.add(&inode{inodeNum: 5})
+	if got := c.add(&inode{inodeNum: 5}); got != first {
+		t.Error("add replaced an inode which was already cached")
+	}
+}
+
+func TestInodeCacheDisabled(t *testing.T) {
+	c := newInodeCache(0)
+	c.add(&inode{inodeNum: 5})
+	if _, ok := c.get(5); ok {
+		t.Error("disabled cache returned an inode")
+	}
+	if got := c.stats().Len; got != 0 {
+		t.Errorf("disabled cache holds %d inodes", got)
+	}
+}
+
+func TestFileSystemInodeCache(t *testing.T) {
+	img := testimage.New(testimage.Ext4()).
+		File("a.txt", []byte("a")).
+		Link("dir/b.txt", "a.txt").
+		MustBuild()
+
+	fsys, err := NewFS(bytes.NewReader(img), WithInodeCacheSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.ReadFile(fsys, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	before := fsys.InodeCacheStats()
+	if before.Misses == 0 || before.Len == 0 {
+		t.Fatalf("first read did not populate the cache: %+v", before)
+	}
+
+	if _, err := fs.ReadFile(fsys, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	after := fsys.InodeCacheStats()
+	if after.Misses != before.Misses {
+		t.Errorf("second read missed the cache: %+v then %+v", before, after)
+	}
+	if after.Hits <= before.Hits {
+		t.Errorf("second read did not hit the cache: %+v then %+v", before, after)
+	}
+
+	// Both names of the shared, cached inode must be preserved.
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		info, err := fsys.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := name[len(name)-5:]; info.Name() != want {
+			t.Errorf("Stat(%q).Name() = %q, want %q", name, info.Name(), want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Package diskimage holds the helpers the qcow2, VMDK, VHD and VHDX readers
+// share for reading the parent disks, or backing files, their images are
+// layered on.
+package diskimage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Zero fills p with zeros.
+func Zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
+
+// ReadParent reads p from the parent disk at pos. The part of p past the end
+// of the parent reads as zeros.
+func ReadParent(parent io.ReaderAt, p []byte, pos int64) error {
+	n, err := parent.ReadAt(p, pos)
+	if err == io.EOF {
+		Zero(p[n:])
+		return nil
+	}
+	return err
+}
+
+// FindParent returns the first of paths which names a regular file,
+// resolving relative paths, which use Windows separators, against the
+// directory of child. Paths are read from the child, so that paths which are
+// absolute or lead out of its directory are skipped unless unsafe is set;
+// when nothing is found, the error then wraps errUnsafe rather than
+// fs.ErrNotExist.
+func FindParent(child string, paths []string, unsafe bool, errUnsafe error) (string, error) {
+	dir := filepath.Dir(child)
+	skipped := false
+	for _, p := range paths {
+		p = strings.ReplaceAll(p, `\`, "/")
+		if !unsafe && !filepath.IsLocal(p) {
+			skipped = true
+			continue
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		if isRegular(p) {
+			return p, nil
+		}
+	}
+	// Absolute Windows paths only help on the machine which made the disk;
+	// fall back to the file name next to the child.
+	for _, p := range paths {
+		base := p[strings.LastIndexAny(p, `\/`)+1:]
+		if !filepath.IsLocal(base) {
+			continue
+		}
+		if p = filepath.Join(dir, base); isRegular(p) {
+			return p, nil
+		}
+	}
+	if skipped {
+		return "", xerrors.Errorf("none of %q found: %w", paths, errUnsafe)
+	}
+	return "", xerrors.Errorf("none of %q found: %w", paths, fs.ErrNotExist)
+}
+
+// isRegular reports whether name is a regular file. Opening devices or FIFOs
+// could block, or read from something other than a disk image.
+func isRegular(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.Mode().IsRegular()
+}
@@ -0,0 +1,131 @@
+// Package imagetest holds the fixtures shared by the tests of the qcow2, VMDK,
+// VHD and VHDX readers.
+package imagetest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ext "github.com/asalih/go-ext"
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+// Image is a virtual disk read by an image reader.
+type Image interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// ImageFile is a virtual disk opened from files by an image reader.
+type ImageFile interface {
+	Image
+	io.Closer
+}
+
+// RandomData returns size bytes of data generated from seed.
+func RandomData(size int, seed int64) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// IsZero reports whether b only holds zeros.
+func IsZero(b []byte) bool {
+	return bytes.Count(b, []byte{0}) == len(b)
+}
+
+// CheckRead checks that img reads as want, as a whole and with a read of n
+// bytes at off, which should cross the allocation units of the image.
+func CheckRead(t *testing.T, name string, img Image, want []byte, off int64, n int) {
+	t.Helper()
+	got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("%s: read %d bytes with %v, mismatch", name, len(got), err)
+	}
+	buf := make([]byte, n)
+	if _, err := img.ReadAt(buf, off); err != nil || !bytes.Equal(buf, want[off:off+int64(n)]) {
+		t.Errorf("%s: ReadAt(%d) mismatch, %v", name, off, err)
+	}
+}
+
+// FileSystem returns an ext4 image holding the file vm.txt with content.
+func FileSystem(content string) []byte {
+	b := testimage.New(testimage.Ext4())
+	b.File("vm.txt", []byte(content))
+	return b.MustBuild()
+}
+
+// CheckFileSystem checks that r reads as the ext4 image returned by
+// FileSystem(content).
+func CheckFileSystem(t *testing.T, r io.ReaderAt, content string) {
+	t.Helper()
+	fsys, err := ext.NewFS(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile(fsys, "vm.txt"); err != nil || string(got) != content {
+		t.Errorf("ReadFile returned %q, %v", got, err)
+	}
+}
+
+// OpenParentTest describes a child disk and its parent, for CheckOpenParent.
+type OpenParentTest[I ImageFile] struct {
+	// ParentName and ChildName are the file names the disks are written
+	// to, Parent and Child their content.
+	ParentName, ChildName string
+	Parent, Child         []byte
+
+	// Other is a disk which Open must not accept as the parent of Child.
+	Other []byte
+
+	// Want is the content of the child disk read along with its parent.
+	Want []byte
+
+	Open  func(name string) (I, error)
+	Check func(t *testing.T, name string, img I, want []byte)
+}
+
+// CheckOpenParent writes the disks of tt to a directory and checks that Open
+// reads the child along with its parent, refuses the wrong parent and fails
+// with fs.ErrNotExist without one.
+func CheckOpenParent[I ImageFile](t *testing.T, tt OpenParentTest[I]) {
+	t.Helper()
+	dir := t.TempDir()
+	parent, child := filepath.Join(dir, tt.ParentName), filepath.Join(dir, tt.ChildName)
+	writeFile(t, parent, tt.Parent)
+	writeFile(t, child, tt.Child)
+
+	img, err := tt.Open(child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt.Check(t, "opened", img, tt.Want)
+	if err := img.Close(); err != nil {
+		t.Error(err)
+	}
+
+	writeFile(t, parent, tt.Other)
+	if img, err := tt.Open(child); err == nil {
+		img.Close()
+		t.Error("wrong parent was accepted")
+	}
+	if err := os.Remove(parent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tt.Open(child); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open without the parent returned %v", err)
+	}
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
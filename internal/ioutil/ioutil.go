@@ -0,0 +1,21 @@
+// Package ioutil holds the I/O helpers shared by the volume and disk image
+// readers.
+package ioutil
+
+import "io"
+
+// ReadFull reads len(p) bytes at off from r. Short reads are reported as
+// io.ErrUnexpectedEOF, even at the end of r.
+func ReadFull(r io.ReaderAt, p []byte, off int64) error {
+	if len(p) == 0 {
+		return nil
+	}
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+// Package lru implements the least recently used caches of filesystem blocks,
+// inodes and disk image chunks.
+package lru
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache is a cache bounded by the total cost of its values, evicting the least
+// recently used values first. It is safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	mu sync.Mutex
+
+	// maxCost is the limit of the total cost and cost the function pricing
+	// a value. Immutable.
+	maxCost int64
+	cost    func(V) int64
+
+	// lru holds *entry values, most recently used first. entries indexes the
+	// list elements by key.
+	lru       *list.List
+	entries   map[K]*list.Element
+	totalCost int64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+	cost  int64
+}
+
+// Stats reports how effective a cache has been.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+
+	// Len is the number of cached values and Cost their total cost.
+	Len  int
+	Cost int64
+}
+
+// New returns a cache whose values cost at most maxCost in total. cost prices
+// a value; if it is nil, every value costs 1 and maxCost bounds the number of
+// values. A maxCost of zero or less disables the cache.
+func New[K comparable, V any](maxCost int64, cost func(V) int64) *Cache[K, V] {
+	if cost == nil {
+		cost = func(V) int64 { return 1 }
+	}
+	return &Cache[K, V]{
+		maxCost: maxCost,
+		cost:    cost,
+		lru:     list.New(),
+		entries: make(map[K]*list.Element),
+	}
+}
+
+// Bytes prices byte slices by their length, for caches bounded by memory.
+func Bytes(b []byte) int64 {
+	return int64(len(b))
+}
+
+// Get returns the value cached for key and marks it as recently used.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		var zero V
+		return zero, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*entry[K, V]).value, true
+}
+
+// Add caches value for key, evicting the least recently used values to stay
+// within the cost limit. Values costing more than the limit are not cached.
+// If a value is already cached for key, it is kept and returned so that every
+// caller shares a single value; otherwise value is returned.
+func (c *Cache[K, V]) Add(key K, value V) V {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*entry[K, V]).value
+	}
+	cost := c.cost(value)
+	if c.maxCost <= 0 || cost > c.maxCost {
+		return value
+	}
+	for c.totalCost+cost > c.maxCost {
+		oldest := c.lru.Remove(c.lru.Back()).(*entry[K, V])
+		delete(c.entries, oldest.key)
+		c.totalCost -= oldest.cost
+		c.evictions++
+	}
+	c.entries[key] = c.lru.PushFront(&entry[K, V]{key: key, value: value, cost: cost})
+	c.totalCost += cost
+	return value
+}
+
+// Stats returns the effectiveness of the cache.
+func (c *Cache[K, V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Len:       c.lru.Len(),
+		Cost:      c.totalCost,
+	}
+}
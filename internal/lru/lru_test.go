@@ -0,0 +1,34 @@
+package lru
+
+import "testing"
+
+func TestCacheEvictsByCost(t *testing.T) {
+	c := New[int](8, Bytes)
+	c.Add(1, make([]byte, 4))
+	c.Add(2, make([]byte, 4))
+	c.Get(1)
+	c.Add(3, make([]byte, 2))
+	c.Add(4, make([]byte, 9))
+
+	// 2 was the least recently used value when 3 was added, and 4 costs
+	// more than the limit.
+	for key, want := range map[int]bool{1: true, 2: false, 3: true, 4: false} {
+		if _, ok := c.Get(key); ok != want {
+			t.Errorf("Get(%d) cached = %t, want %t", key, ok, want)
+		}
+	}
+	want := Stats{Hits: 3, Misses: 2, Evictions: 1, Len: 2, Cost: 6}
+	if got := c.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	c := New[int, string](0, nil)
+	if got := c.Add(1, "a"); got != "a" {
+		t.Errorf("Add returned %q", got)
+	}
+	if _, ok := c.Get(1); ok {
+		t.Error("disabled cache returned a value")
+	}
+}
@@ -0,0 +1,219 @@
+package testimage
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/asalih/go-ext/linux"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// dxRootInfoOffset is the offset of dx_root_info in the first block of an
+	// htree directory, right after the "." and ".." entries.
+	dxRootInfoOffset = 24
+
+	// dxRootEntriesOffset is the offset of the dx_root entries.
+	dxRootEntriesOffset = 32
+
+	// dxNodeEntriesOffset is the offset of the dx_node entries, after the
+	// empty directory entry spanning the block.
+	dxNodeEntriesOffset = 8
+
+	// dxEntrySize is the size of struct dx_entry.
+	dxEntrySize = 8
+)
+
+// dirent is a directory entry to be written.
+type dirent struct {
+	ino  uint32
+	name string
+	typ  uint8
+	hash uint32
+}
+
+// dxEntry maps the hashes starting at hash to a directory block.
+type dxEntry struct {
+	hash  uint32
+	block uint32
+}
+
+// buildDirectory lays out the blocks of directory in. Directories needing
+// more than one block become htree directories when DirIndex is set.
+func (l *layout) buildDirectory(in *inodeInfo) error {
+	children := make([]dirent, 0, len(in.children))
+	for _, c := range in.children {
+		name := c.name
+		if enc := in.entry.Encryption; enc != nil {
+			name = string(enc.EncryptName(in.ino, []byte(name)))
+			if len(name) > 255 {
+				return xerrors.Errorf("testimage: encrypted name of %q has %d bytes", c.name, len(name))
+			}
+		}
+		children = append(children, dirent{
+			ino:  c.inode.ino,
+			name: name,
+			typ:  l.fileType(c.inode.mode),
+			hash: dxHash(name),
+		})
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+
+	dirType := l.fileType(linux.ModeDirectory)
+	dots := []dirent{
+		{ino: in.ino, name: ".", typ: dirType},
+		{ino: in.parent.ino, name: "..", typ: dirType},
+	}
+	linear, _ := l.packDirents(append(dots, children...))
+	if !l.opts.DirIndex || uint64(len(linear)) <= l.bs {
+		in.data = linear
+		in.size = uint64(len(linear))
+		return nil
+	}
+
+	// Leaf blocks hold the entries in hash order. A block starting with the
+	// hash the previous one ended with is marked by the continuation bit.
+	sort.SliceStable(children, func(i, j int) bool { return children[i].hash < children[j].hash })
+	leaves, starts := l.packDirents(children)
+	index := make([]dxEntry, len(starts))
+	for i, start := range starts {
+		index[i] = dxEntry{hash: children[start].hash, block: uint32(i + 1)}
+		if i > 0 && children[start-1].hash == children[start].hash {
+			index[i].hash |= 1
+		}
+	}
+
+	rootLimit := (l.bs - dxRootEntriesOffset) / dxEntrySize
+	nodeLimit := (l.bs - dxNodeEntriesOffset) / dxEntrySize
+	var levels byte
+	var nodes []byte
+	if uint64(len(index)) > rootLimit {
+		levels = 1
+		var top []dxEntry
+		for start := 0; start < len(index); start += int(nodeLimit) {
+			end := start + int(nodeLimit)
+			if end > len(index) {
+				end = len(index)
+			}
+			node := make([]byte, l.bs)
+			binary.LittleEndian.PutUint16(node[4:], uint16(l.bs))
+			writeDxEntries(node[dxNodeEntriesOffset:], nodeLimit, index[start:end])
+			top = append(top, dxEntry{hash: index[start].hash, block: uint32(1 + len(starts) + len(top))})
+			nodes = append(nodes, node...)
+		}
+		if uint64(len(top)) > rootLimit {
+			return xerrors.Errorf("testimage: directory with %d entries needs more than two htree levels", len(children))
+		}
+		index = top
+	}
+
+	root := make([]byte, l.bs)
+	putDirent(root, dots[0], 12)
+	putDirent(root[12:], dots[1], uint16(l.bs-12))
+	root[dxRootInfoOffset+5] = 8 // info_length
+	root[dxRootInfoOffset+6] = levels
+	writeDxEntries(root[dxRootEntriesOffset:], rootLimit, index)
+
+	in.data = append(append(root, leaves...), nodes...)
+	in.size = uint64(len(in.data))
+	in.indexed = true
+	return nil
+}
+
+// packDirents packs entries into directory blocks. It returns the blocks and
+// the index of the first entry of each block.
+func (l *layout) packDirents(entries []dirent) ([]byte, []int) {
+	var data []byte
+	var starts []int
+	var block []byte
+	var used, last uint64
+	flush := func() {
+		if block == nil {
+			return
+		}
+		binary.LittleEndian.PutUint16(block[last+4:], uint16(l.bs-last))
+		data = append(data, block...)
+	}
+
+	for i, d := range entries {
+		recLen := (8 + uint64(len(d.name)) + 3) &^ 3
+		if block == nil || used+recLen > l.bs {
+			flush()
+			block = make([]byte, l.bs)
+			used = 0
+			starts = append(starts, i)
+		}
+		putDirent(block[used:], d, uint16(recLen))
+		last = used
+		used += recLen
+	}
+	flush()
+	return data, starts
+}
+
+// putDirent writes d as an ext4_dir_entry_2. Without the filetype feature
+// typ is zero and the layout matches ext4_dir_entry.
+func putDirent(dst []byte, d dirent, recLen uint16) {
+	binary.LittleEndian.PutUint32(dst[0:], d.ino)
+	binary.LittleEndian.PutUint16(dst[4:], recLen)
+	dst[6] = byte(len(d.name))
+	dst[7] = d.typ
+	copy(dst[8:], d.name)
+}
+
+// writeDxEntries writes a dx_countlimit followed by entries. The hash of the
+// first entry is implied and its slot holds the count and limit instead.
+func writeDxEntries(dst []byte, limit uint64, entries []dxEntry) {
+	binary.LittleEndian.PutUint16(dst[0:], uint16(limit))
+	binary.LittleEndian.PutUint16(dst[2:], uint16(len(entries)))
+	for i, e := range entries {
+		if i > 0 {
+			binary.LittleEndian.PutUint32(dst[i*dxEntrySize:], e.hash)
+		}
+		binary.LittleEndian.PutUint32(dst[i*dxEntrySize+4:], e.block)
+	}
+}
+
+// fileType returns the dirent file type of an inode mode.
+func (l *layout) fileType(mode uint16) uint8 {
+	if l.opts.NoFileType {
+		return 0
+	}
+	switch mode & linux.FileTypeMask {
+	case linux.ModeRegular:
+		return 1
+	case linux.ModeDirectory:
+		return 2
+	case linux.ModeCharacterDevice:
+		return 3
+	case linux.ModeBlockDevice:
+		return 4
+	case linux.ModeNamedPipe:
+		return 5
+	case linux.ModeSocket:
+		return 6
+	case linux.ModeSymlink:
+		return 7
+	}
+	return 0
+}
+
+// dxHash is the legacy htree hash (dx_hack_hash) over unsigned chars, as
+// selected by EXT2_FLAGS_UNSIGNED_HASH.
+func dxHash(name string) uint32 {
+	hash0, hash1 := uint32(0x12a3fe2d), uint32(0x37abe8f9)
+	for i := 0; i < len(name); i++ {
+		hash := hash1 + (hash0 ^ uint32(name[i])*7152373)
+		if hash&0x80000000 != 0 {
+			hash -= 0x7fffffff
+		}
+		hash1, hash0 = hash0, hash
+	}
+
+	hash := (hash0 << 1) &^ 1
+	// The largest hash is reserved as the end of directory marker.
+	if hash == 0x7fffffff<<1 {
+		hash = (0x7fffffff - 1) << 1
+	}
+	return hash
+}
@@ -0,0 +1,982 @@
+package testimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/linux"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// firstIno is the first inode not reserved by the filesystem. It belongs
+	// to lost+found.
+	firstIno = 11
+
+	// journalIno is the reserved inode of the internal journal.
+	journalIno = 8
+
+	// journalBlocks is the journal size. It is the smallest journal jbd2
+	// accepts.
+	journalBlocks = 1024
+
+	// extraIsize is i_extra_isize of inodes larger than 128 bytes. It covers
+	// every field of disklayout.InodeNew.
+	extraIsize = 32
+
+	// maxExtentLen is the longest initialized extent.
+	maxExtentLen = 32768
+
+	// fastSymlinkMax bounds the length of symlink targets stored in i_block.
+	fastSymlinkMax = 60
+
+	// unsignedHashFlag is EXT2_FLAGS_UNSIGNED_HASH in s_flags.
+	unsignedHashFlag = 0x2
+)
+
+// uuid is the deterministic filesystem UUID of every image.
+var uuid = [16]byte{0x9e, 0x1c, 0x5a, 0x43, 0x2b, 0x77, 0x4d, 0x0a, 0x8f, 0x61, 0x3c, 0x12, 0xd4, 0xe8, 0x05, 0xb9}
+
+// inodeInfo is an inode being laid out.
+type inodeInfo struct {
+	ino   uint32
+	entry *Entry
+	mode  uint16
+	links uint16
+
+	parent   *inodeInfo
+	children []child
+
+	// data is the content stored in data blocks: file data, directory
+	// blocks, slow symlink targets and the journal.
+	data    []byte
+	size    uint64
+	indexed bool
+
+	// target is the symlink target as stored, in i_block or in data.
+	target []byte
+}
+
+// child is a directory entry.
+type child struct {
+	name  string
+	inode *inodeInfo
+}
+
+// layout places the inodes and blocks of one image.
+type layout struct {
+	opts    Options
+	bs      uint64
+	entries []*Entry
+
+	inodes []*inodeInfo
+	inos   map[string]uint32
+
+	firstDataBlock uint64
+	blocksCount    uint64
+	bpg            uint64
+	groups         uint64
+	ipg            uint64
+	itableBlocks   uint64
+	gdtBlocks      uint64
+	descSize       uint64
+
+	img        []byte
+	usedBlocks []bool
+	usedInodes []bool
+	dirs       []uint32
+	next       uint64
+
+	// metaBlocks counts the mapping blocks allocated for the current inode.
+	metaBlocks uint64
+
+	// encrypted is set if any inode is encrypted.
+	encrypted bool
+}
+
+func newLayout(opts Options, entries []*Entry) (*layout, error) {
+	switch opts.BlockSize {
+	case 1024, 2048, 4096:
+	default:
+		return nil, xerrors.Errorf("testimage: unsupported block size %d", opts.BlockSize)
+	}
+	if opts.InodeSize != disklayout.OldInodeSize && opts.InodeSize != 256 {
+		return nil, xerrors.Errorf("testimage: unsupported inode size %d", opts.InodeSize)
+	}
+	if opts.BlocksPerGroup > opts.BlockSize*8 || opts.BlocksPerGroup%8 != 0 {
+		return nil, xerrors.Errorf("testimage: invalid blocks per group %d", opts.BlocksPerGroup)
+	}
+
+	l := &layout{
+		opts:     opts,
+		bs:       uint64(opts.BlockSize),
+		entries:  entries,
+		inos:     make(map[string]uint32),
+		bpg:      uint64(opts.BlocksPerGroup),
+		descSize: disklayout.BgDesc32Size,
+	}
+	if l.bs == 1024 {
+		l.firstDataBlock = 1
+	}
+	if opts.Is64Bit {
+		l.descSize = disklayout.BgDesc64Size
+	}
+	if err := l.assignInodes(); err != nil {
+		return nil, err
+	}
+	for _, in := range l.inodes {
+		if in.mode&linux.FileTypeMask == linux.ModeDirectory && in.entry.Dtime.IsZero() {
+			if err := l.buildDirectory(in); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := l.computeGeometry(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// assignInodes numbers the inodes and links them into their directories.
+func (l *layout) assignInodes() error {
+	root := &inodeInfo{
+		ino:   disklayout.RootDirInode,
+		entry: &Entry{Mode: fs.ModeDir | 0755},
+	}
+	l.inodes = append(l.inodes, root)
+	if l.opts.Journal {
+		l.inodes = append(l.inodes, &inodeInfo{
+			ino:   journalIno,
+			entry: &Entry{Mode: 0600},
+			data:  make([]byte, journalBlocks*l.bs),
+		})
+	}
+
+	byName := map[string]*inodeInfo{".": root}
+	ino := uint32(firstIno)
+	for _, e := range l.entries {
+		if e.Link != "" {
+			continue
+		}
+		in := &inodeInfo{ino: ino, entry: e}
+		ino++
+		l.inodes = append(l.inodes, in)
+		byName[e.Name] = in
+	}
+
+	for _, e := range l.entries {
+		in := byName[e.Name]
+		if e.Link != "" {
+			target := path.Clean(e.Link)
+			var ok bool
+			if in, ok = byName[target]; !ok || in.entry.Link != "" {
+				return xerrors.Errorf("testimage: link %q to missing entry %q", e.Name, e.Link)
+			}
+			if in.entry.Mode.IsDir() {
+				return xerrors.Errorf("testimage: link %q to directory %q", e.Name, e.Link)
+			}
+			if !in.entry.Dtime.IsZero() {
+				return xerrors.Errorf("testimage: link %q to deleted entry %q", e.Name, e.Link)
+			}
+		}
+		parent := byName[path.Dir(e.Name)]
+		l.inos[e.Name] = in.ino
+		if e.Dtime.IsZero() {
+			parent.children = append(parent.children, child{name: path.Base(e.Name), inode: in})
+		}
+		if in.parent == nil {
+			in.parent = parent
+		}
+	}
+
+	for _, in := range l.inodes {
+		if err := l.prepareInode(in); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareInode fills in the mode, link count and content of in.
+func (l *layout) prepareInode(in *inodeInfo) error {
+	e := in.entry
+	mode, err := linuxMode(e.Mode)
+	if err != nil {
+		return xerrors.Errorf("testimage: %q: %w", e.Name, err)
+	}
+	in.mode = mode
+	if !e.Dtime.IsZero() {
+		return nil
+	}
+
+	// Directories are linked from their parent, from their own "." and from
+	// the ".." of every subdirectory. Other inodes once per name.
+	if mode&linux.FileTypeMask == linux.ModeDirectory {
+		in.links = 2
+		for _, c := range in.children {
+			if c.inode.entry.Mode.IsDir() {
+				in.links++
+			}
+		}
+		if in.parent == nil {
+			in.parent = in
+		}
+	} else if in.ino == journalIno {
+		in.links = 1
+	} else {
+		for _, other := range l.entries {
+			if other == e || (other.Link != "" && path.Clean(other.Link) == e.Name) {
+				in.links++
+			}
+		}
+	}
+
+	switch mode & linux.FileTypeMask {
+	case linux.ModeRegular:
+		if in.data == nil {
+			in.data = e.Data
+		}
+		in.size = uint64(len(in.data))
+		if e.Size > int64(in.size) {
+			in.size = uint64(e.Size)
+		}
+	case linux.ModeSymlink:
+		if len(e.Target) == 0 {
+			return xerrors.Errorf("testimage: symlink %q has no target", e.Name)
+		}
+		in.target = []byte(e.Target)
+		if e.Encryption != nil {
+			// struct fscrypt_symlink_data: the ciphertext length, then the
+			// ciphertext.
+			ciphertext := e.Encryption.EncryptName(in.ino, in.target)
+			in.target = make([]byte, 2+len(ciphertext))
+			binary.LittleEndian.PutUint16(in.target, uint16(len(ciphertext)))
+			copy(in.target[2:], ciphertext)
+		}
+		in.size = uint64(len(in.target))
+		if len(in.target) >= fastSymlinkMax {
+			in.data = in.target
+		}
+	}
+	if e.Encryption != nil {
+		l.encrypted = true
+	}
+	return nil
+}
+
+// computeGeometry sizes the block groups and the inode tables.
+func (l *layout) computeGeometry() error {
+	var dataBlocks uint64
+	for _, in := range l.inodes {
+		n := (uint64(len(in.data)) + l.bs - 1) / l.bs
+		// Mapping overhead: indirect blocks or extent tree nodes.
+		dataBlocks += n + n/(l.bs/4) + 3
+		if len(in.entry.Xattrs) > 0 || in.entry.Encryption != nil {
+			dataBlocks++
+		}
+	}
+
+	maxIno := l.inodes[len(l.inodes)-1].ino
+	inodesCount := uint64(maxIno) + 16
+	if uint64(l.opts.InodesCount) > inodesCount {
+		inodesCount = uint64(l.opts.InodesCount)
+	}
+	inodesPerBlock := l.bs / uint64(l.opts.InodeSize)
+	align := inodesPerBlock
+	if align < 8 {
+		align = 8
+	}
+
+	l.groups = 1
+	if l.opts.BlocksCount != 0 {
+		if l.opts.BlocksCount <= l.firstDataBlock {
+			return xerrors.Errorf("testimage: blocks count %d too small", l.opts.BlocksCount)
+		}
+		l.groups = (l.opts.BlocksCount - l.firstDataBlock + l.bpg - 1) / l.bpg
+	}
+	for {
+		l.ipg = (inodesCount + l.groups - 1) / l.groups
+		l.ipg = (l.ipg + align - 1) / align * align
+		if l.ipg > l.bs*8 {
+			if l.opts.BlocksCount != 0 {
+				return xerrors.Errorf("testimage: %d inodes do not fit in %d groups", inodesCount, l.groups)
+			}
+			l.groups++
+			continue
+		}
+		l.itableBlocks = l.ipg * uint64(l.opts.InodeSize) / l.bs
+		l.gdtBlocks = (l.groups*l.descSize + l.bs - 1) / l.bs
+
+		if l.opts.BlocksCount != 0 {
+			l.blocksCount = l.opts.BlocksCount
+			break
+		}
+		var overhead uint64
+		for g := uint64(0); g < l.groups; g++ {
+			overhead += l.groupOverhead(g)
+		}
+		total := l.firstDataBlock + overhead + dataBlocks + 16
+		if groups := (total - l.firstDataBlock + l.bpg - 1) / l.bpg; groups > l.groups {
+			l.groups = groups
+			continue
+		}
+		l.blocksCount = total
+		break
+	}
+
+	// The last group must at least hold its own metadata.
+	last := l.groups - 1
+	lastSize := l.blocksCount - l.firstDataBlock - last*l.bpg
+	if min := l.groupOverhead(last) + 1; lastSize < min {
+		if l.opts.BlocksCount != 0 {
+			return xerrors.Errorf("testimage: last block group of %d blocks is too small", lastSize)
+		}
+		l.blocksCount += min - lastSize
+	}
+	if l.blocksCount > 1<<32 && !l.opts.Is64Bit {
+		return xerrors.Errorf("testimage: %d blocks need the 64-bit feature", l.blocksCount)
+	}
+	return nil
+}
+
+// hasBackup returns whether group g holds a superblock copy, following the
+// sparse_super rule.
+func hasBackup(g uint64) bool {
+	if g <= 1 {
+		return true
+	}
+	for _, base := range []uint64{3, 5, 7} {
+		n := base
+		for n < g {
+			n *= base
+		}
+		if n == g {
+			return true
+		}
+	}
+	return false
+}
+
+// groupStart returns the first block of group g.
+func (l *layout) groupStart(g uint64) uint64 {
+	return l.firstDataBlock + g*l.bpg
+}
+
+// groupOverhead returns the number of metadata blocks at the start of group g.
+func (l *layout) groupOverhead(g uint64) uint64 {
+	n := 2 + l.itableBlocks
+	if hasBackup(g) {
+		n += 1 + l.gdtBlocks
+	}
+	return n
+}
+
+// groupMeta returns the block bitmap, inode bitmap and inode table of group g.
+func (l *layout) groupMeta(g uint64) (uint64, uint64, uint64) {
+	blk := l.groupStart(g)
+	if hasBackup(g) {
+		blk += 1 + l.gdtBlocks
+	}
+	return blk, blk + 1, blk + 2
+}
+
+func (l *layout) build() ([]byte, error) {
+	l.img = make([]byte, l.blocksCount*l.bs)
+	l.usedBlocks = make([]bool, l.blocksCount)
+	l.usedInodes = make([]bool, l.groups*l.ipg+1)
+	l.dirs = make([]uint32, l.groups)
+
+	for b := uint64(0); b < l.firstDataBlock; b++ {
+		l.usedBlocks[b] = true
+	}
+	for g := uint64(0); g < l.groups; g++ {
+		start := l.groupStart(g)
+		for b := start; b < start+l.groupOverhead(g); b++ {
+			l.usedBlocks[b] = true
+		}
+	}
+	for ino := 1; ino < firstIno; ino++ {
+		l.usedInodes[ino] = true
+	}
+	l.next = l.firstDataBlock
+
+	for _, in := range l.inodes {
+		if err := l.writeInode(in); err != nil {
+			return nil, xerrors.Errorf("testimage: inode %d: %w", in.ino, err)
+		}
+	}
+	if err := l.writeMetadata(); err != nil {
+		return nil, err
+	}
+	return l.img, nil
+}
+
+// block returns the contents of block n.
+func (l *layout) block(n uint64) []byte {
+	return l.img[n*l.bs : (n+1)*l.bs]
+}
+
+// alloc returns the next free block.
+func (l *layout) alloc() (uint64, error) {
+	for ; l.next < l.blocksCount; l.next++ {
+		if !l.usedBlocks[l.next] {
+			l.usedBlocks[l.next] = true
+			return l.next, nil
+		}
+	}
+	return 0, xerrors.New("image is full")
+}
+
+// allocMeta allocates a zeroed mapping block for the current inode.
+func (l *layout) allocMeta() (uint64, error) {
+	blk, err := l.alloc()
+	if err != nil {
+		return 0, err
+	}
+	l.metaBlocks++
+	return blk, nil
+}
+
+// writeInode allocates the blocks of in and writes its inode record.
+func (l *layout) writeInode(in *inodeInfo) error {
+	e := in.entry
+	l.metaBlocks = 0
+	l.usedInodes[in.ino] = e.Dtime.IsZero()
+	if in.mode&linux.FileTypeMask == linux.ModeDirectory && e.Dtime.IsZero() {
+		l.dirs[uint64(in.ino-1)/l.ipg]++
+	}
+
+	// Allocate the data blocks, leaving holes unmapped.
+	n := (uint64(len(in.data)) + l.bs - 1) / l.bs
+	var unwritten []bool
+	if len(e.Unwritten) > 0 {
+		if !l.opts.Extents {
+			return xerrors.New("unwritten extents need extents")
+		}
+		for _, r := range e.Unwritten {
+			if end := (uint64(r.Off+r.Len) + l.bs - 1) / l.bs; end > n {
+				n = end
+			}
+		}
+		unwritten = make([]bool, n)
+		for _, r := range e.Unwritten {
+			for i := uint64(r.Off) / l.bs; i*l.bs < uint64(r.Off+r.Len); i++ {
+				unwritten[i] = true
+			}
+		}
+	}
+	phys := make([]uint64, n)
+	var dataBlocks uint64
+	for i := range phys {
+		var chunk []byte
+		if start := uint64(i) * l.bs; start < uint64(len(in.data)) {
+			chunk = in.data[start:]
+		}
+		if uint64(len(chunk)) > l.bs {
+			chunk = chunk[:l.bs]
+		}
+		isUnwritten := unwritten != nil && unwritten[i]
+		if !isUnwritten && (len(chunk) == 0 || e.Sparse && isZero(chunk)) {
+			continue
+		}
+		blk, err := l.alloc()
+		if err != nil {
+			return err
+		}
+		phys[i] = blk
+		dataBlocks++
+		if isUnwritten {
+			// What the block held before it was allocated.
+			copy(l.block(blk), bytes.Repeat([]byte{0xaa}, int(l.bs)))
+			continue
+		}
+		if e.Encryption != nil && in.mode&linux.FileTypeMask == linux.ModeRegular {
+			// Contents are encrypted in whole blocks.
+			chunk = append(make([]byte, 0, l.bs), chunk...)[:l.bs]
+			e.Encryption.EncryptBlock(in.ino, uint64(i), chunk)
+		}
+		copy(l.block(blk), chunk)
+	}
+
+	var iblock [60]byte
+	var flags uint32
+	typ := in.mode & linux.FileTypeMask
+	switch {
+	case typ == linux.ModeCharacterDevice || typ == linux.ModeBlockDevice:
+		encodeDevice(&iblock, e.Major, e.Minor)
+	case typ == linux.ModeSymlink && len(in.data) == 0:
+		copy(iblock[:], in.target)
+	case typ == linux.ModeNamedPipe || typ == linux.ModeSocket:
+	case l.opts.Extents:
+		flags |= disklayout.InExtents
+		if err := l.mapExtents(&iblock, phys, unwritten); err != nil {
+			return err
+		}
+	default:
+		if err := l.mapBlocks(&iblock, phys); err != nil {
+			return err
+		}
+	}
+	if in.indexed {
+		flags |= disklayout.InIndex
+	}
+	flags |= e.Flags
+
+	xattrs := e.Xattrs
+	if e.Encryption != nil {
+		flags |= disklayout.InEncrypt
+		xattrs = map[string][]byte{"encryption.c": e.Encryption.Context}
+		for name, value := range e.Xattrs {
+			xattrs[name] = value
+		}
+	}
+
+	var xattrBlock uint64
+	inBody, inBlock, err := l.splitXattrs(xattrs)
+	if err != nil {
+		return err
+	}
+	if len(inBlock) > 0 {
+		if xattrBlock, err = l.allocMeta(); err != nil {
+			return err
+		}
+		writeXattrBlock(l.block(xattrBlock), inBlock)
+	}
+
+	sectors := (dataBlocks + l.metaBlocks) * (l.bs / 512)
+	raw := disklayout.InodeNew{}
+	raw.ModeRaw = in.mode
+	raw.UIDLo = uint16(e.UID)
+	raw.UIDHi = uint16(e.UID >> 16)
+	raw.GIDLo = uint16(e.GID)
+	raw.GIDHi = uint16(e.GID >> 16)
+	raw.SizeLo = uint32(in.size)
+	raw.SizeHi = uint32(in.size >> 32)
+	raw.LinksCountRaw = in.links
+	raw.BlocksCountLo = uint32(sectors)
+	raw.BlocksCountHi = uint16(sectors >> 32)
+	raw.FlagsRaw = flags
+	raw.DataRaw = iblock
+	raw.Generation = e.Generation
+	raw.FileACLLo = uint32(xattrBlock)
+	raw.FileACLHi = uint16(xattrBlock >> 32)
+	raw.AccessTimeRaw, raw.AccessTimeExtra = encodeTime(e.Atime)
+	raw.ChangeTimeRaw, raw.ChangeTimeExtra = encodeTime(e.Ctime)
+	raw.ModificationTimeRaw, raw.ModificationTimeExtra = encodeTime(e.Mtime)
+	crtime, crtimeExtra := encodeTime(e.Crtime)
+	raw.CreationTime, raw.CreationTimeExtra = uint32(crtime), crtimeExtra
+	if !e.Dtime.IsZero() {
+		raw.DeletionTimeRaw = int32(e.Dtime.Unix())
+	}
+	if l.opts.InodeSize > disklayout.OldInodeSize {
+		raw.ExtraInodeSize = extraIsize
+		raw.ProjectID = e.ProjectID
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, &raw); err != nil {
+		return err
+	}
+	rec := l.inodeRecord(in.ino)
+	copy(rec, buf.Bytes())
+	if len(inBody) > 0 {
+		writeXattrBody(rec[disklayout.OldInodeSize+extraIsize:], inBody)
+	}
+	if in.ino == journalIno {
+		writeJournalSuperBlock(l.block(phys[0]), l.bs)
+	}
+	return nil
+}
+
+// inodeRecord returns the on-disk record of inode ino.
+func (l *layout) inodeRecord(ino uint32) []byte {
+	g := uint64(ino-1) / l.ipg
+	idx := uint64(ino-1) % l.ipg
+	_, _, table := l.groupMeta(g)
+	off := table*l.bs + idx*uint64(l.opts.InodeSize)
+	return l.img[off : off+uint64(l.opts.InodeSize)]
+}
+
+// mapBlocks fills iblock with a block map of phys. Zero entries are holes.
+func (l *layout) mapBlocks(iblock *[60]byte, phys []uint64) error {
+	ppb := l.bs / 4
+	for i, p := range phys {
+		if p == 0 {
+			continue
+		}
+		if p > 1<<32-1 {
+			return xerrors.Errorf("block %d can not be mapped indirectly", p)
+		}
+		if i < 12 {
+			binary.LittleEndian.PutUint32(iblock[4*i:], uint32(p))
+			continue
+		}
+
+		idx := uint64(i) - 12
+		span := ppb
+		depth := 1
+		for ; depth <= 3 && idx >= span; depth++ {
+			idx -= span
+			span *= ppb
+		}
+		if depth > 3 {
+			return xerrors.Errorf("file block %d can not be mapped", i)
+		}
+
+		slot := iblock[4*(11+depth):]
+		for level := depth; level > 0; level-- {
+			tbl, err := l.indirect(slot)
+			if err != nil {
+				return err
+			}
+			span /= ppb
+			slot = tbl[4*(idx/span):]
+			idx %= span
+		}
+		binary.LittleEndian.PutUint32(slot, uint32(p))
+	}
+	return nil
+}
+
+// indirect returns the indirect block referenced by slot, allocating it when
+// the slot is still empty.
+func (l *layout) indirect(slot []byte) ([]byte, error) {
+	if blk := binary.LittleEndian.Uint32(slot); blk != 0 {
+		return l.block(uint64(blk)), nil
+	}
+	blk, err := l.allocMeta()
+	if err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(slot, uint32(blk))
+	return l.block(blk), nil
+}
+
+// mapExtents fills iblock with the root of an extent tree mapping phys. Zero
+// entries are holes, and blocks set in unwritten, which may be nil, are mapped
+// by unwritten extents.
+func (l *layout) mapExtents(iblock *[60]byte, phys []uint64, unwritten []bool) error {
+	var leaves []disklayout.Extent
+	var leafUnwritten []bool
+	for i, p := range phys {
+		if p == 0 {
+			continue
+		}
+		isUnwritten := unwritten != nil && unwritten[i]
+		if n := len(leaves); n > 0 {
+			last := &leaves[n-1]
+			maxLen := uint16(maxExtentLen)
+			if isUnwritten {
+				maxLen--
+			}
+			if last.FirstFileBlock+uint32(last.Length) == uint32(i) && leafUnwritten[n-1] == isUnwritten &&
+				last.PhysicalBlock()+uint64(last.Length) == p && last.Length < maxLen {
+				last.Length++
+				continue
+			}
+		}
+		leaves = append(leaves, disklayout.Extent{
+			FirstFileBlock: uint32(i),
+			Length:         1,
+			StartBlockHi:   uint16(p >> 32),
+			StartBlockLo:   uint32(p),
+		})
+		leafUnwritten = append(leafUnwritten, isUnwritten)
+	}
+	// The length of unwritten extents is stored biased by maxExtentLen.
+	for i := range leaves {
+		if leafUnwritten[i] {
+			leaves[i].Length += maxExtentLen
+		}
+	}
+
+	entries := make([]interface{}, len(leaves))
+	firsts := make([]uint32, len(leaves))
+	for i := range leaves {
+		entries[i] = &leaves[i]
+		firsts[i] = leaves[i].FirstFileBlock
+	}
+
+	const rootEntries = (60 - disklayout.ExtentHeaderSize) / disklayout.ExtentEntrySize
+	nodeEntries := int((l.bs - disklayout.ExtentHeaderSize) / disklayout.ExtentEntrySize)
+	var height uint16
+	for len(entries) > rootEntries {
+		var idxs []interface{}
+		var idxFirsts []uint32
+		for start := 0; start < len(entries); start += nodeEntries {
+			end := start + nodeEntries
+			if end > len(entries) {
+				end = len(entries)
+			}
+			blk, err := l.allocMeta()
+			if err != nil {
+				return err
+			}
+			if err := writeExtentNode(l.block(blk), uint16(nodeEntries), height, entries[start:end]); err != nil {
+				return err
+			}
+			idxs = append(idxs, &disklayout.ExtentIdx{
+				FirstFileBlock: firsts[start],
+				ChildBlockLo:   uint32(blk),
+				ChildBlockHi:   uint16(blk >> 32),
+			})
+			idxFirsts = append(idxFirsts, firsts[start])
+		}
+		entries, firsts = idxs, idxFirsts
+		height++
+	}
+	return writeExtentNode(iblock[:], rootEntries, height, entries)
+}
+
+// writeExtentNode writes an extent tree node holding entries to dst.
+func writeExtentNode(dst []byte, max uint16, height uint16, entries []interface{}) error {
+	var buf bytes.Buffer
+	header := disklayout.ExtentHeader{
+		Magic:      disklayout.ExtentMagic,
+		NumEntries: uint16(len(entries)),
+		MaxEntries: max,
+		Height:     height,
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := binary.Write(&buf, binary.LittleEndian, e); err != nil {
+			return err
+		}
+	}
+	copy(dst, buf.Bytes())
+	return nil
+}
+
+// writeMetadata writes the bitmaps, the group descriptors and the
+// superblocks once every inode has been placed.
+func (l *layout) writeMetadata() error {
+	bits := l.bs * 8
+	var freeBlocks, freeInodes uint64
+	descs := make([]byte, 0, l.groups*l.descSize)
+	for g := uint64(0); g < l.groups; g++ {
+		blockBitmap, inodeBitmap, table := l.groupMeta(g)
+
+		start := l.groupStart(g)
+		bitmap := l.block(blockBitmap)
+		var groupFreeBlocks uint64
+		for i := uint64(0); i < bits; i++ {
+			if b := start + i; i >= l.bpg || b >= l.blocksCount || l.usedBlocks[b] {
+				setBit(bitmap, i)
+			} else {
+				groupFreeBlocks++
+			}
+		}
+
+		bitmap = l.block(inodeBitmap)
+		var groupFreeInodes uint64
+		for i := uint64(0); i < bits; i++ {
+			if ino := g*l.ipg + i + 1; i >= l.ipg || l.usedInodes[ino] {
+				setBit(bitmap, i)
+			} else {
+				groupFreeInodes++
+			}
+		}
+		freeBlocks += groupFreeBlocks
+		freeInodes += groupFreeInodes
+
+		desc := disklayout.BlockGroup64Bit{}
+		desc.BlockBitmapLo, desc.BlockBitmapHi = uint32(blockBitmap), uint32(blockBitmap>>32)
+		desc.InodeBitmapLo, desc.InodeBitmapHi = uint32(inodeBitmap), uint32(inodeBitmap>>32)
+		desc.InodeTableLo, desc.InodeTableHi = uint32(table), uint32(table>>32)
+		desc.FreeBlocksCountLo, desc.FreeBlocksCountHi = uint16(groupFreeBlocks), uint16(groupFreeBlocks>>16)
+		desc.FreeInodesCountLo, desc.FreeInodesCountHi = uint16(groupFreeInodes), uint16(groupFreeInodes>>16)
+		desc.UsedDirsCountLo, desc.UsedDirsCountHi = uint16(l.dirs[g]), uint16(l.dirs[g]>>16)
+
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, &desc); err != nil {
+			return err
+		}
+		descs = append(descs, buf.Bytes()[:l.descSize]...)
+	}
+
+	for g := uint64(0); g < l.groups; g++ {
+		if !hasBackup(g) {
+			continue
+		}
+		sb, err := l.superBlock(g, freeBlocks, freeInodes)
+		if err != nil {
+			return err
+		}
+		start := l.groupStart(g)
+		off := start * l.bs
+		if g == 0 {
+			off = disklayout.SbOffset
+		}
+		copy(l.img[off:], sb)
+		copy(l.img[(start+1)*l.bs:], descs)
+	}
+	return nil
+}
+
+// superBlock returns the superblock copy stored in group g.
+func (l *layout) superBlock(g uint64, freeBlocks, freeInodes uint64) ([]byte, error) {
+	now := uint32(DefaultTime.Unix())
+	logBlockSize := uint32(0)
+	for 1024<<logBlockSize < l.bs {
+		logBlockSize++
+	}
+
+	sb := disklayout.SuperBlock64Bit{}
+	sb.InodesCountRaw = uint32(l.groups * l.ipg)
+	sb.BlocksCountLo, sb.BlocksCountHi = uint32(l.blocksCount), uint32(l.blocksCount>>32)
+	sb.FreeBlocksCountLo, sb.FreeBlocksCountHi = uint32(freeBlocks), uint32(freeBlocks>>32)
+	sb.FreeInodesCountRaw = uint32(freeInodes)
+	sb.FirstDataBlockRaw = uint32(l.firstDataBlock)
+	sb.LogBlockSize = logBlockSize
+	sb.LogClusterSize = logBlockSize
+	sb.BlocksPerGroupRaw = uint32(l.bpg)
+	sb.ClustersPerGroupRaw = uint32(l.bpg)
+	sb.InodesPerGroupRaw = uint32(l.ipg)
+	sb.Wtime = now
+	sb.MaxMountCountRaw = 0xffff
+	sb.MagicRaw = 0xef53
+	sb.State = 1
+	sb.Errors = 1
+	sb.LastCheck = now
+	sb.RevLevel = uint32(disklayout.DynamicRev)
+	sb.FirstInode = firstIno
+	sb.InodeSizeRaw = l.opts.InodeSize
+	sb.BlockGroupNumber = uint16(g)
+	sb.UUID = uuid
+	copy(sb.VolumeName[:], "testimage")
+	sb.HashSeed = [4]uint32{0x01234567, 0x89abcdef, 0xfedcba98, 0x76543210}
+	sb.MkfsTime = now
+	sb.Flags = unsignedHashFlag
+
+	sb.FeatureCompat = disklayout.SbExtAttr
+	sb.FeatureIncompat = disklayout.SbDirentFileType
+	sb.FeatureRoCompat = disklayout.SbSparse | disklayout.SbLargeFile
+	if l.opts.NoFileType {
+		sb.FeatureIncompat = 0
+	}
+	if l.encrypted {
+		sb.FeatureIncompat |= disklayout.SbEncrypted
+	}
+	if l.opts.DirIndex {
+		sb.FeatureCompat |= disklayout.SbDirIndex
+	}
+	if l.opts.Extents {
+		sb.FeatureIncompat |= disklayout.SbExtents
+		if l.opts.InodeSize > disklayout.OldInodeSize {
+			sb.FeatureRoCompat |= disklayout.SbExtraIsize
+			sb.MinInodeSize = extraIsize
+			sb.WantInodeSize = extraIsize
+		}
+	}
+	if l.opts.Is64Bit {
+		sb.FeatureIncompat |= disklayout.SbIs64Bit
+		sb.BgDescSizeRaw = uint16(l.descSize)
+	}
+	if l.opts.Journal {
+		sb.FeatureCompat |= disklayout.SbHasJournal
+		sb.JournalInum = journalIno
+		// Back up the journal inode's i_block and size, as mke2fs does.
+		sb.JnlBackupType = 1
+		rec := l.inodeRecord(journalIno)
+		for i := 0; i < 15; i++ {
+			sb.JnlBlocks[i] = binary.LittleEndian.Uint32(rec[40+4*i:])
+		}
+		sb.JnlBlocks[15] = binary.LittleEndian.Uint32(rec[108:])
+		sb.JnlBlocks[16] = binary.LittleEndian.Uint32(rec[4:])
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, &sb); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeJournalSuperBlock writes a clean jbd2 v2 superblock. jbd2 structures
+// are big-endian.
+func writeJournalSuperBlock(dst []byte, bs uint64) {
+	be := binary.BigEndian
+	be.PutUint32(dst[0x0:], 0xc03b3998) // h_magic
+	be.PutUint32(dst[0x4:], 4)          // h_blocktype: superblock v2
+	be.PutUint32(dst[0xc:], uint32(bs)) // s_blocksize
+	be.PutUint32(dst[0x10:], journalBlocks)
+	be.PutUint32(dst[0x14:], 1) // s_first
+	be.PutUint32(dst[0x18:], 1) // s_sequence
+	copy(dst[0x30:], uuid[:])
+	be.PutUint32(dst[0x40:], 1) // s_nr_users
+}
+
+// linuxMode converts an fs.FileMode to the inode i_mode.
+func linuxMode(m fs.FileMode) (uint16, error) {
+	var mode uint16
+	switch m.Type() {
+	case 0:
+		mode = linux.ModeRegular
+	case fs.ModeDir:
+		mode = linux.ModeDirectory
+	case fs.ModeSymlink:
+		mode = linux.ModeSymlink
+	case fs.ModeDevice:
+		mode = linux.ModeBlockDevice
+	case fs.ModeDevice | fs.ModeCharDevice:
+		mode = linux.ModeCharacterDevice
+	case fs.ModeNamedPipe:
+		mode = linux.ModeNamedPipe
+	case fs.ModeSocket:
+		mode = linux.ModeSocket
+	default:
+		return 0, xerrors.Errorf("unsupported file mode %v", m)
+	}
+	mode |= uint16(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= linux.ModeSetUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= linux.ModeSetGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= linux.ModeSticky
+	}
+	return mode, nil
+}
+
+// encodeDevice stores device numbers in i_block the way the kernel does: the
+// old 16-bit encoding in the first word when both numbers fit in a byte,
+// otherwise the new 32-bit encoding in the second word.
+func encodeDevice(iblock *[60]byte, major, minor uint32) {
+	if major < 256 && minor < 256 {
+		binary.LittleEndian.PutUint32(iblock[0:], major<<8|minor)
+		return
+	}
+	binary.LittleEndian.PutUint32(iblock[4:], minor&0xff|major<<8|(minor&^0xff)<<12)
+}
+
+// encodeTime returns the 32-bit seconds and the extra epoch and nanosecond
+// field of t. The zero time stands for DefaultTime.
+func encodeTime(t time.Time) (int32, uint32) {
+	if t.IsZero() {
+		t = DefaultTime
+	}
+	sec := t.Unix()
+	epoch := uint32((sec-int64(int32(sec)))>>32) & 0x3
+	return int32(sec), epoch | uint32(t.Nanosecond())<<2
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func setBit(bitmap []byte, i uint64) {
+	bitmap[i/8] |= 1 << (i % 8)
+}
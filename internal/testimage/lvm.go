@@ -0,0 +1,74 @@
+package testimage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const (
+	// LVMPEStart is the offset of the first physical extent of the physical
+	// volumes built by LVMPhysicalVolume, as pe_start in sectors.
+	LVMPEStart = 2048
+
+	// lvmMDAOffset and lvmMDASize place the metadata area between the label
+	// and the first extent, where pvcreate puts it.
+	lvmMDAOffset = 4096
+	lvmMDASize   = LVMPEStart*512 - lvmMDAOffset
+)
+
+// lvmChecksum is the CRC-32 variant LVM2 uses for labels and metadata.
+func lvmChecksum(b []byte) uint32 {
+	return ^crc32.Update(^uint32(0xf597a6cf), crc32.IEEETable, b)
+}
+
+// LVMPhysicalVolume returns an LVM2 physical volume of size bytes whose UUID
+// is the 32 character id, with metadata as the text of its metadata area.
+func LVMPhysicalVolume(id string, size int, metadata string) []byte {
+	pv := make([]byte, size)
+
+	// The label goes in sector 1, as pvcreate does.
+	label := pv[512:1024]
+	copy(label, "LABELONE")
+	binary.LittleEndian.PutUint64(label[8:], 1)
+	binary.LittleEndian.PutUint32(label[20:], 32)
+	copy(label[24:], "LVM2 001")
+	hdr := label[32:]
+	copy(hdr, id)
+	binary.LittleEndian.PutUint64(hdr[32:], uint64(size))
+	binary.LittleEndian.PutUint64(hdr[40:], LVMPEStart*512)
+	// A zero terminated data area list, then the metadata area list.
+	binary.LittleEndian.PutUint64(hdr[72:], lvmMDAOffset)
+	binary.LittleEndian.PutUint64(hdr[80:], lvmMDASize)
+	binary.LittleEndian.PutUint32(label[16:], lvmChecksum(label[20:]))
+
+	LVMPutMetadata(pv, metadata, 512)
+	return pv
+}
+
+// LVMPutMetadata rewrites the metadata area of a physical volume built by
+// LVMPhysicalVolume to hold metadata at offset bytes into the area, wrapping
+// around the end of the area like LVM's circular buffer.
+func LVMPutMetadata(pv []byte, metadata string, offset int) {
+	area := pv[lvmMDAOffset : lvmMDAOffset+lvmMDASize]
+	text := append([]byte(metadata), 0)
+	for i, c := range text {
+		pos := offset + i
+		if pos >= len(area) {
+			pos = pos - len(area) + 512
+		}
+		area[pos] = c
+	}
+
+	hdr := area[:512]
+	for i := range hdr {
+		hdr[i] = 0
+	}
+	copy(hdr[4:], "\x20LVM2\x20x[5A%r0N*>")
+	binary.LittleEndian.PutUint32(hdr[20:], 1)
+	binary.LittleEndian.PutUint64(hdr[24:], lvmMDAOffset)
+	binary.LittleEndian.PutUint64(hdr[32:], lvmMDASize)
+	binary.LittleEndian.PutUint64(hdr[40:], uint64(offset))
+	binary.LittleEndian.PutUint64(hdr[48:], uint64(len(text)))
+	binary.LittleEndian.PutUint32(hdr[56:], lvmChecksum(text))
+	binary.LittleEndian.PutUint32(hdr[0:], lvmChecksum(hdr[4:]))
+}
@@ -0,0 +1,169 @@
+package testimage
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+
+	"github.com/asalih/go-ext/disklayout"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// xattrMagic starts both the in-inode attribute area and attribute blocks.
+	xattrMagic = 0xea020000
+
+	// xattrBlockHeaderSize is the size of struct ext4_xattr_header.
+	xattrBlockHeaderSize = 32
+
+	// xattrEntryHeaderSize is the size of struct ext4_xattr_entry without
+	// the name.
+	xattrEntryHeaderSize = 16
+)
+
+// xattrPrefixes maps attribute name prefixes to their name index. Full names
+// come before the prefixes they start with.
+var xattrPrefixes = []struct {
+	prefix string
+	index  uint8
+}{
+	{"system.posix_acl_access", 2},
+	{"system.posix_acl_default", 3},
+	{"user.", 1},
+	{"trusted.", 4},
+	{"security.", 6},
+	{"system.", 7},
+	// The fscrypt context, which is not visible to userspace.
+	{"encryption.", 9},
+}
+
+// xattr is an extended attribute with its name split into index and suffix.
+type xattr struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+func (x xattr) entrySize() int {
+	return xattrEntryHeaderSize + pad4(len(x.name))
+}
+
+// splitXattrs sorts the attributes the way ext4 expects them and splits them
+// between the inode body and an attribute block.
+func (l *layout) splitXattrs(m map[string][]byte) ([]xattr, []xattr, error) {
+	attrs := make([]xattr, 0, len(m))
+	for full, value := range m {
+		x, err := parseXattr(full)
+		if err != nil {
+			return nil, nil, err
+		}
+		x.value = value
+		attrs = append(attrs, x)
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		a, b := attrs[i], attrs[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+
+	var body, block []xattr
+	bodyFree := 0
+	if l.opts.InodeSize > disklayout.OldInodeSize {
+		// The magic and the terminating zero word.
+		bodyFree = int(l.opts.InodeSize) - disklayout.OldInodeSize - extraIsize - 8
+	}
+	blockFree := int(l.bs) - xattrBlockHeaderSize - 4
+	for _, x := range attrs {
+		need := x.entrySize() + pad4(len(x.value))
+		if len(block) == 0 && need <= bodyFree {
+			body = append(body, x)
+			bodyFree -= need
+			continue
+		}
+		if need > blockFree {
+			return nil, nil, xerrors.Errorf("extended attributes do not fit in a block")
+		}
+		block = append(block, x)
+		blockFree -= need
+	}
+	return body, block, nil
+}
+
+func parseXattr(full string) (xattr, error) {
+	for _, p := range xattrPrefixes {
+		if strings.HasPrefix(full, p.prefix) {
+			x := xattr{index: p.index, name: full[len(p.prefix):]}
+			if len(x.name) > 255 {
+				return xattr{}, xerrors.Errorf("extended attribute name %q is too long", full)
+			}
+			return x, nil
+		}
+	}
+	return xattr{}, xerrors.Errorf("unsupported extended attribute %q", full)
+}
+
+// writeXattrBody writes the in-inode attribute area to dst, which starts
+// right after i_extra_isize. Value offsets are relative to the first entry.
+func writeXattrBody(dst []byte, attrs []xattr) {
+	binary.LittleEndian.PutUint32(dst, xattrMagic)
+	writeXattrEntries(dst[4:], 0, attrs)
+}
+
+// writeXattrBlock writes an attribute block referenced by a single inode.
+func writeXattrBlock(dst []byte, attrs []xattr) {
+	hashes := writeXattrEntries(dst, xattrBlockHeaderSize, attrs)
+
+	var hash uint32
+	for _, h := range hashes {
+		hash = hash<<16 ^ hash>>16 ^ h
+	}
+	le := binary.LittleEndian
+	le.PutUint32(dst[0:], xattrMagic)
+	le.PutUint32(dst[4:], 1) // h_refcount
+	le.PutUint32(dst[8:], 1) // h_blocks
+	le.PutUint32(dst[16:], hash)
+}
+
+// writeXattrEntries writes attrs as entries starting at offset off of region
+// and their values packed at the end of region. It returns the entry hashes.
+func writeXattrEntries(region []byte, off int, attrs []xattr) []uint32 {
+	le := binary.LittleEndian
+	end := len(region)
+	hashes := make([]uint32, len(attrs))
+	for i, x := range attrs {
+		end -= pad4(len(x.value))
+		copy(region[end:], x.value)
+		hashes[i] = xattrHash(x.name, region[end:end+pad4(len(x.value))])
+
+		e := region[off:]
+		e[0] = byte(len(x.name))
+		e[1] = x.index
+		le.PutUint16(e[2:], uint16(end))
+		le.PutUint32(e[8:], uint32(len(x.value)))
+		le.PutUint32(e[12:], hashes[i])
+		copy(e[xattrEntryHeaderSize:], x.name)
+		off += x.entrySize()
+	}
+	return hashes
+}
+
+// xattrHash is ext4_xattr_hash_entry over the name and the zero padded value.
+func xattrHash(name string, value []byte) uint32 {
+	var hash uint32
+	for i := 0; i < len(name); i++ {
+		hash = hash<<5 ^ hash>>27 ^ uint32(name[i])
+	}
+	for i := 0; i+4 <= len(value); i += 4 {
+		hash = hash<<16 ^ hash>>16 ^ binary.LittleEndian.Uint32(value[i:])
+	}
+	return hash
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,26 @@
+// Package unixtime formats times as seconds since the epoch, as PAX headers
+// and bodyfiles record them.
+package unixtime
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format formats t as seconds since the epoch, with a fraction if it has
+// nanoseconds. Times before the epoch are negative, fraction included.
+func Format(t time.Time) string {
+	secs, nsecs := t.Unix(), int64(t.Nanosecond())
+	if nsecs == 0 {
+		return strconv.FormatInt(secs, 10)
+	}
+	sign := ""
+	if secs < 0 {
+		sign = "-"
+		secs = -(secs + 1)
+		nsecs = 1e9 - nsecs
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%09d", sign, secs, nsecs), "0")
+}
@@ -0,0 +1,31 @@
+// Package uuid formats the identifiers of filesystems, volumes and arrays the
+// way the tools which create them print them.
+package uuid
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// Group splits s into groups of the given lengths, joined by sep. s is
+// returned unchanged if its length is not the sum of the groups.
+func Group(s, sep string, groups ...int) string {
+	n := 0
+	for _, g := range groups {
+		n += g
+	}
+	if len(s) != n {
+		return s
+	}
+	parts := make([]string, len(groups))
+	for i, g := range groups {
+		parts[i], s = s[:g], s[g:]
+	}
+	return strings.Join(parts, sep)
+}
+
+// Format formats the 16 byte UUID b in its canonical form,
+// xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx.
+func Format(b [16]byte) string {
+	return Group(hex.EncodeToString(b[:]), "-", 8, 4, 4, 4, 12)
+}
@@ -245,9 +245,37 @@ func (m FileMode) IsDir() bool {
 	return m.FileType() == S_IFDIR
 }
 
-// Mode returns fs.FileMode
+// FSMode converts m to the equivalent fs.FileMode: file type, permission and
+// setuid, setgid and sticky bits.
 func (m FileMode) FSMode() fs.FileMode {
-	return fs.FileMode(m.FileType())
+	mode := fs.FileMode(m.Permissions())
+	switch m.FileType() {
+	case ModeDirectory:
+		mode |= fs.ModeDir
+	case ModeSymlink:
+		mode |= fs.ModeSymlink
+	case ModeBlockDevice:
+		mode |= fs.ModeDevice
+	case ModeCharacterDevice:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case ModeNamedPipe:
+		mode |= fs.ModeNamedPipe
+	case ModeSocket:
+		mode |= fs.ModeSocket
+	case ModeRegular:
+	default:
+		mode |= fs.ModeIrregular
+	}
+	if m&ModeSetUID != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&ModeSetGID != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&ModeSticky != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
 }
 
 // String returns a string representation of m.
@@ -0,0 +1,389 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/asalih/go-ext/internal/ioutil"
+	"golang.org/x/xerrors"
+)
+
+const (
+	magic          = "LUKS\xba\xbe"
+	secondaryMagic = "SKUL\xba\xbe"
+
+	luks1HeaderSize = 592
+	luks1KeySlots   = 8
+	luks1DigestSize = 20
+	luks1SlotActive = 0x00ac71f3
+
+	luks2BinarySize = 4096
+	// maxLUKS2HeaderSize bounds the binary and JSON header areas.
+	maxLUKS2HeaderSize = 4 << 20
+)
+
+// luks2HeaderOffsets are the offsets at which LUKS2 headers are looked up;
+// the secondary header follows the primary at one of them, depending on the
+// size of the JSON area.
+var luks2HeaderOffsets = []int64{0, 0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000}
+
+// Header is a LUKS header.
+type Header struct {
+	Version int
+	UUID    string
+	// Label is the label of LUKS2 devices.
+	Label string
+	// Cipher is the data encryption, such as aes-xts-plain64.
+	Cipher string
+	// KeySize is the size of the volume key in bytes.
+	KeySize int
+	// DataOffset is the offset of the encrypted data in bytes, and DataSize
+	// its size, or -1 if it extends to the end of the device.
+	DataOffset int64
+	DataSize   int64
+	// SectorSize is the encryption sector size.
+	SectorSize int64
+	// IVTweak is added to the sector number to form the IV of a sector.
+	IVTweak  uint64
+	KeySlots []KeySlot
+
+	digests []digest
+}
+
+// KeySlot is an active key slot, which holds the volume key encrypted with a
+// key derived from a passphrase.
+type KeySlot struct {
+	ID int
+	// KDF is the key derivation function: pbkdf2, argon2i or argon2id.
+	KDF  string
+	Hash string
+	// Iterations is the number of PBKDF2 iterations or the Argon2 time
+	// cost.
+	Iterations int
+	// Memory is the Argon2 memory cost in KiB.
+	Memory      int
+	Parallelism int
+
+	salt       []byte
+	keySize    int // bytes of the key derived from the passphrase
+	areaOffset int64
+	areaCipher string
+	stripes    int
+	afHash     string
+}
+
+// digest verifies volume keys: the PBKDF2 derivation of a valid key with the
+// salt and iterations is value.
+type digest struct {
+	hash       string
+	iterations int
+	salt       []byte
+	value      []byte
+	// keySlots lists the key slots the digest applies to, or nil for all.
+	keySlots []int
+}
+
+// ReadHeader reads the LUKS1 or LUKS2 header of r.
+func ReadHeader(r io.ReaderAt) (*Header, error) {
+	b := make([]byte, luks1HeaderSize)
+	if err := ioutil.ReadFull(r, b, 0); err != nil || string(b[:6]) != magic {
+		// A damaged primary LUKS2 header leaves the secondary.
+		if h, err := readLUKS2(r); err == nil {
+			return h, nil
+		}
+		return nil, ErrNotLUKS
+	}
+	switch v := binary.BigEndian.Uint16(b[6:]); v {
+	case 1:
+		return parseLUKS1(b)
+	case 2:
+		return readLUKS2(r)
+	default:
+		return nil, xerrors.Errorf("luks: unsupported version %d", v)
+	}
+}
+
+// parseLUKS1 parses a LUKS1 header.
+func parseLUKS1(b []byte) (*Header, error) {
+	be := binary.BigEndian
+	h := &Header{
+		Version:    1,
+		Cipher:     cstring(b[8:40]) + "-" + cstring(b[40:72]),
+		DataOffset: int64(be.Uint32(b[104:])) * sectorSize,
+		DataSize:   -1,
+		SectorSize: sectorSize,
+		KeySize:    int(be.Uint32(b[108:])),
+		UUID:       cstring(b[168:208]),
+	}
+	hash := strings.ToLower(cstring(b[72:104]))
+	h.digests = []digest{{
+		hash:       hash,
+		iterations: int(be.Uint32(b[164:])),
+		salt:       append([]byte(nil), b[132:164]...),
+		value:      append([]byte(nil), b[112:132]...),
+	}}
+	if h.KeySize <= 0 || h.KeySize > 512 {
+		return nil, xerrors.Errorf("luks: invalid key size %d", h.KeySize)
+	}
+	for i := 0; i < luks1KeySlots; i++ {
+		s := b[208+48*i:]
+		if be.Uint32(s) != luks1SlotActive {
+			continue
+		}
+		h.KeySlots = append(h.KeySlots, KeySlot{
+			ID:         i,
+			KDF:        "pbkdf2",
+			Hash:       hash,
+			Iterations: int(be.Uint32(s[4:])),
+			salt:       append([]byte(nil), s[8:40]...),
+			keySize:    h.KeySize,
+			areaOffset: int64(be.Uint32(s[40:])) * sectorSize,
+			areaCipher: h.Cipher,
+			stripes:    int(be.Uint32(s[44:])),
+			afHash:     hash,
+		})
+	}
+	return h, nil
+}
+
+// readLUKS2 reads the valid LUKS2 header with the highest sequence number.
+func readLUKS2(r io.ReaderAt) (*Header, error) {
+	var best []byte
+	var bestSeq uint64
+	for _, offset := range luks2HeaderOffsets {
+		hdr, err := readLUKS2Area(r, offset)
+		if err != nil {
+			continue
+		}
+		if seq := binary.BigEndian.Uint64(hdr[16:]); best == nil || seq > bestSeq {
+			best, bestSeq = hdr, seq
+		}
+	}
+	if best == nil {
+		return nil, xerrors.Errorf("luks: no valid LUKS2 header: %w", ErrNotLUKS)
+	}
+	return parseLUKS2(best)
+}
+
+// readLUKS2Area reads and verifies the binary header and JSON area at offset.
+func readLUKS2Area(r io.ReaderAt, offset int64) ([]byte, error) {
+	bin := make([]byte, luks2BinarySize)
+	if err := ioutil.ReadFull(r, bin, offset); err != nil {
+		return nil, err
+	}
+	m := string(bin[:6])
+	if (offset == 0 && m != magic) || (offset != 0 && m != secondaryMagic) || binary.BigEndian.Uint16(bin[6:]) != 2 {
+		return nil, ErrNotLUKS
+	}
+	size := binary.BigEndian.Uint64(bin[8:])
+	if size < luks2BinarySize || size > maxLUKS2HeaderSize || binary.BigEndian.Uint64(bin[256:]) != uint64(offset) {
+		return nil, xerrors.Errorf("luks: invalid LUKS2 header at %d", offset)
+	}
+	hdr := make([]byte, size)
+	copy(hdr, bin)
+	if err := ioutil.ReadFull(r, hdr[luks2BinarySize:], offset+luks2BinarySize); err != nil {
+		return nil, err
+	}
+	if alg := cstring(hdr[72:104]); alg != "sha256" {
+		return nil, xerrors.Errorf("luks: unsupported header checksum %q", alg)
+	}
+	want := append([]byte(nil), hdr[448:448+sha256.Size]...)
+	for i := 448; i < 448+64; i++ {
+		hdr[i] = 0
+	}
+	if sum := sha256.Sum256(hdr); !bytes.Equal(sum[:], want) {
+		return nil, xerrors.Errorf("luks: LUKS2 header at %d has a bad checksum", offset)
+	}
+	return hdr, nil
+}
+
+// luks2Metadata is the JSON metadata of a LUKS2 header. Sizes and offsets
+// are decimal strings, to hold 64 bit values.
+type luks2Metadata struct {
+	Keyslots map[string]luks2Keyslot `json:"keyslots"`
+	Segments map[string]luks2Segment `json:"segments"`
+	Digests  map[string]luks2Digest  `json:"digests"`
+}
+
+type luks2Keyslot struct {
+	Type    string `json:"type"`
+	KeySize int    `json:"key_size"`
+	AF      struct {
+		Type    string `json:"type"`
+		Stripes int    `json:"stripes"`
+		Hash    string `json:"hash"`
+	} `json:"af"`
+	Area struct {
+		Type       string `json:"type"`
+		Offset     string `json:"offset"`
+		Encryption string `json:"encryption"`
+		KeySize    int    `json:"key_size"`
+	} `json:"area"`
+	KDF struct {
+		Type       string `json:"type"`
+		Hash       string `json:"hash"`
+		Iterations int    `json:"iterations"`
+		Time       int    `json:"time"`
+		Memory     int    `json:"memory"`
+		CPUs       int    `json:"cpus"`
+		Salt       string `json:"salt"`
+	} `json:"kdf"`
+}
+
+type luks2Segment struct {
+	Type       string   `json:"type"`
+	Offset     string   `json:"offset"`
+	Size       string   `json:"size"`
+	IVTweak    string   `json:"iv_tweak"`
+	Encryption string   `json:"encryption"`
+	SectorSize int64    `json:"sector_size"`
+	Flags      []string `json:"flags"`
+}
+
+type luks2Digest struct {
+	Type       string   `json:"type"`
+	Keyslots   []string `json:"keyslots"`
+	Segments   []string `json:"segments"`
+	Hash       string   `json:"hash"`
+	Iterations int      `json:"iterations"`
+	Salt       string   `json:"salt"`
+	Digest     string   `json:"digest"`
+}
+
+// parseLUKS2 parses a verified LUKS2 header.
+func parseLUKS2(hdr []byte) (*Header, error) {
+	h := &Header{
+		Version: 2,
+		Label:   cstring(hdr[24:72]),
+		UUID:    cstring(hdr[168:208]),
+	}
+	var meta luks2Metadata
+	if err := json.Unmarshal(bytes.TrimRight(hdr[luks2BinarySize:], "\x00"), &meta); err != nil {
+		return nil, xerrors.Errorf("luks: LUKS2 metadata: %w", err)
+	}
+
+	if len(meta.Segments) != 1 {
+		return nil, xerrors.Errorf("luks: %d data segments, reencryption is not supported", len(meta.Segments))
+	}
+	var segmentID string
+	for id, seg := range meta.Segments {
+		segmentID = id
+		if seg.Type != "crypt" {
+			return nil, xerrors.Errorf("luks: unsupported segment type %q", seg.Type)
+		}
+		if len(seg.Flags) != 0 {
+			return nil, xerrors.Errorf("luks: unsupported segment flags %q", seg.Flags)
+		}
+		var err error
+		if h.DataOffset, err = strconv.ParseInt(seg.Offset, 10, 64); err != nil {
+			return nil, xerrors.Errorf("luks: segment offset: %w", err)
+		}
+		h.DataSize = -1
+		if seg.Size != "dynamic" {
+			if h.DataSize, err = strconv.ParseInt(seg.Size, 10, 64); err != nil {
+				return nil, xerrors.Errorf("luks: segment size: %w", err)
+			}
+		}
+		if seg.IVTweak != "" {
+			if h.IVTweak, err = strconv.ParseUint(seg.IVTweak, 10, 64); err != nil {
+				return nil, xerrors.Errorf("luks: segment IV tweak: %w", err)
+			}
+		}
+		h.Cipher = seg.Encryption
+		h.SectorSize = seg.SectorSize
+	}
+	if h.SectorSize != 512 && h.SectorSize != 1024 && h.SectorSize != 2048 && h.SectorSize != 4096 {
+		return nil, xerrors.Errorf("luks: invalid sector size %d", h.SectorSize)
+	}
+
+	for id, d := range meta.Digests {
+		if d.Type != "pbkdf2" || !contains(d.Segments, segmentID) {
+			continue
+		}
+		salt, err := base64.StdEncoding.DecodeString(d.Salt)
+		if err != nil {
+			return nil, xerrors.Errorf("luks: digest %s salt: %w", id, err)
+		}
+		value, err := base64.StdEncoding.DecodeString(d.Digest)
+		if err != nil {
+			return nil, xerrors.Errorf("luks: digest %s: %w", id, err)
+		}
+		dg := digest{hash: d.Hash, iterations: d.Iterations, salt: salt, value: value, keySlots: []int{}}
+		for _, ks := range d.Keyslots {
+			n, err := strconv.Atoi(ks)
+			if err != nil {
+				return nil, xerrors.Errorf("luks: digest %s key slot %q: %w", id, ks, err)
+			}
+			dg.keySlots = append(dg.keySlots, n)
+		}
+		h.digests = append(h.digests, dg)
+	}
+	if len(h.digests) == 0 {
+		return nil, errors.New("luks: no digest for the data segment")
+	}
+
+	for id, ks := range meta.Keyslots {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, xerrors.Errorf("luks: key slot %q: %w", id, err)
+		}
+		if ks.Type != "luks2" || ks.AF.Type != "luks1" || ks.Area.Type != "raw" {
+			// Reencryption slots and the like hold no volume key.
+			continue
+		}
+		slot := KeySlot{
+			ID:          n,
+			KDF:         ks.KDF.Type,
+			Hash:        ks.KDF.Hash,
+			Iterations:  ks.KDF.Iterations,
+			Memory:      ks.KDF.Memory,
+			Parallelism: ks.KDF.CPUs,
+			keySize:     ks.Area.KeySize,
+			areaCipher:  ks.Area.Encryption,
+			stripes:     ks.AF.Stripes,
+			afHash:      ks.AF.Hash,
+		}
+		if slot.KDF != "pbkdf2" {
+			slot.Iterations = ks.KDF.Time
+		}
+		if slot.salt, err = base64.StdEncoding.DecodeString(ks.KDF.Salt); err != nil {
+			return nil, xerrors.Errorf("luks: key slot %d salt: %w", n, err)
+		}
+		if slot.areaOffset, err = strconv.ParseInt(ks.Area.Offset, 10, 64); err != nil {
+			return nil, xerrors.Errorf("luks: key slot %d area offset: %w", n, err)
+		}
+		if h.KeySize == 0 {
+			h.KeySize = ks.KeySize
+		} else if ks.KeySize != h.KeySize {
+			continue
+		}
+		h.KeySlots = append(h.KeySlots, slot)
+	}
+	sort.Slice(h.KeySlots, func(i, j int) bool { return h.KeySlots[i].ID < h.KeySlots[j].ID })
+	return h, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// cstring returns the NUL terminated string in b.
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
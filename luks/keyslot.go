@@ -0,0 +1,180 @@
+package luks
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"github.com/asalih/go-ext/internal/ioutil"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/xerrors"
+)
+
+// maxStripes bounds the anti-forensic stripes of a key slot.
+const maxStripes = 1 << 16
+
+// hashFunc returns the hash function named name in LUKS headers.
+func hashFunc(name string) (func() hash.Hash, error) {
+	switch name {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha384":
+		return sha512.New384, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, xerrors.Errorf("luks: unsupported hash %q", name)
+}
+
+// deriveKey derives the key of the slot from passphrase.
+func (s *KeySlot) deriveKey(passphrase []byte) ([]byte, error) {
+	switch s.KDF {
+	case "pbkdf2":
+		h, err := hashFunc(s.Hash)
+		if err != nil {
+			return nil, err
+		}
+		return pbkdf2.Key(passphrase, s.salt, s.Iterations, s.keySize, h), nil
+	case "argon2i", "argon2id":
+		if s.Parallelism < 1 || s.Parallelism > 255 || s.Memory < 8*s.Parallelism || s.Iterations < 1 {
+			return nil, xerrors.Errorf("luks: key slot %d: invalid Argon2 parameters", s.ID)
+		}
+		if s.KDF == "argon2i" {
+			return argon2.Key(passphrase, s.salt, uint32(s.Iterations), uint32(s.Memory), uint8(s.Parallelism), uint32(s.keySize)), nil
+		}
+		return argon2.IDKey(passphrase, s.salt, uint32(s.Iterations), uint32(s.Memory), uint8(s.Parallelism), uint32(s.keySize)), nil
+	}
+	return nil, xerrors.Errorf("luks: key slot %d: unsupported key derivation %q", s.ID, s.KDF)
+}
+
+// unlock returns the volume key of size bytes the slot holds, decrypting its
+// key material with the key derived from passphrase.
+func (s *KeySlot) unlock(r io.ReaderAt, passphrase []byte, size int) ([]byte, error) {
+	if s.stripes < 1 || s.stripes > maxStripes {
+		return nil, xerrors.Errorf("luks: key slot %d: invalid stripe count %d", s.ID, s.stripes)
+	}
+	key, err := s.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newCipher(s.areaCipher, key)
+	if err != nil {
+		return nil, xerrors.Errorf("luks: key slot %d: %w", s.ID, err)
+	}
+	// The key material is encrypted in 512 byte sectors numbered from its
+	// start.
+	material := make([]byte, (size*s.stripes+sectorSize-1)/sectorSize*sectorSize)
+	if err := ioutil.ReadFull(r, material, s.areaOffset); err != nil {
+		return nil, xerrors.Errorf("luks: key slot %d: failed to read key material: %w", s.ID, err)
+	}
+	for i := 0; i < len(material); i += sectorSize {
+		c.decrypt(material[i:i+sectorSize], uint64(i/sectorSize))
+	}
+	h, err := hashFunc(s.afHash)
+	if err != nil {
+		return nil, err
+	}
+	return afMerge(material[:size*s.stripes], size, s.stripes, h), nil
+}
+
+// afMerge recovers the key of size bytes split into stripes by the LUKS
+// anti-forensic splitter: every stripe but the last is XORed in and
+// diffused in turn, then the last is XORed in.
+func afMerge(material []byte, size, stripes int, h func() hash.Hash) []byte {
+	d := make([]byte, size)
+	for i := 0; i < stripes-1; i++ {
+		subtle.XORBytes(d, d, material[i*size:(i+1)*size])
+		diffuse(d, h)
+	}
+	subtle.XORBytes(d, d, material[(stripes-1)*size:])
+	return d
+}
+
+// diffuse replaces each digest-sized block of b, the last possibly partial,
+// by the hash of its index and content.
+func diffuse(b []byte, h func() hash.Hash) {
+	hh := h()
+	ds := hh.Size()
+	var index [4]byte
+	for i := 0; i*ds < len(b); i++ {
+		block := b[i*ds:]
+		if len(block) > ds {
+			block = block[:ds]
+		}
+		hh.Reset()
+		binary.BigEndian.PutUint32(index[:], uint32(i))
+		hh.Write(index[:])
+		hh.Write(block)
+		copy(block, hh.Sum(nil))
+	}
+}
+
+// verifyKey reports whether key is the volume key, optionally only checking
+// the digests which apply to slot if slot is not negative.
+func (h *Header) verifyKey(key []byte, slot int) (bool, error) {
+	for _, d := range h.digests {
+		if slot >= 0 && d.keySlots != nil && !containsInt(d.keySlots, slot) {
+			continue
+		}
+		hf, err := hashFunc(d.hash)
+		if err != nil {
+			return false, err
+		}
+		if hmac.Equal(pbkdf2.Key(key, d.salt, d.iterations, len(d.value), hf), d.value) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Unlock returns the volume key held by the first key slot the passphrase
+// opens, or by the slot with the given ID if slot is not negative.
+func (h *Header) Unlock(r io.ReaderAt, passphrase []byte, slot int) ([]byte, error) {
+	var firstErr error
+	for i := range h.KeySlots {
+		s := &h.KeySlots[i]
+		if slot >= 0 && s.ID != slot {
+			continue
+		}
+		key, err := s.unlock(r, passphrase, h.KeySize)
+		if err == nil {
+			var ok bool
+			if ok, err = h.verifyKey(key, s.ID); ok {
+				return key, nil
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, xerrors.Errorf("%v: %w", firstErr, ErrWrongKey)
+	}
+	return nil, ErrWrongKey
+}
+
+// VerifyKey reports whether key is the volume key of the device.
+func (h *Header) VerifyKey(key []byte) bool {
+	if h.KeySize != 0 && len(key) != h.KeySize {
+		return false
+	}
+	ok, _ := h.verifyKey(key, -1)
+	return ok
+}
+
+func containsInt(list []int, n int) bool {
+	for _, e := range list {
+		if e == n {
+			return true
+		}
+	}
+	return false
+}
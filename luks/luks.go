@@ -0,0 +1,179 @@
+// Package luks reads LUKS1 and LUKS2 encrypted devices given a passphrase or
+// the volume key. The decrypted data is exposed as an io.ReaderAt which can be
+// passed to ext.NewFS.
+//
+// Only the aes-xts-plain64 and aes-xts-plain ciphers are supported. Devices
+// in the middle of reencryption, and LUKS2 key slots stored in tokens, are
+// not.
+package luks
+
+import (
+	"crypto/aes"
+	"errors"
+	"io"
+
+	"github.com/asalih/go-ext/internal/ioutil"
+	"golang.org/x/crypto/xts"
+	"golang.org/x/xerrors"
+)
+
+const sectorSize = 512
+
+var (
+	// ErrNotLUKS is returned for devices without a LUKS header.
+	ErrNotLUKS = errors.New("luks: not a LUKS device")
+
+	// ErrNoKey is returned by New if it was given neither a passphrase nor a
+	// volume key.
+	ErrNoKey = errors.New("luks: no passphrase or volume key")
+
+	// ErrWrongKey is returned when no key slot can be opened with the
+	// passphrase, or the volume key does not match the header.
+	ErrWrongKey = errors.New("luks: wrong passphrase or volume key")
+)
+
+// Option configures a Device.
+type Option func(*options)
+
+type options struct {
+	passphrase []byte
+	key        []byte
+	slot       int
+}
+
+// WithPassphrase sets the passphrase the volume key is derived from.
+func WithPassphrase(passphrase []byte) Option {
+	return func(o *options) {
+		o.passphrase = passphrase
+	}
+}
+
+// WithVolumeKey sets the volume key, also called the master key, as dumped by
+// cryptsetup luksDump --dump-volume-key or recovered from memory.
+func WithVolumeKey(key []byte) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+// WithKeySlot restricts passphrase checks to the key slot with the given ID,
+// skipping the costly key derivation of the others.
+func WithKeySlot(id int) Option {
+	return func(o *options) {
+		o.slot = id
+	}
+}
+
+// Device is an unlocked LUKS device. It is safe for concurrent use.
+type Device struct {
+	*Header
+
+	r      io.ReaderAt
+	size   int64
+	cipher *sectorCipher
+}
+
+// New unlocks the LUKS device r of size bytes with the passphrase or volume
+// key given as options.
+func New(r io.ReaderAt, size int64, opts ...Option) (*Device, error) {
+	o := options{slot: -1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	key := o.key
+	switch {
+	case key != nil:
+		if !h.VerifyKey(key) {
+			return nil, ErrWrongKey
+		}
+	case o.passphrase != nil:
+		if key, err = h.Unlock(r, o.passphrase, o.slot); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrNoKey
+	}
+
+	c, err := newCipher(h.Cipher, key)
+	if err != nil {
+		return nil, err
+	}
+	d := &Device{Header: h, r: r, size: h.DataSize, cipher: c}
+	if d.size < 0 {
+		d.size = size - h.DataOffset
+	}
+	if d.size < 0 || d.size%h.SectorSize != 0 {
+		return nil, xerrors.Errorf("luks: invalid data size %d", d.size)
+	}
+	return d, nil
+}
+
+// Size returns the size of the decrypted data in bytes.
+func (d *Device) Size() int64 {
+	return d.size
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("luks: negative offset")
+	}
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	var err error
+	if rest := d.size - off; int64(len(p)) > rest {
+		p = p[:rest]
+		err = io.EOF
+	}
+
+	ss := d.SectorSize
+	first := off / ss
+	last := (off + int64(len(p)) - 1) / ss
+	buf := make([]byte, (last-first+1)*ss)
+	if rerr := ioutil.ReadFull(d.r, buf, d.DataOffset+first*ss); rerr != nil {
+		return 0, rerr
+	}
+	for i := int64(0); i*ss < int64(len(buf)); i++ {
+		d.cipher.decrypt(buf[i*ss:(i+1)*ss], d.IVTweak+uint64(first+i))
+	}
+	return copy(p, buf[off-first*ss:]), err
+}
+
+// sectorCipher decrypts sectors with a cipher of the form
+// cipher-mode-ivgenerator.
+type sectorCipher struct {
+	xts *xts.Cipher
+	// ivMask truncates sector numbers, for the 32 bit plain IV.
+	ivMask uint64
+}
+
+func newCipher(spec string, key []byte) (*sectorCipher, error) {
+	var mask uint64
+	switch spec {
+	case "aes-xts-plain64":
+		mask = ^uint64(0)
+	case "aes-xts-plain":
+		mask = 0xffffffff
+	default:
+		return nil, xerrors.Errorf("luks: unsupported cipher %q", spec)
+	}
+	if len(key) != 32 && len(key) != 64 {
+		return nil, xerrors.Errorf("luks: invalid %s key size %d", spec, len(key))
+	}
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return nil, xerrors.Errorf("luks: %w", err)
+	}
+	return &sectorCipher{xts: c, ivMask: mask}, nil
+}
+
+// decrypt decrypts the sector b in place, with the IV of sector number n.
+func (c *sectorCipher) decrypt(b []byte, n uint64) {
+	c.xts.Decrypt(b, b, n&c.ivMask)
+}
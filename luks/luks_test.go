@@ -0,0 +1,303 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"math/rand"
+	"testing"
+
+	ext "github.com/asalih/go-ext"
+	"github.com/asalih/go-ext/internal/testimage"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+const testStripes = 4000
+
+func randomBytes(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// encrypt encrypts b in place in sectors of ss bytes numbered from first.
+func encrypt(b, key []byte, ss int, first uint64) {
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < len(b); i += ss {
+		c.Encrypt(b[i:i+ss], b[i:i+ss], first+uint64(i/ss))
+	}
+}
+
+// afSplit splits key into stripes as cryptsetup does.
+func afSplit(key []byte, stripes int, h func() hash.Hash, seed int64) []byte {
+	out := randomBytes(len(key)*stripes, seed)
+	d := make([]byte, len(key))
+	for i := 0; i < stripes-1; i++ {
+		for j := range d {
+			d[j] ^= out[i*len(key)+j]
+		}
+		diffuse(d, h)
+	}
+	for j := range d {
+		out[(stripes-1)*len(key)+j] = d[j] ^ key[j]
+	}
+	return out
+}
+
+// keyMaterial returns the encrypted stripes of key for a slot whose key is
+// derived as slotKey, padded to whole sectors.
+func keyMaterial(key, slotKey []byte, seed int64) []byte {
+	m := afSplit(key, testStripes, sha256.New, seed)
+	for len(m)%sectorSize != 0 {
+		m = append(m, 0)
+	}
+	encrypt(m, slotKey, sectorSize, 0)
+	return m
+}
+
+func writeLUKS1(data, key, passphrase []byte) []byte {
+	be := binary.BigEndian
+	const iterations = 1000
+	h := make([]byte, 8*sectorSize)
+	copy(h, magic)
+	be.PutUint16(h[6:], 1)
+	copy(h[8:], "aes")
+	copy(h[40:], "xts-plain64")
+	copy(h[72:], "sha256")
+	be.PutUint32(h[108:], uint32(len(key)))
+	salt := randomBytes(32, 10)
+	copy(h[112:], pbkdf2.Key(key, salt, iterations, luks1DigestSize, sha256.New))
+	copy(h[132:], salt)
+	be.PutUint32(h[164:], iterations)
+	copy(h[168:], "9a9d4c0f-2a43-4e3c-9d3c-0c8f5b5a1e11")
+	for i := 0; i < luks1KeySlots; i++ {
+		be.PutUint32(h[208+48*i:], 0x0000dead)
+	}
+
+	// Slot 0 holds the key under another passphrase, slot 3 under
+	// passphrase.
+	img := h
+	for i, pass := range map[int][]byte{0: []byte("other"), 3: passphrase} {
+		s := img[208+48*i:]
+		salt := randomBytes(32, int64(20+i))
+		be.PutUint32(s, luks1SlotActive)
+		be.PutUint32(s[4:], iterations)
+		copy(s[8:], salt)
+		be.PutUint32(s[40:], uint32(len(img)/sectorSize))
+		be.PutUint32(s[44:], testStripes)
+		img = append(img, keyMaterial(key, pbkdf2.Key(pass, salt, iterations, len(key), sha256.New), int64(i))...)
+	}
+	be.PutUint32(img[104:], uint32(len(img)/sectorSize))
+	payload := append([]byte(nil), data...)
+	encrypt(payload, key, sectorSize, 0)
+	return append(img, payload...)
+}
+
+type testSlot struct {
+	kdf        string
+	passphrase string
+}
+
+func writeLUKS2(data, key []byte, sectorSize int, slots []testSlot) []byte {
+	const (
+		hdrSize  = 16 << 10
+		areaSize = 1 << 20
+	)
+	keyslots := map[string]interface{}{}
+	var areas []byte
+	var ids []string
+	for i, s := range slots {
+		id := fmt.Sprint(i)
+		ids = append(ids, id)
+		salt := randomBytes(32, int64(30+i))
+		kdf := map[string]interface{}{"type": s.kdf, "salt": base64.StdEncoding.EncodeToString(salt)}
+		var slotKey []byte
+		if s.kdf == "pbkdf2" {
+			kdf["hash"], kdf["iterations"] = "sha256", 1000
+			slotKey = pbkdf2.Key([]byte(s.passphrase), salt, 1000, len(key), sha256.New)
+		} else {
+			kdf["time"], kdf["memory"], kdf["cpus"] = 1, 64, 1
+			slotKey = argon2.IDKey([]byte(s.passphrase), salt, 1, 64, 1, uint32(len(key)))
+		}
+		offset := 2*hdrSize + len(areas)
+		m := keyMaterial(key, slotKey, int64(i))
+		areas = append(areas, m...)
+		for len(areas)%4096 != 0 {
+			areas = append(areas, 0)
+		}
+		keyslots[id] = map[string]interface{}{
+			"type": "luks2", "key_size": len(key),
+			"af":   map[string]interface{}{"type": "luks1", "stripes": testStripes, "hash": "sha256"},
+			"area": map[string]interface{}{"type": "raw", "offset": fmt.Sprint(offset), "size": fmt.Sprint(len(m)), "encryption": "aes-xts-plain64", "key_size": len(key)},
+			"kdf":  kdf,
+		}
+	}
+	dataOffset := 2*hdrSize + areaSize
+	digestSalt := randomBytes(32, 40)
+	meta := map[string]interface{}{
+		"keyslots": keyslots,
+		"tokens":   map[string]interface{}{},
+		"segments": map[string]interface{}{"0": map[string]interface{}{
+			"type": "crypt", "offset": fmt.Sprint(dataOffset), "size": "dynamic", "iv_tweak": "0",
+			"encryption": "aes-xts-plain64", "sector_size": sectorSize,
+		}},
+		"digests": map[string]interface{}{"0": map[string]interface{}{
+			"type": "pbkdf2", "keyslots": ids, "segments": []string{"0"}, "hash": "sha256", "iterations": 1000,
+			"salt":   base64.StdEncoding.EncodeToString(digestSalt),
+			"digest": base64.StdEncoding.EncodeToString(pbkdf2.Key(key, digestSalt, 1000, 32, sha256.New)),
+		}},
+		"config": map[string]interface{}{"json_size": fmt.Sprint(hdrSize - luks2BinarySize), "keyslots_size": fmt.Sprint(areaSize)},
+	}
+	js, err := json.Marshal(meta)
+	if err != nil {
+		panic(err)
+	}
+
+	img := make([]byte, dataOffset)
+	for i, m := range []string{magic, secondaryMagic} {
+		hdr := img[i*hdrSize : (i+1)*hdrSize]
+		copy(hdr, m)
+		binary.BigEndian.PutUint16(hdr[6:], 2)
+		binary.BigEndian.PutUint64(hdr[8:], hdrSize)
+		binary.BigEndian.PutUint64(hdr[16:], 7)
+		copy(hdr[24:], "secret")
+		copy(hdr[72:], "sha256")
+		copy(hdr[168:], "6f0e3c1a-44b5-4f43-8a57-d62b8e1f0c21")
+		binary.BigEndian.PutUint64(hdr[256:], uint64(i*hdrSize))
+		copy(hdr[luks2BinarySize:], js)
+		sum := sha256.Sum256(hdr)
+		copy(hdr[448:], sum[:])
+	}
+	copy(img[2*hdrSize:], areas)
+	payload := append([]byte(nil), data...)
+	encrypt(payload, key, sectorSize, 0)
+	return append(img, payload...)
+}
+
+func checkRead(t *testing.T, name string, d *Device, want []byte) {
+	t.Helper()
+	if d.Size() != int64(len(want)) {
+		t.Errorf("%s: size %d, want %d", name, d.Size(), len(want))
+	}
+	got, err := io.ReadAll(io.NewSectionReader(d, 0, d.Size()))
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("%s: read %d bytes with %v, mismatch", name, len(got), err)
+	}
+	buf := make([]byte, 5000)
+	if _, err := d.ReadAt(buf, 1000); err != nil || !bytes.Equal(buf, want[1000:6000]) {
+		t.Errorf("%s: ReadAt mismatch, %v", name, err)
+	}
+}
+
+func TestLUKS1(t *testing.T) {
+	data := randomBytes(64<<10, 1)
+	key := randomBytes(64, 2)
+	raw := writeLUKS1(data, key, []byte("correct horse"))
+	r := bytes.NewReader(raw)
+
+	h, err := ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != 1 || h.Cipher != "aes-xts-plain64" || h.KeySize != 64 || h.UUID != "9a9d4c0f-2a43-4e3c-9d3c-0c8f5b5a1e11" {
+		t.Errorf("header %+v", h)
+	}
+	if len(h.KeySlots) != 2 || h.KeySlots[0].ID != 0 || h.KeySlots[1].ID != 3 || h.KeySlots[1].KDF != "pbkdf2" {
+		t.Errorf("key slots %+v", h.KeySlots)
+	}
+
+	d, err := New(r, int64(len(raw)), WithPassphrase([]byte("correct horse")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, "passphrase", d, data)
+	if _, err := New(r, int64(len(raw)), WithPassphrase([]byte("correct horse")), WithKeySlot(0)); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("passphrase of another slot returned %v, want %v", err, ErrWrongKey)
+	}
+	if _, err := New(r, int64(len(raw)), WithPassphrase([]byte("wrong"))); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("wrong passphrase returned %v, want %v", err, ErrWrongKey)
+	}
+
+	d, err = New(r, int64(len(raw)), WithVolumeKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, "volume key", d, data)
+	key[0]++
+	if _, err := New(r, int64(len(raw)), WithVolumeKey(key)); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("wrong volume key returned %v, want %v", err, ErrWrongKey)
+	}
+	if _, err := New(r, int64(len(raw))); !errors.Is(err, ErrNoKey) {
+		t.Errorf("New without key returned %v, want %v", err, ErrNoKey)
+	}
+	if _, err := New(bytes.NewReader(data), int64(len(data)), WithVolumeKey(key)); !errors.Is(err, ErrNotLUKS) {
+		t.Errorf("New of plain data returned %v, want %v", err, ErrNotLUKS)
+	}
+}
+
+func TestLUKS2(t *testing.T) {
+	data := randomBytes(64<<10, 3)
+	key := randomBytes(64, 4)
+	slots := []testSlot{{"argon2id", "argon"}, {"pbkdf2", "pbkdf"}}
+	for _, ss := range []int{512, 4096} {
+		raw := writeLUKS2(data, key, ss, slots)
+		r := bytes.NewReader(raw)
+		h, err := ReadHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Version != 2 || h.Label != "secret" || h.SectorSize != int64(ss) || len(h.KeySlots) != 2 || h.KeySlots[0].KDF != "argon2id" || h.KeySlots[0].Memory != 64 {
+			t.Errorf("header %+v", h)
+		}
+		for i, s := range slots {
+			d, err := New(r, int64(len(raw)), WithPassphrase([]byte(s.passphrase)))
+			if err != nil {
+				t.Fatalf("sector size %d, %s: %v", ss, s.kdf, err)
+			}
+			checkRead(t, s.kdf, d, data)
+			if _, err := New(r, int64(len(raw)), WithPassphrase([]byte(s.passphrase)), WithKeySlot(1-i)); !errors.Is(err, ErrWrongKey) {
+				t.Errorf("passphrase of another slot returned %v, want %v", err, ErrWrongKey)
+			}
+		}
+
+		// The secondary header takes over from a damaged primary one.
+		raw[5000]++
+		d, err := New(bytes.NewReader(raw), int64(len(raw)), WithVolumeKey(key))
+		if err != nil {
+			t.Fatalf("damaged primary header: %v", err)
+		}
+		checkRead(t, "secondary", d, data)
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	b := testimage.New(testimage.Ext4())
+	b.File("secret.txt", []byte("decrypted"))
+	data := b.MustBuild()
+	key := randomBytes(32, 5)
+	raw := writeLUKS2(data, key, 4096, []testSlot{{"pbkdf2", "pass"}})
+	d, err := New(bytes.NewReader(raw), int64(len(raw)), WithPassphrase([]byte("pass")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := ext.NewFS(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile(fsys, "secret.txt"); err != nil || string(got) != "decrypted" {
+		t.Errorf("ReadFile returned %q, %v", got, err)
+	}
+}
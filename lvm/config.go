@@ -0,0 +1,259 @@
+package lvm
+
+import (
+	"strconv"
+
+	"golang.org/x/xerrors"
+)
+
+// section is a section of LVM2 metadata text, holding key = value settings
+// and nested sections. Values are string, int64, []interface{} of those, or
+// *section.
+type section struct {
+	// keys holds the names of the settings and subsections in the order they
+	// appear.
+	keys   []string
+	values map[string]interface{}
+}
+
+func newSection() *section {
+	return &section{values: make(map[string]interface{})}
+}
+
+func (s *section) set(key string, v interface{}) {
+	if _, ok := s.values[key]; !ok {
+		s.keys = append(s.keys, key)
+	}
+	s.values[key] = v
+}
+
+// str returns the string setting key.
+func (s *section) str(key string) (string, error) {
+	v, ok := s.values[key].(string)
+	if !ok {
+		return "", xerrors.Errorf("lvm: missing string setting %q", key)
+	}
+	return v, nil
+}
+
+// int returns the integer setting key, which must not be negative.
+func (s *section) int(key string) (uint64, error) {
+	v, ok := s.values[key].(int64)
+	if !ok || v < 0 {
+		return 0, xerrors.Errorf("lvm: missing integer setting %q", key)
+	}
+	return uint64(v), nil
+}
+
+// list returns the array setting key.
+func (s *section) list(key string) ([]interface{}, error) {
+	v, ok := s.values[key].([]interface{})
+	if !ok {
+		return nil, xerrors.Errorf("lvm: missing array setting %q", key)
+	}
+	return v, nil
+}
+
+// sub returns the subsection key, or nil if there is none.
+func (s *section) sub(key string) *section {
+	v, _ := s.values[key].(*section)
+	return v
+}
+
+// subs returns the subsections of s in order.
+func (s *section) subs() []*namedSection {
+	var subs []*namedSection
+	for _, key := range s.keys {
+		if sub, ok := s.values[key].(*section); ok {
+			subs = append(subs, &namedSection{name: key, section: sub})
+		}
+	}
+	return subs
+}
+
+type namedSection struct {
+	name string
+	*section
+}
+
+// maxConfigDepth bounds the nesting of sections and arrays.
+const maxConfigDepth = 32
+
+// configParser parses LVM2 metadata text, the format of lvm.conf and of the
+// volume group descriptions in metadata areas.
+type configParser struct {
+	text []byte
+	pos  int
+}
+
+// parseConfig parses metadata text into its top-level section.
+func parseConfig(text []byte) (*section, error) {
+	p := &configParser{text: text}
+	root := newSection()
+	if err := p.parseSettings(root, 0); err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.text) {
+		return nil, p.errorf("unexpected %q", p.text[p.pos])
+	}
+	return root, nil
+}
+
+func (p *configParser) errorf(format string, args ...interface{}) error {
+	line := 1
+	for _, c := range p.text[:p.pos] {
+		if c == '\n' {
+			line++
+		}
+	}
+	return xerrors.Errorf("lvm: metadata line %d: %s", line, xerrors.Errorf(format, args...))
+}
+
+// skipSpace skips white space and comments.
+func (p *configParser) skipSpace() {
+	for p.pos < len(p.text) {
+		switch c := p.text[p.pos]; {
+		case c == '#':
+			for p.pos < len(p.text) && p.text[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == 0:
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// parseSettings parses settings and subsections into s until a closing
+// brace or the end of the text.
+func (p *configParser) parseSettings(s *section, depth int) error {
+	if depth > maxConfigDepth {
+		return p.errorf("sections nested too deep")
+	}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.text) || p.text[p.pos] == '}' {
+			return nil
+		}
+		key := p.parseIdent()
+		if key == "" {
+			return p.errorf("expected a setting name, got %q", p.text[p.pos])
+		}
+		p.skipSpace()
+		if p.pos >= len(p.text) {
+			return p.errorf("unexpected end of metadata after %q", key)
+		}
+
+		switch p.text[p.pos] {
+		case '{':
+			p.pos++
+			sub := newSection()
+			if err := p.parseSettings(sub, depth+1); err != nil {
+				return err
+			}
+			if p.pos >= len(p.text) {
+				return p.errorf("unterminated section %q", key)
+			}
+			p.pos++
+			s.set(key, sub)
+		case '=':
+			p.pos++
+			v, err := p.parseValue(depth + 1)
+			if err != nil {
+				return err
+			}
+			s.set(key, v)
+		default:
+			return p.errorf("unexpected %q after %q", p.text[p.pos], key)
+		}
+	}
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == '-' || c == '+'
+}
+
+func (p *configParser) parseIdent() string {
+	start := p.pos
+	for p.pos < len(p.text) && isIdentChar(p.text[p.pos]) {
+		p.pos++
+	}
+	return string(p.text[start:p.pos])
+}
+
+// parseValue parses a string, an integer or an array of those.
+func (p *configParser) parseValue(depth int) (interface{}, error) {
+	if depth > maxConfigDepth {
+		return nil, p.errorf("arrays nested too deep")
+	}
+	p.skipSpace()
+	if p.pos >= len(p.text) {
+		return nil, p.errorf("unexpected end of metadata")
+	}
+
+	switch c := p.text[p.pos]; {
+	case c == '"':
+		return p.parseString()
+	case c == '[':
+		p.pos++
+		var list []interface{}
+		for {
+			p.skipSpace()
+			if p.pos < len(p.text) && p.text[p.pos] == ']' {
+				p.pos++
+				return list, nil
+			}
+			if len(list) > 0 {
+				if p.pos >= len(p.text) || p.text[p.pos] != ',' {
+					return nil, p.errorf("expected ',' in array")
+				}
+				p.pos++
+			}
+			v, err := p.parseValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	case c == '-' || c >= '0' && c <= '9':
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.text) && (isIdentChar(p.text[p.pos])) {
+			p.pos++
+		}
+		word := string(p.text[start:p.pos])
+		if n, err := strconv.ParseInt(word, 10, 64); err == nil {
+			return n, nil
+		}
+		// Floating point settings are of no use here; keep them as text.
+		return word, nil
+	default:
+		return nil, p.errorf("unexpected %q in value", c)
+	}
+}
+
+// parseString parses a double-quoted string, in which a backslash escapes the
+// next character.
+func (p *configParser) parseString() (string, error) {
+	p.pos++
+	var out []byte
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return string(out), nil
+		case '\\':
+			if p.pos >= len(p.text) {
+				return "", p.errorf("unterminated string")
+			}
+			out = append(out, p.text[p.pos])
+			p.pos++
+		default:
+			out = append(out, c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
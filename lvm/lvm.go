@@ -0,0 +1,261 @@
+// Package lvm reads LVM2 physical volumes and reconstructs the logical volumes
+// described by their metadata. Linear, striped, zero and error segments are
+// supported; mirrors, RAID, snapshots and thin volumes are not.
+//
+// A logical volume opened by this package is an io.ReaderAt, so filesystems
+// inside it can be passed straight to ext.NewFS.
+package lvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"github.com/asalih/go-ext/internal/ioutil"
+	"github.com/asalih/go-ext/internal/uuid"
+	"golang.org/x/xerrors"
+)
+
+// SectorSize is the unit LVM2 metadata addresses devices in.
+const SectorSize = 512
+
+const (
+	// labelScanSectors is the number of sectors at the start of a device
+	// searched for the label.
+	labelScanSectors = 4
+
+	labelID   = "LABELONE"
+	labelType = "LVM2 001"
+
+	// pvHeaderMaxAreas bounds the data and metadata area lists of a PV
+	// header, which must fit in the label sector.
+	pvHeaderMaxAreas = 16
+
+	mdaHeaderSize  = 512
+	mdaMagic       = "\x20LVM2\x20x[5A%r0N*>"
+	mdaVersion     = 1
+	mdaMaxRawLocns = 4
+
+	// rawLocnIgnored marks a metadata area LVM was told not to use.
+	rawLocnIgnored = 0x1
+
+	// maxMetadataSize bounds the metadata text read from a metadata area.
+	maxMetadataSize = 64 << 20
+
+	// initialCRC seeds every LVM2 checksum.
+	initialCRC = 0xf597a6cf
+)
+
+// ErrNoLabel is returned by ReadPhysicalVolume for devices without an LVM2
+// label.
+var ErrNoLabel = errors.New("lvm: no physical volume label")
+
+// checksum computes the CRC used by LVM2: CRC-32 with the IEEE polynomial,
+// seeded with initialCRC and without the final inversion.
+func checksum(b []byte) uint32 {
+	return ^crc32.Update(^uint32(initialCRC), crc32.IEEETable, b)
+}
+
+// Area is a region of a physical volume. A Size of zero means the area
+// extends to the end of the device.
+type Area struct {
+	Offset uint64
+	Size   uint64
+}
+
+// PhysicalVolume is an LVM2 physical volume read from a device.
+type PhysicalVolume struct {
+	// UUID is the physical volume's identifier, in the dashed form used by
+	// LVM's tools and metadata.
+	UUID string
+
+	// DeviceSize is the size of the device as recorded by LVM.
+	DeviceSize uint64
+
+	DataAreas     []Area
+	MetadataAreas []Area
+
+	// Metadata is the newest volume group metadata text found in the
+	// metadata areas, or nil if the physical volume holds none.
+	Metadata []byte
+
+	// VolumeGroup is the name of the volume group Metadata describes, and
+	// Seqno its sequence number.
+	VolumeGroup string
+	Seqno       uint64
+
+	dev io.ReaderAt
+}
+
+// ReadPhysicalVolume reads the label, header and metadata areas of the LVM2
+// physical volume on dev.
+func ReadPhysicalVolume(dev io.ReaderAt) (*PhysicalVolume, error) {
+	buf := make([]byte, labelScanSectors*SectorSize)
+	n, err := dev.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, xerrors.Errorf("lvm: failed to read label: %w", err)
+	}
+	buf = buf[:n]
+
+	for sector := 0; (sector+1)*SectorSize <= len(buf); sector++ {
+		label := buf[sector*SectorSize : (sector+1)*SectorSize]
+		if string(label[0:8]) != labelID {
+			continue
+		}
+		if binary.LittleEndian.Uint64(label[8:]) != uint64(sector) {
+			continue
+		}
+		if checksum(label[20:]) != binary.LittleEndian.Uint32(label[16:]) {
+			return nil, xerrors.Errorf("lvm: label checksum mismatch in sector %d", sector)
+		}
+		if string(label[24:32]) != labelType {
+			return nil, xerrors.Errorf("lvm: unsupported label type %q", label[24:32])
+		}
+		offset := binary.LittleEndian.Uint32(label[20:])
+		if offset < 32 || offset >= SectorSize {
+			return nil, xerrors.Errorf("lvm: invalid PV header offset %d", offset)
+		}
+		pv, err := parsePVHeader(label[offset:])
+		if err != nil {
+			return nil, err
+		}
+		pv.dev = dev
+		if err := pv.readMetadata(); err != nil {
+			return nil, err
+		}
+		return pv, nil
+	}
+	return nil, ErrNoLabel
+}
+
+// parsePVHeader parses the PV header following the label.
+func parsePVHeader(b []byte) (*PhysicalVolume, error) {
+	if len(b) < 40 {
+		return nil, errors.New("lvm: truncated PV header")
+	}
+	pv := &PhysicalVolume{
+		UUID:       uuid.Group(string(bytes.TrimRight(b[0:32], "\x00")), "-", 6, 4, 4, 4, 4, 4, 6),
+		DeviceSize: binary.LittleEndian.Uint64(b[32:]),
+	}
+
+	// The data areas and then the metadata areas follow, each list ended by
+	// a zeroed entry.
+	b = b[40:]
+	for _, list := range []*[]Area{&pv.DataAreas, &pv.MetadataAreas} {
+		for {
+			if len(b) < 16 || len(*list) > pvHeaderMaxAreas {
+				return nil, errors.New("lvm: unterminated area list in PV header")
+			}
+			a := Area{Offset: binary.LittleEndian.Uint64(b), Size: binary.LittleEndian.Uint64(b[8:])}
+			b = b[16:]
+			if a.Offset == 0 {
+				break
+			}
+			*list = append(*list, a)
+		}
+	}
+	return pv, nil
+}
+
+// sameUUID reports whether a and b are the same identifier, dashed or not.
+func sameUUID(a, b string) bool {
+	strip := func(s string) string {
+		return string(bytes.ReplaceAll([]byte(s), []byte("-"), nil))
+	}
+	return strip(a) == strip(b)
+}
+
+// readMetadata reads the metadata text of every metadata area and keeps the
+// newest one. Damaged areas are skipped as long as one is intact.
+func (pv *PhysicalVolume) readMetadata() error {
+	var firstErr error
+	for _, area := range pv.MetadataAreas {
+		text, err := pv.readMetadataArea(area)
+		if err == nil && text != nil {
+			var name string
+			var seqno uint64
+			name, seqno, err = metadataVersion(text)
+			if err == nil && (pv.Metadata == nil || seqno > pv.Seqno) {
+				pv.Metadata, pv.VolumeGroup, pv.Seqno = text, name, seqno
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = xerrors.Errorf("lvm: metadata area at %d: %w", area.Offset, err)
+		}
+	}
+	if pv.Metadata == nil {
+		return firstErr
+	}
+	return nil
+}
+
+// readMetadataArea returns the current metadata text of a metadata area, or
+// nil if it holds none.
+func (pv *PhysicalVolume) readMetadataArea(area Area) ([]byte, error) {
+	hdr := make([]byte, mdaHeaderSize)
+	if err := ioutil.ReadFull(pv.dev, hdr, int64(area.Offset)); err != nil {
+		return nil, err
+	}
+	if string(hdr[4:20]) != mdaMagic {
+		return nil, errors.New("bad magic")
+	}
+	if checksum(hdr[4:]) != binary.LittleEndian.Uint32(hdr) {
+		return nil, errors.New("header checksum mismatch")
+	}
+	if v := binary.LittleEndian.Uint32(hdr[20:]); v != mdaVersion {
+		return nil, xerrors.Errorf("unsupported version %d", v)
+	}
+	start := binary.LittleEndian.Uint64(hdr[24:])
+	size := binary.LittleEndian.Uint64(hdr[32:])
+	if start != area.Offset || size <= mdaHeaderSize {
+		return nil, xerrors.Errorf("header describes area %d+%d", start, size)
+	}
+
+	// Only the first location is used by LVM2; the others are reserved.
+	locn := hdr[40:]
+	offset := binary.LittleEndian.Uint64(locn)
+	length := binary.LittleEndian.Uint64(locn[8:])
+	sum := binary.LittleEndian.Uint32(locn[16:])
+	flags := binary.LittleEndian.Uint32(locn[20:])
+	if offset == 0 || flags&rawLocnIgnored != 0 {
+		return nil, nil
+	}
+	if offset < mdaHeaderSize || offset >= size || length > size-mdaHeaderSize || length > maxMetadataSize {
+		return nil, xerrors.Errorf("metadata at %d+%d does not fit", offset, length)
+	}
+
+	// The area is a circular buffer: text running past its end wraps around
+	// to just after the header.
+	text := make([]byte, length)
+	first := length
+	if offset+length > size {
+		first = size - offset
+	}
+	if err := ioutil.ReadFull(pv.dev, text[:first], int64(start+offset)); err != nil {
+		return nil, err
+	}
+	if err := ioutil.ReadFull(pv.dev, text[first:], int64(start+mdaHeaderSize)); err != nil {
+		return nil, err
+	}
+	if checksum(text) != sum {
+		return nil, errors.New("metadata checksum mismatch")
+	}
+	return bytes.TrimRight(text, "\x00"), nil
+}
+
+// metadataVersion returns the volume group name and sequence number of
+// metadata text.
+func metadataVersion(text []byte) (string, uint64, error) {
+	root, err := parseConfig(text)
+	if err != nil {
+		return "", 0, err
+	}
+	subs := root.subs()
+	if len(subs) != 1 {
+		return "", 0, xerrors.Errorf("lvm: metadata describes %d volume groups", len(subs))
+	}
+	seqno, err := subs[0].int("seqno")
+	return subs[0].name, seqno, err
+}
@@ -0,0 +1,345 @@
+package lvm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+const (
+	pv0ID = "pv0aaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	pv1ID = "pv1bbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	testPVSize     = 2 << 20
+	testExtentSize = 4096
+	peStart        = testimage.LVMPEStart * SectorSize
+)
+
+// testMetadata describes a volume group of two physical volumes with 4k
+// extents, in the format vgcreate writes.
+const testMetadata = `# Generated by LVM2 version 2.03.11(2) (2021-01-08): Mon Jan  1 00:00:00 2024
+
+vg0 {
+	id = "Vg0Vg0-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+	seqno = 7
+	format = "lvm2" # informational
+	status = ["RESIZEABLE", "READ", "WRITE"]
+	flags = []
+	extent_size = 8		# 4 Kilobytes
+	max_lv = 0
+	max_pv = 0
+	metadata_copies = 0
+
+	physical_volumes {
+
+		pv0 {
+			id = "pv0aaa-aaaa-aaaa-aaaa-aaaa-aaaa-aaaaaa"
+			device = "/dev/sda2"	# Hint only
+			status = ["ALLOCATABLE"]
+			flags = []
+			dev_size = 4096	# 2 Megabytes
+			pe_start = 2048
+			pe_count = 256	# 1 Megabytes
+		}
+
+		pv1 {
+			id = "pv1bbb-bbbb-bbbb-bbbb-bbbb-bbbb-bbbbbb"
+			device = "/dev/sdb"
+			status = ["ALLOCATABLE"]
+			flags = []
+			dev_size = 4096
+			pe_start = 2048
+			pe_count = 256
+		}
+	}
+
+	logical_volumes {
+
+		linear {
+			id = "lin000-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+			status = ["READ", "WRITE", "VISIBLE"]
+			flags = []
+			creation_time = 1704067200
+			segment_count = 2
+
+			segment2 {
+				start_extent = 4
+				extent_count = 4
+				type = "striped"
+				stripe_count = 1
+				stripes = [
+					"pv1", 0
+				]
+			}
+			segment1 {
+				start_extent = 0
+				extent_count = 4
+				type = "striped"
+				stripe_count = 1
+				stripes = [
+					"pv0", 0
+				]
+			}
+		}
+
+		striped {
+			id = "str000-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+			status = ["READ", "WRITE", "VISIBLE"]
+			segment_count = 1
+
+			segment1 {
+				start_extent = 0
+				extent_count = 8
+				type = "striped"
+				stripe_count = 2
+				stripe_size = 2	# 1 Kilobytes
+				stripes = [
+					"pv0", 10,
+					"pv1", 10
+				]
+			}
+		}
+
+		zeros {
+			id = "zer000-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+			status = ["READ", "VISIBLE"]
+			segment_count = 1
+
+			segment1 {
+				start_extent = 0
+				extent_count = 2
+				type = "zero"
+			}
+		}
+
+		mirrored {
+			id = "mir000-aaaa-bbbb-cccc-dddd-eeee-ffffff"
+			status = ["READ", "WRITE", "VISIBLE"]
+			segment_count = 1
+
+			segment1 {
+				start_extent = 0
+				extent_count = 1
+				type = "raid1"
+				device_count = 2
+				region_size = 1024
+				raids = [
+					"mirrored_rmeta_0", "mirrored_rimage_0",
+					"mirrored_rmeta_1", "mirrored_rimage_1"
+				]
+			}
+		}
+	}
+}
+# Generated by LVM2
+contents = "Text Format Volume Group"
+version = 1
+
+description = "Created *after* executing 'vgcreate vg0 /dev/sda2 \"/dev/sdb\"'"
+
+creation_host = "test"	# Linux test 6.1.0 #1 SMP x86_64
+creation_time = 1704067200	# Mon Jan  1 00:00:00 2024
+`
+
+// testVolumes returns the physical volumes of testMetadata, along with the
+// content of the linear and striped logical volumes written to them.
+func testVolumes() (pvs [2][]byte, linear, striped []byte) {
+	pvs[0] = testimage.LVMPhysicalVolume(pv0ID, testPVSize, testMetadata)
+	pvs[1] = testimage.LVMPhysicalVolume(pv1ID, testPVSize, testMetadata)
+	rng := rand.New(rand.NewSource(1))
+
+	linear = make([]byte, 8*testExtentSize)
+	rng.Read(linear)
+	copy(pvs[0][peStart:], linear[:4*testExtentSize])
+	copy(pvs[1][peStart:], linear[4*testExtentSize:])
+
+	// 1k chunks alternate between the two stripes, starting at extent 10.
+	striped = make([]byte, 8*testExtentSize)
+	rng.Read(striped)
+	for chunk := 0; chunk*1024 < len(striped); chunk++ {
+		dst := pvs[chunk%2][peStart+10*testExtentSize+chunk/2*1024:]
+		copy(dst, striped[chunk*1024:(chunk+1)*1024])
+	}
+	return pvs, linear, striped
+}
+
+func TestReadPhysicalVolume(t *testing.T) {
+	pvs, _, _ := testVolumes()
+	pv, err := ReadPhysicalVolume(bytes.NewReader(pvs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.UUID != "pv0aaa-aaaa-aaaa-aaaa-aaaa-aaaa-aaaaaa" {
+		t.Errorf("UUID = %q", pv.UUID)
+	}
+	if pv.DeviceSize != testPVSize || pv.VolumeGroup != "vg0" || pv.Seqno != 7 {
+		t.Errorf("got size %d, volume group %q seqno %d", pv.DeviceSize, pv.VolumeGroup, pv.Seqno)
+	}
+	if len(pv.DataAreas) != 1 || pv.DataAreas[0] != (Area{Offset: peStart}) {
+		t.Errorf("DataAreas = %+v", pv.DataAreas)
+	}
+	if len(pv.MetadataAreas) != 1 || pv.MetadataAreas[0].Offset != 4096 {
+		t.Errorf("MetadataAreas = %+v", pv.MetadataAreas)
+	}
+
+	if _, err := ReadPhysicalVolume(bytes.NewReader(make([]byte, 4096))); !errors.Is(err, ErrNoLabel) {
+		t.Errorf("ReadPhysicalVolume of a blank device returned %v, want %v", err, ErrNoLabel)
+	}
+
+	for name, offset := range map[string]int{"label": 512 + 100, "metadata": 4096 + 600} {
+		damaged := append([]byte(nil), pvs[0]...)
+		damaged[offset]++
+		if _, err := ReadPhysicalVolume(bytes.NewReader(damaged)); err == nil {
+			t.Errorf("damaged %s was accepted", name)
+		}
+	}
+}
+
+func TestReadPhysicalVolumeWrappedMetadata(t *testing.T) {
+	pvs, _, _ := testVolumes()
+	// Start the text 100 bytes before the end of the metadata area.
+	testimage.LVMPutMetadata(pvs[0], testMetadata, peStart-4096-100)
+	pv, err := ReadPhysicalVolume(bytes.NewReader(pvs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pv.Metadata) != testMetadata {
+		t.Errorf("wrapped metadata read as %q", pv.Metadata)
+	}
+}
+
+func openTestGroup(t *testing.T, devs ...[]byte) *VolumeGroup {
+	t.Helper()
+	var readers []io.ReaderAt
+	for _, dev := range devs {
+		readers = append(readers, bytes.NewReader(dev))
+	}
+	vg, err := Open(readers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vg
+}
+
+func TestVolumeGroup(t *testing.T) {
+	pvs, _, _ := testVolumes()
+	vg := openTestGroup(t, pvs[0], pvs[1])
+
+	if vg.Name != "vg0" || vg.Seqno != 7 || vg.ExtentSize != testExtentSize {
+		t.Errorf("got volume group %q seqno %d extent size %d", vg.Name, vg.Seqno, vg.ExtentSize)
+	}
+	if len(vg.PhysicalVolumes) != 2 || vg.PhysicalVolumes[1].Device != "/dev/sdb" || vg.PhysicalVolumes[1].PV == nil {
+		t.Errorf("PhysicalVolumes = %+v", vg.PhysicalVolumes)
+	}
+	var names []string
+	for _, lv := range vg.LogicalVolumes {
+		names = append(names, lv.Name)
+	}
+	if got := len(names); got != 4 {
+		t.Fatalf("got logical volumes %q", names)
+	}
+
+	lv, ok := vg.LogicalVolume("linear")
+	if !ok {
+		t.Fatal("linear volume not found")
+	}
+	if !lv.Visible() || len(lv.Segments) != 2 || lv.Segments[0].StartExtent != 0 || lv.Segments[1].Stripes[0].PV != "pv1" {
+		t.Errorf("linear volume = %+v", lv)
+	}
+	if lv.Size() != 8*testExtentSize {
+		t.Errorf("Size() = %d", lv.Size())
+	}
+}
+
+func TestLogicalVolumeOpen(t *testing.T) {
+	pvs, linear, striped := testVolumes()
+	vg := openTestGroup(t, pvs[0], pvs[1])
+
+	for name, want := range map[string][]byte{
+		"linear":  linear,
+		"striped": striped,
+		"zeros":   make([]byte, 2*testExtentSize),
+	} {
+		lv, _ := vg.LogicalVolume(name)
+		r, err := lv.Open()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: read %d bytes with %v, mismatch", name, len(got), err)
+		}
+
+		// Reads crossing extent, segment and stripe boundaries.
+		for _, off := range []int64{0, 1000, 4095, 4096*4 - 10, int64(len(want)) - 3000} {
+			if off >= int64(len(want)) {
+				continue
+			}
+			buf := make([]byte, 3000)
+			n, err := r.ReadAt(buf, off)
+			if err != nil && err != io.EOF || !bytes.Equal(buf[:n], want[off:off+int64(n)]) {
+				t.Errorf("%s: ReadAt(%d) returned %d, %v", name, off, n, err)
+			}
+		}
+	}
+
+	lv, _ := vg.LogicalVolume("mirrored")
+	if _, err := lv.Open(); err == nil {
+		t.Error("raid1 volume opened")
+	}
+}
+
+func TestMissingPhysicalVolume(t *testing.T) {
+	pvs, _, _ := testVolumes()
+	vg := openTestGroup(t, pvs[0], make([]byte, 4096))
+	if vg.PhysicalVolumes[1].PV != nil {
+		t.Error("missing physical volume was found")
+	}
+	for _, name := range []string{"linear", "striped"} {
+		lv, _ := vg.LogicalVolume(name)
+		if _, err := lv.Open(); !errors.Is(err, ErrMissingPhysicalVolume) {
+			t.Errorf("%s: Open returned %v, want %v", name, err, ErrMissingPhysicalVolume)
+		}
+	}
+	if lv, _ := vg.LogicalVolume("zeros"); lv != nil {
+		if _, err := lv.Open(); err != nil {
+			t.Errorf("zeros: %v", err)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	root, err := parseConfig([]byte(`a = 1 # comment
+s = "quote \" and \\ backslash"
+list = [ "x", -2, [3] ]
+sec {
+	inner = 0
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := root.int("a"); err != nil || n != 1 {
+		t.Errorf("a = %d, %v", n, err)
+	}
+	if s, err := root.str("s"); err != nil || s != `quote " and \ backslash` {
+		t.Errorf("s = %q, %v", s, err)
+	}
+	if l, err := root.list("list"); err != nil || len(l) != 3 || l[1] != int64(-2) {
+		t.Errorf("list = %v, %v", l, err)
+	}
+	if subs := root.subs(); len(subs) != 1 || subs[0].name != "sec" {
+		t.Errorf("subs = %v", subs)
+	}
+
+	for _, bad := range []string{"a = ", "a {", `a = "x`, "a = [1 2]", "= 1", "a 1", "}"} {
+		if _, err := parseConfig([]byte(bad)); err == nil {
+			t.Errorf("parseConfig(%q) succeeded", bad)
+		}
+	}
+}
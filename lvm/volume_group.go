@@ -0,0 +1,443 @@
+package lvm
+
+import (
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/asalih/go-ext/internal/ioutil"
+	"golang.org/x/xerrors"
+)
+
+// Segment types understood by LogicalVolume.Open.
+const (
+	SegmentStriped = "striped"
+	SegmentLinear  = "linear"
+	SegmentZero    = "zero"
+	SegmentError   = "error"
+)
+
+// ErrMissingPhysicalVolume is returned when opening a logical volume that has
+// extents on a physical volume which was not passed to NewVolumeGroup.
+var ErrMissingPhysicalVolume = errors.New("lvm: physical volume missing")
+
+// VolumeGroup is an LVM2 volume group as described by its metadata.
+type VolumeGroup struct {
+	Name  string
+	UUID  string
+	Seqno uint64
+
+	// ExtentSize is the size of a physical extent in bytes.
+	ExtentSize uint64
+
+	PhysicalVolumes []*PhysicalVolumeInfo
+	LogicalVolumes  []*LogicalVolume
+}
+
+// PhysicalVolumeInfo is a physical volume as listed in volume group metadata.
+type PhysicalVolumeInfo struct {
+	// Name is the name the metadata refers to the physical volume by, such
+	// as "pv0".
+	Name string
+	UUID string
+
+	// Device is the device path the physical volume was last seen at.
+	Device string
+
+	// PEStart is the byte offset of the first physical extent.
+	PEStart uint64
+	PECount uint64
+
+	// PV is the physical volume itself, or nil if it is missing.
+	PV *PhysicalVolume
+}
+
+// LogicalVolume is a logical volume of a volume group.
+type LogicalVolume struct {
+	Name   string
+	UUID   string
+	Status []string
+
+	Segments []*Segment
+
+	vg *VolumeGroup
+}
+
+// Segment maps a range of a logical volume's extents.
+type Segment struct {
+	StartExtent uint64
+	ExtentCount uint64
+	Type        string
+
+	// StripeSize is the size of a stripe in bytes. It is only meaningful for
+	// striped segments with more than one stripe.
+	StripeSize uint64
+
+	Stripes []Stripe
+}
+
+// Stripe is the physical extent range of a physical volume backing one
+// stripe of a segment.
+type Stripe struct {
+	// PV is the name of the physical volume in the volume group metadata.
+	PV          string
+	StartExtent uint64
+}
+
+// Open reads the labels of devs and assembles the volume group they are the
+// physical volumes of. Devices without a label are skipped.
+func Open(devs ...io.ReaderAt) (*VolumeGroup, error) {
+	var pvs []*PhysicalVolume
+	for i, dev := range devs {
+		pv, err := ReadPhysicalVolume(dev)
+		if errors.Is(err, ErrNoLabel) {
+			continue
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("device %d: %w", i, err)
+		}
+		pvs = append(pvs, pv)
+	}
+	return NewVolumeGroup(pvs...)
+}
+
+// NewVolumeGroup assembles the volume group described by the newest metadata
+// of pvs. The physical volumes must all belong to that volume group, but may
+// be incomplete: logical volumes on missing ones fail to open.
+func NewVolumeGroup(pvs ...*PhysicalVolume) (*VolumeGroup, error) {
+	var newest *PhysicalVolume
+	for _, pv := range pvs {
+		if pv.Metadata != nil && (newest == nil || pv.Seqno > newest.Seqno) {
+			newest = pv
+		}
+	}
+	if newest == nil {
+		return nil, errors.New("lvm: no volume group metadata found")
+	}
+	vg, err := parseVolumeGroup(newest.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pv := range pvs {
+		var info *PhysicalVolumeInfo
+		for _, i := range vg.PhysicalVolumes {
+			if sameUUID(i.UUID, pv.UUID) {
+				info = i
+				break
+			}
+		}
+		if info == nil {
+			return nil, xerrors.Errorf("lvm: physical volume %s is not part of volume group %s", pv.UUID, vg.Name)
+		}
+		info.PV = pv
+	}
+	return vg, nil
+}
+
+// parseVolumeGroup parses volume group metadata text.
+func parseVolumeGroup(text []byte) (*VolumeGroup, error) {
+	root, err := parseConfig(text)
+	if err != nil {
+		return nil, err
+	}
+	subs := root.subs()
+	if len(subs) != 1 {
+		return nil, xerrors.Errorf("lvm: metadata describes %d volume groups", len(subs))
+	}
+	s := subs[0]
+
+	vg := &VolumeGroup{Name: s.name}
+	if vg.UUID, err = s.str("id"); err != nil {
+		return nil, err
+	}
+	if vg.Seqno, err = s.int("seqno"); err != nil {
+		return nil, err
+	}
+	extentSize, err := s.int("extent_size")
+	if err != nil {
+		return nil, err
+	}
+	if extentSize == 0 || extentSize > 1<<32 {
+		return nil, xerrors.Errorf("lvm: invalid extent size %d", extentSize)
+	}
+	vg.ExtentSize = extentSize * SectorSize
+
+	if pvs := s.sub("physical_volumes"); pvs != nil {
+		for _, p := range pvs.subs() {
+			info, err := parsePhysicalVolumeInfo(p)
+			if err != nil {
+				return nil, xerrors.Errorf("physical volume %s: %w", p.name, err)
+			}
+			vg.PhysicalVolumes = append(vg.PhysicalVolumes, info)
+		}
+	}
+	if lvs := s.sub("logical_volumes"); lvs != nil {
+		for _, l := range lvs.subs() {
+			lv, err := parseLogicalVolume(l)
+			if err != nil {
+				return nil, xerrors.Errorf("logical volume %s: %w", l.name, err)
+			}
+			lv.vg = vg
+			vg.LogicalVolumes = append(vg.LogicalVolumes, lv)
+		}
+	}
+	return vg, nil
+}
+
+func parsePhysicalVolumeInfo(s *namedSection) (*PhysicalVolumeInfo, error) {
+	info := &PhysicalVolumeInfo{Name: s.name}
+	var err error
+	if info.UUID, err = s.str("id"); err != nil {
+		return nil, err
+	}
+	info.Device, _ = s.str("device")
+	peStart, err := s.int("pe_start")
+	if err != nil {
+		return nil, err
+	}
+	info.PEStart = peStart * SectorSize
+	if info.PECount, err = s.int("pe_count"); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func parseLogicalVolume(s *namedSection) (*LogicalVolume, error) {
+	lv := &LogicalVolume{Name: s.name}
+	var err error
+	if lv.UUID, err = s.str("id"); err != nil {
+		return nil, err
+	}
+	if status, err := s.list("status"); err == nil {
+		for _, v := range status {
+			if flag, ok := v.(string); ok {
+				lv.Status = append(lv.Status, flag)
+			}
+		}
+	}
+
+	for _, seg := range s.subs() {
+		segment, err := parseSegment(seg)
+		if err != nil {
+			return nil, xerrors.Errorf("%s: %w", seg.name, err)
+		}
+		lv.Segments = append(lv.Segments, segment)
+	}
+	sort.Slice(lv.Segments, func(i, j int) bool {
+		return lv.Segments[i].StartExtent < lv.Segments[j].StartExtent
+	})
+	var next uint64
+	for _, seg := range lv.Segments {
+		if seg.StartExtent != next {
+			return nil, xerrors.Errorf("lvm: segments leave a gap or overlap at extent %d", next)
+		}
+		next += seg.ExtentCount
+	}
+	return lv, nil
+}
+
+func parseSegment(s *namedSection) (*Segment, error) {
+	seg := &Segment{}
+	var err error
+	if seg.StartExtent, err = s.int("start_extent"); err != nil {
+		return nil, err
+	}
+	if seg.ExtentCount, err = s.int("extent_count"); err != nil {
+		return nil, err
+	}
+	if seg.Type, err = s.str("type"); err != nil {
+		return nil, err
+	}
+	if seg.Type != SegmentStriped && seg.Type != SegmentLinear {
+		// Other segment types are kept so that they can be listed, but their
+		// layout is not parsed.
+		return seg, nil
+	}
+
+	stripes, err := s.list("stripes")
+	if err != nil {
+		return nil, err
+	}
+	if len(stripes) == 0 || len(stripes)%2 != 0 {
+		return nil, xerrors.Errorf("lvm: malformed stripe list of %d values", len(stripes))
+	}
+	for i := 0; i < len(stripes); i += 2 {
+		pv, ok1 := stripes[i].(string)
+		start, ok2 := stripes[i+1].(int64)
+		if !ok1 || !ok2 || start < 0 {
+			return nil, xerrors.Errorf("lvm: malformed stripe %d", i/2)
+		}
+		seg.Stripes = append(seg.Stripes, Stripe{PV: pv, StartExtent: uint64(start)})
+	}
+	if len(seg.Stripes) > 1 {
+		stripeSize, err := s.int("stripe_size")
+		if err != nil {
+			return nil, err
+		}
+		if stripeSize == 0 {
+			return nil, errors.New("lvm: zero stripe size")
+		}
+		seg.StripeSize = stripeSize * SectorSize
+	}
+	return seg, nil
+}
+
+// LogicalVolume returns the logical volume called name.
+func (vg *VolumeGroup) LogicalVolume(name string) (*LogicalVolume, bool) {
+	for _, lv := range vg.LogicalVolumes {
+		if lv.Name == name {
+			return lv, true
+		}
+	}
+	return nil, false
+}
+
+// physicalVolume returns the physical volume called name in the metadata.
+func (vg *VolumeGroup) physicalVolume(name string) *PhysicalVolumeInfo {
+	for _, info := range vg.PhysicalVolumes {
+		if info.Name == name {
+			return info
+		}
+	}
+	return nil
+}
+
+// Size returns the size of the logical volume in bytes.
+func (lv *LogicalVolume) Size() int64 {
+	var extents uint64
+	for _, seg := range lv.Segments {
+		extents += seg.ExtentCount
+	}
+	return int64(extents * lv.vg.ExtentSize)
+}
+
+// Visible reports whether the logical volume is one users see, as opposed to
+// a volume LVM keeps internally such as the metadata of a thin pool.
+func (lv *LogicalVolume) Visible() bool {
+	for _, flag := range lv.Status {
+		if flag == "VISIBLE" {
+			return true
+		}
+	}
+	return false
+}
+
+// Open returns a reader for the content of the logical volume. It fails if a
+// segment has an unsupported type or lies on a missing physical volume.
+func (lv *LogicalVolume) Open() (*io.SectionReader, error) {
+	r := &lvReader{extentSize: lv.vg.ExtentSize}
+	for _, seg := range lv.Segments {
+		rs := readerSegment{
+			start:      seg.StartExtent * lv.vg.ExtentSize,
+			size:       seg.ExtentCount * lv.vg.ExtentSize,
+			typ:        seg.Type,
+			stripeSize: seg.StripeSize,
+		}
+		switch seg.Type {
+		case SegmentStriped, SegmentLinear:
+			for _, stripe := range seg.Stripes {
+				info := lv.vg.physicalVolume(stripe.PV)
+				if info == nil {
+					return nil, xerrors.Errorf("lvm: %s refers to unknown physical volume %s", lv.Name, stripe.PV)
+				}
+				if info.PV == nil {
+					return nil, xerrors.Errorf("%s of %s: %w", info.UUID, lv.Name, ErrMissingPhysicalVolume)
+				}
+				extents := (seg.ExtentCount + uint64(len(seg.Stripes)) - 1) / uint64(len(seg.Stripes))
+				if stripe.StartExtent+extents > info.PECount {
+					return nil, xerrors.Errorf("lvm: %s maps extents past the end of %s", lv.Name, stripe.PV)
+				}
+				rs.stripes = append(rs.stripes, readerStripe{
+					dev:    info.PV.dev,
+					offset: info.PEStart + stripe.StartExtent*lv.vg.ExtentSize,
+				})
+			}
+			if len(rs.stripes) > 1 && seg.ExtentCount%uint64(len(rs.stripes)) != 0 {
+				return nil, xerrors.Errorf("lvm: %s has %d extents over %d stripes", lv.Name, seg.ExtentCount, len(rs.stripes))
+			}
+		case SegmentZero, SegmentError:
+		default:
+			return nil, xerrors.Errorf("lvm: %s has an unsupported %q segment", lv.Name, seg.Type)
+		}
+		r.segments = append(r.segments, rs)
+	}
+	return io.NewSectionReader(r, 0, lv.Size()), nil
+}
+
+// lvReader reads a logical volume by mapping its offsets onto the physical
+// volumes.
+type lvReader struct {
+	extentSize uint64
+	segments   []readerSegment
+}
+
+// readerSegment is a segment of a logical volume, in bytes.
+type readerSegment struct {
+	start, size uint64
+	typ         string
+	stripeSize  uint64
+	stripes     []readerStripe
+}
+
+type readerStripe struct {
+	dev    io.ReaderAt
+	offset uint64
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (r *lvReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("lvm: negative offset")
+	}
+	read := 0
+	for len(p) > 0 {
+		pos := uint64(off) + uint64(read)
+		i := sort.Search(len(r.segments), func(i int) bool {
+			return r.segments[i].start+r.segments[i].size > pos
+		})
+		if i == len(r.segments) {
+			return read, io.EOF
+		}
+		n, err := r.segments[i].readAt(p, pos-r.segments[i].start)
+		read += n
+		p = p[n:]
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// readAt reads from the segment at offset off within it, stopping at the end
+// of the segment or of a stripe chunk.
+func (s *readerSegment) readAt(p []byte, off uint64) (int, error) {
+	if rest := s.size - off; uint64(len(p)) > rest {
+		p = p[:rest]
+	}
+	switch s.typ {
+	case SegmentZero:
+		for i := range p {
+			p[i] = 0
+		}
+		return len(p), nil
+	case SegmentError:
+		return 0, xerrors.Errorf("lvm: read of an error segment at %d", s.start+off)
+	}
+
+	stripe := s.stripes[0]
+	devOff := off
+	if len(s.stripes) > 1 {
+		// Chunks of stripeSize bytes go to the stripes in turn.
+		chunk := off / s.stripeSize
+		stripe = s.stripes[chunk%uint64(len(s.stripes))]
+		devOff = chunk/uint64(len(s.stripes))*s.stripeSize + off%s.stripeSize
+		if rest := s.stripeSize - off%s.stripeSize; uint64(len(p)) > rest {
+			p = p[:rest]
+		}
+	}
+	if err := ioutil.ReadFull(stripe.dev, p, int64(stripe.offset+devOff)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
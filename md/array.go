@@ -0,0 +1,499 @@
+package md
+
+import (
+	"errors"
+	"io"
+
+	"github.com/asalih/go-ext/internal/ioutil"
+	"golang.org/x/xerrors"
+)
+
+// Layouts of RAID5 and RAID6 arrays, which place the parity blocks of each
+// stripe. RAID4 always uses LayoutParityLast.
+const (
+	LayoutLeftAsymmetric  = 0
+	LayoutRightAsymmetric = 1
+	// LayoutLeftSymmetric is the default layout of mdadm.
+	LayoutLeftSymmetric  = 2
+	LayoutRightSymmetric = 3
+	LayoutParityFirst    = 4
+	LayoutParityLast     = 5
+
+	// The rotating layouts are the RAID6 layouts of DDF containers.
+	LayoutRotatingZeroRestart = 8
+	LayoutRotatingNRestart    = 9
+	LayoutRotatingNContinue   = 10
+
+	// The RAID6 layouts below lay out P like the RAID5 layout of the same
+	// name and keep Q on the last member. They are used while converting
+	// RAID5 arrays to RAID6.
+	LayoutLeftAsymmetric6  = 16
+	LayoutRightAsymmetric6 = 17
+	LayoutLeftSymmetric6   = 18
+	LayoutRightSymmetric6  = 19
+	LayoutParityFirst6     = 20
+)
+
+// ErrDegraded is returned when more members of an array are missing than
+// its redundancy can make up for.
+var ErrDegraded = errors.New("md: too many members missing")
+
+// Array is an md array assembled from its members.
+type Array struct {
+	UUID string
+	Name string
+
+	Level  int
+	Layout int
+
+	// ChunkSize is the size of a chunk in bytes.
+	ChunkSize uint64
+
+	RaidDisks int
+
+	// Events is the event count of the newest superblock of the members.
+	Events uint64
+
+	// Members holds the member in each slot of the array, or nil for missing
+	// and stale members.
+	Members []*Member
+
+	// Size is the size of the array data in bytes.
+	Size int64
+
+	// memberSize is the number of bytes of every member holding array data.
+	memberSize uint64
+}
+
+// Assemble assembles the array that members belong to. Spares and members
+// with fewer events than the newest one are left out; the array fails to
+// assemble if that leaves it without enough members to be read.
+func Assemble(members ...*Member) (*Array, error) {
+	var newest *Member
+	for _, m := range members {
+		if m.Role != RoleSpare && (newest == nil || m.Events > newest.Events) {
+			newest = m
+		}
+	}
+	if newest == nil {
+		return nil, errors.New("md: no active members")
+	}
+
+	a := &Array{
+		UUID:      newest.UUID,
+		Name:      newest.Name,
+		Level:     newest.Level,
+		Layout:    newest.Layout,
+		ChunkSize: newest.ChunkSize,
+		RaidDisks: newest.RaidDisks,
+		Events:    newest.Events,
+	}
+	if err := a.checkGeometry(); err != nil {
+		return nil, err
+	}
+
+	a.Members = make([]*Member, a.RaidDisks)
+	for _, m := range members {
+		if m.UUID != a.UUID {
+			return nil, xerrors.Errorf("md: member of array %s given for array %s", m.UUID, a.UUID)
+		}
+		if m.Role == RoleSpare || m.Role >= a.RaidDisks || m.Events != a.Events {
+			continue
+		}
+		if a.Members[m.Role] != nil {
+			return nil, xerrors.Errorf("md: two members in slot %d", m.Role)
+		}
+		a.Members[m.Role] = m
+	}
+
+	var missing int
+	for _, m := range a.Members {
+		if m == nil {
+			missing++
+			continue
+		}
+		if a.memberSize != 0 && m.DataSize != a.memberSize && a.Level == LevelRAID0 {
+			// md splits such arrays in zones striped over fewer members.
+			return nil, errors.New("md: RAID0 arrays of members of different sizes are not supported")
+		}
+		if a.memberSize == 0 || m.DataSize < a.memberSize {
+			a.memberSize = m.DataSize
+		}
+	}
+	if missing > a.redundancy() {
+		return nil, xerrors.Errorf("%d of %d members of a RAID%d array: %w", missing, a.RaidDisks, a.Level, ErrDegraded)
+	}
+	if a.Level != LevelRAID1 {
+		a.memberSize -= a.memberSize % a.ChunkSize
+	}
+	a.Size = int64(a.memberSize) * int64(a.dataDisks())
+	return a, nil
+}
+
+// checkGeometry checks that the level, layout, chunk size and number of
+// members of the array are supported.
+func (a *Array) checkGeometry() error {
+	minDisks := 1
+	switch a.Level {
+	case LevelRAID0, LevelRAID1:
+	case LevelRAID4:
+		minDisks = 2
+		a.Layout = LayoutParityLast
+	case LevelRAID5:
+		minDisks = 2
+		if a.Layout < LayoutLeftAsymmetric || a.Layout > LayoutParityLast {
+			return xerrors.Errorf("md: unsupported RAID5 layout %d", a.Layout)
+		}
+	case LevelRAID6:
+		minDisks = 4
+		switch {
+		case a.Layout >= LayoutLeftAsymmetric && a.Layout <= LayoutParityLast:
+		case a.Layout >= LayoutRotatingZeroRestart && a.Layout <= LayoutRotatingNContinue:
+		case a.Layout >= LayoutLeftAsymmetric6 && a.Layout <= LayoutParityFirst6:
+		default:
+			return xerrors.Errorf("md: unsupported RAID6 layout %d", a.Layout)
+		}
+	default:
+		return xerrors.Errorf("md: unsupported RAID level %d", a.Level)
+	}
+	if a.RaidDisks < minDisks || a.RaidDisks > sb1MaxDev {
+		return xerrors.Errorf("md: invalid RAID%d array of %d members", a.Level, a.RaidDisks)
+	}
+	if a.Level != LevelRAID1 && (a.ChunkSize == 0 || a.ChunkSize%512 != 0) {
+		return xerrors.Errorf("md: invalid chunk size %d", a.ChunkSize)
+	}
+	return nil
+}
+
+// redundancy returns the number of members the array can do without.
+func (a *Array) redundancy() int {
+	switch a.Level {
+	case LevelRAID1:
+		return a.RaidDisks - 1
+	case LevelRAID4, LevelRAID5:
+		return 1
+	case LevelRAID6:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// dataDisks returns the number of data chunks in a stripe.
+func (a *Array) dataDisks() int {
+	switch a.Level {
+	case LevelRAID1:
+		return 1
+	case LevelRAID0:
+		return a.RaidDisks
+	default:
+		return a.RaidDisks - a.redundancy()
+	}
+}
+
+// Missing returns the slots of the array without a member.
+func (a *Array) Missing() []int {
+	var missing []int
+	for i, m := range a.Members {
+		if m == nil {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// Open returns a reader for the array data.
+func (a *Array) Open() *io.SectionReader {
+	r := &arrayReader{
+		a:     a,
+		devs:  make([]io.ReaderAt, a.RaidDisks),
+		chunk: int64(a.ChunkSize),
+	}
+	for i, m := range a.Members {
+		if m != nil {
+			r.devs[i] = io.NewSectionReader(m.dev, int64(m.DataOffset), int64(a.memberSize))
+		}
+	}
+	return io.NewSectionReader(r, 0, a.Size)
+}
+
+// arrayReader reads the data of an array from its members.
+type arrayReader struct {
+	a     *Array
+	devs  []io.ReaderAt
+	chunk int64
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (r *arrayReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("md: negative offset")
+	}
+	if off >= r.a.Size {
+		return 0, io.EOF
+	}
+	var err error
+	if rest := r.a.Size - off; int64(len(p)) > rest {
+		p = p[:rest]
+		err = io.EOF
+	}
+	if r.a.Level == LevelRAID1 {
+		if rerr := r.readMirror(p, off); rerr != nil {
+			return 0, rerr
+		}
+		return len(p), err
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		chunk, within := pos/r.chunk, pos%r.chunk
+		buf := p[read:]
+		if rest := r.chunk - within; int64(len(buf)) > rest {
+			buf = buf[:rest]
+		}
+
+		var rerr error
+		if r.a.Level == LevelRAID0 {
+			n := int64(r.a.RaidDisks)
+			rerr = ioutil.ReadFull(r.devs[chunk%n], buf, chunk/n*r.chunk+within)
+		} else {
+			n := int64(r.a.dataDisks())
+			g := r.a.geometry(chunk / n)
+			rerr = r.readData(g, g.data[chunk%n], buf, chunk/n*r.chunk+within)
+		}
+		if rerr != nil {
+			return read, rerr
+		}
+		read += len(buf)
+	}
+	return read, err
+}
+
+// readMirror reads from the first member of a RAID1 array which can be read.
+func (r *arrayReader) readMirror(p []byte, off int64) error {
+	var err error
+	for _, dev := range r.devs {
+		if dev == nil {
+			continue
+		}
+		if err = ioutil.ReadFull(dev, p, off); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// stripeGeometry is the placement of the chunks of a RAID4/5/6 stripe.
+type stripeGeometry struct {
+	// data holds the member of every data chunk, in array order.
+	data []int
+	// p and q are the members holding the parity chunks; q is -1 for RAID4
+	// and RAID5.
+	p, q int
+	// ddf reports that Q is computed over every member in member order
+	// instead of over the data members starting after Q.
+	ddf bool
+}
+
+// geometry returns the placement of the chunks of a stripe, the way the md
+// driver's raid5_compute_sector does.
+func (a *Array) geometry(stripe int64) stripeGeometry {
+	n := a.RaidDisks
+	dataDisks := a.dataDisks()
+	g := stripeGeometry{data: make([]int, dataDisks), q: -1}
+	s := int(stripe % int64(n))
+	s1 := int(stripe % int64(n-1))
+
+	for dd := range g.data {
+		disk := dd
+		if a.Level != LevelRAID6 {
+			switch a.Layout {
+			case LayoutLeftAsymmetric:
+				g.p = dataDisks - s
+				if disk >= g.p {
+					disk++
+				}
+			case LayoutRightAsymmetric:
+				g.p = s
+				if disk >= g.p {
+					disk++
+				}
+			case LayoutLeftSymmetric:
+				g.p = dataDisks - s
+				disk = (g.p + 1 + disk) % n
+			case LayoutRightSymmetric:
+				g.p = s
+				disk = (g.p + 1 + disk) % n
+			case LayoutParityFirst:
+				g.p = 0
+				disk++
+			case LayoutParityLast:
+				g.p = dataDisks
+			}
+			g.data[dd] = disk
+			continue
+		}
+
+		switch a.Layout {
+		case LayoutLeftAsymmetric, LayoutRightAsymmetric, LayoutRotatingZeroRestart, LayoutRotatingNRestart:
+			switch a.Layout {
+			case LayoutLeftAsymmetric:
+				g.p = n - 1 - s
+			case LayoutRightAsymmetric, LayoutRotatingZeroRestart:
+				g.p = s
+			case LayoutRotatingNRestart:
+				g.p = n - 1 - int((stripe+1)%int64(n))
+			}
+			g.q = g.p + 1
+			if g.p == n-1 {
+				disk++
+				g.q = 0
+			} else if disk >= g.p {
+				disk += 2
+			}
+		case LayoutLeftSymmetric:
+			g.p = n - 1 - s
+			g.q = (g.p + 1) % n
+			disk = (g.p + 2 + disk) % n
+		case LayoutRightSymmetric:
+			g.p = s
+			g.q = (g.p + 1) % n
+			disk = (g.p + 2 + disk) % n
+		case LayoutParityFirst:
+			g.p, g.q = 0, 1
+			disk += 2
+		case LayoutParityLast:
+			g.p, g.q = dataDisks, dataDisks+1
+		case LayoutRotatingNContinue:
+			g.p = n - 1 - s
+			g.q = (g.p + n - 1) % n
+			disk = (g.p + 1 + disk) % n
+		case LayoutLeftAsymmetric6:
+			g.p = dataDisks - s1
+			if disk >= g.p {
+				disk++
+			}
+			g.q = n - 1
+		case LayoutRightAsymmetric6:
+			g.p = s1
+			if disk >= g.p {
+				disk++
+			}
+			g.q = n - 1
+		case LayoutLeftSymmetric6:
+			g.p = dataDisks - s1
+			disk = (g.p + 1 + disk) % (n - 1)
+			g.q = n - 1
+		case LayoutRightSymmetric6:
+			g.p = s1
+			disk = (g.p + 1 + disk) % (n - 1)
+			g.q = n - 1
+		case LayoutParityFirst6:
+			g.p = 0
+			disk++
+			g.q = n - 1
+		}
+		g.data[dd] = disk
+	}
+	g.ddf = a.Level == LevelRAID6 && a.Layout >= LayoutRotatingZeroRestart && a.Layout <= LayoutRotatingNContinue
+	return g
+}
+
+// slot returns the syndrome slot of the data chunk on member disk, which is
+// the power of the generator its data is multiplied by in Q.
+func (g *stripeGeometry) slot(disk, n int) int {
+	if g.ddf {
+		return disk
+	}
+	slot := 0
+	for i := (g.q + 1) % n; i != disk; i = (i + 1) % n {
+		if i != g.p && i != g.q {
+			slot++
+		}
+	}
+	return slot
+}
+
+// readData reads the data chunk on member disk at offset off of the members,
+// reconstructing it from the other members if disk is missing or fails.
+func (r *arrayReader) readData(g stripeGeometry, disk int, p []byte, off int64) error {
+	var err error
+	if r.devs[disk] != nil {
+		if err = ioutil.ReadFull(r.devs[disk], p, off); err == nil {
+			return nil
+		}
+	}
+	if rerr := r.reconstruct(g, disk, p, off); rerr != nil {
+		if err != nil {
+			return err
+		}
+		return rerr
+	}
+	return nil
+}
+
+// readMember reads from member disk, returning nil if it is missing or fails.
+func (r *arrayReader) readMember(disk int, size int, off int64) []byte {
+	if disk < 0 || r.devs[disk] == nil {
+		return nil
+	}
+	buf := make([]byte, size)
+	if ioutil.ReadFull(r.devs[disk], buf, off) != nil {
+		return nil
+	}
+	return buf
+}
+
+// reconstruct recomputes the data chunk on member x from the other data
+// chunks and the parity of the stripe.
+func (r *arrayReader) reconstruct(g stripeGeometry, x int, p []byte, off int64) error {
+	n := r.a.RaidDisks
+	parity := r.readMember(g.p, len(p), off)
+	syndrome := r.readMember(g.q, len(p), off)
+
+	// pxy and qxy accumulate P and Q without the chunks that are missing.
+	pxy := make([]byte, len(p))
+	qxy := make([]byte, len(p))
+	if parity != nil {
+		copy(pxy, parity)
+	}
+	if syndrome != nil {
+		copy(qxy, syndrome)
+	}
+	y := -1
+	for _, d := range g.data {
+		if d == x {
+			continue
+		}
+		buf := r.readMember(d, len(p), off)
+		if buf == nil {
+			if y >= 0 {
+				return xerrors.Errorf("stripe at %d: %w", off, ErrDegraded)
+			}
+			y = d
+			continue
+		}
+		xorInto(pxy, buf)
+		mulXorInto(qxy, buf, gfPow(g.slot(d, n)))
+	}
+
+	switch {
+	case y < 0 && parity != nil:
+		copy(p, pxy)
+	case y < 0 && syndrome != nil:
+		// Q' = g^x * Dx.
+		copy(p, qxy)
+		mulInto(p, gfInv(gfPow(g.slot(x, n))))
+	case parity != nil && syndrome != nil:
+		// Dx + Dy = P' and g^x*Dx + g^y*Dy = Q', so that
+		// Dx = (Q' + g^y*P') / (g^x + g^y).
+		gx, gy := gfPow(g.slot(x, n)), gfPow(g.slot(y, n))
+		copy(p, qxy)
+		mulXorInto(p, pxy, gy)
+		mulInto(p, gfInv(gx^gy))
+	default:
+		return xerrors.Errorf("stripe at %d: %w", off, ErrDegraded)
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+// Package md reads the superblocks of Linux software RAID (md) members and
+// reassembles RAID0, RAID1, RAID4, RAID5 and RAID6 arrays into a single
+// io.ReaderAt. RAID4/5/6 arrays missing as many members as their parity
+// allows are read by reconstructing the missing data on the fly.
+//
+// Filesystems inside an array, or LVM physical volumes, can be read straight
+// from Array.Open.
+package md
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/asalih/go-ext/internal/uuid"
+	"golang.org/x/xerrors"
+)
+
+// RAID levels, as stored in superblocks.
+const (
+	LevelRAID0 = 0
+	LevelRAID1 = 1
+	LevelRAID4 = 4
+	LevelRAID5 = 5
+	LevelRAID6 = 6
+)
+
+// RoleSpare is the Role of members which hold no data of the array: spares
+// and faulty devices.
+const RoleSpare = -1
+
+const (
+	magic = 0xa92b4efc
+
+	// sb090Size and sb090Reserved describe the 0.90 superblock, which lives
+	// in the last 64k aligned 64k block of the device.
+	sb090Size     = 4096
+	sb090Reserved = 64 << 10
+
+	// sb1Size is the most a 1.x superblock occupies, including the table of
+	// device roles.
+	sb1Size   = 4096
+	sb1MaxDev = (sb1Size - 256) / 2
+
+	// 1.x feature bits.
+	featureRecoveryOffset = 0x2
+	featureReshapeActive  = 0x4
+
+	// 0.90 disk state bits.
+	diskFaulty = 0
+	diskActive = 1
+	diskSync   = 2
+)
+
+// ErrNoSuperblock is returned by ReadMember for devices without an md
+// superblock.
+var ErrNoSuperblock = errors.New("md: no superblock")
+
+// Member is a device of an md array, described by its superblock.
+type Member struct {
+	// Version is the superblock format: "0.90", "1.0", "1.1" or "1.2".
+	Version string
+
+	// UUID identifies the array, formatted as mdadm does.
+	UUID string
+
+	// Name is the array name of 1.x superblocks.
+	Name string
+
+	Level  int
+	Layout int
+
+	// ChunkSize is the size of a chunk in bytes.
+	ChunkSize uint64
+
+	// RaidDisks is the number of members holding data or parity.
+	RaidDisks int
+
+	// Role is the slot of the member in the array, or RoleSpare.
+	Role int
+
+	// Events counts superblock updates. Members with fewer events than the
+	// others are stale.
+	Events uint64
+
+	// DataOffset is the offset of the array data on the device, and DataSize
+	// the number of bytes of it the array uses.
+	DataOffset uint64
+	DataSize   uint64
+
+	dev io.ReaderAt
+}
+
+// ReadMember reads the md superblock of dev, which is size bytes long. The
+// 1.1, 1.2 and 1.0 locations are tried before the 0.90 one.
+func ReadMember(dev io.ReaderAt, size int64) (*Member, error) {
+	type location struct {
+		version string
+		offset  int64
+	}
+	locations := []location{{"1.1", 0}, {"1.2", 4096}}
+	if sectors := size / 512; sectors >= 16 {
+		locations = append(locations, location{"1.0", (sectors - 16) &^ 7 * 512})
+	}
+
+	for _, loc := range locations {
+		m, err := readSuperblock1(dev, loc.offset)
+		if errors.Is(err, ErrNoSuperblock) {
+			continue
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("md: %s superblock: %w", loc.version, err)
+		}
+		m.Version = loc.version
+		m.dev = dev
+		return m, nil
+	}
+
+	if size >= sb090Reserved {
+		m, err := readSuperblock090(dev, size&^(sb090Reserved-1)-sb090Reserved)
+		if err != nil && !errors.Is(err, ErrNoSuperblock) {
+			err = xerrors.Errorf("md: 0.90 superblock: %w", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.dev = dev
+		return m, nil
+	}
+	return nil, ErrNoSuperblock
+}
+
+// readSuperblock1 parses the 1.x superblock at offset.
+func readSuperblock1(dev io.ReaderAt, offset int64) (*Member, error) {
+	sb := make([]byte, sb1Size)
+	n, err := dev.ReadAt(sb, offset)
+	if n < 256 {
+		if err == nil || err == io.EOF {
+			return nil, ErrNoSuperblock
+		}
+		return nil, err
+	}
+	sb = sb[:n]
+	le := binary.LittleEndian
+	if le.Uint32(sb) != magic || le.Uint32(sb[4:]) != 1 {
+		return nil, ErrNoSuperblock
+	}
+	if le.Uint64(sb[144:]) != uint64(offset)/512 {
+		return nil, xerrors.Errorf("superblock at sector %d records itself at %d", offset/512, le.Uint64(sb[144:]))
+	}
+
+	maxDev := int(le.Uint32(sb[220:]))
+	if maxDev > sb1MaxDev || 256+2*maxDev > len(sb) {
+		return nil, xerrors.Errorf("invalid max_dev %d", maxDev)
+	}
+	csumLen := 256 + 2*maxDev
+	if want, got := le.Uint32(sb[216:]), checksum1(sb[:csumLen]); want != got {
+		return nil, xerrors.Errorf("checksum mismatch: stored %#x, computed %#x", want, got)
+	}
+
+	features := le.Uint32(sb[8:])
+	if features&featureReshapeActive != 0 {
+		return nil, errors.New("arrays being reshaped are not supported")
+	}
+	m := &Member{
+		UUID:       uuid.Group(hex.EncodeToString(sb[16:32]), ":", 8, 8, 8, 8),
+		Name:       string(bytes.TrimRight(sb[32:64], "\x00")),
+		Level:      int(int32(le.Uint32(sb[72:]))),
+		Layout:     int(le.Uint32(sb[76:])),
+		ChunkSize:  uint64(le.Uint32(sb[88:])) * 512,
+		RaidDisks:  int(le.Uint32(sb[92:])),
+		Events:     le.Uint64(sb[200:]),
+		DataOffset: le.Uint64(sb[128:]) * 512,
+		DataSize:   le.Uint64(sb[80:]) * 512,
+		Role:       RoleSpare,
+	}
+	// The used size is not recorded for RAID0 members, which use all the
+	// space available.
+	if m.DataSize == 0 {
+		m.DataSize = le.Uint64(sb[136:]) * 512
+	}
+	if devNumber := int(le.Uint32(sb[160:])); devNumber < maxDev {
+		// Roles from 0xff00 up mark spare, faulty and journal devices.
+		if role := le.Uint16(sb[256+2*devNumber:]); role < 0xff00 {
+			m.Role = int(role)
+		}
+	}
+	// A member still being rebuilt only holds valid data up to its recovery
+	// offset, so it cannot be relied on.
+	if features&featureRecoveryOffset != 0 {
+		m.Role = RoleSpare
+	}
+	return m, nil
+}
+
+// checksum1 computes the checksum of a 1.x superblock, ignoring the stored
+// checksum.
+func checksum1(sb []byte) uint32 {
+	var sum uint64
+	for i := 0; i+4 <= len(sb); i += 4 {
+		if i == 216 {
+			continue
+		}
+		sum += uint64(binary.LittleEndian.Uint32(sb[i:]))
+	}
+	if len(sb)%4 == 2 {
+		sum += uint64(binary.LittleEndian.Uint16(sb[len(sb)-2:]))
+	}
+	return uint32(sum&0xffffffff + sum>>32)
+}
+
+// readSuperblock090 parses the 0.90 superblock at offset. It is stored in the
+// byte order of the machine which wrote it, so both are accepted.
+func readSuperblock090(dev io.ReaderAt, offset int64) (*Member, error) {
+	sb := make([]byte, sb090Size)
+	if _, err := dev.ReadAt(sb, offset); err != nil {
+		if err == io.EOF {
+			return nil, ErrNoSuperblock
+		}
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(sb) == magic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(sb) == magic:
+		order = binary.BigEndian
+	default:
+		return nil, ErrNoSuperblock
+	}
+	word := func(i int) uint32 {
+		return order.Uint32(sb[4*i:])
+	}
+	if word(1) != 0 || word(2) != 90 {
+		return nil, xerrors.Errorf("unsupported version %d.%d", word(1), word(2))
+	}
+	if want, got := word(38), checksum090(sb, order); want != got {
+		return nil, xerrors.Errorf("checksum mismatch: stored %#x, computed %#x", want, got)
+	}
+
+	// The events counter is split in two words, low word first on little
+	// endian machines.
+	events := uint64(word(40))<<32 | uint64(word(39))
+	if order == binary.BigEndian {
+		events = uint64(word(39))<<32 | uint64(word(40))
+	}
+	m := &Member{
+		Version:   "0.90",
+		UUID:      fmt.Sprintf("%08x:%08x:%08x:%08x", word(5), word(13), word(14), word(15)),
+		Level:     int(int32(word(7))),
+		Layout:    int(word(64)),
+		ChunkSize: uint64(word(65)),
+		RaidDisks: int(word(10)),
+		Events:    events,
+		DataSize:  uint64(word(8)) * 1024,
+		Role:      RoleSpare,
+	}
+	if m.DataSize == 0 {
+		m.DataSize = uint64(offset)
+	}
+	// this_disk is the last disk descriptor: number, major, minor, raid_disk
+	// and state.
+	const thisDisk = 992
+	state := word(thisDisk + 4)
+	if state&(1<<diskFaulty) == 0 && state&(1<<diskActive) != 0 && state&(1<<diskSync) != 0 {
+		m.Role = int(word(thisDisk + 3))
+	}
+	return m, nil
+}
+
+// checksum090 computes the checksum of a 0.90 superblock, ignoring the stored
+// checksum.
+func checksum090(sb []byte, order binary.ByteOrder) uint32 {
+	var sum uint64
+	for i := 0; i < sb090Size/4; i++ {
+		if i == 38 {
+			continue
+		}
+		sum += uint64(order.Uint32(sb[4*i:]))
+	}
+	return uint32(sum&0xffffffff + sum>>32)
+}
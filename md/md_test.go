@@ -0,0 +1,418 @@
+package md
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"testing"
+
+	ext "github.com/asalih/go-ext"
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+var testUUID = [16]byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+// testSuperblock holds the fields written to test superblocks.
+type testSuperblock struct {
+	level, layout, raidDisks, role int
+	chunk                          uint64
+	events                         uint64
+	// size is the number of bytes of array data on the member.
+	size uint64
+}
+
+// dataOffset is where put1 places the array data of 1.1 and 1.2 members.
+const dataOffset = 8192
+
+// put1 writes a 1.x superblock at offset and returns dev.
+func put1(dev []byte, offset int64, sb testSuperblock) []byte {
+	const maxDev = 16
+	b := dev[offset : offset+256+2*maxDev]
+	le := binary.LittleEndian
+	le.PutUint32(b, magic)
+	le.PutUint32(b[4:], 1)
+	copy(b[16:], testUUID[:])
+	copy(b[32:], "host:test")
+	le.PutUint32(b[72:], uint32(int32(sb.level)))
+	le.PutUint32(b[76:], uint32(sb.layout))
+	le.PutUint64(b[80:], sb.size/512)
+	le.PutUint32(b[88:], uint32(sb.chunk/512))
+	le.PutUint32(b[92:], uint32(sb.raidDisks))
+	if offset != 0 && offset != 4096 {
+		// 1.0: the data comes first.
+		le.PutUint64(b[128:], 0)
+	} else {
+		le.PutUint64(b[128:], dataOffset/512)
+	}
+	le.PutUint64(b[144:], uint64(offset/512))
+	le.PutUint32(b[160:], 3)
+	le.PutUint64(b[200:], sb.events)
+	le.PutUint32(b[220:], maxDev)
+	for i := 0; i < maxDev; i++ {
+		le.PutUint16(b[256+2*i:], 0xffff)
+	}
+	if sb.role != RoleSpare {
+		le.PutUint16(b[256+2*3:], uint16(sb.role))
+	}
+	le.PutUint32(b[216:], checksum1(b))
+	return dev
+}
+
+// put090 writes a 0.90 superblock in the given byte order at the end of dev.
+func put090(dev []byte, order binary.ByteOrder, sb testSuperblock) []byte {
+	offset := int64(len(dev))&^(sb090Reserved-1) - sb090Reserved
+	b := dev[offset : offset+sb090Size]
+	put := func(i int, v uint32) { order.PutUint32(b[4*i:], v) }
+	put(0, magic)
+	put(2, 90)
+	put(5, 0x11111111)
+	put(7, uint32(int32(sb.level)))
+	put(8, uint32(sb.size/1024))
+	put(10, uint32(sb.raidDisks))
+	put(13, 0x22222222)
+	put(14, 0x33333333)
+	put(15, 0x44444444)
+	if order == binary.LittleEndian {
+		put(39, uint32(sb.events))
+	} else {
+		put(40, uint32(sb.events))
+	}
+	put(64, uint32(sb.layout))
+	put(65, uint32(sb.chunk))
+	if sb.role != RoleSpare {
+		put(992+3, uint32(sb.role))
+		put(992+4, 1<<diskActive|1<<diskSync)
+	}
+	put(38, checksum090(b, order))
+	return dev
+}
+
+// encode lays data out on the members of an array the way md does, computing
+// the parity of RAID4/5/6 stripes.
+func encode(a *Array, data []byte) [][]byte {
+	chunk := int(a.ChunkSize)
+	dataDisks := a.dataDisks()
+	memberSize := len(data) / dataDisks
+	members := make([][]byte, a.RaidDisks)
+	for i := range members {
+		members[i] = make([]byte, memberSize)
+	}
+
+	switch a.Level {
+	case LevelRAID1:
+		for _, m := range members {
+			copy(m, data)
+		}
+	case LevelRAID0:
+		for c := 0; c*chunk < len(data); c++ {
+			copy(members[c%a.RaidDisks][c/a.RaidDisks*chunk:], data[c*chunk:(c+1)*chunk])
+		}
+	default:
+		for s := 0; s*chunk < memberSize; s++ {
+			g := a.geometry(int64(s))
+			off := s * chunk
+			for dd, disk := range g.data {
+				src := data[(s*dataDisks+dd)*chunk:][:chunk]
+				copy(members[disk][off:], src)
+				xorInto(members[g.p][off:off+chunk], src)
+				if g.q >= 0 {
+					mulXorInto(members[g.q][off:off+chunk], src, gfPow(g.slot(disk, a.RaidDisks)))
+				}
+			}
+		}
+	}
+	return members
+}
+
+// newTestArray returns the members of an array of n members holding random
+// data, with 1.2 superblocks.
+func newTestArray(level, layout, n int, chunk uint64) (devs [][]byte, data []byte) {
+	a := &Array{Level: level, Layout: layout, RaidDisks: n, ChunkSize: chunk}
+	a.checkGeometry()
+	data = make([]byte, 6*int(chunk)*a.dataDisks())
+	rand.New(rand.NewSource(int64(level*100 + layout*10 + n))).Read(data)
+	for role, m := range encode(a, data) {
+		dev := make([]byte, dataOffset+len(m))
+		copy(dev[dataOffset:], m)
+		devs = append(devs, put1(dev, 4096, testSuperblock{
+			level: level, layout: layout, raidDisks: n, role: role,
+			chunk: chunk, events: 10, size: uint64(len(m)),
+		}))
+	}
+	return devs, data
+}
+
+func readMembers(t *testing.T, devs [][]byte) []*Member {
+	t.Helper()
+	var members []*Member
+	for _, dev := range devs {
+		if dev == nil {
+			continue
+		}
+		m, err := ReadMember(bytes.NewReader(dev), int64(len(dev)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, m)
+	}
+	return members
+}
+
+func TestGeometry(t *testing.T) {
+	type stripe struct {
+		p, q int
+		data []int
+	}
+	for _, tc := range []struct {
+		level, layout, n int
+		stripes          []stripe
+	}{
+		{LevelRAID5, LayoutLeftAsymmetric, 3, []stripe{{2, -1, []int{0, 1}}, {1, -1, []int{0, 2}}, {0, -1, []int{1, 2}}}},
+		{LevelRAID5, LayoutRightAsymmetric, 3, []stripe{{0, -1, []int{1, 2}}, {1, -1, []int{0, 2}}, {2, -1, []int{0, 1}}}},
+		{LevelRAID5, LayoutLeftSymmetric, 3, []stripe{{2, -1, []int{0, 1}}, {1, -1, []int{2, 0}}, {0, -1, []int{1, 2}}}},
+		{LevelRAID5, LayoutRightSymmetric, 3, []stripe{{0, -1, []int{1, 2}}, {1, -1, []int{2, 0}}, {2, -1, []int{0, 1}}}},
+		{LevelRAID4, 0, 3, []stripe{{2, -1, []int{0, 1}}, {2, -1, []int{0, 1}}}},
+		{LevelRAID6, LayoutLeftSymmetric, 4, []stripe{{3, 0, []int{1, 2}}, {2, 3, []int{0, 1}}, {1, 2, []int{3, 0}}, {0, 1, []int{2, 3}}}},
+		{LevelRAID6, LayoutLeftSymmetric6, 4, []stripe{{2, 3, []int{0, 1}}, {1, 3, []int{2, 0}}, {0, 3, []int{1, 2}}}},
+	} {
+		a := &Array{Level: tc.level, Layout: tc.layout, RaidDisks: tc.n, ChunkSize: 512}
+		if err := a.checkGeometry(); err != nil {
+			t.Fatal(err)
+		}
+		for s, want := range tc.stripes {
+			g := a.geometry(int64(s))
+			if g.p != want.p || g.q != want.q || len(g.data) != len(want.data) {
+				t.Errorf("RAID%d layout %d stripe %d: got %+v, want %+v", tc.level, tc.layout, s, g, want)
+				continue
+			}
+			for i := range g.data {
+				if g.data[i] != want.data[i] {
+					t.Errorf("RAID%d layout %d stripe %d: got %+v, want %+v", tc.level, tc.layout, s, g, want)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestSyndrome(t *testing.T) {
+	// On a 4 member left-symmetric RAID6, stripe 0 has Q on member 0 and
+	// data on members 1 and 2, so Q = D0 + 2*D1.
+	a := &Array{Level: LevelRAID6, Layout: LayoutLeftSymmetric, RaidDisks: 4, ChunkSize: 512}
+	data := make([]byte, 2*512)
+	data[0], data[512] = 0x01, 0x80
+	members := encode(a, data)
+	if members[0][0] != 0x1c {
+		t.Errorf("Q = %#x, want 0x1c", members[0][0])
+	}
+	if members[3][0] != 0x81 {
+		t.Errorf("P = %#x, want 0x81", members[3][0])
+	}
+}
+
+// without returns devs with the members in slots removed.
+func without(devs [][]byte, slots ...int) [][]byte {
+	out := append([][]byte(nil), devs...)
+	for _, s := range slots {
+		out[s] = nil
+	}
+	return out
+}
+
+func checkArray(t *testing.T, name string, devs [][]byte, data []byte) {
+	t.Helper()
+	a, err := Assemble(readMembers(t, devs)...)
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	r := a.Open()
+	if r.Size() != int64(len(data)) {
+		t.Errorf("%s: size %d, want %d", name, r.Size(), len(data))
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("%s: read %d bytes with %v, mismatch", name, len(got), err)
+	}
+	// An unaligned read spanning several chunks.
+	buf := make([]byte, 3*int(a.ChunkSize)+100)
+	if a.Level == LevelRAID1 {
+		buf = buf[:100]
+	}
+	off := int64(a.ChunkSize/2) + 3
+	if _, err := r.ReadAt(buf, off); err != nil || !bytes.Equal(buf, data[off:off+int64(len(buf))]) {
+		t.Errorf("%s: ReadAt(%d) mismatch, %v", name, off, err)
+	}
+}
+
+func TestArrayLevels(t *testing.T) {
+	type config struct {
+		level, layout, n int
+	}
+	configs := []config{
+		{LevelRAID0, 0, 3},
+		{LevelRAID1, 0, 3},
+		{LevelRAID4, 0, 4},
+	}
+	for layout := LayoutLeftAsymmetric; layout <= LayoutParityLast; layout++ {
+		configs = append(configs, config{LevelRAID5, layout, 4}, config{LevelRAID6, layout, 5})
+	}
+	for _, layout := range []int{
+		LayoutRotatingZeroRestart, LayoutRotatingNRestart, LayoutRotatingNContinue,
+		LayoutLeftAsymmetric6, LayoutRightAsymmetric6, LayoutLeftSymmetric6, LayoutRightSymmetric6, LayoutParityFirst6,
+	} {
+		configs = append(configs, config{LevelRAID6, layout, 5})
+	}
+
+	for _, c := range configs {
+		devs, data := newTestArray(c.level, c.layout, c.n, 1024)
+		name := func(missing ...int) string {
+			return fmt.Sprintf("RAID%d layout %d missing %v", c.level, c.layout, missing)
+		}
+		checkArray(t, name(), devs, data)
+
+		// Remove every combination of members the array can do without.
+		a := &Array{Level: c.level, RaidDisks: c.n}
+		switch a.redundancy() {
+		case 0:
+		case 1:
+			for i := 0; i < c.n; i++ {
+				checkArray(t, name(i), without(devs, i), data)
+			}
+		default:
+			for i := 0; i < c.n; i++ {
+				for j := i + 1; j < c.n; j++ {
+					checkArray(t, name(i, j), without(devs, i, j), data)
+				}
+			}
+		}
+
+		if a.redundancy()+1 < c.n {
+			missing := make([]int, a.redundancy()+1)
+			for i := range missing {
+				missing[i] = i
+			}
+			if _, err := Assemble(readMembers(t, without(devs, missing...))...); !errors.Is(err, ErrDegraded) {
+				t.Errorf("%s: Assemble returned %v, want %v", name(missing...), err, ErrDegraded)
+			}
+		}
+	}
+}
+
+func TestReadMemberVersions(t *testing.T) {
+	const size = 256 << 10
+	sb := testSuperblock{level: LevelRAID1, raidDisks: 2, role: 1, events: 42, size: 64 << 10}
+	for _, tc := range []struct {
+		version string
+		dev     []byte
+		uuid    string
+		offset  uint64
+	}{
+		{"1.1", put1(make([]byte, size), 0, sb), "deadbeef:01020304:05060708:090a0b0c", dataOffset},
+		{"1.2", put1(make([]byte, size), 4096, sb), "deadbeef:01020304:05060708:090a0b0c", dataOffset},
+		{"1.0", put1(make([]byte, size), size-8192, sb), "deadbeef:01020304:05060708:090a0b0c", 0},
+		{"0.90", put090(make([]byte, size), binary.LittleEndian, sb), "11111111:22222222:33333333:44444444", 0},
+		{"0.90", put090(make([]byte, size), binary.BigEndian, sb), "11111111:22222222:33333333:44444444", 0},
+	} {
+		m, err := ReadMember(bytes.NewReader(tc.dev), size)
+		if err != nil {
+			t.Errorf("%s: %v", tc.version, err)
+			continue
+		}
+		if m.Version != tc.version || m.UUID != tc.uuid || m.Level != LevelRAID1 || m.RaidDisks != 2 ||
+			m.Role != 1 || m.Events != 42 || m.DataOffset != tc.offset || m.DataSize != 64<<10 {
+			t.Errorf("%s: got %+v", tc.version, m)
+		}
+	}
+
+	spare := sb
+	spare.role = RoleSpare
+	if m, err := ReadMember(bytes.NewReader(put1(make([]byte, size), 4096, spare)), size); err != nil || m.Role != RoleSpare {
+		t.Errorf("spare read as %+v, %v", m, err)
+	}
+
+	dev := put1(make([]byte, size), 4096, sb)
+	dev[4096+80]++
+	if _, err := ReadMember(bytes.NewReader(dev), size); err == nil || errors.Is(err, ErrNoSuperblock) {
+		t.Errorf("damaged superblock read with %v", err)
+	}
+	if _, err := ReadMember(bytes.NewReader(make([]byte, size)), size); !errors.Is(err, ErrNoSuperblock) {
+		t.Errorf("blank device read with %v, want %v", err, ErrNoSuperblock)
+	}
+}
+
+func TestAssembleStaleMember(t *testing.T) {
+	devs, data := newTestArray(LevelRAID5, LayoutLeftSymmetric, 3, 1024)
+	// Member 1 dropped out of the array before the last update, and its data
+	// is out of date.
+	for i := dataOffset; i < len(devs[1]); i++ {
+		devs[1][i] = 0xff
+	}
+	put1(devs[1], 4096, testSuperblock{
+		level: LevelRAID5, layout: LayoutLeftSymmetric, raidDisks: 3, role: 1,
+		chunk: 1024, events: 9, size: uint64(len(devs[1]) - dataOffset),
+	})
+
+	a, err := Assemble(readMembers(t, devs)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing := a.Missing(); len(missing) != 1 || missing[0] != 1 {
+		t.Errorf("Missing() = %v, want [1]", missing)
+	}
+	checkArray(t, "stale member", devs, data)
+
+	other := readMembers(t, devs[:1])[0]
+	other.UUID = "other"
+	if _, err := Assemble(append(readMembers(t, devs[1:]), other)...); err == nil {
+		t.Error("members of different arrays assembled")
+	}
+}
+
+func TestArrayFileSystem(t *testing.T) {
+	b := testimage.New(testimage.Ext4())
+	b.File("a.txt", []byte("on raid"))
+	img := b.MustBuild()
+
+	// A degraded RAID5 array of three members with 64k chunks.
+	const chunk = 64 << 10
+	stripe := 2 * chunk
+	data := make([]byte, (len(img)+stripe-1)/stripe*stripe)
+	copy(data, img)
+	a := &Array{Level: LevelRAID5, Layout: LayoutLeftSymmetric, RaidDisks: 3, ChunkSize: chunk}
+	var devs []io.ReaderAt
+	for role, m := range encode(a, data) {
+		if role == 0 {
+			continue
+		}
+		dev := put1(append(make([]byte, dataOffset), m...), 4096, testSuperblock{
+			level: LevelRAID5, layout: LayoutLeftSymmetric, raidDisks: 3, role: role,
+			chunk: chunk, events: 1, size: uint64(len(m)),
+		})
+		devs = append(devs, bytes.NewReader(dev))
+	}
+
+	var members []*Member
+	for _, dev := range devs {
+		m, err := ReadMember(dev, int64(dev.(*bytes.Reader).Size()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, m)
+	}
+	array, err := Assemble(members...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := ext.NewFS(array.Open())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile(fsys, "a.txt"); err != nil || string(data) != "on raid" {
+		t.Errorf("ReadFile returned %q, %v", data, err)
+	}
+}
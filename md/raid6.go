@@ -0,0 +1,70 @@
+package md
+
+// RAID6 computes its Q syndrome over GF(2^8) with the polynomial
+// x^8 + x^4 + x^3 + x^2 + 1 and generator 2: Q = sum of g^i * D_i, where i
+// is the syndrome slot of the data block.
+
+var (
+	gfExp [512]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+// gfMul multiplies a and b.
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+// gfPow returns g^n.
+func gfPow(n int) byte {
+	return gfExp[n%255]
+}
+
+// gfInv returns the multiplicative inverse of a, which must not be zero.
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// xorInto sets dst to dst ^ src.
+func xorInto(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// mulXorInto sets dst to dst ^ c*src.
+func mulXorInto(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	lc := gfLog[c]
+	for i, s := range src {
+		if s != 0 {
+			dst[i] ^= gfExp[gfLog[s]+lc]
+		}
+	}
+}
+
+// mulInto sets dst to c*dst.
+func mulInto(dst []byte, c byte) {
+	for i, d := range dst {
+		dst[i] = gfMul(d, c)
+	}
+}
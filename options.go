@@ -0,0 +1,96 @@
+package ext
+
+// Option configures a FileSystem created by NewFS.
+type Option func(*options)
+
+// options holds the settings collected from Option values.
+type options struct {
+	inodeCacheSize int
+
+	// blockCache overrides the cache built from blockCacheSize if set.
+	blockCache        BlockCache
+	blockCacheSize    int64
+	metadataReadahead int
+
+	encryptionKeys []encryptionKey
+}
+
+// encryptionKey is an fscrypt master key. descriptor overrides the v1 key
+// descriptor computed from the key.
+type encryptionKey struct {
+	descriptor *[8]byte
+	key        []byte
+}
+
+func defaultOptions() options {
+	return options{
+		inodeCacheSize:    DefaultInodeCacheSize,
+		blockCacheSize:    DefaultBlockCacheSize,
+		metadataReadahead: DefaultMetadataReadahead,
+	}
+}
+
+// newBlockCache returns the block cache selected by the options, or nil if
+// block caching is disabled.
+func (o *options) newBlockCache() BlockCache {
+	if o.blockCache != nil {
+		return o.blockCache
+	}
+	if o.blockCacheSize <= 0 {
+		return nil
+	}
+	return NewLRUBlockCache(o.blockCacheSize)
+}
+
+// WithInodeCacheSize sets the number of parsed inodes kept in memory. A size
+// of zero or less disables the inode cache.
+func WithInodeCacheSize(size int) Option {
+	return func(o *options) {
+		o.inodeCacheSize = size
+	}
+}
+
+// WithBlockCacheSize sets the memory limit, in bytes, of the LRU cache holding
+// metadata blocks. A size of zero or less disables the block cache and
+// metadata readahead.
+func WithBlockCacheSize(size int64) Option {
+	return func(o *options) {
+		o.blockCacheSize = size
+	}
+}
+
+// WithBlockCache makes the FileSystem cache metadata blocks in c instead of
+// the default LRU cache.
+func WithBlockCache(c BlockCache) Option {
+	return func(o *options) {
+		o.blockCache = c
+	}
+}
+
+// WithMetadataReadahead sets the number of blocks read from the device at once
+// when a metadata block is not cached. Values below 2 disable readahead.
+func WithMetadataReadahead(blocks int) Option {
+	return func(o *options) {
+		o.metadataReadahead = blocks
+	}
+}
+
+// WithEncryptionKey adds an fscrypt master key for reading encrypted
+// directories and files. It is used for v2 policies by its key identifier and
+// for v1 policies by the descriptor fscrypt and e4crypt give it. The option
+// may be repeated; files whose key is missing list under their no-key names
+// and fail to read with ErrNoKey.
+func WithEncryptionKey(key []byte) Option {
+	return func(o *options) {
+		o.encryptionKeys = append(o.encryptionKeys, encryptionKey{key: key})
+	}
+}
+
+// WithEncryptionKeyDescriptor adds a v1 fscrypt master key under an explicit
+// key descriptor, as used by Android and other tools which do not derive the
+// descriptor from the key.
+func WithEncryptionKeyDescriptor(descriptor [8]byte, key []byte) Option {
+	return func(o *options) {
+		o.encryptionKeys = append(o.encryptionKeys, encryptionKey{descriptor: &descriptor, key: key})
+	}
+}
@@ -0,0 +1,251 @@
+package partition
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	gptSignature     = "EFI PART"
+	gptHeaderMinSize = 92
+	gptEntryMinSize  = 128
+
+	// maxGPTEntriesSize bounds the partition entry array. The usual array
+	// is 16 KiB.
+	maxGPTEntriesSize = 1 << 20
+)
+
+// gptSectorSizes are the logical sector sizes GPT detection tries.
+var gptSectorSizes = []int{DefaultSectorSize, 4096}
+
+// GUID is a GPT GUID, stored in its mixed-endian on-disk form.
+type GUID [16]byte
+
+// Well-known GPT partition type GUIDs.
+var (
+	LinuxFilesystemGUID = MustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	LinuxLVMGUID        = MustParseGUID("E6D6D379-F507-44C2-A23C-238F2A3DF928")
+	LinuxRAIDGUID       = MustParseGUID("A19D880F-05FC-4D3B-A006-743F0F84911E")
+	EFISystemGUID       = MustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+)
+
+// ParseGUID parses a GUID in its canonical textual form.
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	var raw [16]byte
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return g, xerrors.Errorf("partition: invalid GUID %q", s)
+	}
+	digits := s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	if _, err := hex.Decode(raw[:], []byte(digits)); err != nil {
+		return g, xerrors.Errorf("partition: invalid GUID %q: %w", s, err)
+	}
+	// The first three groups are little-endian on disk.
+	g[0], g[1], g[2], g[3] = raw[3], raw[2], raw[1], raw[0]
+	g[4], g[5] = raw[5], raw[4]
+	g[6], g[7] = raw[7], raw[6]
+	copy(g[8:], raw[8:])
+	return g, nil
+}
+
+// MustParseGUID is ParseGUID panicking on invalid input.
+func MustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// String implements fmt.Stringer.String.
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10], g[10:16])
+}
+
+// IsZero reports whether g is the nil GUID, which marks unused GPT entries.
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// gptHeader is a decoded GPT header.
+type gptHeader struct {
+	myLBA        uint64
+	alternateLBA uint64
+	diskGUID     GUID
+	entriesLBA   uint64
+	numEntries   uint32
+	entrySize    uint32
+	entriesCRC   uint32
+}
+
+// readGPT reads the GPT of disk, using the backup header and entries when the
+// primary ones are damaged.
+func readGPT(disk io.ReaderAt, size int64) (*Table, error) {
+	for _, ss := range gptSectorSizes {
+		t, err := readGPTSectorSize(disk, size, ss)
+		if err == ErrNoPartitionTable {
+			continue
+		}
+		return t, err
+	}
+	return nil, ErrNoPartitionTable
+}
+
+// readGPTSectorSize reads the GPT of disk assuming logical sectors of ss
+// bytes. It returns ErrNoPartitionTable if neither header carries the GPT
+// signature.
+func readGPTSectorSize(disk io.ReaderAt, size int64, ss int) (*Table, error) {
+	sectors := uint64(size) / uint64(ss)
+	if sectors < 3 {
+		return nil, ErrNoPartitionTable
+	}
+
+	primary, primaryErr := readGPTHeader(disk, ss, 1)
+	if primaryErr == nil {
+		parts, err := readGPTEntries(disk, size, ss, primary)
+		if err == nil {
+			return newGPTTable(ss, primary, parts, false), nil
+		}
+		primaryErr = err
+	}
+
+	// The backup header is normally in the last sector. A damaged primary
+	// header whose signature survived may still point at it.
+	backupLBA := sectors - 1
+	backup, backupErr := readGPTHeader(disk, ss, backupLBA)
+	if backupErr == ErrNoPartitionTable && primary != nil && primary.alternateLBA != backupLBA && primary.alternateLBA < sectors {
+		backup, backupErr = readGPTHeader(disk, ss, primary.alternateLBA)
+	}
+	if backupErr == nil {
+		parts, err := readGPTEntries(disk, size, ss, backup)
+		if err == nil {
+			return newGPTTable(ss, backup, parts, true), nil
+		}
+		backupErr = err
+	}
+
+	if primaryErr == ErrNoPartitionTable && backupErr == ErrNoPartitionTable {
+		return nil, ErrNoPartitionTable
+	}
+	if primaryErr == ErrNoPartitionTable {
+		return nil, backupErr
+	}
+	return nil, xerrors.Errorf("partition: primary GPT: %v, backup GPT: %w", primaryErr, backupErr)
+}
+
+func newGPTTable(ss int, h *gptHeader, parts []Partition, backup bool) *Table {
+	return &Table{
+		Scheme:     SchemeGPT,
+		SectorSize: ss,
+		DiskGUID:   h.diskGUID,
+		Backup:     backup,
+		Partitions: parts,
+	}
+}
+
+// readGPTHeader reads and verifies the GPT header at sector lba. The header is
+// returned along with the error if only its checksum is wrong, so that its
+// pointer to the other header can still be used.
+func readGPTHeader(disk io.ReaderAt, ss int, lba uint64) (*gptHeader, error) {
+	sector, err := readAt(disk, int64(lba)*int64(ss), ss)
+	if err != nil {
+		return nil, xerrors.Errorf("partition: failed to read GPT header at sector %d: %w", lba, err)
+	}
+	if string(sector[:8]) != gptSignature {
+		return nil, ErrNoPartitionTable
+	}
+
+	h := &gptHeader{
+		myLBA:        binary.LittleEndian.Uint64(sector[24:]),
+		alternateLBA: binary.LittleEndian.Uint64(sector[32:]),
+		entriesLBA:   binary.LittleEndian.Uint64(sector[72:]),
+		numEntries:   binary.LittleEndian.Uint32(sector[80:]),
+		entrySize:    binary.LittleEndian.Uint32(sector[84:]),
+		entriesCRC:   binary.LittleEndian.Uint32(sector[88:]),
+	}
+	copy(h.diskGUID[:], sector[56:72])
+
+	hdrSize := binary.LittleEndian.Uint32(sector[12:])
+	if hdrSize < gptHeaderMinSize || hdrSize > uint32(ss) {
+		return h, xerrors.Errorf("partition: GPT header at sector %d has size %d", lba, hdrSize)
+	}
+	want := binary.LittleEndian.Uint32(sector[16:])
+	hdr := append([]byte(nil), sector[:hdrSize]...)
+	binary.LittleEndian.PutUint32(hdr[16:], 0)
+	if got := crc32.ChecksumIEEE(hdr); got != want {
+		return h, xerrors.Errorf("partition: GPT header at sector %d has checksum %#x, want %#x", lba, got, want)
+	}
+	if h.myLBA != lba {
+		return h, xerrors.Errorf("partition: GPT header at sector %d claims to be at sector %d", lba, h.myLBA)
+	}
+	if h.entrySize < gptEntryMinSize || h.entrySize%8 != 0 || uint64(h.numEntries)*uint64(h.entrySize) > maxGPTEntriesSize {
+		return h, xerrors.Errorf("partition: GPT header at sector %d has %d entries of %d bytes", lba, h.numEntries, h.entrySize)
+	}
+	return h, nil
+}
+
+// readGPTEntries reads and verifies the partition entries h points at.
+func readGPTEntries(disk io.ReaderAt, size int64, ss int, h *gptHeader) ([]Partition, error) {
+	off := int64(h.entriesLBA) * int64(ss)
+	length := int(h.numEntries) * int(h.entrySize)
+	if h.entriesLBA > uint64(size)/uint64(ss) || off+int64(length) > size {
+		return nil, xerrors.Errorf("partition: GPT entries at sector %d are past the end of the disk", h.entriesLBA)
+	}
+	raw, err := readAt(disk, off, length)
+	if err != nil {
+		return nil, xerrors.Errorf("partition: failed to read GPT entries: %w", err)
+	}
+	if got := crc32.ChecksumIEEE(raw); got != h.entriesCRC {
+		return nil, xerrors.Errorf("partition: GPT entries have checksum %#x, want %#x", got, h.entriesCRC)
+	}
+
+	var parts []Partition
+	for i := 0; i < int(h.numEntries); i++ {
+		e := raw[i*int(h.entrySize):]
+		var typeGUID GUID
+		copy(typeGUID[:], e[0:16])
+		if typeGUID.IsZero() {
+			continue
+		}
+		first := binary.LittleEndian.Uint64(e[32:])
+		last := binary.LittleEndian.Uint64(e[40:])
+		if last < first {
+			return nil, xerrors.Errorf("partition: GPT entry %d ends at sector %d before it starts at %d", i+1, last, first)
+		}
+
+		p := Partition{
+			Index:      i + 1,
+			Start:      int64(first) * int64(ss),
+			Size:       int64(last-first+1) * int64(ss),
+			TypeGUID:   typeGUID,
+			Attributes: binary.LittleEndian.Uint64(e[48:]),
+			Name:       decodeGPTName(e[56:128]),
+		}
+		copy(p.GUID[:], e[16:32])
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+// decodeGPTName decodes a NUL-terminated UTF-16LE partition name.
+func decodeGPTName(raw []byte) string {
+	units := make([]uint16, 0, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		u := binary.LittleEndian.Uint16(raw[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,167 @@
+package partition
+
+import (
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	mbrEntriesOffset = 446
+	mbrEntrySize     = 16
+	mbrEntries       = 4
+	mbrSignature     = 0xaa55
+
+	// maxLogicalPartitions bounds the extended partition chain, which a
+	// corrupted or malicious EBR could make loop.
+	maxLogicalPartitions = 128
+)
+
+// MBR partition types with a meaning to Read.
+const (
+	TypeEmpty         = 0x00
+	TypeExtendedCHS   = 0x05
+	TypeExtendedLBA   = 0x0f
+	TypeLinux         = 0x83
+	TypeLinuxExtended = 0x85
+	TypeLinuxLVM      = 0x8e
+	TypeGPTProtective = 0xee
+	TypeLinuxRAID     = 0xfd
+)
+
+// mbrEntry is a partition entry of an MBR or EBR.
+type mbrEntry struct {
+	status   byte
+	typ      byte
+	firstLBA uint32
+	sectors  uint32
+}
+
+func (e *mbrEntry) isExtended() bool {
+	return e.typ == TypeExtendedCHS || e.typ == TypeExtendedLBA || e.typ == TypeLinuxExtended
+}
+
+// mbr is a decoded master or extended boot record.
+type mbr struct {
+	entries [mbrEntries]mbrEntry
+}
+
+// parseMBR decodes the boot record in sector, which must carry the boot
+// signature.
+func parseMBR(sector []byte) (*mbr, error) {
+	if binary.LittleEndian.Uint16(sector[510:]) != mbrSignature {
+		return nil, ErrNoPartitionTable
+	}
+	m := &mbr{}
+	for i := range m.entries {
+		raw := sector[mbrEntriesOffset+i*mbrEntrySize:]
+		m.entries[i] = mbrEntry{
+			status:   raw[0],
+			typ:      raw[4],
+			firstLBA: binary.LittleEndian.Uint32(raw[8:]),
+			sectors:  binary.LittleEndian.Uint32(raw[12:]),
+		}
+	}
+	return m, nil
+}
+
+func readMBR(disk io.ReaderAt, size int64) (*mbr, error) {
+	if size < DefaultSectorSize {
+		return nil, ErrNoPartitionTable
+	}
+	sector, err := readAt(disk, 0, DefaultSectorSize)
+	if err != nil {
+		return nil, xerrors.Errorf("partition: failed to read MBR: %w", err)
+	}
+	return parseMBR(sector)
+}
+
+// protective reports whether the MBR only stands in front of a GPT.
+func (m *mbr) protective() bool {
+	for _, e := range m.entries {
+		if e.typ == TypeGPTProtective {
+			return true
+		}
+	}
+	return false
+}
+
+// table returns the primary partitions of m followed by the logical
+// partitions of its extended partition.
+func (m *mbr) table(disk io.ReaderAt, size int64) (*Table, error) {
+	t := &Table{Scheme: SchemeMBR, SectorSize: DefaultSectorSize}
+	var extended *mbrEntry
+	for i := range m.entries {
+		e := &m.entries[i]
+		if e.typ == TypeEmpty || e.sectors == 0 {
+			continue
+		}
+		if e.isExtended() {
+			if extended == nil {
+				extended = e
+			}
+			continue
+		}
+		t.Partitions = append(t.Partitions, newMBRPartition(i+1, e, 0))
+	}
+
+	if extended != nil {
+		logical, err := readLogical(disk, size, extended)
+		if err != nil {
+			return nil, err
+		}
+		t.Partitions = append(t.Partitions, logical...)
+	}
+	return t, nil
+}
+
+// readLogical follows the chain of extended boot records starting at the
+// extended partition ext. Each EBR describes one logical partition, relative
+// to the EBR itself, and links to the next EBR, relative to ext.
+func readLogical(disk io.ReaderAt, size int64, ext *mbrEntry) ([]Partition, error) {
+	var parts []Partition
+	extStart := uint64(ext.firstLBA)
+	visited := make(map[uint64]bool)
+	for ebrLBA := extStart; len(parts) < maxLogicalPartitions; {
+		if visited[ebrLBA] {
+			return nil, xerrors.Errorf("partition: extended partition chain loops at sector %d", ebrLBA)
+		}
+		visited[ebrLBA] = true
+
+		off := int64(ebrLBA * DefaultSectorSize)
+		if off+DefaultSectorSize > size {
+			return nil, xerrors.Errorf("partition: EBR at sector %d is past the end of the disk", ebrLBA)
+		}
+		sector, err := readAt(disk, off, DefaultSectorSize)
+		if err != nil {
+			return nil, xerrors.Errorf("partition: failed to read EBR at sector %d: %w", ebrLBA, err)
+		}
+		ebr, err := parseMBR(sector)
+		if err != nil {
+			return nil, xerrors.Errorf("partition: invalid EBR at sector %d: %w", ebrLBA, err)
+		}
+
+		if e := &ebr.entries[0]; e.typ != TypeEmpty && e.sectors != 0 {
+			parts = append(parts, newMBRPartition(mbrEntries+1+len(parts), e, ebrLBA))
+		}
+		next := &ebr.entries[1]
+		if !next.isExtended() || next.sectors == 0 {
+			return parts, nil
+		}
+		ebrLBA = extStart + uint64(next.firstLBA)
+	}
+	return parts, nil
+}
+
+// newMBRPartition returns the partition described by e, whose first sector is
+// relative to sector base.
+func newMBRPartition(index int, e *mbrEntry, base uint64) Partition {
+	return Partition{
+		Index:    index,
+		Start:    int64((base + uint64(e.firstLBA)) * DefaultSectorSize),
+		Size:     int64(e.sectors) * DefaultSectorSize,
+		Type:     e.typ,
+		Bootable: e.status&0x80 != 0,
+	}
+}
@@ -0,0 +1,113 @@
+// Package partition reads the partition tables of whole disk images: MBR,
+// including the logical partitions of extended partitions, and GPT, falling
+// back to the backup GPT when the primary one is damaged.
+package partition
+
+import (
+	"errors"
+	"io"
+)
+
+// DefaultSectorSize is the logical sector size MBR partitions are addressed
+// in, and the first one GPT detection tries.
+const DefaultSectorSize = 512
+
+// ErrNoPartitionTable is returned by Read for disks holding neither an MBR
+// nor a GPT.
+var ErrNoPartitionTable = errors.New("partition: no partition table")
+
+// Scheme is the partitioning scheme of a disk.
+type Scheme int
+
+const (
+	// SchemeMBR is the classic DOS partition table.
+	SchemeMBR Scheme = iota + 1
+
+	// SchemeGPT is the GUID partition table.
+	SchemeGPT
+)
+
+// String implements fmt.Stringer.String.
+func (s Scheme) String() string {
+	switch s {
+	case SchemeMBR:
+		return "mbr"
+	case SchemeGPT:
+		return "gpt"
+	default:
+		return "unknown"
+	}
+}
+
+// Table is the partition table of a disk.
+type Table struct {
+	Scheme Scheme
+
+	// SectorSize is the logical sector size the table is addressed in.
+	SectorSize int
+
+	// DiskGUID identifies a GPT disk.
+	DiskGUID GUID
+
+	// Backup reports that the primary GPT header or entries were damaged and
+	// the backup copy at the end of the disk was used instead.
+	Backup bool
+
+	Partitions []Partition
+}
+
+// Partition is a partition found in a partition table. Start and Size are in
+// bytes; they are not clamped to the size of the disk.
+type Partition struct {
+	// Index is the partition number as Linux counts it: the GPT entry number
+	// starting at 1, 1 to 4 for MBR primary partitions and 5 onwards for MBR
+	// logical partitions.
+	Index int
+
+	Start int64
+	Size  int64
+
+	// Type is the MBR partition type. Bootable is the MBR active flag.
+	Type     byte
+	Bootable bool
+
+	// TypeGUID, GUID, Name and Attributes come from the GPT entry.
+	TypeGUID   GUID
+	GUID       GUID
+	Name       string
+	Attributes uint64
+}
+
+// Open returns a reader over the partition content of disk.
+func (p *Partition) Open(disk io.ReaderAt) *io.SectionReader {
+	return io.NewSectionReader(disk, p.Start, p.Size)
+}
+
+// Read reads the partition table of disk, which is size bytes long. A GPT is
+// preferred over the protective or hybrid MBR in front of it.
+func Read(disk io.ReaderAt, size int64) (*Table, error) {
+	mbr, mbrErr := readMBR(disk, size)
+	if mbrErr == nil && !mbr.protective() {
+		return mbr.table(disk, size)
+	}
+
+	t, err := readGPT(disk, size)
+	if err == nil {
+		return t, nil
+	}
+	// Either there is no partition table at all, or the protective MBR
+	// announces a GPT which is too damaged to read.
+	return nil, err
+}
+
+// readAt reads count bytes at off, failing on short reads.
+func readAt(disk io.ReaderAt, off int64, count int) ([]byte, error) {
+	buf := make([]byte, count)
+	if n, err := disk.ReadAt(buf, off); n < count {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
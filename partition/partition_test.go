@@ -0,0 +1,242 @@
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+	"unicode/utf16"
+)
+
+// putMBREntry writes partition entry i of the boot record in sector.
+func putMBREntry(sector []byte, i int, typ byte, firstLBA, sectors uint32) {
+	raw := sector[mbrEntriesOffset+i*mbrEntrySize:]
+	raw[4] = typ
+	binary.LittleEndian.PutUint32(raw[8:], firstLBA)
+	binary.LittleEndian.PutUint32(raw[12:], sectors)
+	binary.LittleEndian.PutUint16(sector[510:], mbrSignature)
+}
+
+// newMBRDisk returns a disk of the given number of sectors with a primary
+// Linux partition and an extended partition holding two logical ones.
+func newMBRDisk(sectors int) []byte {
+	disk := make([]byte, sectors*DefaultSectorSize)
+	putMBREntry(disk, 0, TypeLinux, 2048, 1024)
+	disk[mbrEntriesOffset] = 0x80
+	putMBREntry(disk, 1, TypeExtendedLBA, 4096, 4096)
+
+	// The first EBR sits at the start of the extended partition, the second
+	// one 2048 sectors in.
+	ebr1 := disk[4096*DefaultSectorSize:]
+	putMBREntry(ebr1, 0, TypeLinuxLVM, 64, 512)
+	putMBREntry(ebr1, 1, TypeExtendedCHS, 2048, 2048)
+	ebr2 := disk[(4096+2048)*DefaultSectorSize:]
+	putMBREntry(ebr2, 0, TypeLinux, 64, 1024)
+	return disk
+}
+
+func TestReadMBR(t *testing.T) {
+	disk := newMBRDisk(8192)
+	table, err := Read(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Scheme != SchemeMBR {
+		t.Errorf("Scheme = %v, want %v", table.Scheme, SchemeMBR)
+	}
+
+	want := []Partition{
+		{Index: 1, Start: 2048 * 512, Size: 1024 * 512, Type: TypeLinux, Bootable: true},
+		{Index: 5, Start: (4096 + 64) * 512, Size: 512 * 512, Type: TypeLinuxLVM},
+		{Index: 6, Start: (4096 + 2048 + 64) * 512, Size: 1024 * 512, Type: TypeLinux},
+	}
+	if len(table.Partitions) != len(want) {
+		t.Fatalf("got %d partitions, want %d: %+v", len(table.Partitions), len(want), table.Partitions)
+	}
+	for i, p := range table.Partitions {
+		if p != want[i] {
+			t.Errorf("partition %d = %+v, want %+v", i, p, want[i])
+		}
+	}
+}
+
+func TestReadMBRLoop(t *testing.T) {
+	disk := newMBRDisk(8192)
+	// Point the second EBR back at the first one.
+	putMBREntry(disk[(4096+2048)*DefaultSectorSize:], 1, TypeExtendedLBA, 0, 2048)
+	if _, err := Read(bytes.NewReader(disk), int64(len(disk))); err == nil {
+		t.Error("looping extended partition chain was accepted")
+	}
+}
+
+func TestReadNoPartitionTable(t *testing.T) {
+	disk := make([]byte, 64*1024)
+	if _, err := Read(bytes.NewReader(disk), int64(len(disk))); !errors.Is(err, ErrNoPartitionTable) {
+		t.Errorf("Read returned %v, want %v", err, ErrNoPartitionTable)
+	}
+}
+
+type gptPart struct {
+	typ         GUID
+	first, last uint64
+	name        string
+}
+
+const gptEntries = 128
+
+// putGPT writes the GPT header at sector lba and the entries at sector
+// entriesLBA.
+func putGPT(disk []byte, ss int, lba, altLBA, entriesLBA uint64, parts []gptPart) {
+	entries := make([]byte, gptEntries*gptEntryMinSize)
+	for i, p := range parts {
+		e := entries[i*gptEntryMinSize:]
+		copy(e[0:16], p.typ[:])
+		e[16] = byte(i + 1)
+		binary.LittleEndian.PutUint64(e[32:], p.first)
+		binary.LittleEndian.PutUint64(e[40:], p.last)
+		for j, u := range utf16.Encode([]rune(p.name)) {
+			binary.LittleEndian.PutUint16(e[56+2*j:], u)
+		}
+	}
+	copy(disk[int(entriesLBA)*ss:], entries)
+
+	sectors := uint64(len(disk) / ss)
+	hdr := disk[int(lba)*ss:]
+	copy(hdr, gptSignature)
+	binary.LittleEndian.PutUint32(hdr[8:], 0x00010000)
+	binary.LittleEndian.PutUint32(hdr[12:], gptHeaderMinSize)
+	binary.LittleEndian.PutUint64(hdr[24:], lba)
+	binary.LittleEndian.PutUint64(hdr[32:], altLBA)
+	binary.LittleEndian.PutUint64(hdr[40:], 34)
+	binary.LittleEndian.PutUint64(hdr[48:], sectors-34)
+	diskGUID := MustParseGUID("01234567-89AB-CDEF-0123-456789ABCDEF")
+	copy(hdr[56:72], diskGUID[:])
+	binary.LittleEndian.PutUint64(hdr[72:], entriesLBA)
+	binary.LittleEndian.PutUint32(hdr[80:], gptEntries)
+	binary.LittleEndian.PutUint32(hdr[84:], gptEntryMinSize)
+	binary.LittleEndian.PutUint32(hdr[88:], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(hdr[16:], crc32.ChecksumIEEE(hdr[:gptHeaderMinSize]))
+}
+
+// newGPTDisk returns a disk with a protective MBR, the primary GPT and the
+// backup GPT.
+func newGPTDisk(ss int, sectors uint64, parts []gptPart) []byte {
+	disk := make([]byte, int(sectors)*ss)
+	putMBREntry(disk, 0, TypeGPTProtective, 1, uint32(sectors-1))
+	entrySectors := uint64(gptEntries * gptEntryMinSize / ss)
+	putGPT(disk, ss, 1, sectors-1, 2, parts)
+	putGPT(disk, ss, sectors-1, 1, sectors-1-entrySectors, parts)
+	return disk
+}
+
+var testGPTParts = []gptPart{
+	{typ: EFISystemGUID, first: 40, last: 99, name: "EFI"},
+	{typ: LinuxFilesystemGUID, first: 100, last: 299, name: "root ✓"},
+}
+
+func checkGPT(t *testing.T, table *Table, ss int) {
+	t.Helper()
+	if table.Scheme != SchemeGPT || table.SectorSize != ss {
+		t.Errorf("got a %v table with %d byte sectors, want gpt with %d", table.Scheme, table.SectorSize, ss)
+	}
+	if got := table.DiskGUID.String(); got != "01234567-89AB-CDEF-0123-456789ABCDEF" {
+		t.Errorf("DiskGUID = %s", got)
+	}
+	if len(table.Partitions) != len(testGPTParts) {
+		t.Fatalf("got %d partitions, want %d", len(table.Partitions), len(testGPTParts))
+	}
+	for i, p := range table.Partitions {
+		want := testGPTParts[i]
+		if p.Index != i+1 || p.TypeGUID != want.typ || p.Name != want.name ||
+			p.Start != int64(want.first)*int64(ss) || p.Size != int64(want.last-want.first+1)*int64(ss) {
+			t.Errorf("partition %d = %+v, want %+v", i, p, want)
+		}
+	}
+}
+
+func TestReadGPT(t *testing.T) {
+	for _, ss := range []int{512, 4096} {
+		disk := newGPTDisk(ss, 400, testGPTParts)
+		table, err := Read(bytes.NewReader(disk), int64(len(disk)))
+		if err != nil {
+			t.Fatalf("%d byte sectors: %v", ss, err)
+		}
+		checkGPT(t, table, ss)
+		if table.Backup {
+			t.Errorf("%d byte sectors: intact primary GPT not used", ss)
+		}
+	}
+}
+
+func TestReadGPTBackup(t *testing.T) {
+	for name, corrupt := range map[string]func(disk []byte){
+		"header checksum": func(disk []byte) { disk[512+40]++ },
+		"header wiped":    func(disk []byte) { zeroBytes(disk[512:1024]) },
+		"entries":         func(disk []byte) { disk[2*512+100]++ },
+	} {
+		disk := newGPTDisk(512, 400, testGPTParts)
+		corrupt(disk)
+		table, err := Read(bytes.NewReader(disk), int64(len(disk)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		checkGPT(t, table, 512)
+		if !table.Backup {
+			t.Errorf("%s: backup GPT not used", name)
+		}
+	}
+
+	// With both copies damaged, the protective MBR leads to an error.
+	disk := newGPTDisk(512, 400, testGPTParts)
+	disk[512+40]++
+	disk[len(disk)-512+40]++
+	if _, err := Read(bytes.NewReader(disk), int64(len(disk))); err == nil || errors.Is(err, ErrNoPartitionTable) {
+		t.Errorf("Read of a damaged GPT returned %v", err)
+	}
+}
+
+func TestPartitionOpen(t *testing.T) {
+	disk := newGPTDisk(512, 400, testGPTParts)
+	copy(disk[100*512:], "partition content")
+	table, err := Read(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := table.Partitions[1].Open(bytes.NewReader(disk))
+	if r.Size() != 200*512 {
+		t.Errorf("Size() = %d", r.Size())
+	}
+	buf := make([]byte, 17)
+	if _, err := r.ReadAt(buf, 0); err != nil || string(buf) != "partition content" {
+		t.Errorf("ReadAt returned %q, %v", buf, err)
+	}
+	if _, err := r.ReadAt(buf, r.Size()); err != io.EOF {
+		t.Errorf("ReadAt past the end returned %v", err)
+	}
+}
+
+func TestGUID(t *testing.T) {
+	const s = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	g := MustParseGUID(s)
+	if g.String() != s {
+		t.Errorf("String() = %s, want %s", g, s)
+	}
+	// The first three groups are stored little-endian.
+	if g[0] != 0xaf || g[4] != 0x83 || g[6] != 0x72 || g[8] != 0x8e {
+		t.Errorf("GUID bytes = % x", g[:])
+	}
+	for _, bad := range []string{"", "0FC63DAF-8483-4772-8E79-3D69D8477DE", "0FC63DAF+8483-4772-8E79-3D69D8477DE4", "0FC63DAF-8483-4772-8E79-3D69D8477DEX"} {
+		if _, err := ParseGUID(bad); err == nil {
+			t.Errorf("ParseGUID(%q) succeeded", bad)
+		}
+	}
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,470 @@
+// Package qcow2 reads QEMU copy-on-write (qcow2) disk images, versions 2 and
+// 3, including compressed clusters and backing files. The virtual disk is
+// exposed as an io.ReaderAt which can be passed to partition.Read or
+// ext.NewFS.
+//
+// L2 tables and decompressed clusters are kept in an LRU cache.
+//
+// Encrypted images, external data files, extended L2 entries and zstd
+// compressed clusters are not supported. Internal snapshots are ignored; the
+// active state of the disk is read.
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/asalih/go-ext/internal/diskimage"
+	"github.com/asalih/go-ext/internal/ioutil"
+	"github.com/asalih/go-ext/internal/lru"
+	"golang.org/x/xerrors"
+)
+
+// DefaultCacheSize is the memory limit, in bytes, of the cache of L2 tables
+// and decompressed clusters an Image uses unless configured otherwise with
+// WithCacheSize.
+const DefaultCacheSize = 16 << 20
+
+const (
+	magic = "QFI\xfb"
+
+	minClusterBits = 9
+	maxClusterBits = 21
+
+	// maxL1Size bounds the L1 table read in memory: 32M entries map 2^25
+	// L2 tables, far beyond any disk.
+	maxL1Size = 32 << 20
+
+	// maxBackingChain bounds the length of chains of backing files opened by
+	// Open.
+	maxBackingChain = 32
+
+	// Incompatible feature bits.
+	incompatDirty        = 1 << 0
+	incompatCorrupt      = 1 << 1
+	incompatExternalData = 1 << 2
+	incompatCompression  = 1 << 3
+	incompatExtendedL2   = 1 << 4
+
+	l1OffsetMask = 0x00fffffffffffe00
+	l2OffsetMask = 0x00fffffffffffe00
+
+	l2Compressed = 1 << 62
+	// l2Zero marks a cluster reading as zeros, in version 3.
+	l2Zero = 1 << 0
+)
+
+var (
+	// ErrNotQCOW2 is returned by New for images which are not qcow2 images.
+	ErrNotQCOW2 = errors.New("qcow2: not a qcow2 image")
+
+	// ErrNoBacking is returned when reading clusters the image leaves to its
+	// backing file, if it was not given one with WithBacking.
+	ErrNoBacking = errors.New("qcow2: backing file not provided")
+
+	// ErrUnsafeBacking is returned by Open for images whose backing file name
+	// is absolute or leads out of the directory of the image, unless allowed
+	// with WithUnsafeBacking.
+	ErrUnsafeBacking = errors.New("qcow2: backing file outside the image directory")
+)
+
+// Option configures an Image.
+type Option func(*options)
+
+type options struct {
+	backing       io.ReaderAt
+	cacheSize     int64
+	unsafeBacking bool
+}
+
+// WithBacking sets the reader of the image's backing file, which supplies the
+// clusters the image does not allocate. Reads past the end of the backing
+// file return zeros.
+func WithBacking(r io.ReaderAt) Option {
+	return func(o *options) {
+		o.backing = r
+	}
+}
+
+// WithCacheSize sets the memory limit, in bytes, of the LRU cache of L2 tables
+// and decompressed clusters. A size of zero or less disables the cache.
+func WithCacheSize(size int64) Option {
+	return func(o *options) {
+		o.cacheSize = size
+	}
+}
+
+// WithUnsafeBacking sets whether Open follows backing file names which are
+// absolute or lead out of the directory of the image. Names are read from the
+// image, so that an untrusted image could otherwise make Open read any file
+// on the host.
+func WithUnsafeBacking(enabled bool) Option {
+	return func(o *options) {
+		o.unsafeBacking = enabled
+	}
+}
+
+// Image is a qcow2 image. It is safe for concurrent use.
+type Image struct {
+	// Version is the qcow2 version, 2 or 3.
+	Version int
+
+	// ClusterSize is the size of the clusters the image allocates.
+	ClusterSize int64
+
+	// BackingFile is the name of the backing file as recorded in the image,
+	// or "" if the image has none. Relative names are relative to the
+	// directory of the image.
+	BackingFile string
+
+	size        int64
+	clusterBits uint
+	l2Bits      uint
+	l1          []uint64
+	r           io.ReaderAt
+	backing     io.ReaderAt
+	closers     []io.Closer
+	cache       *lru.Cache[cacheKey, []byte]
+}
+
+// cacheKey identifies a cached L2 table or decompressed cluster by its offset
+// in the image.
+type cacheKey struct {
+	offset     uint64
+	compressed bool
+}
+
+// New reads the qcow2 image r. Images with a backing file can be read without
+// one, except for the clusters they leave to it, which fail with
+// ErrNoBacking.
+func New(r io.ReaderAt, opts ...Option) (*Image, error) {
+	return newImage(r, newOptions(opts))
+}
+
+func newOptions(opts []Option) options {
+	o := options{cacheSize: DefaultCacheSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func newImage(r io.ReaderAt, o options) (*Image, error) {
+	hdr := make([]byte, 112)
+	if err := ioutil.ReadFull(r, hdr[:72], 0); err != nil {
+		return nil, xerrors.Errorf("qcow2: failed to read header: %w", err)
+	}
+	be := binary.BigEndian
+	if string(hdr[:4]) != magic {
+		return nil, ErrNotQCOW2
+	}
+	img := &Image{
+		Version: int(be.Uint32(hdr[4:])),
+		r:       r,
+		backing: o.backing,
+	}
+	if img.Version != 2 && img.Version != 3 {
+		return nil, xerrors.Errorf("qcow2: unsupported version %d", img.Version)
+	}
+
+	img.clusterBits = uint(be.Uint32(hdr[20:]))
+	if img.clusterBits < minClusterBits || img.clusterBits > maxClusterBits {
+		return nil, xerrors.Errorf("qcow2: invalid cluster bits %d", img.clusterBits)
+	}
+	img.ClusterSize = 1 << img.clusterBits
+	img.l2Bits = img.clusterBits - 3
+	img.size = int64(be.Uint64(hdr[24:]))
+	if img.size < 0 {
+		return nil, xerrors.Errorf("qcow2: invalid size %d", uint64(img.size))
+	}
+	if method := be.Uint32(hdr[32:]); method != 0 {
+		return nil, xerrors.Errorf("qcow2: encrypted images are not supported (method %d)", method)
+	}
+
+	if img.Version == 3 {
+		if err := ioutil.ReadFull(r, hdr[72:104], 72); err != nil {
+			return nil, xerrors.Errorf("qcow2: failed to read header: %w", err)
+		}
+		incompat := be.Uint64(hdr[72:])
+		if unknown := incompat &^ (incompatDirty | incompatCorrupt | incompatCompression); unknown != 0 {
+			switch {
+			case unknown&incompatExternalData != 0:
+				return nil, errors.New("qcow2: external data files are not supported")
+			case unknown&incompatExtendedL2 != 0:
+				return nil, errors.New("qcow2: extended L2 entries are not supported")
+			default:
+				return nil, xerrors.Errorf("qcow2: unsupported incompatible features %#x", unknown)
+			}
+		}
+		if incompat&incompatCompression != 0 {
+			// The compression type follows the version 3 header fields.
+			if be.Uint32(hdr[100:]) < 105 {
+				return nil, errors.New("qcow2: header too short for its compression type")
+			}
+			if err := ioutil.ReadFull(r, hdr[104:105], 104); err != nil {
+				return nil, xerrors.Errorf("qcow2: failed to read header: %w", err)
+			}
+			if hdr[104] != 0 {
+				return nil, xerrors.Errorf("qcow2: unsupported compression type %d", hdr[104])
+			}
+		}
+	}
+
+	if offset, size := be.Uint64(hdr[8:]), be.Uint32(hdr[16:]); offset != 0 && size != 0 {
+		if size > 1023 {
+			return nil, xerrors.Errorf("qcow2: backing file name of %d bytes", size)
+		}
+		name := make([]byte, size)
+		if err := ioutil.ReadFull(r, name, int64(offset)); err != nil {
+			return nil, xerrors.Errorf("qcow2: failed to read backing file name: %w", err)
+		}
+		img.BackingFile = string(name)
+	}
+
+	l1Size := be.Uint32(hdr[36:])
+	l1Offset := be.Uint64(hdr[40:])
+	// Every cluster of the disk must be mapped by the L1 table.
+	if need := (uint64(img.size) + uint64(1)<<(img.clusterBits+img.l2Bits) - 1) >> (img.clusterBits + img.l2Bits); uint64(l1Size) < need {
+		return nil, xerrors.Errorf("qcow2: L1 table of %d entries for %d needed", l1Size, need)
+	}
+	if l1Size > maxL1Size {
+		return nil, xerrors.Errorf("qcow2: L1 table of %d entries is too large", l1Size)
+	}
+	raw := make([]byte, 8*int(l1Size))
+	if err := ioutil.ReadFull(r, raw, int64(l1Offset)); err != nil {
+		return nil, xerrors.Errorf("qcow2: failed to read L1 table: %w", err)
+	}
+	img.l1 = make([]uint64, l1Size)
+	for i := range img.l1 {
+		img.l1[i] = be.Uint64(raw[8*i:])
+	}
+	if o.cacheSize > 0 {
+		img.cache = lru.New[cacheKey](o.cacheSize, lru.Bytes)
+	}
+	return img, nil
+}
+
+// Open opens the qcow2 image file name along with its chain of backing files,
+// which may be qcow2 images or raw disk images. The image must be closed to
+// close the files.
+//
+// Backing files must be named relative to the directory of the image naming
+// them, without leaving it, unless allowed with WithUnsafeBacking. The
+// options apply to every image of the chain, except for WithBacking which
+// Open ignores.
+func Open(name string, opts ...Option) (*Image, error) {
+	o := newOptions(opts)
+	o.backing = nil
+	return open(name, o, 0)
+}
+
+func open(name string, o options, depth int) (*Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	img, err := newImage(f, o)
+	if err != nil {
+		f.Close()
+		return nil, xerrors.Errorf("%s: %w", name, err)
+	}
+	img.closers = append(img.closers, f)
+	if img.BackingFile == "" {
+		return img, nil
+	}
+
+	if depth >= maxBackingChain {
+		img.Close()
+		return nil, xerrors.Errorf("qcow2: more than %d backing files", maxBackingChain)
+	}
+	path := img.BackingFile
+	if !o.unsafeBacking && !filepath.IsLocal(path) {
+		img.Close()
+		return nil, xerrors.Errorf("%s: %q: %w", name, path, ErrUnsafeBacking)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(name), path)
+	}
+	backing, closer, err := openBacking(path, o, depth+1)
+	if err != nil {
+		img.Close()
+		return nil, xerrors.Errorf("qcow2: backing file of %s: %w", name, err)
+	}
+	img.backing = backing
+	img.closers = append(img.closers, closer)
+	return img, nil
+}
+
+// openBacking opens a backing file, as a qcow2 image if it is one and as a
+// raw image otherwise.
+func openBacking(path string, o options, depth int) (io.ReaderAt, io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	head := make([]byte, 4)
+	if _, err := f.ReadAt(head, 0); err != nil || string(head) != magic {
+		return f, f, nil
+	}
+	f.Close()
+	img, err := open(path, o, depth)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, img, nil
+}
+
+// Size returns the size of the virtual disk in bytes.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// Close closes the files opened by Open. It does nothing for images created
+// by New.
+func (img *Image) Close() error {
+	var err error
+	for _, c := range img.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	img.closers = nil
+	return err
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("qcow2: negative offset")
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	var err error
+	if rest := img.size - off; int64(len(p)) > rest {
+		p = p[:rest]
+		err = io.EOF
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		within := pos & (img.ClusterSize - 1)
+		buf := p[read:]
+		if rest := img.ClusterSize - within; int64(len(buf)) > rest {
+			buf = buf[:rest]
+		}
+		if rerr := img.readCluster(buf, pos); rerr != nil {
+			return read, rerr
+		}
+		read += len(buf)
+	}
+	return read, err
+}
+
+// readCluster reads p from the virtual disk at pos, within a single cluster.
+func (img *Image) readCluster(p []byte, pos int64) error {
+	l1Index := uint64(pos) >> (img.clusterBits + img.l2Bits)
+	l2Table := img.l1[l1Index] & l1OffsetMask
+	if l2Table == 0 {
+		return img.readBacking(p, pos)
+	}
+
+	l2Index := (uint64(pos) >> img.clusterBits) & (1<<img.l2Bits - 1)
+	entry, err := img.l2Entry(l2Table, l2Index)
+	if err != nil {
+		return err
+	}
+	within := pos & (img.ClusterSize - 1)
+
+	if entry&l2Compressed != 0 {
+		return img.readCompressed(p, entry, within)
+	}
+	if img.Version == 3 && entry&l2Zero != 0 {
+		diskimage.Zero(p)
+		return nil
+	}
+	host := entry & l2OffsetMask
+	if host == 0 {
+		return img.readBacking(p, pos)
+	}
+	if err := ioutil.ReadFull(img.r, p, int64(host)+within); err != nil {
+		return xerrors.Errorf("qcow2: failed to read cluster at %d: %w", host, err)
+	}
+	return nil
+}
+
+// l2Entry returns entry index of the L2 table at offset table. Whole tables
+// are read into the cache, if the image has one.
+func (img *Image) l2Entry(table, index uint64) (uint64, error) {
+	if img.cache == nil {
+		var raw [8]byte
+		if err := ioutil.ReadFull(img.r, raw[:], int64(table+8*index)); err != nil {
+			return 0, xerrors.Errorf("qcow2: failed to read L2 table at %d: %w", table, err)
+		}
+		return binary.BigEndian.Uint64(raw[:]), nil
+	}
+
+	key := cacheKey{offset: table}
+	raw, ok := img.cache.Get(key)
+	if !ok {
+		raw = make([]byte, img.ClusterSize)
+		if err := ioutil.ReadFull(img.r, raw, int64(table)); err != nil {
+			return 0, xerrors.Errorf("qcow2: failed to read L2 table at %d: %w", table, err)
+		}
+		raw = img.cache.Add(key, raw)
+	}
+	return binary.BigEndian.Uint64(raw[8*index:]), nil
+}
+
+// readCompressed reads p at offset within of the compressed cluster described
+// by entry, which holds the host offset of the deflate stream and the number
+// of 512 byte sectors it spans beyond the first.
+func (img *Image) readCompressed(p []byte, entry uint64, within int64) error {
+	x := 62 - (img.clusterBits - 8)
+	host := entry & (1<<x - 1)
+	sectors := (entry >> x) & (1<<(img.clusterBits-8) - 1)
+	size := int64(sectors+1)*512 - int64(host&511)
+
+	key := cacheKey{offset: host, compressed: true}
+	if img.cache != nil {
+		if cluster, ok := img.cache.Get(key); ok {
+			copy(p, cluster[within:])
+			return nil
+		}
+	}
+
+	raw := make([]byte, size)
+	// The last compressed cluster may end before its last sector does.
+	n, err := img.r.ReadAt(raw, int64(host))
+	if n == 0 && err != nil {
+		return xerrors.Errorf("qcow2: failed to read compressed cluster at %d: %w", host, err)
+	}
+	cluster := make([]byte, img.ClusterSize)
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(raw[:n])), cluster); err != nil {
+		return xerrors.Errorf("qcow2: compressed cluster at %d: %w", host, err)
+	}
+	if img.cache != nil {
+		img.cache.Add(key, cluster)
+	}
+	copy(p, cluster[within:])
+	return nil
+}
+
+// readBacking reads p from the backing file at pos, or zeros if the image has
+// none.
+func (img *Image) readBacking(p []byte, pos int64) error {
+	if img.backing == nil {
+		if img.BackingFile != "" {
+			return xerrors.Errorf("%s: %w", img.BackingFile, ErrNoBacking)
+		}
+		diskimage.Zero(p)
+		return nil
+	}
+	return diskimage.ReadParent(img.backing, p, pos)
+}
@@ -0,0 +1,285 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/imagetest"
+)
+
+const testClusterBits = 12
+
+// testCluster is the content given to a cluster of a test image.
+type testCluster struct {
+	data       []byte
+	compressed bool
+	zero       bool
+}
+
+// writeQCOW2 returns a version 3 image of size bytes with 4k clusters holding
+// clusters, indexed by cluster number, and leaving the others unallocated.
+func writeQCOW2(size int64, clusters map[int64]testCluster, backing string) []byte {
+	const cs = 1 << testClusterBits
+	l2Entries := int64(cs / 8)
+	l1Size := (size/cs + l2Entries - 1) / l2Entries
+
+	img := make([]byte, 2*cs)
+	be := binary.BigEndian
+	copy(img, magic)
+	be.PutUint32(img[4:], 3)
+	if backing != "" {
+		copy(img[512:], backing)
+		be.PutUint64(img[8:], 512)
+		be.PutUint32(img[16:], uint32(len(backing)))
+	}
+	be.PutUint32(img[20:], testClusterBits)
+	be.PutUint64(img[24:], uint64(size))
+	be.PutUint32(img[36:], uint32(l1Size))
+	be.PutUint64(img[40:], cs)
+	be.PutUint32(img[96:], 4)
+	be.PutUint32(img[100:], 104)
+
+	l2Tables := make(map[int64]int64)
+	for c := int64(0); c < size/cs; c++ {
+		tc, ok := clusters[c]
+		if !ok {
+			continue
+		}
+		l1Index := c / l2Entries
+		table, ok := l2Tables[l1Index]
+		if !ok {
+			img = alignCluster(img)
+			table = int64(len(img))
+			img = append(img, make([]byte, cs)...)
+			l2Tables[l1Index] = table
+			be.PutUint64(img[cs+8*l1Index:], uint64(table)|1<<63)
+		}
+
+		var entry uint64
+		switch {
+		case tc.zero:
+			entry = l2Zero
+		case tc.compressed:
+			var buf bytes.Buffer
+			zw, _ := flate.NewWriter(&buf, flate.BestCompression)
+			zw.Write(tc.data)
+			zw.Close()
+			host := uint64(len(img))
+			img = append(img, buf.Bytes()...)
+			sectors := (host+uint64(buf.Len())-1)/512 - host/512
+			entry = l2Compressed | host | sectors<<(62-(testClusterBits-8))
+		default:
+			img = alignCluster(img)
+			entry = uint64(len(img)) | 1<<63
+			img = append(img, tc.data...)
+		}
+		be.PutUint64(img[table+8*(c%l2Entries):], entry)
+	}
+	return img
+}
+
+// alignCluster pads img to a cluster boundary, after compressed clusters.
+func alignCluster(img []byte) []byte {
+	for len(img)%(1<<testClusterBits) != 0 {
+		img = append(img, 0)
+	}
+	return img
+}
+
+func randomCluster(rng *rand.Rand) []byte {
+	b := make([]byte, 1<<testClusterBits)
+	rng.Read(b[:len(b)/2])
+	return b
+}
+
+func TestReadClusters(t *testing.T) {
+	const size = 8 << 20
+	const cs = 1 << testClusterBits
+	rng := rand.New(rand.NewSource(1))
+	backing := make([]byte, size-3*cs)
+	rng.Read(backing)
+
+	want := make([]byte, size)
+	copy(want, backing)
+	clusters := map[int64]testCluster{}
+	// Allocated, compressed and zero clusters in both L2 tables; the rest
+	// comes from the backing file, which ends before the disk does.
+	for _, c := range []int64{0, 1, 5, 600, 2047} {
+		clusters[c] = testCluster{data: randomCluster(rng)}
+	}
+	for _, c := range []int64{2, 3, 513, 1500} {
+		clusters[c] = testCluster{data: randomCluster(rng), compressed: true}
+	}
+	for _, c := range []int64{4, 700} {
+		clusters[c] = testCluster{zero: true, data: make([]byte, cs)}
+	}
+	for c, tc := range clusters {
+		copy(want[c*cs:], tc.data)
+	}
+
+	raw := writeQCOW2(size, clusters, "base.raw")
+	img, err := New(bytes.NewReader(raw), WithBacking(bytes.NewReader(backing)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Size() != size || img.BackingFile != "base.raw" || img.ClusterSize != cs {
+		t.Errorf("got size %d, backing file %q, cluster size %d", img.Size(), img.BackingFile, img.ClusterSize)
+	}
+	got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes with %v, mismatch", len(got), err)
+	}
+	buf := make([]byte, 3*cs)
+	if _, err := img.ReadAt(buf, cs+100); err != nil || !bytes.Equal(buf, want[cs+100:][:len(buf)]) {
+		t.Errorf("unaligned ReadAt mismatch, %v", err)
+	}
+
+	// Without the backing file, only allocated clusters can be read.
+	img, err = New(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.ReadAt(buf[:cs], 2*cs); err != nil {
+		t.Errorf("read of a compressed cluster returned %v", err)
+	}
+	if _, err := img.ReadAt(buf[:cs], 10*cs); !errors.Is(err, ErrNoBacking) {
+		t.Errorf("read of an unallocated cluster returned %v, want %v", err, ErrNoBacking)
+	}
+}
+
+// countingReader counts the reads of an image.
+type countingReader struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+func TestCache(t *testing.T) {
+	const cs = 1 << testClusterBits
+	rng := rand.New(rand.NewSource(1))
+	clusters := map[int64]testCluster{
+		0: {data: randomCluster(rng)},
+		1: {data: randomCluster(rng)},
+		2: {data: randomCluster(rng), compressed: true},
+	}
+	raw := writeQCOW2(1<<20, clusters, "")
+	buf := make([]byte, cs)
+	for _, tt := range []struct {
+		name string
+		opts []Option
+		// reads are the reads of cluster 0, cluster 1 and twice cluster 2.
+		reads []int
+	}{
+		{"cached", nil, []int{2, 1, 1, 0}},
+		{"uncached", []Option{WithCacheSize(0)}, []int{2, 2, 2, 2}},
+	} {
+		r := &countingReader{r: bytes.NewReader(raw)}
+		img, err := New(r, tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, c := range []int64{0, 1, 2, 2} {
+			r.reads = 0
+			if _, err := img.ReadAt(buf, c*cs); err != nil || !bytes.Equal(buf, clusters[c].data) {
+				t.Fatalf("%s: cluster %d read with %v, mismatch", tt.name, c, err)
+			}
+			if r.reads != tt.reads[i] {
+				t.Errorf("%s: read %d of cluster %d took %d reads, want %d", tt.name, i, c, r.reads, tt.reads[i])
+			}
+		}
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(bytes.NewReader(make([]byte, 4096))); !errors.Is(err, ErrNotQCOW2) {
+		t.Errorf("New of a raw image returned %v, want %v", err, ErrNotQCOW2)
+	}
+	for name, patch := range map[string]func(b []byte){
+		"version":   func(b []byte) { binary.BigEndian.PutUint32(b[4:], 4) },
+		"encrypted": func(b []byte) { binary.BigEndian.PutUint32(b[32:], 1) },
+		"extended":  func(b []byte) { binary.BigEndian.PutUint64(b[72:], incompatExtendedL2) },
+		"l1 size":   func(b []byte) { binary.BigEndian.PutUint32(b[36:], 0) },
+	} {
+		raw := writeQCOW2(1<<20, nil, "")
+		patch(raw)
+		if _, err := New(bytes.NewReader(raw)); err == nil {
+			t.Errorf("%s: New succeeded", name)
+		}
+	}
+}
+
+func TestOpenBackingChain(t *testing.T) {
+	const cs = 1 << testClusterBits
+	dir := t.TempDir()
+	base := bytes.Repeat([]byte("base"), 1<<18)
+	mid := map[int64]testCluster{1: {data: bytes.Repeat([]byte("m"), cs), compressed: true}}
+	top := map[int64]testCluster{2: {data: bytes.Repeat([]byte("t"), cs)}}
+	for name, data := range map[string][]byte{
+		"base.raw":   base,
+		"mid.qcow2":  writeQCOW2(1<<20, mid, "base.raw"),
+		"top.qcow2":  writeQCOW2(1<<20, top, filepath.Join(dir, "mid.qcow2")),
+		"orphan.img": writeQCOW2(1<<20, nil, "missing.raw"),
+		"escape.img": writeQCOW2(1<<20, nil, "../base.raw"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// top.qcow2 names mid.qcow2 by its absolute path.
+	if _, err := Open(filepath.Join(dir, "top.qcow2")); !errors.Is(err, ErrUnsafeBacking) {
+		t.Errorf("Open with an absolute backing file returned %v, want %v", err, ErrUnsafeBacking)
+	}
+	if _, err := Open(filepath.Join(dir, "escape.img"), WithUnsafeBacking(false)); !errors.Is(err, ErrUnsafeBacking) {
+		t.Errorf("Open with a backing file out of its directory returned %v, want %v", err, ErrUnsafeBacking)
+	}
+	img, err := Open(filepath.Join(dir, "top.qcow2"), WithUnsafeBacking(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	buf := make([]byte, 3*cs)
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []byte{'b', 'm', 't'} {
+		if buf[i*cs] != want {
+			t.Errorf("cluster %d starts with %q, want %q", i, buf[i*cs], want)
+		}
+	}
+
+	if _, err := Open(filepath.Join(dir, "orphan.img")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open with a missing backing file returned %v", err)
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	const cs = 1 << testClusterBits
+	raw := imagetest.FileSystem("inside qcow2")
+
+	clusters := map[int64]testCluster{}
+	for c := int64(0); c*cs < int64(len(raw)); c++ {
+		data := raw[c*cs : (c+1)*cs]
+		if imagetest.IsZero(data) {
+			continue
+		}
+		clusters[c] = testCluster{data: data, compressed: c%2 == 1}
+	}
+	img, err := New(bytes.NewReader(writeQCOW2(int64(len(raw)), clusters, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagetest.CheckFileSystem(t, img, "inside qcow2")
+}
@@ -1,13 +1,29 @@
 package ext
 
+import (
+	"encoding/binary"
+
+	"github.com/asalih/go-ext/linux"
+)
+
+// refInode is an inode without content: a character or block device, a fifo
+// or a socket.
 type refInode struct {
 	inode inode
+
+	// major and minor are the device numbers of device nodes. Immutable.
+	major uint32
+	minor uint32
 }
 
 // newRefInode is the inode ref
 func newRefInode(args inodeArgs) (*refInode, error) {
 	file := &refInode{}
 	file.inode.init(args, file)
+	switch args.diskInode.Mode().FileType() {
+	case linux.ModeCharacterDevice, linux.ModeBlockDevice:
+		file.major, file.minor = decodeDevice(args.diskInode.Data())
+	}
 	return file, nil
 }
 
@@ -15,3 +31,15 @@ func (in *inode) isRefInode() bool {
 	_, ok := in.impl.(*refInode)
 	return ok
 }
+
+// decodeDevice returns the device numbers stored in the i_block of a device
+// node. Like the kernel, it reads the old 16-bit encoding, an 8-bit major and
+// minor, from the first word if it is set and the new 32-bit encoding, a
+// 12-bit major and 20-bit minor, from the second word otherwise.
+func decodeDevice(iblock []byte) (major, minor uint32) {
+	if old := binary.LittleEndian.Uint32(iblock[0:]); old != 0 {
+		return (old >> 8) & 0xff, old & 0xff
+	}
+	dev := binary.LittleEndian.Uint32(iblock[4:])
+	return (dev & 0xfff00) >> 8, dev&0xff | (dev>>12)&0xfff00
+}
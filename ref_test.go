@@ -0,0 +1,44 @@
+package ext
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+func TestDeviceNumbers(t *testing.T) {
+	devices := []testimage.Entry{
+		// Both numbers fit the old 16-bit encoding.
+		{Name: "null", Mode: fs.ModeDevice | fs.ModeCharDevice | 0666, Major: 1, Minor: 3},
+		{Name: "sda", Mode: fs.ModeDevice | 0660, Major: 8, Minor: 0},
+		// The others need the new 32-bit encoding.
+		{Name: "nvme0n1p300", Mode: fs.ModeDevice | 0660, Major: 259, Minor: 70000},
+		{Name: "tty300", Mode: fs.ModeDevice | fs.ModeCharDevice | 0620, Major: 4, Minor: 300},
+		{Name: "zero", Mode: fs.ModeDevice | fs.ModeCharDevice | 0600},
+	}
+	fsys := extractImage(t, devices...)
+	for _, e := range devices {
+		info, err := fsys.Stat(e.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := info.Sys().(*Statx)
+		if st.RdevMajor != e.Major || st.RdevMinor != e.Minor {
+			t.Errorf("%s has device %d,%d, want %d,%d", e.Name, st.RdevMajor, st.RdevMinor, e.Major, e.Minor)
+		}
+		if info.Mode().Type() != e.Mode.Type() {
+			t.Errorf("%s has mode %v, want %v", e.Name, info.Mode(), e.Mode)
+		}
+	}
+
+	// Other inodes have none.
+	fsys = extractImage(t, testimage.Entry{Name: "fifo", Mode: fs.ModeNamedPipe | 0600})
+	info, err := fsys.Stat("fifo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := info.Sys().(*Statx); st.RdevMajor != 0 || st.RdevMinor != 0 {
+		t.Errorf("fifo has device %d,%d", st.RdevMajor, st.RdevMinor)
+	}
+}
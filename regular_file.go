@@ -2,6 +2,8 @@ package ext
 
 import (
 	"io"
+
+	"github.com/asalih/go-ext/linux"
 )
 
 // regularFile represents a regular file's inode. This too follows the
@@ -17,25 +19,109 @@ type regularFile struct {
 	// io.ReaderAt is more strict than io.Reader in the sense that a partial read
 	// is always accompanied by an error. If a read spans past the end of file, a
 	// partial read (within file range) is done and io.EOF is returned.
-	impl io.ReaderAt
+	impl fileReader
+}
+
+// fileReader is implemented by the readers of regular file data. readAt is
+// ReadAt doing its I/O through fsR, a view of the file's FileSystem which may
+// be bound to a context, instead of the FileSystem the inode was read from.
+type fileReader interface {
+	io.ReaderAt
+	readAt(fsR *FileSystem, dst []byte, off int64) (int, error)
+}
+
+// reader returns an io.ReaderAt over the file data doing its I/O through fsR.
+func (rf *regularFile) reader(fsR *FileSystem) io.ReaderAt {
+	return &viewReader{fsR: fsR, r: rf.impl}
+}
+
+// viewReader reads file data through a given view of its FileSystem.
+type viewReader struct {
+	fsR *FileSystem
+	r   fileReader
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (v *viewReader) ReadAt(dst []byte, off int64) (int, error) {
+	return v.r.readAt(v.fsR, dst, off)
 }
 
 // newRegularFile is the regularFile constructor. It figures out what kind of
-// file this is and initializes the fileReader.
+// file this is and initializes the fileReader. The contents of encrypted
+// regular files are decrypted by the fileReader; directories and symlinks
+// mapped by a regularFile are read as stored.
 func newRegularFile(args inodeArgs) (*regularFile, error) {
+	var rf *regularFile
 	if args.diskInode.Flags().Extents {
 		file, err := newExtentFile(args)
 		if err != nil {
 			return nil, err
 		}
-		return &file.regFile, nil
+		rf = &file.regFile
+	} else {
+		file, err := newBlockMapFile(args)
+		if err != nil {
+			return nil, err
+		}
+		rf = &file.regFile
 	}
 
-	file, err := newBlockMapFile(args)
+	if args.crypt != nil && args.diskInode.Mode().FileType() == linux.ModeRegular {
+		rf.impl = &cryptReader{rf: rf, r: rf.impl}
+	}
+	return rf, nil
+}
+
+// dataSize returns the number of bytes the extent or block map reader maps.
+// The last block of an encrypted file is read in full to be decrypted.
+func (rf *regularFile) dataSize() uint64 {
+	size := rf.inode.diskInode.Size()
+	if rf.inode.crypt != nil {
+		size = (size + rf.inode.blkSize - 1) / rf.inode.blkSize * rf.inode.blkSize
+	}
+	return size
+}
+
+// dataRange is a range of file data mapped to blocks on disk.
+type dataRange struct {
+	off, length uint64
+}
+
+// dataRanges returns the ranges of the file which are not holes, in order and
+// clamped to the file size. Adjacent ranges are merged.
+func (rf *regularFile) dataRanges(fsR *FileSystem) ([]dataRange, error) {
+	impl := rf.impl
+	if c, ok := impl.(*cryptReader); ok {
+		impl = c.r
+	}
+	var ranges []dataRange
+	var err error
+	switch f := impl.(type) {
+	case *extentFile:
+		ranges = f.dataRanges(&f.root, nil)
+	case *blockMapFile:
+		ranges, err = f.dataRanges(fsR)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &file.regFile, nil
+
+	size := rf.inode.diskInode.Size()
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if r.off >= size {
+			break
+		}
+		if r.off+r.length > size {
+			r.length = size - r.off
+		}
+		if n := len(merged); n > 0 && merged[n-1].off+merged[n-1].length == r.off {
+			merged[n-1].length += r.length
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
 }
 
 func (in *inode) isRegular() bool {
@@ -0,0 +1,209 @@
+package ext
+
+import (
+	"context"
+	"io"
+
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/syserror"
+	"golang.org/x/xerrors"
+)
+
+// inodeScanChunkSize is the amount of inode table read from the device at once
+// by an InodeScanner.
+const inodeScanChunkSize = 1 << 20
+
+// InodeScanner reads every allocated inode of a FileSystem in inode number
+// order, which is also their order on disk. It reads the inode tables in large
+// sequential chunks, bypassing the inode and block caches, and skips the parts
+// of each table the inode bitmap and group descriptor mark unused.
+//
+// Reserved inodes (below the superblock's first inode) are allocated and
+// reported like any other. ScanDeletedInodes returns an InodeScanner over the
+// deleted inodes instead. An InodeScanner is not safe for concurrent use.
+//
+//	s := fsys.ScanInodes()
+//	for s.Next() {
+//		inodeNum, in := s.Inode()
+//		...
+//	}
+//	if err := s.Err(); err != nil {
+//		...
+//	}
+type InodeScanner struct {
+	ctx context.Context
+	fsR *FileSystem
+
+	// deleted selects the unallocated inodes which were once in use instead
+	// of the allocated ones.
+	deleted bool
+
+	// group is the block group being scanned and bitmap its inode bitmap,
+	// nil until the group is started.
+	group  uint32
+	bitmap []byte
+
+	// used is the number of inode table entries in the current group which
+	// may be in use. idx is the index of the next entry to look at.
+	used uint32
+	idx  uint32
+
+	// chunk holds the inode table entries from chunkStart on.
+	chunk      []byte
+	chunkStart uint32
+
+	inodeNum uint32
+	inode    disklayout.Inode
+	err      error
+}
+
+// ScanInodes returns an InodeScanner over all allocated inodes of f.
+func (f *FileSystem) ScanInodes() *InodeScanner {
+	return f.ScanInodesContext(context.Background())
+}
+
+// ScanInodesContext is ScanInodes bound to ctx. The scan stops with ctx.Err()
+// once ctx is done.
+func (f *FileSystem) ScanInodesContext(ctx context.Context) *InodeScanner {
+	return &InodeScanner{ctx: ctx, fsR: f.withContext(ctx)}
+}
+
+// ScanDeletedInodes returns an InodeScanner over the deleted inodes of f:
+// those the inode bitmap marks free but which have a file type or a deletion
+// time, which inodes never used have not. Their metadata is as the kernel
+// left it; ext4 usually truncated them and their size and blocks are gone.
+func (f *FileSystem) ScanDeletedInodes() *InodeScanner {
+	return f.ScanDeletedInodesContext(context.Background())
+}
+
+// ScanDeletedInodesContext is ScanDeletedInodes bound to ctx. The scan stops
+// with ctx.Err() once ctx is done.
+func (f *FileSystem) ScanDeletedInodesContext(ctx context.Context) *InodeScanner {
+	return &InodeScanner{ctx: ctx, fsR: f.withContext(ctx), deleted: true}
+}
+
+// Next advances to the next inode of the scan, which is then available through
+// Inode. It returns false when the scan is over or failed; Err tells which.
+func (s *InodeScanner) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	if s.err = s.ctx.Err(); s.err != nil {
+		return false
+	}
+
+	sb := s.fsR.sb
+	for {
+		if s.bitmap == nil {
+			if int(s.group) >= len(s.fsR.bgs) {
+				return false
+			}
+			if s.err = s.startGroup(); s.err != nil {
+				return false
+			}
+		}
+
+		for ; s.idx < s.used; s.idx++ {
+			allocated := s.bitmap[s.idx/8]&(1<<(s.idx%8)) != 0
+			if allocated == s.deleted {
+				continue
+			}
+			in, err := s.readInode(s.idx)
+			if err != nil {
+				s.err = err
+				return false
+			}
+			if s.deleted && in.Mode() == 0 && in.DeletionTime().Unix() == 0 {
+				continue
+			}
+			s.inodeNum = s.group*sb.InodesPerGroup() + s.idx + 1
+			s.inode = in
+			s.idx++
+			return true
+		}
+
+		s.group++
+		s.bitmap = nil
+		s.chunk = s.chunk[:0]
+	}
+}
+
+// Inode returns the number and on-disk structure of the current inode. The
+// structure is not shared with anything and may be kept by the caller.
+func (s *InodeScanner) Inode() (uint32, disklayout.Inode) {
+	return s.inodeNum, s.inode
+}
+
+// Err returns the error that stopped the scan, if any.
+func (s *InodeScanner) Err() error {
+	return s.err
+}
+
+// startGroup prepares the scan of block group s.group. Groups whose inode
+// table was never initialized get an empty bitmap.
+func (s *InodeScanner) startGroup() error {
+	sb := s.fsR.sb
+	bg := s.fsR.bgs[s.group]
+	inodesPerGrp := sb.InodesPerGroup()
+	s.idx = 0
+	s.used = inodesPerGrp
+	s.bitmap = []byte{}
+
+	// Without group descriptor checksums, the kernel ignores the unused inode
+	// count and uninitialized flag, and so do we.
+	roCompat := sb.ReadOnlyCompatibleFeatures()
+	if roCompat.GdtCsum || roCompat.MetadataCsum {
+		if bg.Flags().InodeUninit {
+			s.used = 0
+			return nil
+		}
+		unused := bg.UnusedInodeCount()
+		if unused > inodesPerGrp {
+			return xerrors.Errorf("block group %d has %d unused inodes out of %d: %w", s.group, unused, inodesPerGrp, syserror.EFSCORRUPTED)
+		}
+		s.used -= unused
+	}
+	if s.used == 0 {
+		return nil
+	}
+
+	bitmap, err := s.fsR.meta.block(bg.InodeBitmap())
+	if err != nil {
+		return xerrors.Errorf("failed to read inode bitmap of block group %d: %w", s.group, err)
+	}
+	s.bitmap = bitmap
+	return nil
+}
+
+// readInode decodes entry idx of the current group's inode table, reading the
+// next chunk of the table if needed.
+func (s *InodeScanner) readInode(idx uint32) (disklayout.Inode, error) {
+	sb := s.fsR.sb
+	recSize := uint32(sb.InodeSize())
+	if idx < s.chunkStart || (idx-s.chunkStart+1)*recSize > uint32(len(s.chunk)) {
+		count := uint32(inodeScanChunkSize) / recSize
+		if count > s.used-idx {
+			count = s.used - idx
+		}
+		if uint32(cap(s.chunk)) < count*recSize {
+			s.chunk = make([]byte, count*recSize)
+		}
+		s.chunk = s.chunk[:count*recSize]
+
+		off := s.fsR.bgs[s.group].InodeTable()*sb.BlockSize() + uint64(idx)*uint64(recSize)
+		if n, err := s.fsR.dev.ReadAt(s.chunk, int64(off)); n < len(s.chunk) {
+			if err == nil || err == io.EOF {
+				err = syserror.EIO
+			}
+			return nil, xerrors.Errorf("failed to read inode table of block group %d: %w", s.group, err)
+		}
+		s.chunkStart = idx
+	}
+
+	in := newDiskInode(sb)
+	start := (idx - s.chunkStart) * recSize
+	if err := in.UnmarshalBytes(s.chunk[start : start+uint32(in.SizeBytes())]); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
@@ -0,0 +1,169 @@
+package ext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+// scanInodes returns the inodes an InodeScanner reports, by inode number.
+func scanInodes(t *testing.T, fsys *FileSystem) map[uint32]disklayout.Inode {
+	t.Helper()
+	inodes := make(map[uint32]disklayout.Inode)
+	last := uint32(0)
+	s := fsys.ScanInodes()
+	for s.Next() {
+		inodeNum, in := s.Inode()
+		if inodeNum <= last {
+			t.Fatalf("inode %d reported after inode %d", inodeNum, last)
+		}
+		last = inodeNum
+		inodes[inodeNum] = in
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return inodes
+}
+
+func TestScanInodes(t *testing.T) {
+	forEachImage(t, func(t *testing.T, fsys *FileSystem, b *testimage.Builder, entries map[string]testimage.Entry) {
+		scanned := scanInodes(t, fsys)
+
+		// Every file is found by the scan, with the inode a lookup returns.
+		reachable := map[uint32]bool{}
+		err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			st := info.Sys().(*Statx)
+			reachable[uint32(st.Ino)] = true
+
+			in, ok := scanned[uint32(st.Ino)]
+			if !ok {
+				t.Errorf("%s: inode %d not scanned", path, st.Ino)
+				return nil
+			}
+			if uint16(in.Mode()) != st.Mode || in.Size() != st.Size || in.LinksCount() != uint16(st.Nlink) {
+				t.Errorf("%s: scanned inode %d differs from its lookup", path, st.Ino)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Apart from the reserved inodes, which come before lost+found in
+		// these images, only those files are allocated.
+		for inodeNum := range scanned {
+			if inodeNum >= b.Ino("lost+found") && !reachable[inodeNum] {
+				t.Errorf("unreachable inode %d scanned", inodeNum)
+			}
+		}
+		if !scanned[disklayout.RootDirInode].Mode().IsDir() {
+			t.Error("root inode not scanned as a directory")
+		}
+	})
+}
+
+func TestScanInodesUninitializedGroups(t *testing.T) {
+	b := testimage.New(testimage.Options{BlockSize: 1024, InodeSize: 128, BlocksPerGroup: 512})
+	for _, e := range testEntries() {
+		b.Add(e)
+	}
+	img := b.MustBuild()
+
+	fsys, err := NewFS(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := scanInodes(t, fsys)
+	inodesPerGrp := fsys.sb.InodesPerGroup()
+	last := uint32(0)
+	for inodeNum := range all {
+		if inodeNum > last {
+			last = inodeNum
+		}
+	}
+	lastGroup := getBGNum(last, inodesPerGrp)
+	if lastGroup == 0 {
+		t.Fatal("test image has a single group of inodes")
+	}
+
+	// Claim group descriptor checksums, mark the inode table of the last used
+	// group uninitialized and hide all but 12 inodes of group 0.
+	const keep = 12
+	sbOff := disklayout.SbOffset
+	roCompat := binary.LittleEndian.Uint32(img[sbOff+0x64:])
+	binary.LittleEndian.PutUint32(img[sbOff+0x64:], roCompat|disklayout.SbGdtCsum)
+	gdtOff := int((uint64(fsys.sb.FirstDataBlock()) + 1) * fsys.sb.BlockSize())
+	desc := func(group uint32) []byte {
+		off := gdtOff + int(group)*disklayout.BgDesc32Size
+		return img[off : off+disklayout.BgDesc32Size]
+	}
+	binary.LittleEndian.PutUint16(desc(lastGroup)[0x12:], disklayout.BgInodeUninit)
+	binary.LittleEndian.PutUint16(desc(0)[0x1c:], uint16(inodesPerGrp-keep))
+
+	fsys, err = NewFS(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := scanInodes(t, fsys)
+	for inodeNum := range all {
+		group := getBGNum(inodeNum, inodesPerGrp)
+		hidden := group == lastGroup || (group == 0 && inodeNum > keep)
+		if _, ok := got[inodeNum]; ok == hidden {
+			t.Errorf("inode %d of group %d: scanned %v, want %v", inodeNum, group, ok, !hidden)
+		}
+	}
+}
+
+func TestScanDeletedInodes(t *testing.T) {
+	dtime := time.Date(2022, time.June, 1, 2, 3, 4, 0, time.UTC)
+	b := testimage.New(testimage.Ext4())
+	b.File("kept.txt", []byte("kept"))
+	b.Add(testimage.Entry{Name: "gone.txt", Mode: 0640, Data: []byte("gone"), Dtime: dtime})
+	b.Add(testimage.Entry{Name: "gone-dir", Mode: fs.ModeDir | 0755, Dtime: dtime})
+	fsys, err := NewFS(bytes.NewReader(b.MustBuild()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat("gone.txt"); err == nil {
+		t.Fatal("deleted file is reachable")
+	}
+
+	deleted := make(map[uint32]disklayout.Inode)
+	s := fsys.ScanDeletedInodes()
+	for s.Next() {
+		inodeNum, in := s.Inode()
+		deleted[inodeNum] = in
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("scanned %d deleted inodes, want 2", len(deleted))
+	}
+	for _, name := range []string{"gone.txt", "gone-dir"} {
+		in, ok := deleted[b.Ino(name)]
+		if !ok {
+			t.Errorf("%s: inode %d not scanned", name, b.Ino(name))
+			continue
+		}
+		if !in.DeletionTime().Equal(dtime) || in.LinksCount() != 0 {
+			t.Errorf("%s: deleted at %v with %d links", name, in.DeletionTime(), in.LinksCount())
+		}
+	}
+	if _, ok := scanInodes(t, fsys)[b.Ino("gone.txt")]; ok {
+		t.Error("deleted inode scanned as allocated")
+	}
+}
@@ -0,0 +1,232 @@
+// Package split reads raw images split over several segment files, such as
+// disk.001, disk.002 and so on or disk.aa, disk.ab and so on as written by
+// split(1), FTK Imager and dd-based acquisition tools. The segments are
+// stitched into a single io.ReaderAt which can be passed to ext.NewFS or
+// partition.Read without concatenating them first.
+package split
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrSegmentSize is returned for segments whose size does not match the
+// others. Every segment but the last must have the size of the first, and the
+// last one may not be larger.
+var ErrSegmentSize = errors.New("split: segment sizes do not match")
+
+// Option configures an Image.
+type Option func(*options)
+
+type options struct {
+	anySize bool
+}
+
+// WithAnySegmentSize accepts segments of any non-zero size instead of
+// requiring equal sizes.
+func WithAnySegmentSize() Option {
+	return func(o *options) {
+		o.anySize = true
+	}
+}
+
+// Image is a raw image made of consecutive segments. It is safe for
+// concurrent use if the segments are.
+type Image struct {
+	segments []io.ReaderAt
+
+	// starts holds the offset of every segment in the image, followed by
+	// the image size.
+	starts  []int64
+	closers []io.Closer
+}
+
+// New returns the image made of segments, in order, with the given sizes.
+func New(segments []io.ReaderAt, sizes []int64, opts ...Option) (*Image, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(segments) == 0 {
+		return nil, errors.New("split: no segments")
+	}
+	if len(sizes) != len(segments) {
+		return nil, xerrors.Errorf("split: %d sizes for %d segments", len(sizes), len(segments))
+	}
+
+	img := &Image{
+		segments: segments,
+		starts:   make([]int64, 0, len(segments)+1),
+	}
+	var off int64
+	for i, size := range sizes {
+		switch {
+		case size <= 0:
+			return nil, xerrors.Errorf("split: segment %d has %d bytes: %w", i+1, size, ErrSegmentSize)
+		case o.anySize:
+		case i < len(sizes)-1 && size != sizes[0]:
+			return nil, xerrors.Errorf("split: segment %d has %d bytes, want %d: %w", i+1, size, sizes[0], ErrSegmentSize)
+		case size > sizes[0]:
+			return nil, xerrors.Errorf("split: last segment has %d bytes, more than %d: %w", size, sizes[0], ErrSegmentSize)
+		}
+		img.starts = append(img.starts, off)
+		off += size
+	}
+	img.starts = append(img.starts, off)
+	return img, nil
+}
+
+// Segments returns the number of segments of the image.
+func (img *Image) Segments() int {
+	return len(img.segments)
+}
+
+// Size returns the size of the image in bytes.
+func (img *Image) Size() int64 {
+	return img.starts[len(img.starts)-1]
+}
+
+// ReadAt implements io.ReaderAt.ReadAt. Reads spanning segments are split
+// between them.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("split: negative offset")
+	}
+	size := img.Size()
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		if pos >= size {
+			return read, io.EOF
+		}
+		// Find the last segment starting at or before pos.
+		seg := sort.Search(len(img.segments), func(i int) bool {
+			return img.starts[i+1] > pos
+		})
+		want := p[read:]
+		if end := img.starts[seg+1]; int64(len(want)) > end-pos {
+			want = want[:end-pos]
+		}
+		n, err := img.segments[seg].ReadAt(want, pos-img.starts[seg])
+		read += n
+		if n < len(want) {
+			if err == nil || err == io.EOF {
+				err = xerrors.Errorf("split: segment %d is shorter than %d bytes: %w", seg+1, img.starts[seg+1]-img.starts[seg], io.ErrUnexpectedEOF)
+			}
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// Close closes the segment files opened by Open.
+func (img *Image) Close() error {
+	var firstErr error
+	for _, c := range img.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	img.closers = nil
+	return firstErr
+}
+
+// SegmentName returns the name of segment n, counted from 1, of the image
+// whose first segment file is first. The extension of first is a counter,
+// either decimal digits such as 001 or 000, or letters such as aa, which is
+// incremented keeping its width and case: disk.001 is followed by disk.002
+// and disk.aa by disk.ab, disk.az by disk.ba.
+func SegmentName(first string, n int) (string, error) {
+	ext := filepath.Ext(first)
+	if n < 1 || len(ext) < 3 {
+		return "", xerrors.Errorf("split: no segment %d for %s", n, first)
+	}
+	counter := []byte(ext[1:])
+
+	var base, zero byte
+	switch c := counter[0]; {
+	case c >= '0' && c <= '9':
+		base, zero = 10, '0'
+	case c >= 'a' && c <= 'z':
+		base, zero = 26, 'a'
+	case c >= 'A' && c <= 'Z':
+		base, zero = 26, 'A'
+	default:
+		return "", xerrors.Errorf("split: %s has no segment counter", first)
+	}
+	for _, c := range counter {
+		if c < zero || c >= zero+base {
+			return "", xerrors.Errorf("split: %s has no segment counter", first)
+		}
+	}
+
+	// Add n-1 to the counter, digit by digit from the right.
+	carry := n - 1
+	for i := len(counter) - 1; i >= 0 && carry > 0; i-- {
+		d := int(counter[i]-zero) + carry
+		counter[i] = zero + byte(d%int(base))
+		carry = d / int(base)
+	}
+	if carry > 0 {
+		return "", xerrors.Errorf("split: no segment %d for %s", n, first)
+	}
+	return first[:len(first)-len(counter)] + string(counter), nil
+}
+
+// Open opens the image whose first segment file is name, such as disk.001
+// or disk.aa, along with the segment files following it. The image must be
+// closed to close the files.
+func Open(name string, opts ...Option) (*Image, error) {
+	if _, err := SegmentName(name, 1); err != nil {
+		return nil, err
+	}
+
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	var sizes []int64
+	for n := 1; ; n++ {
+		next, err := SegmentName(name, n)
+		if err != nil {
+			break
+		}
+		f, err := os.Open(next)
+		if n > 1 && errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, f)
+		info, err := f.Stat()
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		sizes = append(sizes, info.Size())
+	}
+
+	segments := make([]io.ReaderAt, len(files))
+	for i, f := range files {
+		segments[i] = f
+	}
+	img, err := New(segments, sizes, opts...)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	for _, f := range files {
+		img.closers = append(img.closers, f)
+	}
+	return img, nil
+}
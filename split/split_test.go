@@ -0,0 +1,242 @@
+package split
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ext "github.com/asalih/go-ext"
+	"github.com/asalih/go-ext/internal/testimage"
+	"github.com/asalih/go-ext/partition"
+)
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+// splitData cuts data into segments of segSize bytes.
+func splitData(data []byte, segSize int) ([]io.ReaderAt, []int64) {
+	var segments []io.ReaderAt
+	var sizes []int64
+	for off := 0; off < len(data); off += segSize {
+		end := off + segSize
+		if end > len(data) {
+			end = len(data)
+		}
+		segments = append(segments, bytes.NewReader(data[off:end]))
+		sizes = append(sizes, int64(end-off))
+	}
+	return segments, sizes
+}
+
+func TestReadAt(t *testing.T) {
+	data := testData(10000)
+	img, err := New(splitData(data, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Size() != int64(len(data)) || img.Segments() != 10 {
+		t.Fatalf("Size = %d, Segments = %d", img.Size(), img.Segments())
+	}
+	for _, tc := range []struct{ off, n int }{
+		{0, 10000}, {0, 1024}, {1000, 100}, {1023, 2}, {2047, 3000}, {9999, 1}, {9216, 784},
+	} {
+		buf := make([]byte, tc.n)
+		if n, err := img.ReadAt(buf, int64(tc.off)); n != tc.n || err != nil {
+			t.Errorf("ReadAt(%d, %d) = %d, %v", tc.off, tc.n, n, err)
+		} else if !bytes.Equal(buf, data[tc.off:tc.off+tc.n]) {
+			t.Errorf("ReadAt(%d, %d) returned wrong data", tc.off, tc.n)
+		}
+	}
+
+	buf := make([]byte, 100)
+	if n, err := img.ReadAt(buf, 9950); n != 50 || err != io.EOF {
+		t.Errorf("ReadAt past the end = %d, %v, want 50, EOF", n, err)
+	}
+	if n, err := img.ReadAt(buf, 10000); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt at the end = %d, %v, want 0, EOF", n, err)
+	}
+}
+
+func TestSegmentSizes(t *testing.T) {
+	r := bytes.NewReader(make([]byte, 100))
+	for _, tc := range []struct {
+		sizes []int64
+		ok    bool
+	}{
+		{[]int64{100}, true},
+		{[]int64{100, 100, 50}, true},
+		{[]int64{100, 50, 100}, false},
+		{[]int64{100, 150}, false},
+		{[]int64{100, 0}, false},
+	} {
+		segments := make([]io.ReaderAt, len(tc.sizes))
+		for i := range segments {
+			segments[i] = r
+		}
+		_, err := New(segments, tc.sizes)
+		if tc.ok != (err == nil) {
+			t.Errorf("New with sizes %v: %v", tc.sizes, err)
+		}
+		if err != nil && tc.sizes[len(tc.sizes)-1] != 0 && !errors.Is(err, ErrSegmentSize) {
+			t.Errorf("New with sizes %v: %v, want ErrSegmentSize", tc.sizes, err)
+		}
+	}
+
+	data := testData(300)
+	segments := []io.ReaderAt{bytes.NewReader(data[:50]), bytes.NewReader(data[50:250]), bytes.NewReader(data[250:])}
+	img, err := New(segments, []int64{50, 200, 50}, WithAnySegmentSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 300)
+	if _, err := img.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, data) {
+		t.Errorf("ReadAt with any segment size: %v", err)
+	}
+
+	// A segment shorter than its declared size fails the read.
+	short, _ := New([]io.ReaderAt{bytes.NewReader(data[:40]), bytes.NewReader(data)}, []int64{50, 50})
+	if _, err := short.ReadAt(buf[:60], 0); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ReadAt of short segment: %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestSegmentName(t *testing.T) {
+	for _, tc := range []struct {
+		first string
+		n     int
+		want  string
+	}{
+		{"disk.001", 1, "disk.001"},
+		{"disk.001", 2, "disk.002"},
+		{"disk.001", 10, "disk.010"},
+		{"disk.000", 1000, "disk.999"},
+		{"disk.raw.01", 5, "disk.raw.05"},
+		{"disk.aa", 2, "disk.ab"},
+		{"disk.aa", 27, "disk.ba"},
+		{"disk.AZ", 2, "disk.BA"},
+		{"/a/b.aaa", 678, "/a/b.bab"},
+	} {
+		if got, err := SegmentName(tc.first, tc.n); err != nil || got != tc.want {
+			t.Errorf("SegmentName(%q, %d) = %q, %v, want %q", tc.first, tc.n, got, err, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		first string
+		n     int
+	}{
+		{"disk.001", 1000},
+		{"disk.zz", 2},
+		{"disk.img", 0},
+		{"disk.a1", 1},
+		{"disk", 1},
+		{"disk.1", 1},
+	} {
+		if got, err := SegmentName(tc.first, tc.n); err == nil {
+			t.Errorf("SegmentName(%q, %d) = %q, want error", tc.first, tc.n, got)
+		}
+	}
+}
+
+// writeSegments writes data to dir split in segments of segSize bytes named
+// after first.
+func writeSegments(t *testing.T, dir, first string, data []byte, segSize int) string {
+	for i := 0; i*segSize < len(data); i++ {
+		end := (i + 1) * segSize
+		if end > len(data) {
+			end = len(data)
+		}
+		name, err := SegmentName(filepath.Join(dir, first), i+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, data[i*segSize:end], 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, first)
+}
+
+func TestOpenFileSystem(t *testing.T) {
+	b := testimage.New(testimage.Ext4())
+	b.File("evidence.txt", []byte("acquired"))
+	fsImg := b.MustBuild()
+
+	for _, first := range []string{"disk.001", "disk.aa"} {
+		t.Run(first, func(t *testing.T) {
+			name := writeSegments(t, t.TempDir(), first, fsImg, 300*1024)
+			img, err := Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close()
+			if img.Segments() < 2 || img.Size() != int64(len(fsImg)) {
+				t.Fatalf("opened %d segments of %d bytes", img.Segments(), img.Size())
+			}
+
+			fsys, err := ext.NewFS(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err := fs.ReadFile(fsys, "evidence.txt"); err != nil || string(data) != "acquired" {
+				t.Errorf("ReadFile returned %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestOpenPartitioned(t *testing.T) {
+	b := testimage.New(testimage.Ext4())
+	b.File("evidence.txt", []byte("partitioned"))
+	fsImg := b.MustBuild()
+
+	// An MBR with one Linux partition starting at sector 2048.
+	disk := make([]byte, 1<<20+len(fsImg))
+	copy(disk[1<<20:], fsImg)
+	entry := disk[446:]
+	entry[4] = 0x83
+	putLE32(entry[8:], 2048)
+	putLE32(entry[12:], uint32(len(fsImg)/512))
+	disk[510], disk[511] = 0x55, 0xaa
+
+	name := writeSegments(t, t.TempDir(), "disk.001", disk, 1<<20)
+	img, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	table, err := partition.Read(img, img.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.Partitions) != 1 {
+		t.Fatalf("found %d partitions", len(table.Partitions))
+	}
+	p := table.Partitions[0]
+	fsys, err := ext.NewFS(io.NewSectionReader(img, p.Start, p.Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile(fsys, "evidence.txt"); err != nil || string(data) != "partitioned" {
+		t.Errorf("ReadFile returned %q, %v", data, err)
+	}
+}
+
+func putLE32(b []byte, v uint32) {
+	b[0], b[1], b[2], b[3] = byte(v), byte(v>>8), byte(v>>16), byte(v>>24)
+}
+
+func TestOpenMissingFirst(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "disk.001")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open of missing image: %v, want ErrNotExist", err)
+	}
+}
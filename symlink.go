@@ -2,6 +2,9 @@ package ext
 
 import (
 	"strings"
+
+	"github.com/asalih/go-ext/common"
+	"github.com/asalih/go-ext/syserror"
 )
 
 // symlink represents a symlink inode.
@@ -20,6 +23,9 @@ func newSymlink(args inodeArgs) (*symlink, error) {
 	// If the symlink target is lesser than 60 bytes, its stores in inode.Data().
 	// Otherwise either extents or block maps will be used to store the link.
 	size := args.diskInode.Size()
+	if size > common.PATH_MAX {
+		return nil, syserror.ENAMETOOLONG
+	}
 	if size < 60 {
 		link = args.diskInode.Data()[:size]
 	} else {
@@ -30,12 +36,20 @@ func newSymlink(args inodeArgs) (*symlink, error) {
 		}
 
 		link = make([]byte, size)
-		if n, err := regFile.impl.ReadAt(link, 0); uint64(n) < size {
+		if n, err := regFile.reader(args.fs).ReadAt(link, 0); uint64(n) < size {
+			return nil, err
+		}
+	}
+
+	target := string(link)
+	if args.crypt != nil {
+		var err error
+		if target, err = args.crypt.symlinkTarget(link); err != nil {
 			return nil, err
 		}
 	}
 
-	file := &symlink{target: string(link)}
+	file := &symlink{target: target}
 	file.inode.init(args, file)
 	return file, nil
 }
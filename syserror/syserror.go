@@ -7,16 +7,18 @@ import (
 
 // The following variables have the same meaning as their syscall equivalent.
 var (
-	EIDRM    = error(syscall.Errno(0x2b))
-	EINTR    = error(syscall.Errno(0x4))
-	EIO      = error(syscall.Errno(0x5))
-	EISDIR   = error(syscall.Errno(0x15))
-	ENOENT   = error(syscall.Errno(0x2))
-	ENOEXEC  = error(syscall.Errno(0x8))
-	ENOMEM   = error(syscall.Errno(0xc))
-	ENOTSOCK = error(syscall.Errno(0x58))
-	ENOSPC   = error(syscall.Errno(0x1c))
-	ENOSYS   = error(syscall.Errno(0x26))
+	EIDRM        = error(syscall.Errno(0x2b))
+	EINTR        = error(syscall.Errno(0x4))
+	EIO          = error(syscall.Errno(0x5))
+	EISDIR       = error(syscall.Errno(0x15))
+	ENAMETOOLONG = error(syscall.Errno(0x24))
+	ENOENT       = error(syscall.Errno(0x2))
+	ENOEXEC      = error(syscall.Errno(0x8))
+	ENOMEM       = error(syscall.Errno(0xc))
+	ENOTSOCK     = error(syscall.Errno(0x58))
+	ENOSPC       = error(syscall.Errno(0x1c))
+	ENOSYS       = error(syscall.Errno(0x26))
+	EUCLEAN      = error(syscall.Errno(0x75))
 )
 
 var (
@@ -37,4 +39,8 @@ var (
 
 	// EINVAL is returned for invalid argument
 	EINVAL = errors.New("invalid argument")
+
+	// EFSCORRUPTED is returned when on-disk structures are inconsistent. ext4
+	// reports this condition as EUCLEAN.
+	EFSCORRUPTED = EUCLEAN
 )
@@ -0,0 +1,347 @@
+package ext
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asalih/go-ext/internal/unixtime"
+	"github.com/asalih/go-ext/linux"
+	"golang.org/x/xerrors"
+)
+
+// tarBlockSize is the size of tar headers and the unit data is padded to.
+const tarBlockSize = 512
+
+// TarOption configures a FileSystem.WriteTar.
+type TarOption func(*tarOptions)
+
+type tarOptions struct {
+	ctx    context.Context
+	sparse bool
+}
+
+// WithTarContext binds the reads of WriteTar to ctx, which stops it with
+// ctx.Err() once done.
+func WithTarContext(ctx context.Context) TarOption {
+	return func(o *tarOptions) {
+		o.ctx = ctx
+	}
+}
+
+// WithTarSparse sets whether files with holes are written as GNU sparse
+// entries, which is the default. Without it their holes are written out as
+// zeros.
+func WithTarSparse(enabled bool) TarOption {
+	return func(o *tarOptions) {
+		o.sparse = enabled
+	}
+}
+
+// WriteTar writes the file or directory tree root to w as a PAX tar archive.
+// Entries are named relative to root, so a directory root is not part of the
+// archive and a file root is archived under its base name.
+//
+// Entries record the owner and group IDs, the permission bits and the access,
+// modification and change times to the nanosecond. Symlinks, device nodes
+// and fifos get their own entries, files sharing an inode are archived once
+// and linked to by hard link entries, and extended attributes are stored as
+// SCHILY.xattr PAX records. Files with holes are written in the GNU sparse
+// format 1.0 so that their holes take no space. Sockets cannot be archived
+// and are left out.
+func (f *FileSystem) WriteTar(w io.Writer, root string, opts ...TarOption) error {
+	o := tarOptions{ctx: context.Background(), sparse: true}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	f = f.withContext(o.ctx)
+
+	tw := &tarWriter{
+		fsys:   f,
+		w:      w,
+		tw:     tar.NewWriter(w),
+		sparse: o.sparse,
+		links:  make(map[uint64]string),
+	}
+	root = path.Clean(root)
+	err := fs.WalkDir(f, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctxErr := o.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		var rel string
+		switch {
+		case name != root:
+			rel = strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+			if root == "." {
+				rel = name
+			}
+		case d.IsDir():
+			return nil
+		default:
+			rel = path.Base(name)
+		}
+		return tw.writeEntry(name, rel, d)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.tw.Close()
+}
+
+// tarWriter holds the state of a WriteTar.
+type tarWriter struct {
+	fsys   *FileSystem
+	w      io.Writer
+	tw     *tar.Writer
+	sparse bool
+
+	// links maps the inode numbers of archived files with several links to
+	// their entry name.
+	links map[uint64]string
+}
+
+// writeEntry archives the file name, whose entry is d, as rel.
+func (t *tarWriter) writeEntry(name, rel string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*Statx)
+	if !ok {
+		return xerrors.Errorf("%s has no inode metadata", name)
+	}
+
+	hdr := &tar.Header{
+		Name:       rel,
+		Mode:       int64(st.Mode) &^ linux.FileTypeMask,
+		Uid:        int(st.UID),
+		Gid:        int(st.GID),
+		ModTime:    st.Mtime,
+		AccessTime: st.Atime,
+		ChangeTime: st.Ctime,
+		Format:     tar.FormatPAX,
+	}
+	attrs, err := t.fsys.Xattrs(name)
+	if err != nil {
+		return err
+	}
+	if len(attrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(attrs))
+		for k, v := range attrs {
+			hdr.PAXRecords["SCHILY.xattr."+k] = string(v)
+		}
+	}
+
+	if !info.IsDir() && st.Nlink > 1 {
+		if first, ok := t.links[st.Ino]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			return t.tw.WriteHeader(hdr)
+		}
+	}
+
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case mode.IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+	case mode&fs.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		link, err := fs.ReadFile(t.fsys, name)
+		if err != nil {
+			return err
+		}
+		hdr.Linkname = string(link)
+	case mode&fs.ModeDevice != 0:
+		hdr.Typeflag = tar.TypeBlock
+		if mode&fs.ModeCharDevice != 0 {
+			hdr.Typeflag = tar.TypeChar
+		}
+		hdr.Devmajor = int64(st.RdevMajor)
+		hdr.Devminor = int64(st.RdevMinor)
+	case mode&fs.ModeNamedPipe != 0:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		return nil
+	}
+	if st.Nlink > 1 && !info.IsDir() {
+		t.links[st.Ino] = hdr.Name
+	}
+
+	if hdr.Typeflag != tar.TypeReg {
+		return t.tw.WriteHeader(hdr)
+	}
+	return t.writeFile(name, hdr)
+}
+
+// writeFile archives the regular file name under hdr.
+func (t *tarWriter) writeFile(name string, hdr *tar.Header) error {
+	in, err := t.fsys.lookupPath(name)
+	if err != nil {
+		return err
+	}
+	rf, ok := in.impl.(*regularFile)
+	if !ok {
+		return xerrors.Errorf("%s is not a regular file", name)
+	}
+	r := io.NewSectionReader(rf.reader(t.fsys), 0, hdr.Size)
+
+	if t.sparse {
+		ranges, err := rf.dataRanges(t.fsys)
+		if err != nil {
+			return err
+		}
+		var mapped uint64
+		for _, dr := range ranges {
+			mapped += dr.length
+		}
+		if mapped < uint64(hdr.Size) {
+			return t.writeSparse(hdr, ranges, r)
+		}
+	}
+
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(t.tw, r); err != nil {
+		return xerrors.Errorf("failed to archive %s: %w", name, err)
+	}
+	return nil
+}
+
+// writeSparse writes a file with holes as a GNU sparse 1.0 entry, which
+// archive/tar cannot write. It is a PAX entry named after a GNUSparseFile.0
+// directory whose records hold the real name and size, and whose data is a
+// map of the data ranges followed by the data of those ranges.
+func (t *tarWriter) writeSparse(hdr *tar.Header, ranges []dataRange, r io.ReaderAt) error {
+	// Finish the previous entry, the headers are written directly to w.
+	if err := t.tw.Flush(); err != nil {
+		return err
+	}
+
+	// A hole at the end is recorded by an empty range.
+	if n := len(ranges); n == 0 || ranges[n-1].off+ranges[n-1].length < uint64(hdr.Size) {
+		ranges = append(ranges, dataRange{off: uint64(hdr.Size)})
+	}
+	sparseMap := strconv.AppendInt(nil, int64(len(ranges)), 10)
+	sparseMap = append(sparseMap, '\n')
+	var dataSize int64
+	for _, dr := range ranges {
+		sparseMap = strconv.AppendUint(sparseMap, dr.off, 10)
+		sparseMap = append(sparseMap, '\n')
+		sparseMap = strconv.AppendUint(sparseMap, dr.length, 10)
+		sparseMap = append(sparseMap, '\n')
+		dataSize += int64(dr.length)
+	}
+	sparseMap = append(sparseMap, make([]byte, tarPadding(int64(len(sparseMap))))...)
+	size := int64(len(sparseMap)) + dataSize
+
+	dir, file := path.Split(hdr.Name)
+	name := path.Join(dir, "GNUSparseFile.0", file)
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+		"size":                strconv.FormatInt(size, 10),
+		"uid":                 strconv.Itoa(hdr.Uid),
+		"gid":                 strconv.Itoa(hdr.Gid),
+		"mtime":               unixtime.Format(hdr.ModTime),
+		"atime":               unixtime.Format(hdr.AccessTime),
+		"ctime":               unixtime.Format(hdr.ChangeTime),
+	}
+	if len(name) > 100 {
+		records["path"] = name
+	}
+	for k, v := range hdr.PAXRecords {
+		records[k] = v
+	}
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pax strings.Builder
+	for _, k := range keys {
+		pax.WriteString(paxRecord(k, records[k]))
+	}
+
+	paxName := path.Join(dir, "PaxHeaders.0", file)
+	blocks := tarHeaderBlock(paxName, tar.TypeXHeader, 0, 0, 0, int64(pax.Len()), hdr.ModTime)
+	blocks = append(blocks, pax.String()...)
+	blocks = append(blocks, make([]byte, tarPadding(int64(pax.Len())))...)
+	blocks = append(blocks, tarHeaderBlock(name, tar.TypeReg, hdr.Mode, hdr.Uid, hdr.Gid, size, hdr.ModTime)...)
+	blocks = append(blocks, sparseMap...)
+	if _, err := t.w.Write(blocks); err != nil {
+		return err
+	}
+
+	for _, dr := range ranges {
+		if _, err := io.Copy(t.w, io.NewSectionReader(r, int64(dr.off), int64(dr.length))); err != nil {
+			return xerrors.Errorf("failed to archive %s: %w", hdr.Name, err)
+		}
+	}
+	_, err := t.w.Write(make([]byte, tarPadding(dataSize)))
+	return err
+}
+
+// tarPadding returns the number of bytes padding n bytes to a block.
+func tarPadding(n int64) int64 {
+	return -n & (tarBlockSize - 1)
+}
+
+// tarHeaderBlock returns a ustar header block. Fields which do not fit are
+// left empty; the PAX records preceding the header hold them.
+func tarHeaderBlock(name string, typeflag byte, mode int64, uid, gid int, size int64, mtime time.Time) []byte {
+	blk := make([]byte, tarBlockSize)
+	copy(blk[0:100], name)
+	putTarOctal(blk[100:108], mode)
+	putTarOctal(blk[108:116], int64(uid))
+	putTarOctal(blk[116:124], int64(gid))
+	putTarOctal(blk[124:136], size)
+	putTarOctal(blk[136:148], mtime.Unix())
+	blk[156] = typeflag
+	copy(blk[257:], "ustar\x0000")
+
+	// The checksum is computed with the checksum field set to spaces.
+	copy(blk[148:156], "        ")
+	var sum int64
+	for _, b := range blk {
+		sum += int64(b)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return blk
+}
+
+// putTarOctal writes v as a NUL terminated octal number filling b, if it fits.
+func putTarOctal(b []byte, v int64) {
+	s := fmt.Sprintf("%0*o", len(b)-1, v)
+	if v < 0 || len(s) > len(b)-1 {
+		return
+	}
+	copy(b, s)
+}
+
+// paxRecord formats a PAX record, which starts with its own length.
+func paxRecord(k, v string) string {
+	size := len(k) + len(v) + len(" =\n")
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	if len(record) != size {
+		// The length gained a digit.
+		record = strconv.Itoa(len(record)) + " " + k + "=" + v + "\n"
+	}
+	return record
+}
@@ -0,0 +1,174 @@
+package ext
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+// readTar returns the headers and the contents of the entries of archive.
+func readTar(t *testing.T, archive []byte) (map[string]*tar.Header, map[string][]byte) {
+	t.Helper()
+	hdrs := make(map[string]*tar.Header)
+	data := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return hdrs, data
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := hdrs[hdr.Name]; ok {
+			t.Errorf("%s archived twice", hdr.Name)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading %s: %v", hdr.Name, err)
+		}
+		hdrs[hdr.Name], data[hdr.Name] = hdr, b
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	forEachImage(t, func(t *testing.T, fsys *FileSystem, b *testimage.Builder, entries map[string]testimage.Entry) {
+		var buf bytes.Buffer
+		if err := fsys.WriteTar(&buf, "/"); err != nil {
+			t.Fatal(err)
+		}
+		hdrs, data := readTar(t, buf.Bytes())
+
+		for _, name := range []string{"a.txt", "big.bin", "dir/sub/deep.txt", "xattr.txt"} {
+			if !bytes.Equal(data[name], entries[name].Data) {
+				t.Errorf("%s differs", name)
+			}
+		}
+		if hdr := hdrs["a.txt"]; hdr == nil || hdr.Uid != 1000 || hdr.Gid != 100 || hdr.Mode != 0644 {
+			t.Errorf("a.txt has header %+v", hdr)
+		}
+		if hdr := hdrs["dir/sub/"]; hdr == nil || hdr.Typeflag != tar.TypeDir {
+			t.Errorf("dir/sub/ has header %+v", hdr)
+		}
+		if hdr := hdrs["link"]; hdr == nil || hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "a.txt" {
+			t.Errorf("link has header %+v", hdr)
+		}
+		if hdr := hdrs["longlink"]; hdr == nil || hdr.Linkname != entries["longlink"].Target {
+			t.Errorf("longlink has header %+v", hdr)
+		}
+
+		// Whichever of a.txt and hard.txt is walked first holds the data.
+		first, second := hdrs["a.txt"], hdrs["hard.txt"]
+		if first == nil || second == nil {
+			t.Fatalf("a.txt or hard.txt is missing")
+		}
+		if first.Typeflag == tar.TypeLink {
+			first, second = second, first
+		}
+		if first.Typeflag != tar.TypeReg || second.Typeflag != tar.TypeLink || second.Linkname != first.Name {
+			t.Errorf("hard link archived as %+v and %+v", first, second)
+		}
+
+		if hdr := hdrs["dev/null"]; hdr == nil || hdr.Typeflag != tar.TypeChar || hdr.Devmajor != 1 || hdr.Devminor != 3 {
+			t.Errorf("dev/null has header %+v", hdr)
+		}
+		if hdr := hdrs["dev/fifo"]; hdr == nil || hdr.Typeflag != tar.TypeFifo {
+			t.Errorf("dev/fifo has header %+v", hdr)
+		}
+		if hdr := hdrs["xattr.txt"]; hdr == nil {
+			t.Errorf("xattr.txt is missing")
+		} else {
+			for k, v := range entries["xattr.txt"].Xattrs {
+				if got := hdr.PAXRecords["SCHILY.xattr."+k]; got != string(v) {
+					t.Errorf("xattr.txt has %s = %q, want %q", k, got, v)
+				}
+			}
+		}
+
+		sparse := entries["sparse.bin"]
+		hdr := hdrs["sparse.bin"]
+		if hdr == nil || hdr.Size != sparse.Size {
+			t.Fatalf("sparse.bin has header %+v", hdr)
+		}
+		want := make([]byte, sparse.Size)
+		copy(want, sparse.Data)
+		if !bytes.Equal(data["sparse.bin"], want) {
+			t.Errorf("sparse.bin differs")
+		}
+		if int64(buf.Len()) > sparse.Size {
+			t.Errorf("archive of %d bytes holds the holes of sparse.bin", buf.Len())
+		}
+
+		// Without sparse entries the holes are written out.
+		buf.Reset()
+		if err := fsys.WriteTar(&buf, "sparse.bin", WithTarSparse(false)); err != nil {
+			t.Fatal(err)
+		}
+		_, data = readTar(t, buf.Bytes())
+		if !bytes.Equal(data["sparse.bin"], want) || int64(buf.Len()) < sparse.Size {
+			t.Errorf("sparse.bin archived as %d bytes in %d", len(data["sparse.bin"]), buf.Len())
+		}
+	})
+}
+
+func TestWriteTarTimes(t *testing.T) {
+	mtime := time.Date(2021, time.March, 4, 5, 6, 7, 123456789, time.UTC)
+	fsys := extractImage(t,
+		testimage.Entry{Name: "dir/a.txt", Mode: 0644, Data: []byte("a"), Mtime: mtime},
+		testimage.Entry{Name: "dir/holes", Mode: 0644, Data: []byte("x"), Size: 1 << 20, Mtime: mtime},
+	)
+	var buf bytes.Buffer
+	if err := fsys.WriteTar(&buf, "dir"); err != nil {
+		t.Fatal(err)
+	}
+	hdrs, _ := readTar(t, buf.Bytes())
+	if len(hdrs) != 2 {
+		t.Errorf("archived %d entries, want 2", len(hdrs))
+	}
+	for _, name := range []string{"a.txt", "holes"} {
+		if hdr := hdrs[name]; hdr == nil || !hdr.ModTime.Equal(mtime) {
+			t.Errorf("%s has header %+v, want mtime %v", name, hdr, mtime)
+		}
+	}
+}
+
+func TestUnwrittenExtents(t *testing.T) {
+	// A block of data, a hole, preallocated blocks and a trailing hole, as
+	// fallocate(2) past the data of a file leaves it.
+	const bs = 4096
+	data := bytes.Repeat([]byte("data"), bs/4)
+	fsys := extractImage(t, testimage.Entry{
+		Name:      "prealloc",
+		Mode:      0644,
+		Data:      data,
+		Size:      16 * bs,
+		Unwritten: []testimage.Range{{Off: 2 * bs, Len: 11 * bs}},
+	})
+	want := make([]byte, 16*bs)
+	copy(want, data)
+
+	got, err := fs.ReadFile(fsys, "prealloc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("prealloc reads stale bytes of its unwritten blocks")
+	}
+
+	var buf bytes.Buffer
+	if err := fsys.WriteTar(&buf, "prealloc"); err != nil {
+		t.Fatal(err)
+	}
+	_, files := readTar(t, buf.Bytes())
+	if !bytes.Equal(files["prealloc"], want) {
+		t.Errorf("prealloc archived as %d bytes which differ", len(files["prealloc"]))
+	}
+	if buf.Len() > 4*bs {
+		t.Errorf("archive of %d bytes holds the unwritten blocks of prealloc", buf.Len())
+	}
+}
@@ -0,0 +1,428 @@
+// Package timeline builds filesystem timelines of ext images. It writes
+// bodyfiles in the format of The Sleuth Kit's fls -m and ils -m, one line of
+// metadata per file with its access, modification, change and creation times,
+// and sorts them into a mactime-style CSV timeline of events.
+package timeline
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ext "github.com/asalih/go-ext"
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/internal/unixtime"
+	"github.com/asalih/go-ext/linux"
+	"golang.org/x/xerrors"
+)
+
+// Record is one line of a bodyfile:
+//
+//	MD5|name|inode|mode|UID|GID|size|atime|mtime|ctime|crtime
+//
+// Times are in seconds since the epoch with an optional fraction. A zero time
+// is written as 0, which bodyfiles use for a time that is not recorded.
+type Record struct {
+	// MD5 is the hex MD5 digest of the content of regular files, or "0" if
+	// it was not computed.
+	MD5 string
+
+	// Name is the path of the file. Symlinks are followed by " -> " and
+	// their target, deleted files by " (deleted)".
+	Name  string
+	Inode uint64
+
+	// Mode is the type of the directory entry, a slash, the type of the
+	// inode and the permissions, as in "r/rrw-r--r--" or "d/drwxr-xr-x".
+	// The entry type is "-" when unknown.
+	Mode string
+	UID  uint32
+	GID  uint32
+	Size uint64
+
+	Atime  time.Time
+	Mtime  time.Time
+	Ctime  time.Time
+	Crtime time.Time
+}
+
+// String returns r as a bodyfile line, without the line break.
+func (r Record) String() string {
+	md5 := r.MD5
+	if md5 == "" {
+		md5 = "0"
+	}
+	return strings.Join([]string{
+		md5,
+		r.Name,
+		strconv.FormatUint(r.Inode, 10),
+		r.Mode,
+		strconv.FormatUint(uint64(r.UID), 10),
+		strconv.FormatUint(uint64(r.GID), 10),
+		strconv.FormatUint(r.Size, 10),
+		formatTime(r.Atime),
+		formatTime(r.Mtime),
+		formatTime(r.Ctime),
+		formatTime(r.Crtime),
+	}, "|")
+}
+
+// ParseRecord parses a bodyfile line. Names holding "|" are accepted, since
+// every other field is known.
+func ParseRecord(line string) (Record, error) {
+	fields := strings.Split(strings.TrimRight(line, "\r\n"), "|")
+	if len(fields) < 11 {
+		return Record{}, xerrors.Errorf("timeline: bodyfile line has %d fields, want 11", len(fields))
+	}
+	// The name takes whatever the nine fields after it leave.
+	tail := fields[len(fields)-9:]
+	r := Record{
+		MD5:  fields[0],
+		Name: strings.Join(fields[1:len(fields)-9], "|"),
+		Mode: tail[1],
+	}
+
+	var err error
+	if r.Inode, err = parseUint(tail[0], 64); err != nil {
+		return Record{}, err
+	}
+	uid, err := parseUint(tail[2], 32)
+	if err != nil {
+		return Record{}, err
+	}
+	gid, err := parseUint(tail[3], 32)
+	if err != nil {
+		return Record{}, err
+	}
+	r.UID, r.GID = uint32(uid), uint32(gid)
+	if r.Size, err = parseUint(tail[4], 64); err != nil {
+		return Record{}, err
+	}
+	for i, t := range []*time.Time{&r.Atime, &r.Mtime, &r.Ctime, &r.Crtime} {
+		if *t, err = parseTime(tail[5+i]); err != nil {
+			return Record{}, err
+		}
+	}
+	return r, nil
+}
+
+// ReadBodyfile reads the records of a bodyfile. Empty lines are skipped.
+func ReadBodyfile(r io.Reader) ([]Record, error) {
+	var records []Record
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		rec, err := ParseRecord(sc.Text())
+		if err != nil {
+			return nil, xerrors.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Option configures Walk and WriteBodyfile.
+type Option func(*options)
+
+type options struct {
+	deleted    bool
+	md5        bool
+	mountPoint string
+	errFunc    func(name string, err error) error
+}
+
+// WithDeleted adds a record for every deleted inode found by
+// ext.FileSystem.ScanDeletedInodes. Their names are lost with their directory
+// entries, so they are named like The Sleuth Kit names orphan files:
+// /$OrphanFiles/OrphanFile-<inode> (deleted).
+func WithDeleted(enabled bool) Option {
+	return func(o *options) {
+		o.deleted = enabled
+	}
+}
+
+// WithMD5 computes the MD5 digest of every regular file, which means reading
+// all of their content.
+func WithMD5(enabled bool) Option {
+	return func(o *options) {
+		o.md5 = enabled
+	}
+}
+
+// WithMountPoint prefixes every name with dir, the path the filesystem was
+// mounted on, so that the bodyfiles of several filesystems can be merged.
+func WithMountPoint(dir string) Option {
+	return func(o *options) {
+		o.mountPoint = strings.TrimSuffix(dir, "/")
+	}
+}
+
+// WithErrorFunc sets the function Walk reports the files it fails to read to,
+// with their path in fsys. Returning nil skips the file, and the content of a
+// directory that cannot be read, and goes on with the walk; returning an error
+// stops it. Without it, Walk skips the files and returns their errors joined
+// once the walk is over.
+func WithErrorFunc(fn func(name string, err error) error) Option {
+	return func(o *options) {
+		o.errFunc = fn
+	}
+}
+
+// Walk calls fn with the record of every file and directory of fsys, root
+// included, and then with those of the deleted inodes if WithDeleted is set.
+// Files are visited in no particular order, but fn is never called
+// concurrently. An error from fn stops the walk and is returned.
+//
+// Files which cannot be read are left out and reported as WithErrorFunc
+// describes, so that one damaged directory or inode does not cost the records
+// of the rest of the filesystem.
+func Walk(ctx context.Context, fsys *ext.FileSystem, fn func(Record) error, opts ...Option) error {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var errs []error
+	report := o.errFunc
+	if report == nil {
+		report = func(name string, err error) error {
+			errs = append(errs, xerrors.Errorf("%s: %w", name, err))
+			return nil
+		}
+	}
+
+	var mu sync.Mutex
+	err := fsys.Walk(ctx, "/", func(name string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		var rec Record
+		if err == nil {
+			rec, err = fileRecord(ctx, fsys, name, d, o)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			return report(name, err)
+		}
+		return fn(rec)
+	}, ext.WithInodeOrder(true))
+	if err == nil && o.deleted {
+		s := fsys.ScanDeletedInodesContext(ctx)
+		for err == nil && s.Next() {
+			inodeNum, in := s.Inode()
+			err = fn(deletedRecord(inodeNum, in, o))
+		}
+		if err == nil {
+			err = s.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// WriteBodyfile writes the records of Walk to w, one line each.
+func WriteBodyfile(ctx context.Context, w io.Writer, fsys *ext.FileSystem, opts ...Option) error {
+	bw := bufio.NewWriter(w)
+	err := Walk(ctx, fsys, func(r Record) error {
+		_, err := fmt.Fprintln(bw, r)
+		return err
+	}, opts...)
+	// The records of the files which could be read are written even if
+	// others could not.
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// fileRecord returns the record of the file name, whose entry is d.
+func fileRecord(ctx context.Context, fsys *ext.FileSystem, name string, d fs.DirEntry, o options) (Record, error) {
+	info, err := d.Info()
+	if err != nil {
+		return Record{}, err
+	}
+	st, ok := info.Sys().(*ext.Statx)
+	if !ok {
+		return Record{}, xerrors.Errorf("timeline: %s has no inode metadata", name)
+	}
+	rec := Record{
+		MD5:    "0",
+		Name:   o.mountPoint + name,
+		Inode:  st.Ino,
+		Mode:   ModeString(st.Mode, st.Mode),
+		UID:    st.UID,
+		GID:    st.GID,
+		Size:   st.Size,
+		Atime:  st.Atime,
+		Mtime:  st.Mtime,
+		Ctime:  st.Ctime,
+		Crtime: st.Btime,
+	}
+	if name == "/" && o.mountPoint != "" {
+		rec.Name = o.mountPoint
+	}
+
+	// Paths of Walk are rooted, those of fs.FS are not.
+	fsName := strings.TrimPrefix(name, "/")
+	switch {
+	case st.Mode&linux.FileTypeMask == linux.ModeSymlink:
+		target, err := readAll(ctx, fsys, fsName)
+		if err != nil {
+			return Record{}, err
+		}
+		rec.Name += " -> " + string(target)
+	case st.Mode&linux.FileTypeMask == linux.ModeRegular && o.md5:
+		f, err := fsys.OpenContext(ctx, fsName)
+		if err != nil {
+			return Record{}, err
+		}
+		defer f.Close()
+		h := md5.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return Record{}, xerrors.Errorf("timeline: failed to hash %s: %w", name, err)
+		}
+		rec.MD5 = hex.EncodeToString(h.Sum(nil))
+	}
+	return rec, nil
+}
+
+// readAll returns the content of the file name.
+func readAll(ctx context.Context, fsys *ext.FileSystem, name string) ([]byte, error) {
+	f, err := fsys.OpenContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// deletedRecord returns the record of the deleted inode inodeNum.
+func deletedRecord(inodeNum uint32, in disklayout.Inode, o options) Record {
+	rec := Record{
+		MD5:   "0",
+		Name:  fmt.Sprintf("%s/$OrphanFiles/OrphanFile-%d (deleted)", o.mountPoint, inodeNum),
+		Inode: uint64(inodeNum),
+		Mode:  ModeString(0, uint16(in.Mode())),
+		UID:   in.UID(),
+		GID:   in.GID(),
+		Size:  in.Size(),
+		Atime: in.AccessTime(),
+		Mtime: in.ModificationTime(),
+		Ctime: in.ChangeTime(),
+	}
+	rec.Crtime, _ = in.BirthTime()
+	return rec
+}
+
+// ModeString formats the type of a directory entry and the type and
+// permissions of its inode, both linux modes, as bodyfiles do. Only the type
+// bits of entry are used; if it has none, the entry type is "-".
+func ModeString(entry, mode uint16) string {
+	var b strings.Builder
+	b.WriteByte(typeLetter(entry))
+	b.WriteByte('/')
+	b.WriteByte(typeLetter(mode))
+
+	const rwx = "rwxrwxrwx"
+	for i := 0; i < 9; i++ {
+		c := byte('-')
+		if mode&(1<<(8-i)) != 0 {
+			c = rwx[i]
+		}
+		// The set-user-ID, set-group-ID and sticky bits show in the execute
+		// permission of the owner, group and others.
+		special := [...]uint16{linux.ModeSetUID, linux.ModeSetGID, linux.ModeSticky}
+		if i%3 == 2 && mode&special[i/3] != 0 {
+			lower, upper := byte('s'), byte('S')
+			if i == 8 {
+				lower, upper = 't', 'T'
+			}
+			c = upper
+			if mode&(1<<(8-i)) != 0 {
+				c = lower
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// typeLetter returns the letter bodyfiles use for the file type of mode.
+func typeLetter(mode uint16) byte {
+	switch mode & linux.FileTypeMask {
+	case linux.ModeRegular:
+		return 'r'
+	case linux.ModeDirectory:
+		return 'd'
+	case linux.ModeSymlink:
+		return 'l'
+	case linux.ModeCharacterDevice:
+		return 'c'
+	case linux.ModeBlockDevice:
+		return 'b'
+	case linux.ModeNamedPipe:
+		return 'p'
+	case linux.ModeSocket:
+		return 'h'
+	}
+	return '-'
+}
+
+// formatTime formats t as unixtime.Format does, except for the zero time
+// which is 0.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return unixtime.Format(t)
+}
+
+// parseTime parses a time written by formatTime.
+func parseTime(s string) (time.Time, error) {
+	secs, frac, _ := strings.Cut(s, ".")
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, xerrors.Errorf("timeline: invalid time %q", s)
+	}
+	var nsec int64
+	if frac != "" {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		if nsec, err = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64); err != nil || nsec < 0 {
+			return time.Time{}, xerrors.Errorf("timeline: invalid time %q", s)
+		}
+		if strings.HasPrefix(secs, "-") {
+			nsec = -nsec
+		}
+	}
+	if sec == 0 && nsec == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(sec, nsec).UTC(), nil
+}
+
+func parseUint(s string, bitSize int) (uint64, error) {
+	v, err := strconv.ParseUint(s, 10, bitSize)
+	if err != nil {
+		return 0, xerrors.Errorf("timeline: invalid number %q", s)
+	}
+	return v, nil
+}
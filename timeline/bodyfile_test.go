@@ -0,0 +1,221 @@
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ext "github.com/asalih/go-ext"
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+var (
+	atime  = time.Date(2021, time.January, 1, 10, 0, 0, 100, time.UTC)
+	mtime  = time.Date(2021, time.January, 2, 10, 0, 0, 200000000, time.UTC)
+	ctime  = time.Date(2021, time.January, 3, 10, 0, 0, 0, time.UTC)
+	crtime = time.Date(2020, time.December, 31, 23, 59, 59, 999999999, time.UTC)
+	dtime  = time.Date(2021, time.February, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// testImage returns a filesystem holding a few files with distinct times and
+// a deleted one.
+func testImage(t *testing.T, opts testimage.Options) (*ext.FileSystem, *testimage.Builder) {
+	t.Helper()
+	b := testimage.New(opts)
+	b.Add(testimage.Entry{Name: "etc/passwd", Mode: 0644, Data: []byte("root:x:0:0::/root:/bin/sh\n"), UID: 1, GID: 2,
+		Atime: atime, Mtime: mtime, Ctime: ctime, Crtime: crtime})
+	b.Add(testimage.Entry{Name: "bin/su", Mode: fs.ModeSetuid | 0755, Data: []byte("su")})
+	b.Add(testimage.Entry{Name: "tmp", Mode: fs.ModeDir | fs.ModeSticky | 0777})
+	b.Add(testimage.Entry{Name: "link", Mode: fs.ModeSymlink | 0777, Target: "etc/passwd"})
+	b.Add(testimage.Entry{Name: "gone", Mode: 0600, Mtime: mtime, Dtime: dtime})
+	fsys, err := ext.NewFS(bytes.NewReader(b.MustBuild()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys, b
+}
+
+// records returns the records of Walk by name.
+func records(t *testing.T, fsys *ext.FileSystem, opts ...Option) map[string]Record {
+	t.Helper()
+	recs := make(map[string]Record)
+	err := Walk(context.Background(), fsys, func(r Record) error {
+		if _, ok := recs[r.Name]; ok {
+			t.Errorf("%s reported twice", r.Name)
+		}
+		recs[r.Name] = r
+		return nil
+	}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+func TestWalk(t *testing.T) {
+	fsys, b := testImage(t, testimage.Ext4())
+	recs := records(t, fsys, WithMD5(true))
+
+	passwd, ok := recs["/etc/passwd"]
+	if !ok {
+		t.Fatalf("no record for /etc/passwd in %v", recs)
+	}
+	sum := md5.Sum([]byte("root:x:0:0::/root:/bin/sh\n"))
+	want := Record{
+		MD5:    hex.EncodeToString(sum[:]),
+		Name:   "/etc/passwd",
+		Inode:  uint64(b.Ino("etc/passwd")),
+		Mode:   "r/rrw-r--r--",
+		UID:    1,
+		GID:    2,
+		Size:   26,
+		Atime:  atime,
+		Mtime:  mtime,
+		Ctime:  ctime,
+		Crtime: crtime,
+	}
+	if passwd.String() != want.String() {
+		t.Errorf("got  %s\nwant %s", passwd, want)
+	}
+
+	for name, mode := range map[string]string{
+		"/":                   "d/drwxr-xr-x",
+		"/bin/su":             "r/rrwsr-xr-x",
+		"/tmp":                "d/drwxrwxrwt",
+		"/link -> etc/passwd": "l/lrwxrwxrwx",
+	} {
+		if r, ok := recs[name]; !ok || r.Mode != mode {
+			t.Errorf("%s has mode %q, want %q", name, r.Mode, mode)
+		}
+	}
+	if r := recs["/link -> etc/passwd"]; r.MD5 != "0" {
+		t.Errorf("symlink has MD5 %s", r.MD5)
+	}
+	for name := range recs {
+		if strings.Contains(name, "gone") || strings.Contains(name, "deleted") {
+			t.Errorf("deleted file reported without WithDeleted: %s", name)
+		}
+	}
+
+	// Deleted inodes are named after their inode number.
+	recs = records(t, fsys, WithDeleted(true), WithMountPoint("/mnt/"))
+	gone, ok := recs["/mnt/$OrphanFiles/OrphanFile-"+strconv.Itoa(int(b.Ino("gone")))+" (deleted)"]
+	if !ok {
+		t.Fatalf("no record for the deleted inode in %v", recs)
+	}
+	if gone.Mode != "-/rrw-------" || !gone.Mtime.Equal(mtime) {
+		t.Errorf("deleted inode has record %s", gone)
+	}
+	if _, ok := recs["/mnt"]; !ok {
+		t.Errorf("no record for the mount point")
+	}
+	if _, ok := recs["/mnt/etc/passwd"]; !ok {
+		t.Errorf("no record for /mnt/etc/passwd")
+	}
+}
+
+func TestWalkNoCreationTime(t *testing.T) {
+	fsys, _ := testImage(t, testimage.Ext2())
+	r := records(t, fsys)["/etc/passwd"]
+	if !r.Crtime.IsZero() || !r.Mtime.Equal(mtime.Truncate(time.Second)) {
+		t.Errorf("128 byte inode has record %s", r)
+	}
+}
+
+// failingReader fails the reads starting in [off, off+n).
+type failingReader struct {
+	r      *bytes.Reader
+	off, n int64
+}
+
+var errRead = errors.New("read failed")
+
+func (f failingReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.off && off < f.off+f.n {
+		return 0, errRead
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func TestWalkUnreadable(t *testing.T) {
+	bad := bytes.Repeat([]byte("unreadable"), 1000)
+	b := testimage.New(testimage.Ext2())
+	b.File("bad", bad)
+	b.File("good", []byte("good"))
+	raw := b.MustBuild()
+	fsys, err := ext.NewFS(failingReader{bytes.NewReader(raw), int64(bytes.Index(raw, bad)), int64(len(bad))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	err = Walk(context.Background(), fsys, func(r Record) error {
+		names = append(names, r.Name)
+		return nil
+	}, WithMD5(true))
+	if !errors.Is(err, errRead) || !strings.Contains(err.Error(), "/bad") {
+		t.Errorf("Walk returned %v, want the error of /bad", err)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, " "); got != "/ /good /lost+found" {
+		t.Errorf("Walk reported %s", got)
+	}
+
+	var failed []string
+	err = Walk(context.Background(), fsys, func(Record) error { return nil }, WithMD5(true),
+		WithErrorFunc(func(name string, err error) error {
+			failed = append(failed, name)
+			return nil
+		}))
+	if err != nil || len(failed) != 1 || failed[0] != "/bad" {
+		t.Errorf("Walk reported %q and returned %v", failed, err)
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	fsys, _ := testImage(t, testimage.Ext4())
+	var buf bytes.Buffer
+	if err := WriteBodyfile(context.Background(), &buf, fsys, WithDeleted(true)); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ReadBodyfile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := records(t, fsys, WithDeleted(true))
+	if len(parsed) != len(recs) {
+		t.Errorf("read %d records, wrote %d", len(parsed), len(recs))
+	}
+	for _, r := range parsed {
+		if r.String() != recs[r.Name].String() {
+			t.Errorf("read  %s\nwrote %s", r, recs[r.Name])
+		}
+	}
+	if !recs["/etc/passwd"].Atime.Equal(atime) {
+		t.Errorf("atime lost its nanoseconds")
+	}
+
+	r, err := ParseRecord("0|a|b.txt|12|r/rrw-r--r--|0|0|5|-1.5|0|1600000000.000000001|0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "a|b.txt" || !r.Atime.Equal(time.Unix(-2, 5e8)) || !r.Mtime.IsZero() || r.Ctime.Nanosecond() != 1 {
+		t.Errorf("parsed %+v", r)
+	}
+	if got := r.String(); got != "0|a|b.txt|12|r/rrw-r--r--|0|0|5|-1.5|0|1600000000.000000001|0" {
+		t.Errorf("formatted as %s", got)
+	}
+	for _, line := range []string{"0|a|1|r/r---------|0|0|0|0|0|0", "0|a|x|r/r---------|0|0|0|0|0|0|0", "0|a|1|r/r---------|0|0|0|0|0|0|1.x"} {
+		if _, err := ParseRecord(line); err == nil {
+			t.Errorf("ParseRecord(%q) succeeded", line)
+		}
+	}
+}
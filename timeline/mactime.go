@@ -0,0 +1,98 @@
+package timeline
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DateFormat is the layout of the dates of a CSV timeline. It is the one of
+// mactime with nanoseconds added.
+const DateFormat = "Mon Jan 02 2006 15:04:05.000000000"
+
+// Event is one line of a timeline: a time at which a file was modified,
+// accessed, changed or created, or several of these at once.
+type Event struct {
+	Time time.Time
+
+	// Type is "macb" with the letters of the times of Record other than
+	// Time replaced by dots, as in "m.c." for a file modified and changed
+	// at Time.
+	Type   string
+	Record Record
+}
+
+// Events returns the events of records between from and to, both included,
+// sorted by time and then by name. Every record contributes an event per
+// distinct time it holds; zero times are left out. A zero from or to leaves
+// that end of the range open.
+func Events(records []Record, from, to time.Time) []Event {
+	var events []Event
+	for _, r := range records {
+		times := [4]time.Time{r.Mtime, r.Atime, r.Ctime, r.Crtime}
+		for i, t := range times {
+			if t.IsZero() || (!from.IsZero() && t.Before(from)) || (!to.IsZero() && t.After(to)) {
+				continue
+			}
+			// Times equal to an earlier one were merged into its event.
+			merged := false
+			for _, prev := range times[:i] {
+				merged = merged || prev.Equal(t)
+			}
+			if merged {
+				continue
+			}
+
+			typ := []byte("....")
+			for j, other := range times {
+				if other.Equal(t) {
+					typ[j] = "macb"[j]
+				}
+			}
+			events = append(events, Event{Time: t, Type: string(typ), Record: r})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if !events[i].Time.Equal(events[j].Time) {
+			return events[i].Time.Before(events[j].Time)
+		}
+		return events[i].Record.Name < events[j].Record.Name
+	})
+	return events
+}
+
+// WriteCSV writes events as a CSV timeline with the columns of mactime -d:
+//
+//	Date,Size,Type,Mode,UID,GID,Meta,File Name
+//
+// Dates are formatted with DateFormat in loc, or in UTC if loc is nil, and
+// Meta is the inode number.
+func WriteCSV(w io.Writer, events []Event, loc *time.Location) error {
+	if loc == nil {
+		loc = time.UTC
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"Date", "Size", "Type", "Mode", "UID", "GID", "Meta", "File Name"}); err != nil {
+		return err
+	}
+	for _, e := range events {
+		r := e.Record
+		err := cw.Write([]string{
+			e.Time.In(loc).Format(DateFormat),
+			strconv.FormatUint(r.Size, 10),
+			e.Type,
+			r.Mode,
+			strconv.FormatUint(uint64(r.UID), 10),
+			strconv.FormatUint(uint64(r.GID), 10),
+			strconv.FormatUint(r.Inode, 10),
+			r.Name,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
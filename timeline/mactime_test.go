@@ -0,0 +1,48 @@
+package timeline
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	t0 := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	recs := []Record{
+		{Name: "/b", Inode: 12, Mode: "r/rrw-r--r--", Size: 3, Mtime: t0, Atime: t0.Add(time.Hour), Ctime: t0, Crtime: t0.Add(-time.Hour)},
+		{Name: "/a", Inode: 13, Mode: "d/drwxr-xr-x", Mtime: t0, Atime: t0, Ctime: t0, Crtime: t0},
+		{Name: "/old", Inode: 14, Mode: "r/rrw-r--r--", Mtime: t0.AddDate(-1, 0, 0)},
+	}
+
+	var got []string
+	for _, e := range Events(recs, time.Time{}, time.Time{}) {
+		got = append(got, e.Time.Format(time.RFC3339)+" "+e.Type+" "+e.Record.Name)
+	}
+	want := []string{
+		"2020-03-01T12:00:00Z m... /old",
+		"2021-03-01T11:00:00Z ...b /b",
+		"2021-03-01T12:00:00Z macb /a",
+		"2021-03-01T12:00:00Z m.c. /b",
+		"2021-03-01T13:00:00Z .a.. /b",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got events\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The range includes both ends.
+	events := Events(recs, t0.Add(-time.Hour), t0)
+	if len(events) != 3 || events[0].Type != "...b" || events[2].Type != "m.c." {
+		t.Errorf("events in range: %+v", events)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, events[1:2], time.FixedZone("CET", 3600)); err != nil {
+		t.Fatal(err)
+	}
+	wantCSV := "Date,Size,Type,Mode,UID,GID,Meta,File Name\n" +
+		"Mon Mar 01 2021 13:00:00.000000000,0,macb,d/drwxr-xr-x,0,0,13,/a\n"
+	if buf.String() != wantCSV {
+		t.Errorf("WriteCSV wrote\n%s\nwant\n%s", buf.String(), wantCSV)
+	}
+}
@@ -8,13 +8,20 @@ import (
 	"github.com/asalih/go-ext/syserror"
 )
 
+// maxPreallocBlockGroups bounds the initial capacity of the block group
+// descriptor slice.
+const maxPreallocBlockGroups = 1024
+
 // readFromDisk performs a binary read from disk into the given struct from
 // the absolute offset provided.
 func readFromDisk(dev io.ReaderAt, abOff int64, v common.Unmarshal) error {
 	n := v.SizeBytes()
 	buf := make([]byte, n)
-	if read, _ := dev.ReadAt(buf, abOff); read < int(n) {
-		return syserror.EIO
+	if read, err := dev.ReadAt(buf, abOff); read < int(n) {
+		if err == nil || err == io.EOF {
+			err = syserror.EIO
+		}
+		return err
 	}
 
 	return v.UnmarshalBytes(buf)
@@ -49,7 +56,7 @@ func readSuperBlock(dev io.ReaderAt) (disklayout.SuperBlock, error) {
 
 // blockGroupsCount returns the number of block groups in the ext fs.
 func blockGroupsCount(sb disklayout.SuperBlock) uint64 {
-	blocksCount := sb.BlocksCount()
+	blocksCount := sb.BlocksCount() - uint64(sb.FirstDataBlock())
 	blocksPerGroup := uint64(sb.BlocksPerGroup())
 
 	// Round up the result. float64 can compromise precision so do it manually.
@@ -58,22 +65,32 @@ func blockGroupsCount(sb disklayout.SuperBlock) uint64 {
 
 // readBlockGroups reads the block group descriptor table from block group 0 in
 // the underlying device.
+//
+// The descriptors are appended as they are read rather than preallocated, so a
+// corrupted group count fails with EIO at the end of the device instead of
+// exhausting memory.
 func readBlockGroups(dev io.ReaderAt, sb disklayout.SuperBlock) ([]disklayout.BlockGroup, error) {
 	bgCount := blockGroupsCount(sb)
 	bgdSize := uint64(sb.BgDescSize())
 	is64Bit := sb.IncompatibleFeatures().Is64Bit
-	bgds := make([]disklayout.BlockGroup, bgCount)
+	prealloc := bgCount
+	if prealloc > maxPreallocBlockGroups {
+		prealloc = maxPreallocBlockGroups
+	}
+	bgds := make([]disklayout.BlockGroup, 0, prealloc)
 
 	for i, off := uint64(0), uint64(sb.FirstDataBlock()+1)*sb.BlockSize(); i < bgCount; i, off = i+1, off+bgdSize {
+		var bgd disklayout.BlockGroup
 		if is64Bit {
-			bgds[i] = &disklayout.BlockGroup64Bit{}
+			bgd = &disklayout.BlockGroup64Bit{}
 		} else {
-			bgds[i] = &disklayout.BlockGroup32Bit{}
+			bgd = &disklayout.BlockGroup32Bit{}
 		}
 
-		if err := readFromDisk(dev, int64(off), bgds[i]); err != nil {
+		if err := readFromDisk(dev, int64(off), bgd); err != nil {
 			return nil, err
 		}
+		bgds = append(bgds, bgd)
 	}
 	return bgds, nil
 }
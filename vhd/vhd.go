@@ -0,0 +1,452 @@
+// Package vhd reads Microsoft Virtual Hard Disk (VHD) images: fixed, dynamic
+// and differencing disks. The virtual disk is exposed as an io.ReaderAt which
+// can be passed to partition.Read or ext.NewFS.
+package vhd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/asalih/go-ext/internal/diskimage"
+	"github.com/asalih/go-ext/internal/ioutil"
+	"golang.org/x/xerrors"
+)
+
+// Disk types.
+const (
+	TypeFixed        = 2
+	TypeDynamic      = 3
+	TypeDifferencing = 4
+)
+
+const (
+	footerSize        = 512
+	dynamicHeaderSize = 1024
+	sectorSize        = 512
+
+	footerCookie  = "conectix"
+	dynamicCookie = "cxsparse"
+
+	// unallocated marks blocks without an entry in the block allocation
+	// table.
+	unallocated = 0xffffffff
+
+	// maxBlockSize and maxTableEntries bound the block allocation table.
+	maxBlockSize    = 256 << 20
+	maxTableEntries = 1 << 24
+
+	// maxParentChain bounds the length of chains of parents opened by Open.
+	maxParentChain = 32
+)
+
+var (
+	// ErrNotVHD is returned by New for images which are not VHD images.
+	ErrNotVHD = errors.New("vhd: not a VHD image")
+
+	// ErrNoParent is returned when reading sectors a differencing disk leaves
+	// to its parent, if it was not given one with WithParent.
+	ErrNoParent = errors.New("vhd: parent disk not provided")
+
+	// ErrUnsafeParent is returned by Open for differencing disks whose parent
+	// is only found at paths which are absolute or lead out of the directory
+	// of the disk, unless allowed with WithUnsafeParent.
+	ErrUnsafeParent = errors.New("vhd: parent disk outside the image directory")
+)
+
+// Option configures an Image.
+type Option func(*options)
+
+type options struct {
+	parent       io.ReaderAt
+	unsafeParent bool
+}
+
+// WithParent sets the reader of the parent of a differencing disk, which
+// supplies the sectors the disk does not hold.
+func WithParent(r io.ReaderAt) Option {
+	return func(o *options) {
+		o.parent = r
+	}
+}
+
+// WithUnsafeParent sets whether Open follows parent locators which are
+// absolute or lead out of the directory of the disk. Locators are read from
+// the disk, so that an untrusted disk could otherwise make Open read any file
+// on the host.
+func WithUnsafeParent(enabled bool) Option {
+	return func(o *options) {
+		o.unsafeParent = enabled
+	}
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Image is a VHD image. It is safe for concurrent use.
+type Image struct {
+	// Type is TypeFixed, TypeDynamic or TypeDifferencing.
+	Type int
+
+	// UniqueID identifies the disk. Differencing disks record the UniqueID
+	// of their parent in ParentID.
+	UniqueID [16]byte
+	ParentID [16]byte
+
+	// ParentPaths are the paths to the parent of a differencing disk found
+	// in its parent locators, relative ones first, followed by the parent's
+	// file name.
+	ParentPaths []string
+
+	// BlockSize is the allocation unit of dynamic and differencing disks.
+	BlockSize int64
+
+	size       int64
+	bat        []uint32
+	bitmapSize int64
+	r          io.ReaderAt
+	parent     io.ReaderAt
+	closers    []io.Closer
+}
+
+// New reads the VHD image r, which is size bytes long. Differencing disks can
+// be read without their parent, except for the sectors they leave to it,
+// which fail with ErrNoParent.
+func New(r io.ReaderAt, size int64, opts ...Option) (*Image, error) {
+	o := newOptions(opts)
+
+	footer, err := readFooter(r, size)
+	if err != nil {
+		return nil, err
+	}
+	be := binary.BigEndian
+	img := &Image{
+		Type:   int(be.Uint32(footer[60:])),
+		size:   int64(be.Uint64(footer[48:])),
+		r:      r,
+		parent: o.parent,
+	}
+	copy(img.UniqueID[:], footer[68:84])
+	if img.size < 0 {
+		return nil, xerrors.Errorf("vhd: invalid size %d", uint64(img.size))
+	}
+
+	switch img.Type {
+	case TypeFixed:
+		if img.size > size-footerSize {
+			return nil, xerrors.Errorf("vhd: fixed disk of %d bytes in a file of %d", img.size, size)
+		}
+		return img, nil
+	case TypeDynamic, TypeDifferencing:
+	default:
+		return nil, xerrors.Errorf("vhd: unsupported disk type %d", img.Type)
+	}
+
+	hdr := make([]byte, dynamicHeaderSize)
+	if err := ioutil.ReadFull(r, hdr, int64(be.Uint64(footer[16:]))); err != nil {
+		return nil, xerrors.Errorf("vhd: failed to read dynamic disk header: %w", err)
+	}
+	if string(hdr[:8]) != dynamicCookie {
+		return nil, errors.New("vhd: bad dynamic disk header cookie")
+	}
+	if want, got := be.Uint32(hdr[36:]), checksum(hdr, 36); want != got {
+		return nil, xerrors.Errorf("vhd: dynamic disk header checksum mismatch: stored %#x, computed %#x", want, got)
+	}
+	img.BlockSize = int64(be.Uint32(hdr[32:]))
+	if img.BlockSize < sectorSize || img.BlockSize > maxBlockSize || img.BlockSize%sectorSize != 0 {
+		return nil, xerrors.Errorf("vhd: invalid block size %d", img.BlockSize)
+	}
+	entries := be.Uint32(hdr[28:])
+	if entries > maxTableEntries || int64(entries)*img.BlockSize < img.size {
+		return nil, xerrors.Errorf("vhd: block allocation table of %d entries for a disk of %d bytes", entries, img.size)
+	}
+	// The sector bitmap preceding every block is padded to a sector.
+	img.bitmapSize = (img.BlockSize/sectorSize/8 + sectorSize - 1) / sectorSize * sectorSize
+
+	raw := make([]byte, 4*int(entries))
+	if err := ioutil.ReadFull(r, raw, int64(be.Uint64(hdr[16:]))); err != nil {
+		return nil, xerrors.Errorf("vhd: failed to read block allocation table: %w", err)
+	}
+	img.bat = make([]uint32, entries)
+	for i := range img.bat {
+		img.bat[i] = be.Uint32(raw[4*i:])
+	}
+
+	if img.Type == TypeDifferencing {
+		copy(img.ParentID[:], hdr[40:56])
+		img.ParentPaths = parentPaths(r, hdr)
+	}
+	return img, nil
+}
+
+// readFooter reads the footer at the end of the image, or its copy at the
+// start of dynamic disks if the end is damaged.
+func readFooter(r io.ReaderAt, size int64) ([]byte, error) {
+	var firstErr error
+	for _, offset := range []int64{size - footerSize, 0} {
+		footer := make([]byte, footerSize)
+		if offset < 0 {
+			continue
+		}
+		if err := ioutil.ReadFull(r, footer, offset); err != nil {
+			return nil, xerrors.Errorf("vhd: failed to read footer: %w", err)
+		}
+		if string(footer[:8]) != footerCookie {
+			continue
+		}
+		if want, got := binary.BigEndian.Uint32(footer[64:]), checksum(footer, 64); want != got {
+			if firstErr == nil {
+				firstErr = xerrors.Errorf("vhd: footer checksum mismatch: stored %#x, computed %#x", want, got)
+			}
+			continue
+		}
+		return footer, nil
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ErrNotVHD
+}
+
+// checksum computes the one's complement of the sum of the bytes of b, except
+// for the checksum itself at offset csum.
+func checksum(b []byte, csum int) uint32 {
+	var sum uint32
+	for i, c := range b {
+		if i < csum || i >= csum+4 {
+			sum += uint32(c)
+		}
+	}
+	return ^sum
+}
+
+// parentPaths returns the parent paths of the parent locators of the dynamic
+// disk header hdr, relative ones first, then the parent's name.
+func parentPaths(r io.ReaderAt, hdr []byte) []string {
+	be := binary.BigEndian
+	var relative, absolute []string
+	for i := 0; i < 8; i++ {
+		loc := hdr[576+24*i:]
+		code := string(loc[:4])
+		length := be.Uint32(loc[8:])
+		if length == 0 || length > 4096 {
+			continue
+		}
+		data := make([]byte, length)
+		if ioutil.ReadFull(r, data, int64(be.Uint64(loc[16:]))) != nil {
+			continue
+		}
+		switch code {
+		case "W2ru":
+			relative = append(relative, decodeUTF16(data, binary.LittleEndian))
+		case "W2ku":
+			absolute = append(absolute, decodeUTF16(data, binary.LittleEndian))
+		case "MacX":
+			absolute = append(absolute, strings.TrimPrefix(string(data), "file://"))
+		}
+	}
+	paths := append(relative, absolute...)
+	if name := decodeUTF16(hdr[64:576], binary.BigEndian); name != "" {
+		paths = append(paths, name)
+	}
+	return paths
+}
+
+// decodeUTF16 decodes NUL padded UTF-16 text.
+func decodeUTF16(b []byte, order binary.ByteOrder) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := order.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+// Open opens the VHD image file name along with the chain of parents of a
+// differencing disk, looked up by their parent locators. The image must be
+// closed to close the files.
+//
+// Parents are only looked up in the directory of the disk, or below it,
+// unless allowed with WithUnsafeParent. The options apply to every disk of
+// the chain, except for WithParent which Open ignores.
+func Open(name string, opts ...Option) (*Image, error) {
+	o := newOptions(opts)
+	o.parent = nil
+	return open(name, o, 0)
+}
+
+func open(name string, o options, depth int) (*Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	img, err := newFile(f)
+	if err != nil {
+		f.Close()
+		return nil, xerrors.Errorf("%s: %w", name, err)
+	}
+	img.closers = append(img.closers, f)
+	if img.Type != TypeDifferencing {
+		return img, nil
+	}
+
+	if depth >= maxParentChain {
+		img.Close()
+		return nil, xerrors.Errorf("vhd: more than %d parent disks", maxParentChain)
+	}
+	path, err := diskimage.FindParent(name, img.ParentPaths, o.unsafeParent, ErrUnsafeParent)
+	if err != nil {
+		img.Close()
+		return nil, xerrors.Errorf("vhd: parent of %s: %w", name, err)
+	}
+	parent, err := open(path, o, depth+1)
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	if parent.UniqueID != img.ParentID {
+		parent.Close()
+		img.Close()
+		return nil, xerrors.Errorf("vhd: %s is not the parent of %s", path, name)
+	}
+	img.parent = parent
+	img.closers = append(img.closers, parent)
+	return img, nil
+}
+
+func newFile(f *os.File) (*Image, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return New(f, info.Size())
+}
+
+// Size returns the size of the virtual disk in bytes.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// Close closes the files opened by Open. It does nothing for images created
+// by New.
+func (img *Image) Close() error {
+	var err error
+	for _, c := range img.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	img.closers = nil
+	return err
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vhd: negative offset")
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	var err error
+	if rest := img.size - off; int64(len(p)) > rest {
+		p = p[:rest]
+		err = io.EOF
+	}
+	if img.Type == TypeFixed {
+		if rerr := ioutil.ReadFull(img.r, p, off); rerr != nil {
+			return 0, rerr
+		}
+		return len(p), err
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		within := pos % img.BlockSize
+		buf := p[read:]
+		if rest := img.BlockSize - within; int64(len(buf)) > rest {
+			buf = buf[:rest]
+		}
+		if rerr := img.readBlock(buf, pos); rerr != nil {
+			return read, rerr
+		}
+		read += len(buf)
+	}
+	return read, err
+}
+
+// readBlock reads p from the virtual disk at pos, within a single block.
+func (img *Image) readBlock(p []byte, pos int64) error {
+	block := pos / img.BlockSize
+	within := pos % img.BlockSize
+	entry := img.bat[block]
+	if entry == unallocated {
+		return img.readParent(p, pos)
+	}
+	start := int64(entry) * sectorSize
+	data := start + img.bitmapSize
+	if img.Type == TypeDynamic {
+		return ioutil.ReadFull(img.r, p, data+within)
+	}
+
+	// The sector bitmap of a differencing disk tells which sectors the disk
+	// holds, most significant bit first.
+	first := within / sectorSize
+	last := (within + int64(len(p)) - 1) / sectorSize
+	bitmap := make([]byte, last/8-first/8+1)
+	if err := ioutil.ReadFull(img.r, bitmap, start+first/8); err != nil {
+		return xerrors.Errorf("vhd: failed to read sector bitmap: %w", err)
+	}
+	present := func(sector int64) bool {
+		i := sector/8 - first/8
+		return bitmap[i]&(0x80>>(sector%8)) != 0
+	}
+
+	for len(p) > 0 {
+		sector := within / sectorSize
+		n := (sector+1)*sectorSize - within
+		for int64(len(p)) > n && present((within+n)/sectorSize) == present(sector) {
+			n += sectorSize
+		}
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		var err error
+		if present(sector) {
+			err = ioutil.ReadFull(img.r, p[:n], data+within)
+		} else {
+			err = img.readParent(p[:n], block*img.BlockSize+within)
+		}
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+		within += n
+	}
+	return nil
+}
+
+// readParent reads p from the parent of a differencing disk at pos, or zeros
+// for dynamic disks.
+func (img *Image) readParent(p []byte, pos int64) error {
+	if img.Type != TypeDifferencing {
+		diskimage.Zero(p)
+		return nil
+	}
+	if img.parent == nil {
+		return ErrNoParent
+	}
+	return diskimage.ReadParent(img.parent, p, pos)
+}
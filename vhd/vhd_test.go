@@ -0,0 +1,253 @@
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/asalih/go-ext/internal/imagetest"
+)
+
+const testBlockSize = 64 << 10
+
+func footer(typ int, size int64, id byte) []byte {
+	f := make([]byte, footerSize)
+	be := binary.BigEndian
+	copy(f, footerCookie)
+	be.PutUint32(f[8:], 2)
+	be.PutUint32(f[12:], 0x00010000)
+	be.PutUint64(f[16:], 0xffffffffffffffff)
+	if typ != TypeFixed {
+		be.PutUint64(f[16:], footerSize)
+	}
+	be.PutUint64(f[40:], uint64(size))
+	be.PutUint64(f[48:], uint64(size))
+	be.PutUint32(f[60:], uint32(typ))
+	f[68] = id
+	be.PutUint32(f[64:], checksum(f, 64))
+	return f
+}
+
+// testDisk describes a test image.
+type testDisk struct {
+	typ  int
+	data []byte
+	id   byte
+	// present reports whether a sector is held by a differencing disk; for
+	// dynamic disks, blocks without a present sector are left unallocated.
+	present  func(sector int64) bool
+	parentID byte
+	// parent is the relative path to the parent of a differencing disk.
+	parent string
+}
+
+func writeVHD(d testDisk) []byte {
+	size := int64(len(d.data))
+	if d.typ == TypeFixed {
+		return append(append([]byte(nil), d.data...), footer(d.typ, size, d.id)...)
+	}
+
+	be := binary.BigEndian
+	blocks := (size + testBlockSize - 1) / testBlockSize
+	batOffset := int64(footerSize + dynamicHeaderSize)
+	batSize := (4*blocks + 511) / 512 * 512
+	img := append(footer(d.typ, size, d.id), make([]byte, dynamicHeaderSize+batSize)...)
+	hdr := img[footerSize : footerSize+dynamicHeaderSize]
+	copy(hdr, dynamicCookie)
+	be.PutUint64(hdr[8:], 0xffffffffffffffff)
+	be.PutUint64(hdr[16:], uint64(batOffset))
+	be.PutUint32(hdr[24:], 0x00010000)
+	be.PutUint32(hdr[28:], uint32(blocks))
+	be.PutUint32(hdr[32:], testBlockSize)
+	if d.typ == TypeDifferencing {
+		hdr[40] = d.parentID
+		var name []byte
+		for _, u := range utf16.Encode([]rune("ignored-name.vhd")) {
+			name = be.AppendUint16(name, u)
+		}
+		copy(hdr[64:], name)
+
+		var loc []byte
+		for _, u := range utf16.Encode([]rune(d.parent)) {
+			loc = binary.LittleEndian.AppendUint16(loc, u)
+		}
+		entry := hdr[576:]
+		copy(entry, "W2ru")
+		be.PutUint32(entry[4:], 1)
+		be.PutUint32(entry[8:], uint32(len(loc)))
+		be.PutUint64(entry[16:], uint64(len(img)))
+		img = append(img, loc...)
+		for len(img)%512 != 0 {
+			img = append(img, 0)
+		}
+	}
+
+	const bitmapSize = 512
+	for b := int64(0); b < blocks; b++ {
+		bitmap := make([]byte, bitmapSize)
+		block := make([]byte, testBlockSize)
+		any := false
+		for s := int64(0); s < testBlockSize/512; s++ {
+			sector := b*testBlockSize/512 + s
+			if sector*512 >= size || !d.present(sector) {
+				continue
+			}
+			any = true
+			bitmap[s/8] |= 0x80 >> (s % 8)
+			copy(block[s*512:], d.data[sector*512:(sector+1)*512])
+		}
+		if !any {
+			be.PutUint32(img[batOffset+4*b:], unallocated)
+			continue
+		}
+		be.PutUint32(img[batOffset+4*b:], uint32(len(img)/512))
+		img = append(append(img, bitmap...), block...)
+	}
+	// img has grown since, so hdr no longer aliases it.
+	hdr = img[footerSize : footerSize+dynamicHeaderSize]
+	be.PutUint32(hdr[36:], checksum(hdr, 36))
+	return append(img, footer(d.typ, size, d.id)...)
+}
+
+func checkRead(t *testing.T, name string, img *Image, want []byte) {
+	t.Helper()
+	imagetest.CheckRead(t, name, img, want, testBlockSize-1000, 3000)
+}
+
+func TestFixedAndDynamic(t *testing.T) {
+	data := imagetest.RandomData(5*testBlockSize+3*512, 1)
+	// Blocks 1 and 3 are never written and read as zeros.
+	for _, b := range []int{1, 3} {
+		copy(data[b*testBlockSize:(b+1)*testBlockSize], make([]byte, testBlockSize))
+	}
+	present := func(sector int64) bool {
+		b := sector * 512 / testBlockSize
+		return b != 1 && b != 3
+	}
+	for _, typ := range []int{TypeFixed, TypeDynamic} {
+		raw := writeVHD(testDisk{typ: typ, data: data, present: present})
+		img, err := New(bytes.NewReader(raw), int64(len(raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Type != typ || img.Size() != int64(len(data)) {
+			t.Errorf("type %d: got type %d size %d", typ, img.Type, img.Size())
+		}
+		checkRead(t, "fixed/dynamic", img, data)
+	}
+
+	// Dynamic disks keep a copy of the footer at the start.
+	raw := writeVHD(testDisk{typ: TypeDynamic, data: data, present: present})
+	raw[len(raw)-footerSize+50]++
+	if _, err := New(bytes.NewReader(raw), int64(len(raw))); err != nil {
+		t.Errorf("dynamic disk with a damaged footer: %v", err)
+	}
+
+	if _, err := New(bytes.NewReader(data), int64(len(data))); !errors.Is(err, ErrNotVHD) {
+		t.Errorf("New of a raw image returned %v, want %v", err, ErrNotVHD)
+	}
+}
+
+// differencing returns a differencing disk whose parent locator is
+// parentPath, along with its parent.
+func differencing(parentPath string) (parent, child, want []byte) {
+	size := 4 * testBlockSize
+	parentData := imagetest.RandomData(size, 2)
+	childData := imagetest.RandomData(size, 3)
+	// The child holds every third sector of blocks 0 and 2.
+	present := func(sector int64) bool {
+		b := sector * 512 / testBlockSize
+		return (b == 0 || b == 2) && sector%3 == 0
+	}
+	want = append([]byte(nil), parentData...)
+	for s := int64(0); s*512 < int64(size); s++ {
+		if present(s) {
+			copy(want[s*512:], childData[s*512:(s+1)*512])
+		}
+	}
+	parent = writeVHD(testDisk{typ: TypeDynamic, data: parentData, id: 1, present: func(int64) bool { return true }})
+	child = writeVHD(testDisk{typ: TypeDifferencing, data: childData, id: 2, present: present, parentID: 1, parent: parentPath})
+	return parent, child, want
+}
+
+func TestDifferencing(t *testing.T) {
+	parentRaw, childRaw, want := differencing(`.\parent.vhd`)
+	parent, err := New(bytes.NewReader(parentRaw), int64(len(parentRaw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := New(bytes.NewReader(childRaw), int64(len(childRaw)), WithParent(parent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.ParentID != parent.UniqueID {
+		t.Errorf("ParentID = %x, want %x", img.ParentID, parent.UniqueID)
+	}
+	if len(img.ParentPaths) != 2 || img.ParentPaths[0] != `.\parent.vhd` || img.ParentPaths[1] != "ignored-name.vhd" {
+		t.Errorf("ParentPaths = %q", img.ParentPaths)
+	}
+	checkRead(t, "differencing", img, want)
+
+	img, err = New(bytes.NewReader(childRaw), int64(len(childRaw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.ReadAt(make([]byte, 512), 0); err != nil {
+		t.Errorf("read of a sector held by the child returned %v", err)
+	}
+	if _, err := img.ReadAt(make([]byte, 512), 512); !errors.Is(err, ErrNoParent) {
+		t.Errorf("read of a parent sector returned %v, want %v", err, ErrNoParent)
+	}
+}
+
+func TestOpenParent(t *testing.T) {
+	parent, child, want := differencing(`.\parent.vhd`)
+	imagetest.CheckOpenParent(t, imagetest.OpenParentTest[*Image]{
+		ParentName: "parent.vhd",
+		ChildName:  "child.vhd",
+		Parent:     parent,
+		Child:      child,
+		// A parent with another identifier.
+		Other: writeVHD(testDisk{typ: TypeFixed, data: make([]byte, len(want)), id: 9}),
+		Want:  want,
+		Open:  func(name string) (*Image, error) { return Open(name) },
+		Check: checkRead,
+	})
+}
+
+func TestOpenUnsafeParent(t *testing.T) {
+	parent, child, want := differencing(`..\parent.vhd`)
+	dir := t.TempDir()
+	name := filepath.Join(dir, "sub", "child.vhd")
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	os.WriteFile(filepath.Join(dir, "parent.vhd"), parent, 0o644)
+	os.WriteFile(name, child, 0o644)
+	// Only regular files are taken for the parent.
+	os.Mkdir(filepath.Join(dir, "sub", "parent.vhd"), 0o755)
+
+	if _, err := Open(name); !errors.Is(err, ErrUnsafeParent) {
+		t.Errorf("Open with a parent out of its directory returned %v, want %v", err, ErrUnsafeParent)
+	}
+	img, err := Open(name, WithUnsafeParent(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	checkRead(t, "unsafe parent", img, want)
+}
+
+func TestFileSystem(t *testing.T) {
+	data := imagetest.FileSystem("inside vhd")
+	raw := writeVHD(testDisk{typ: TypeDynamic, data: data, present: func(s int64) bool {
+		return !imagetest.IsZero(data[s*512 : (s+1)*512])
+	}})
+	img, err := New(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagetest.CheckFileSystem(t, img, "inside vhd")
+}
@@ -0,0 +1,599 @@
+// Package vhdx reads Microsoft VHDX disk images: fixed, dynamic and
+// differencing disks. The virtual disk is exposed as an io.ReaderAt which can
+// be passed to partition.Read or ext.NewFS.
+//
+// Images whose log holds updates not yet applied, as left by a host crash,
+// are refused: the log is not replayed.
+package vhdx
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/asalih/go-ext/internal/diskimage"
+	"github.com/asalih/go-ext/internal/ioutil"
+	"github.com/asalih/go-ext/partition"
+	"golang.org/x/xerrors"
+)
+
+const (
+	fileSignature   = "vhdxfile"
+	headerSignature = "head"
+	regionSignature = "regi"
+	metaSignature   = "metadata"
+
+	headerSize      = 4 << 10
+	regionTableSize = 64 << 10
+
+	// maxEntries bounds the region and metadata tables.
+	maxEntries = 2047
+
+	// maxParentChain bounds the length of chains of parents opened by Open.
+	maxParentChain = 32
+
+	// Block allocation table entry states.
+	payloadNotPresent       = 0
+	payloadUndefined        = 1
+	payloadZero             = 2
+	payloadUnmapped         = 3
+	payloadFullyPresent     = 6
+	payloadPartiallyPresent = 7
+	bitmapPresent           = 6
+
+	// sectorsPerChunk is the number of sectors a sector bitmap block covers.
+	sectorsPerChunk = 1 << 23
+)
+
+var (
+	headerOffsets = []int64{64 << 10, 128 << 10}
+	regionOffsets = []int64{192 << 10, 256 << 10}
+
+	batRegion      = partition.MustParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	metadataRegion = partition.MustParseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	fileParametersItem     = partition.MustParseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	virtualDiskSizeItem    = partition.MustParseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	virtualDiskIDItem      = partition.MustParseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	logicalSectorSizeItem  = partition.MustParseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	physicalSectorSizeItem = partition.MustParseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+	parentLocatorItem      = partition.MustParseGUID("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+var (
+	// ErrNotVHDX is returned by New for images which are not VHDX images.
+	ErrNotVHDX = errors.New("vhdx: not a VHDX image")
+
+	// ErrLogNotEmpty is returned by New for images whose log must be
+	// replayed before they can be read.
+	ErrLogNotEmpty = errors.New("vhdx: log replay required")
+
+	// ErrNoParent is returned when reading sectors a differencing disk leaves
+	// to its parent, if it was not given one with WithParent.
+	ErrNoParent = errors.New("vhdx: parent disk not provided")
+
+	// ErrUnsafeParent is returned by Open for differencing disks whose parent
+	// is only found at paths which are absolute or lead out of the directory
+	// of the disk, unless allowed with WithUnsafeParent.
+	ErrUnsafeParent = errors.New("vhdx: parent disk outside the image directory")
+)
+
+// Option configures an Image.
+type Option func(*options)
+
+type options struct {
+	parent       io.ReaderAt
+	unsafeParent bool
+}
+
+// WithParent sets the reader of the parent of a differencing disk, which
+// supplies the sectors the disk does not hold.
+func WithParent(r io.ReaderAt) Option {
+	return func(o *options) {
+		o.parent = r
+	}
+}
+
+// WithUnsafeParent sets whether Open follows parent locators which are
+// absolute or lead out of the directory of the disk. Locators are read from
+// the disk, so that an untrusted disk could otherwise make Open read any file
+// on the host.
+func WithUnsafeParent(enabled bool) Option {
+	return func(o *options) {
+		o.unsafeParent = enabled
+	}
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Image is a VHDX image. It is safe for concurrent use.
+type Image struct {
+	// DataWriteGUID changes whenever the content of the disk does.
+	// Differencing disks record the DataWriteGUID of their parent in
+	// ParentLinkage.
+	DataWriteGUID partition.GUID
+	VirtualDiskID partition.GUID
+
+	BlockSize          int64
+	LogicalSectorSize  int64
+	PhysicalSectorSize int64
+
+	// HasParent reports a differencing disk.
+	HasParent bool
+
+	// ParentLinkage and ParentPaths come from the parent locator of a
+	// differencing disk. ParentPaths lists the relative path first, then the
+	// absolute ones.
+	ParentLinkage partition.GUID
+	ParentPaths   []string
+
+	size       int64
+	chunkRatio int64
+	bat        []uint64
+	r          io.ReaderAt
+	parent     io.ReaderAt
+	closers    []io.Closer
+}
+
+// New reads the VHDX image r. Differencing disks can be read without their
+// parent, except for the sectors they leave to it, which fail with
+// ErrNoParent.
+func New(r io.ReaderAt, opts ...Option) (*Image, error) {
+	o := newOptions(opts)
+
+	sig := make([]byte, 8)
+	if err := ioutil.ReadFull(r, sig, 0); err != nil || string(sig) != fileSignature {
+		return nil, ErrNotVHDX
+	}
+	img := &Image{r: r, parent: o.parent}
+	if err := img.readHeader(); err != nil {
+		return nil, err
+	}
+
+	regions, err := readRegionTable(r)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := regions[metadataRegion]
+	if !ok {
+		return nil, errors.New("vhdx: no metadata region")
+	}
+	if err := img.readMetadata(meta); err != nil {
+		return nil, err
+	}
+	bat, ok := regions[batRegion]
+	if !ok {
+		return nil, errors.New("vhdx: no block allocation table region")
+	}
+	if err := img.readBAT(bat); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// readHeader reads the current header, the valid one of the two copies with
+// the higher sequence number.
+func (img *Image) readHeader() error {
+	var current []byte
+	var seq uint64
+	for _, offset := range headerOffsets {
+		hdr := make([]byte, headerSize)
+		if ioutil.ReadFull(img.r, hdr, offset) != nil || string(hdr[:4]) != headerSignature || !checksumOK(hdr) {
+			continue
+		}
+		if s := binary.LittleEndian.Uint64(hdr[8:]); current == nil || s > seq {
+			current, seq = hdr, s
+		}
+	}
+	if current == nil {
+		return errors.New("vhdx: no valid header")
+	}
+	if v := binary.LittleEndian.Uint16(current[66:]); v != 1 {
+		return xerrors.Errorf("vhdx: unsupported version %d", v)
+	}
+	copy(img.DataWriteGUID[:], current[32:48])
+	var logGUID partition.GUID
+	copy(logGUID[:], current[48:64])
+	if !logGUID.IsZero() {
+		return ErrLogNotEmpty
+	}
+	return nil
+}
+
+// checksumOK verifies the CRC-32C of a header or table, stored at offset 4.
+func checksumOK(b []byte) bool {
+	want := binary.LittleEndian.Uint32(b[4:])
+	c := make([]byte, len(b))
+	copy(c, b)
+	binary.LittleEndian.PutUint32(c[4:], 0)
+	return crc32.Checksum(c, castagnoli) == want
+}
+
+// region is an entry of the region table.
+type region struct {
+	offset int64
+	length int64
+}
+
+// readRegionTable reads the first valid copy of the region table.
+func readRegionTable(r io.ReaderAt) (map[partition.GUID]region, error) {
+	for _, offset := range regionOffsets {
+		table := make([]byte, regionTableSize)
+		if ioutil.ReadFull(r, table, offset) != nil || string(table[:4]) != regionSignature || !checksumOK(table) {
+			continue
+		}
+		count := binary.LittleEndian.Uint32(table[8:])
+		if count > maxEntries {
+			return nil, xerrors.Errorf("vhdx: region table of %d entries", count)
+		}
+		regions := make(map[partition.GUID]region, count)
+		for i := 0; i < int(count); i++ {
+			e := table[16+32*i:]
+			var id partition.GUID
+			copy(id[:], e[:16])
+			if id != batRegion && id != metadataRegion {
+				if binary.LittleEndian.Uint32(e[28:])&1 != 0 {
+					return nil, xerrors.Errorf("vhdx: unsupported required region %s", id)
+				}
+				continue
+			}
+			regions[id] = region{
+				offset: int64(binary.LittleEndian.Uint64(e[16:])),
+				length: int64(binary.LittleEndian.Uint32(e[24:])),
+			}
+		}
+		return regions, nil
+	}
+	return nil, errors.New("vhdx: no valid region table")
+}
+
+// readMetadata reads the metadata items of the metadata region.
+func (img *Image) readMetadata(meta region) error {
+	if meta.length < 32 || meta.length > 256<<20 {
+		return xerrors.Errorf("vhdx: metadata region of %d bytes", meta.length)
+	}
+	data := make([]byte, meta.length)
+	if err := ioutil.ReadFull(img.r, data, meta.offset); err != nil {
+		return xerrors.Errorf("vhdx: failed to read metadata region: %w", err)
+	}
+	if string(data[:8]) != metaSignature {
+		return errors.New("vhdx: bad metadata signature")
+	}
+	le := binary.LittleEndian
+	count := int(le.Uint16(data[10:]))
+	if count > maxEntries || 32+32*count > len(data) {
+		return xerrors.Errorf("vhdx: metadata table of %d entries", count)
+	}
+
+	items := make(map[partition.GUID][]byte, count)
+	for i := 0; i < count; i++ {
+		e := data[32+32*i:]
+		var id partition.GUID
+		copy(id[:], e[:16])
+		offset, length := int64(le.Uint32(e[16:])), int64(le.Uint32(e[20:]))
+		if offset+length > int64(len(data)) {
+			return xerrors.Errorf("vhdx: metadata item %s lies outside the region", id)
+		}
+		switch id {
+		case fileParametersItem, virtualDiskSizeItem, virtualDiskIDItem, logicalSectorSizeItem, physicalSectorSizeItem, parentLocatorItem:
+			items[id] = data[offset : offset+length]
+		default:
+			if le.Uint32(e[24:])&4 != 0 {
+				return xerrors.Errorf("vhdx: unsupported required metadata item %s", id)
+			}
+		}
+	}
+
+	item := func(id partition.GUID, size int) ([]byte, error) {
+		b := items[id]
+		if len(b) < size {
+			return nil, xerrors.Errorf("vhdx: metadata item %s missing", id)
+		}
+		return b, nil
+	}
+	params, err := item(fileParametersItem, 8)
+	if err != nil {
+		return err
+	}
+	img.BlockSize = int64(le.Uint32(params))
+	img.HasParent = le.Uint32(params[4:])&2 != 0
+	size, err := item(virtualDiskSizeItem, 8)
+	if err != nil {
+		return err
+	}
+	img.size = int64(le.Uint64(size))
+	sectorSize, err := item(logicalSectorSizeItem, 4)
+	if err != nil {
+		return err
+	}
+	img.LogicalSectorSize = int64(le.Uint32(sectorSize))
+	if b, err := item(physicalSectorSizeItem, 4); err == nil {
+		img.PhysicalSectorSize = int64(le.Uint32(b))
+	}
+	if b, err := item(virtualDiskIDItem, 16); err == nil {
+		copy(img.VirtualDiskID[:], b)
+	}
+
+	if img.BlockSize < 1<<20 || img.BlockSize > 256<<20 || img.BlockSize&(img.BlockSize-1) != 0 {
+		return xerrors.Errorf("vhdx: invalid block size %d", img.BlockSize)
+	}
+	if img.LogicalSectorSize != 512 && img.LogicalSectorSize != 4096 {
+		return xerrors.Errorf("vhdx: invalid logical sector size %d", img.LogicalSectorSize)
+	}
+	if img.size < 0 || img.size%img.LogicalSectorSize != 0 {
+		return xerrors.Errorf("vhdx: invalid virtual disk size %d", img.size)
+	}
+	img.chunkRatio = sectorsPerChunk * img.LogicalSectorSize / img.BlockSize
+
+	if img.HasParent {
+		locator, err := item(parentLocatorItem, 20)
+		if err != nil {
+			return err
+		}
+		if err := img.parseParentLocator(locator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseParentLocator parses the key-value pairs of a parent locator.
+func (img *Image) parseParentLocator(b []byte) error {
+	le := binary.LittleEndian
+	count := int(le.Uint16(b[18:]))
+	if 20+12*count > len(b) {
+		return xerrors.Errorf("vhdx: parent locator of %d entries does not fit", count)
+	}
+	str := func(offset uint32, length uint16) (string, error) {
+		end := int64(offset) + int64(length)
+		if end > int64(len(b)) {
+			return "", errors.New("vhdx: parent locator entry lies outside the locator")
+		}
+		u := make([]uint16, length/2)
+		for i := range u {
+			u[i] = le.Uint16(b[int(offset)+2*i:])
+		}
+		return string(utf16.Decode(u)), nil
+	}
+
+	var relative, absolute []string
+	for i := 0; i < count; i++ {
+		e := b[20+12*i:]
+		key, err := str(le.Uint32(e), le.Uint16(e[8:]))
+		if err != nil {
+			return err
+		}
+		value, err := str(le.Uint32(e[4:]), le.Uint16(e[10:]))
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "parent_linkage":
+			if img.ParentLinkage, err = partition.ParseGUID(strings.Trim(value, "{}")); err != nil {
+				return xerrors.Errorf("vhdx: parent linkage: %w", err)
+			}
+		case "relative_path":
+			relative = append(relative, value)
+		case "absolute_win32_path", "volume_path":
+			absolute = append(absolute, value)
+		}
+	}
+	img.ParentPaths = append(relative, absolute...)
+	return nil
+}
+
+// readBAT reads the block allocation table.
+func (img *Image) readBAT(bat region) error {
+	blocks := (img.size + img.BlockSize - 1) / img.BlockSize
+	chunks := (blocks + img.chunkRatio - 1) / img.chunkRatio
+	// Payload entries are interleaved with one sector bitmap entry per
+	// chunk. Only differencing disks need the last one.
+	entries := blocks + (blocks-1)/img.chunkRatio
+	if img.HasParent {
+		entries = chunks * (img.chunkRatio + 1)
+	}
+	if blocks == 0 {
+		entries = 0
+	}
+	if 8*entries > bat.length {
+		return xerrors.Errorf("vhdx: block allocation table of %d bytes for %d entries", bat.length, entries)
+	}
+	raw := make([]byte, 8*entries)
+	if err := ioutil.ReadFull(img.r, raw, bat.offset); err != nil {
+		return xerrors.Errorf("vhdx: failed to read block allocation table: %w", err)
+	}
+	img.bat = make([]uint64, entries)
+	for i := range img.bat {
+		img.bat[i] = binary.LittleEndian.Uint64(raw[8*i:])
+	}
+	return nil
+}
+
+// Open opens the VHDX image file name along with the chain of parents of a
+// differencing disk, looked up by their parent locators. The image must be
+// closed to close the files.
+//
+// Parents are only looked up in the directory of the disk, or below it,
+// unless allowed with WithUnsafeParent. The options apply to every disk of
+// the chain, except for WithParent which Open ignores.
+func Open(name string, opts ...Option) (*Image, error) {
+	o := newOptions(opts)
+	o.parent = nil
+	return open(name, o, 0)
+}
+
+func open(name string, o options, depth int) (*Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	img, err := New(f)
+	if err != nil {
+		f.Close()
+		return nil, xerrors.Errorf("%s: %w", name, err)
+	}
+	img.closers = append(img.closers, f)
+	if !img.HasParent {
+		return img, nil
+	}
+
+	if depth >= maxParentChain {
+		img.Close()
+		return nil, xerrors.Errorf("vhdx: more than %d parent disks", maxParentChain)
+	}
+	path, err := diskimage.FindParent(name, img.ParentPaths, o.unsafeParent, ErrUnsafeParent)
+	if err != nil {
+		img.Close()
+		return nil, xerrors.Errorf("vhdx: parent of %s: %w", name, err)
+	}
+	parent, err := open(path, o, depth+1)
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	if parent.DataWriteGUID != img.ParentLinkage {
+		parent.Close()
+		img.Close()
+		return nil, xerrors.Errorf("vhdx: %s changed since %s was created from it", path, name)
+	}
+	img.parent = parent
+	img.closers = append(img.closers, parent)
+	return img, nil
+}
+
+// Size returns the size of the virtual disk in bytes.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// Close closes the files opened by Open. It does nothing for images created
+// by New.
+func (img *Image) Close() error {
+	var err error
+	for _, c := range img.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	img.closers = nil
+	return err
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vhdx: negative offset")
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	var err error
+	if rest := img.size - off; int64(len(p)) > rest {
+		p = p[:rest]
+		err = io.EOF
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		buf := p[read:]
+		if rest := img.BlockSize - pos%img.BlockSize; int64(len(buf)) > rest {
+			buf = buf[:rest]
+		}
+		if rerr := img.readBlock(buf, pos); rerr != nil {
+			return read, rerr
+		}
+		read += len(buf)
+	}
+	return read, err
+}
+
+// readBlock reads p from the virtual disk at pos, within a single block.
+func (img *Image) readBlock(p []byte, pos int64) error {
+	block := pos / img.BlockSize
+	within := pos % img.BlockSize
+	entry := img.bat[block+block/img.chunkRatio]
+	offset := int64(entry>>20) << 20
+
+	switch entry & 7 {
+	case payloadFullyPresent:
+		return ioutil.ReadFull(img.r, p, offset+within)
+	case payloadPartiallyPresent:
+		if img.HasParent {
+			return img.readPartial(p, pos, offset+within)
+		}
+		return xerrors.Errorf("vhdx: partially present block %d in a disk without parent", block)
+	case payloadNotPresent:
+		if img.HasParent {
+			return img.readParent(p, pos)
+		}
+	case payloadUndefined, payloadZero, payloadUnmapped:
+	default:
+		return xerrors.Errorf("vhdx: block %d has an invalid state %d", block, entry&7)
+	}
+	diskimage.Zero(p)
+	return nil
+}
+
+// readPartial reads p from a partially present block of a differencing disk,
+// whose sectors are in the file at offset if they are marked in the chunk's
+// sector bitmap, least significant bit first, and in the parent otherwise.
+func (img *Image) readPartial(p []byte, pos, offset int64) error {
+	chunk := pos / img.BlockSize / img.chunkRatio
+	entry := img.bat[chunk*(img.chunkRatio+1)+img.chunkRatio]
+	if entry&7 != bitmapPresent {
+		return xerrors.Errorf("vhdx: sector bitmap of chunk %d is not present", chunk)
+	}
+	ss := img.LogicalSectorSize
+	first := pos/ss - chunk*sectorsPerChunk
+	last := (pos+int64(len(p))-1)/ss - chunk*sectorsPerChunk
+	bitmap := make([]byte, last/8-first/8+1)
+	if err := ioutil.ReadFull(img.r, bitmap, int64(entry>>20)<<20+first/8); err != nil {
+		return xerrors.Errorf("vhdx: failed to read sector bitmap: %w", err)
+	}
+	present := func(at int64) bool {
+		sector := at/ss - chunk*sectorsPerChunk
+		return bitmap[sector/8-first/8]&(1<<(sector%8)) != 0
+	}
+
+	for len(p) > 0 {
+		n := (pos/ss+1)*ss - pos
+		for int64(len(p)) > n && present(pos+n) == present(pos) {
+			n += ss
+		}
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		var err error
+		if present(pos) {
+			err = ioutil.ReadFull(img.r, p[:n], offset)
+		} else {
+			err = img.readParent(p[:n], pos)
+		}
+		if err != nil {
+			return err
+		}
+		p, pos, offset = p[n:], pos+n, offset+n
+	}
+	return nil
+}
+
+// readParent reads p from the parent of a differencing disk at pos.
+func (img *Image) readParent(p []byte, pos int64) error {
+	if img.parent == nil {
+		return ErrNoParent
+	}
+	return diskimage.ReadParent(img.parent, p, pos)
+}
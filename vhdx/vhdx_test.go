@@ -0,0 +1,349 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/asalih/go-ext/internal/imagetest"
+	"github.com/asalih/go-ext/partition"
+)
+
+const (
+	testBlockSize = 1 << 20
+
+	testMetadataOffset = 1 << 20
+	testBATOffset      = 2 << 20
+	testDataOffset     = 3 << 20
+)
+
+// testDisk describes a test image.
+type testDisk struct {
+	data []byte
+	// id fills the DataWriteGUID.
+	id byte
+	// present reports whether a sector is held by the disk. Blocks without
+	// a present sector are left unallocated.
+	present func(sector int64) bool
+
+	differencing bool
+	parentID     byte
+	parentPath   string
+}
+
+func putChecksum(b []byte) {
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, castagnoli))
+}
+
+func utf16le(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+func parentLocator(linkage partition.GUID, path string) []byte {
+	le := binary.LittleEndian
+	pairs := [][2]string{{"parent_linkage", "{" + linkage.String() + "}"}, {"relative_path", path}}
+	loc := make([]byte, 20+12*len(pairs))
+	locatorType := partition.MustParseGUID("B04AEFB7-D19E-4A81-B789-25B8E9445913")
+	copy(loc, locatorType[:])
+	le.PutUint16(loc[18:], uint16(len(pairs)))
+	for i, kv := range pairs {
+		key, value := utf16le(kv[0]), utf16le(kv[1])
+		e := loc[20+12*i:]
+		le.PutUint32(e, uint32(len(loc)))
+		le.PutUint16(e[8:], uint16(len(key)))
+		loc = append(loc, key...)
+		e = loc[20+12*i:]
+		le.PutUint32(e[4:], uint32(len(loc)))
+		le.PutUint16(e[10:], uint16(len(value)))
+		loc = append(loc, value...)
+	}
+	return loc
+}
+
+func writeVHDX(d testDisk) []byte {
+	le := binary.LittleEndian
+	size := int64(len(d.data))
+	img := make([]byte, testDataOffset)
+	copy(img, fileSignature)
+
+	var dataWrite partition.GUID
+	for i := range dataWrite {
+		dataWrite[i] = d.id
+	}
+	for i, offset := range headerOffsets {
+		hdr := img[offset : offset+headerSize]
+		copy(hdr, headerSignature)
+		le.PutUint64(hdr[8:], uint64(i+1))
+		copy(hdr[32:], dataWrite[:])
+		le.PutUint16(hdr[66:], 1)
+		putChecksum(hdr)
+	}
+	for _, offset := range regionOffsets {
+		table := img[offset : offset+regionTableSize]
+		copy(table, regionSignature)
+		le.PutUint32(table[8:], 2)
+		for i, r := range []struct {
+			id     partition.GUID
+			offset int64
+		}{{batRegion, testBATOffset}, {metadataRegion, testMetadataOffset}} {
+			e := table[16+32*i:]
+			copy(e, r.id[:])
+			le.PutUint64(e[16:], uint64(r.offset))
+			le.PutUint32(e[24:], 1<<20)
+			le.PutUint32(e[28:], 1)
+		}
+		putChecksum(table)
+	}
+
+	meta := img[testMetadataOffset : testMetadataOffset+1<<20]
+	copy(meta, metaSignature)
+	var flags uint32
+	if d.differencing {
+		flags = 2
+	}
+	var linkage partition.GUID
+	for i := range linkage {
+		linkage[i] = d.parentID
+	}
+	items := []struct {
+		id   partition.GUID
+		data []byte
+	}{
+		{fileParametersItem, le.AppendUint32(le.AppendUint32(nil, testBlockSize), flags)},
+		{virtualDiskSizeItem, le.AppendUint64(nil, uint64(size))},
+		{logicalSectorSizeItem, le.AppendUint32(nil, 512)},
+		{physicalSectorSizeItem, le.AppendUint32(nil, 4096)},
+	}
+	if d.differencing {
+		items = append(items, struct {
+			id   partition.GUID
+			data []byte
+		}{parentLocatorItem, parentLocator(linkage, d.parentPath)})
+	}
+	le.PutUint16(meta[10:], uint16(len(items)))
+	at := 64 << 10
+	for i, item := range items {
+		e := meta[32+32*i:]
+		copy(e, item.id[:])
+		le.PutUint32(e[16:], uint32(at))
+		le.PutUint32(e[20:], uint32(len(item.data)))
+		le.PutUint32(e[24:], 4)
+		at += copy(meta[at:], item.data)
+	}
+
+	const chunkRatio = sectorsPerChunk * 512 / testBlockSize
+	bat := img[testBATOffset:]
+	var bitmap []byte
+	blocks := (size + testBlockSize - 1) / testBlockSize
+	for b := int64(0); b < blocks; b++ {
+		block := make([]byte, testBlockSize)
+		count, total := 0, 0
+		for s := b * testBlockSize / 512; s < (b+1)*testBlockSize/512 && s*512 < size; s++ {
+			total++
+			if !d.present(s) {
+				continue
+			}
+			count++
+			copy(block[s*512-b*testBlockSize:], d.data[s*512:(s+1)*512])
+			if bitmap == nil {
+				bitmap = make([]byte, 1<<20)
+			}
+			bitmap[s/8] |= 1 << (s % 8)
+		}
+		entry := bat[8*(b+b/chunkRatio):]
+		switch {
+		case count == 0 && b%2 == 0:
+			le.PutUint64(entry, payloadNotPresent)
+		case count == 0:
+			// Odd unallocated blocks of disks without a parent are
+			// explicitly zero instead.
+			if !d.differencing {
+				le.PutUint64(entry, payloadZero)
+			}
+		default:
+			state := uint64(payloadFullyPresent)
+			if d.differencing && count != total {
+				state = payloadPartiallyPresent
+			}
+			le.PutUint64(entry, uint64(len(img))|state)
+			img = append(img, block...)
+			bat = img[testBATOffset:]
+		}
+	}
+	if d.differencing && bitmap != nil {
+		le.PutUint64(bat[8*chunkRatio:], uint64(len(img))|bitmapPresent)
+		img = append(img, bitmap...)
+	}
+	return img
+}
+
+func checkRead(t *testing.T, name string, img *Image, want []byte) {
+	t.Helper()
+	imagetest.CheckRead(t, name, img, want, testBlockSize-1000, 3000)
+}
+
+func TestDynamic(t *testing.T) {
+	data := imagetest.RandomData(5*testBlockSize+3*512, 1)
+	// Blocks 1 and 2 are never written and read as zeros.
+	for _, b := range []int{1, 2} {
+		copy(data[b*testBlockSize:(b+1)*testBlockSize], make([]byte, testBlockSize))
+	}
+	present := func(sector int64) bool {
+		b := sector * 512 / testBlockSize
+		return b != 1 && b != 2
+	}
+	raw := writeVHDX(testDisk{data: data, id: 7, present: present})
+	img, err := New(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Size() != int64(len(data)) || img.BlockSize != testBlockSize || img.LogicalSectorSize != 512 || img.PhysicalSectorSize != 4096 || img.HasParent {
+		t.Errorf("got size %d, block size %d, sector sizes %d/%d, parent %v", img.Size(), img.BlockSize, img.LogicalSectorSize, img.PhysicalSectorSize, img.HasParent)
+	}
+	if img.DataWriteGUID[0] != 7 {
+		t.Errorf("DataWriteGUID = %s", img.DataWriteGUID)
+	}
+	checkRead(t, "dynamic", img, data)
+
+	// The second header has the higher sequence number; damaging it makes
+	// the first current.
+	damaged := append([]byte(nil), raw...)
+	damaged[headerOffsets[1]+100]++
+	if _, err := New(bytes.NewReader(damaged)); err != nil {
+		t.Errorf("image with a damaged header: %v", err)
+	}
+	damaged[headerOffsets[0]+100]++
+	if _, err := New(bytes.NewReader(damaged)); err == nil {
+		t.Error("image without a valid header was accepted")
+	}
+
+	// A log to replay is refused.
+	dirty := append([]byte(nil), raw...)
+	for _, offset := range headerOffsets {
+		dirty[offset+48] = 1
+		putChecksum(dirty[offset : offset+headerSize])
+	}
+	if _, err := New(bytes.NewReader(dirty)); !errors.Is(err, ErrLogNotEmpty) {
+		t.Errorf("New of an image with a log returned %v, want %v", err, ErrLogNotEmpty)
+	}
+
+	if _, err := New(bytes.NewReader(data)); !errors.Is(err, ErrNotVHDX) {
+		t.Errorf("New of a raw image returned %v, want %v", err, ErrNotVHDX)
+	}
+}
+
+// differencing returns a differencing disk whose parent locator is
+// parentPath, along with its parent.
+func differencing(parentPath string) (parent, child, want []byte) {
+	size := 4 * testBlockSize
+	parentData := imagetest.RandomData(size, 2)
+	childData := imagetest.RandomData(size, 3)
+	// The child holds every third sector of block 0, all of block 2 and
+	// nothing of the others.
+	present := func(sector int64) bool {
+		switch sector * 512 / testBlockSize {
+		case 0:
+			return sector%3 == 0
+		case 2:
+			return true
+		}
+		return false
+	}
+	want = append([]byte(nil), parentData...)
+	for s := int64(0); s*512 < int64(size); s++ {
+		if present(s) {
+			copy(want[s*512:], childData[s*512:(s+1)*512])
+		}
+	}
+	parent = writeVHDX(testDisk{data: parentData, id: 1, present: func(int64) bool { return true }})
+	child = writeVHDX(testDisk{data: childData, id: 2, present: present, differencing: true, parentID: 1, parentPath: parentPath})
+	return parent, child, want
+}
+
+func TestDifferencing(t *testing.T) {
+	parentRaw, childRaw, want := differencing(`.\parent.vhdx`)
+	parent, err := New(bytes.NewReader(parentRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := New(bytes.NewReader(childRaw), WithParent(parent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !img.HasParent || img.ParentLinkage != parent.DataWriteGUID {
+		t.Errorf("HasParent %v, ParentLinkage = %s, want %s", img.HasParent, img.ParentLinkage, parent.DataWriteGUID)
+	}
+	if len(img.ParentPaths) != 1 || img.ParentPaths[0] != `.\parent.vhdx` {
+		t.Errorf("ParentPaths = %q", img.ParentPaths)
+	}
+	checkRead(t, "differencing", img, want)
+
+	img, err = New(bytes.NewReader(childRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.ReadAt(make([]byte, 512), 2*testBlockSize); err != nil {
+		t.Errorf("read of a sector held by the child returned %v", err)
+	}
+	if _, err := img.ReadAt(make([]byte, 512), 512); !errors.Is(err, ErrNoParent) {
+		t.Errorf("read of a parent sector returned %v, want %v", err, ErrNoParent)
+	}
+}
+
+func TestOpenParent(t *testing.T) {
+	parent, child, want := differencing(`.\parent.vhdx`)
+	imagetest.CheckOpenParent(t, imagetest.OpenParentTest[*Image]{
+		ParentName: "parent.vhdx",
+		ChildName:  "child.vhdx",
+		Parent:     parent,
+		Child:      child,
+		// A parent written since.
+		Other: writeVHDX(testDisk{data: make([]byte, len(want)), id: 9, present: func(int64) bool { return false }}),
+		Want:  want,
+		Open:  func(name string) (*Image, error) { return Open(name) },
+		Check: checkRead,
+	})
+}
+
+func TestOpenUnsafeParent(t *testing.T) {
+	parent, child, want := differencing(`..\parent.vhdx`)
+	dir := t.TempDir()
+	name := filepath.Join(dir, "sub", "child.vhdx")
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	os.WriteFile(filepath.Join(dir, "parent.vhdx"), parent, 0o644)
+	os.WriteFile(name, child, 0o644)
+	// Only regular files are taken for the parent.
+	os.Mkdir(filepath.Join(dir, "sub", "parent.vhdx"), 0o755)
+
+	if _, err := Open(name); !errors.Is(err, ErrUnsafeParent) {
+		t.Errorf("Open with a parent out of its directory returned %v, want %v", err, ErrUnsafeParent)
+	}
+	img, err := Open(name, WithUnsafeParent(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	checkRead(t, "unsafe parent", img, want)
+}
+
+func TestFileSystem(t *testing.T) {
+	data := imagetest.FileSystem("inside vhdx")
+	raw := writeVHDX(testDisk{data: data, present: func(s int64) bool {
+		return !imagetest.IsZero(data[s*512 : (s+1)*512])
+	}})
+	img, err := New(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagetest.CheckFileSystem(t, img, "inside vhdx")
+}
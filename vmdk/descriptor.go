@@ -0,0 +1,172 @@
+package vmdk
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// NoParent is the parent content identifier of disks without a parent.
+const NoParent = 0xffffffff
+
+// Extent types.
+const (
+	ExtentSparse = "SPARSE"
+	ExtentFlat   = "FLAT"
+	ExtentZero   = "ZERO"
+	ExtentVMFS   = "VMFS"
+)
+
+// Descriptor is the text descriptor of a VMDK disk, stored in its own file or
+// embedded in a monolithic sparse extent.
+type Descriptor struct {
+	Version int
+	// CID is the content identifier of the disk, which changes when it is
+	// written. Child disks record the CID of their parent in ParentCID.
+	CID                uint32
+	ParentCID          uint32
+	CreateType         string
+	ParentFileNameHint string
+	Extents            []ExtentDescriptor
+	// DDB holds the disk database entries, such as ddb.adapterType.
+	DDB map[string]string
+}
+
+// ExtentDescriptor describes an extent of the disk.
+type ExtentDescriptor struct {
+	Access string
+	// Sectors is the size of the extent in 512 byte sectors.
+	Sectors  int64
+	Type     string
+	FileName string
+	// Offset is the offset of the extent in its file in sectors, for flat
+	// extents.
+	Offset int64
+}
+
+// HasParent reports whether the disk is a child disk.
+func (d *Descriptor) HasParent() bool {
+	return d.ParentCID != NoParent
+}
+
+// ParseDescriptor parses a text descriptor.
+func ParseDescriptor(b []byte) (*Descriptor, error) {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	d := &Descriptor{ParentCID: NoParent, DDB: make(map[string]string)}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok && !strings.HasPrefix(line, "RW ") && !strings.HasPrefix(line, "RDONLY ") && !strings.HasPrefix(line, "NOACCESS ") {
+			if err := d.set(strings.TrimSpace(k), unquote(strings.TrimSpace(v))); err != nil {
+				return nil, xerrors.Errorf("vmdk: descriptor line %d: %w", n, err)
+			}
+			continue
+		}
+		e, err := parseExtent(line)
+		if err != nil {
+			return nil, xerrors.Errorf("vmdk: descriptor line %d: %w", n, err)
+		}
+		d.Extents = append(d.Extents, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, xerrors.Errorf("vmdk: descriptor: %w", err)
+	}
+	if len(d.Extents) == 0 {
+		return nil, errors.New("vmdk: descriptor has no extents")
+	}
+	return d, nil
+}
+
+func (d *Descriptor) set(key, value string) error {
+	var err error
+	switch key {
+	case "version":
+		d.Version, err = strconv.Atoi(value)
+	case "CID":
+		d.CID, err = parseCID(value)
+	case "parentCID":
+		d.ParentCID, err = parseCID(value)
+	case "createType":
+		d.CreateType = value
+	case "parentFileNameHint":
+		d.ParentFileNameHint = value
+	default:
+		if strings.HasPrefix(key, "ddb.") {
+			d.DDB[key] = value
+		}
+	}
+	if err != nil {
+		return xerrors.Errorf("%s: %w", key, err)
+	}
+	return nil
+}
+
+func parseCID(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 16, 32)
+	return uint32(v), err
+}
+
+// parseExtent parses an extent line: the access, the size in sectors, the
+// type, and for all but zero extents the quoted file name, followed by the
+// offset for flat extents.
+func parseExtent(line string) (ExtentDescriptor, error) {
+	var e ExtentDescriptor
+	var fields []string
+	for rest := line; rest != ""; {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			break
+		}
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return e, errors.New("unterminated file name")
+			}
+			fields = append(fields, rest[1:end+1])
+			rest = rest[end+2:]
+			continue
+		}
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		fields = append(fields, rest[:end])
+		rest = rest[end:]
+	}
+	if len(fields) < 3 {
+		return e, xerrors.Errorf("invalid extent %q", line)
+	}
+	e.Access, e.Type = fields[0], fields[2]
+	var err error
+	if e.Sectors, err = strconv.ParseInt(fields[1], 10, 64); err != nil || e.Sectors < 0 {
+		return e, xerrors.Errorf("invalid extent size %q", fields[1])
+	}
+	if len(fields) > 3 {
+		e.FileName = fields[3]
+	}
+	if len(fields) > 4 {
+		if e.Offset, err = strconv.ParseInt(fields[4], 10, 64); err != nil || e.Offset < 0 {
+			return e, xerrors.Errorf("invalid extent offset %q", fields[4])
+		}
+	}
+	if e.Type != ExtentZero && e.FileName == "" {
+		return e, xerrors.Errorf("%s extent without a file name", e.Type)
+	}
+	return e, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
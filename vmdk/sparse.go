@@ -0,0 +1,235 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/asalih/go-ext/internal/diskimage"
+	"github.com/asalih/go-ext/internal/ioutil"
+	"golang.org/x/xerrors"
+)
+
+const (
+	sparseMagic = "KDMV"
+	headerSize  = 512
+	sectorSize  = 512
+
+	// gdAtEnd marks a stream-optimized extent whose grain directory is
+	// located by the footer at the end of the file.
+	gdAtEnd = 0xffffffffffffffff
+
+	// Header flags.
+	flagCompressed = 1 << 16
+	flagMarkers    = 1 << 17
+
+	compressionDeflate = 1
+
+	// Grain table entries.
+	grainUnallocated = 0
+	grainZero        = 1
+
+	// maxGrainDirectory bounds the grain directory read in memory.
+	maxGrainDirectory = 16 << 20
+	// maxDescriptorSize bounds embedded and standalone descriptors.
+	maxDescriptorSize = 1 << 20
+)
+
+// sparseExtent is a hosted sparse extent, the format of monolithic sparse,
+// split sparse and stream-optimized disks.
+type sparseExtent struct {
+	r          io.ReaderAt
+	capacity   int64 // bytes
+	grainSize  int64 // bytes
+	gtEntries  int64
+	compressed bool
+	gd         []uint32
+
+	descriptorOffset int64
+	descriptorSize   int64
+}
+
+// sparseHeader is the header of a sparse extent, also used as the footer of
+// stream-optimized extents.
+type sparseHeader struct {
+	version          uint32
+	flags            uint32
+	capacity         uint64
+	grainSize        uint64
+	descriptorOffset uint64
+	descriptorSize   uint64
+	gtEntries        uint32
+	rgdOffset        uint64
+	gdOffset         uint64
+	compression      uint16
+}
+
+func readSparseHeader(r io.ReaderAt, off int64) (*sparseHeader, error) {
+	b := make([]byte, headerSize)
+	if err := ioutil.ReadFull(r, b, off); err != nil {
+		return nil, err
+	}
+	if string(b[:4]) != sparseMagic {
+		return nil, ErrNotVMDK
+	}
+	le := binary.LittleEndian
+	return &sparseHeader{
+		version:          le.Uint32(b[4:]),
+		flags:            le.Uint32(b[8:]),
+		capacity:         le.Uint64(b[12:]),
+		grainSize:        le.Uint64(b[20:]),
+		descriptorOffset: le.Uint64(b[28:]),
+		descriptorSize:   le.Uint64(b[36:]),
+		gtEntries:        le.Uint32(b[44:]),
+		rgdOffset:        le.Uint64(b[48:]),
+		gdOffset:         le.Uint64(b[56:]),
+		compression:      le.Uint16(b[77:]),
+	}, nil
+}
+
+// newSparseExtent reads the sparse extent r of size bytes.
+func newSparseExtent(r io.ReaderAt, size int64) (*sparseExtent, error) {
+	h, err := readSparseHeader(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if h.version < 1 || h.version > 3 {
+		return nil, xerrors.Errorf("vmdk: unsupported sparse extent version %d", h.version)
+	}
+	if h.gdOffset == gdAtEnd {
+		// Stream-optimized extents end with a footer marker, the footer
+		// and an end-of-stream marker.
+		if size < 3*sectorSize {
+			return nil, errors.New("vmdk: stream-optimized extent without footer")
+		}
+		footer, err := readSparseHeader(r, size-2*sectorSize)
+		if err != nil {
+			return nil, xerrors.Errorf("vmdk: stream-optimized extent footer: %w", err)
+		}
+		h.gdOffset = footer.gdOffset
+	}
+	if h.flags&flagCompressed != 0 && h.compression != compressionDeflate {
+		return nil, xerrors.Errorf("vmdk: unsupported compression algorithm %d", h.compression)
+	}
+	if h.grainSize < 1 || h.grainSize > 1<<16 || h.grainSize&(h.grainSize-1) != 0 {
+		return nil, xerrors.Errorf("vmdk: invalid grain size of %d sectors", h.grainSize)
+	}
+	if h.gtEntries < 1 || h.gtEntries > 1<<16 {
+		return nil, xerrors.Errorf("vmdk: invalid grain table size %d", h.gtEntries)
+	}
+	if h.capacity > 1<<54/sectorSize {
+		return nil, xerrors.Errorf("vmdk: invalid capacity of %d sectors", h.capacity)
+	}
+
+	e := &sparseExtent{
+		r:                r,
+		capacity:         int64(h.capacity) * sectorSize,
+		grainSize:        int64(h.grainSize) * sectorSize,
+		gtEntries:        int64(h.gtEntries),
+		compressed:       h.flags&flagCompressed != 0,
+		descriptorOffset: int64(h.descriptorOffset) * sectorSize,
+		descriptorSize:   int64(h.descriptorSize) * sectorSize,
+	}
+	gtCoverage := e.grainSize * e.gtEntries
+	entries := (e.capacity + gtCoverage - 1) / gtCoverage
+	if entries > maxGrainDirectory {
+		return nil, xerrors.Errorf("vmdk: grain directory of %d entries", entries)
+	}
+	gdOffset := h.gdOffset
+	if gdOffset == 0 {
+		gdOffset = h.rgdOffset
+	}
+	raw := make([]byte, 4*entries)
+	if err := ioutil.ReadFull(r, raw, int64(gdOffset)*sectorSize); err != nil {
+		return nil, xerrors.Errorf("vmdk: failed to read grain directory: %w", err)
+	}
+	e.gd = make([]uint32, entries)
+	for i := range e.gd {
+		e.gd[i] = binary.LittleEndian.Uint32(raw[4*i:])
+	}
+	return e, nil
+}
+
+// descriptor returns the descriptor embedded in the extent, or nil if it has
+// none.
+func (e *sparseExtent) descriptor() ([]byte, error) {
+	if e.descriptorOffset == 0 || e.descriptorSize == 0 {
+		return nil, nil
+	}
+	if e.descriptorSize > maxDescriptorSize {
+		return nil, xerrors.Errorf("vmdk: descriptor of %d bytes", e.descriptorSize)
+	}
+	b := make([]byte, e.descriptorSize)
+	if err := ioutil.ReadFull(e.r, b, e.descriptorOffset); err != nil {
+		return nil, xerrors.Errorf("vmdk: failed to read descriptor: %w", err)
+	}
+	return b, nil
+}
+
+// read reads p from the extent at pos, within a single grain. It returns
+// false if the grain is not allocated, leaving p untouched.
+func (e *sparseExtent) read(p []byte, pos int64) (bool, error) {
+	gtCoverage := e.grainSize * e.gtEntries
+	gt := e.gd[pos/gtCoverage]
+	if gt == 0 {
+		return false, nil
+	}
+	index := pos % gtCoverage / e.grainSize
+	var raw [4]byte
+	if err := ioutil.ReadFull(e.r, raw[:], int64(gt)*sectorSize+4*index); err != nil {
+		return false, xerrors.Errorf("vmdk: failed to read grain table at sector %d: %w", gt, err)
+	}
+	grain := binary.LittleEndian.Uint32(raw[:])
+	switch grain {
+	case grainUnallocated:
+		return false, nil
+	case grainZero:
+		diskimage.Zero(p)
+		return true, nil
+	}
+	within := pos % e.grainSize
+	if e.compressed {
+		return true, e.readCompressed(p, int64(grain)*sectorSize, pos-within, within)
+	}
+	if err := ioutil.ReadFull(e.r, p, int64(grain)*sectorSize+within); err != nil {
+		return false, xerrors.Errorf("vmdk: failed to read grain at sector %d: %w", grain, err)
+	}
+	return true, nil
+}
+
+// readCompressed reads p at offset within of the compressed grain at offset,
+// which starts with the sector of the grain on the disk and the size of the
+// zlib stream which follows.
+func (e *sparseExtent) readCompressed(p []byte, offset, start, within int64) error {
+	var hdr [12]byte
+	if err := ioutil.ReadFull(e.r, hdr[:], offset); err != nil {
+		return xerrors.Errorf("vmdk: failed to read compressed grain at %d: %w", offset, err)
+	}
+	lba := binary.LittleEndian.Uint64(hdr[:])
+	size := binary.LittleEndian.Uint32(hdr[8:])
+	if int64(lba)*sectorSize != start {
+		return xerrors.Errorf("vmdk: compressed grain at %d is for sector %d, want %d", offset, lba, start/sectorSize)
+	}
+	if int64(size) > 2*e.grainSize+1024 {
+		return xerrors.Errorf("vmdk: compressed grain at %d of %d bytes", offset, size)
+	}
+	raw := make([]byte, size)
+	if err := ioutil.ReadFull(e.r, raw, offset+12); err != nil {
+		return xerrors.Errorf("vmdk: failed to read compressed grain at %d: %w", offset, err)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return xerrors.Errorf("vmdk: compressed grain at %d: %w", offset, err)
+	}
+	grain := make([]byte, e.grainSize)
+	// The last grain of the disk may be short.
+	n, err := io.ReadFull(zr, grain)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return xerrors.Errorf("vmdk: compressed grain at %d: %w", offset, err)
+	}
+	diskimage.Zero(grain[n:])
+	copy(p, grain[within:])
+	return nil
+}
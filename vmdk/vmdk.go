@@ -0,0 +1,345 @@
+// Package vmdk reads VMware VMDK disk images: monolithic and split sparse
+// disks, stream-optimized disks with compressed grains, flat disks and child
+// disks of snapshots. The virtual disk is exposed as an io.ReaderAt which can
+// be passed to partition.Read or ext.NewFS.
+//
+// ESXi sparse formats (VMFSSPARSE and SESPARSE extents) are not supported.
+package vmdk
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/asalih/go-ext/internal/diskimage"
+	"github.com/asalih/go-ext/internal/ioutil"
+	"golang.org/x/xerrors"
+)
+
+// maxParentChain bounds the length of chains of parents opened by Open.
+const maxParentChain = 32
+
+var (
+	// ErrNotVMDK is returned by New for images which are not sparse VMDK
+	// extents.
+	ErrNotVMDK = errors.New("vmdk: not a sparse VMDK image")
+
+	// ErrNoParent is returned when reading grains a child disk leaves to its
+	// parent, if it was not given one with WithParent.
+	ErrNoParent = errors.New("vmdk: parent disk not provided")
+
+	// ErrUnsafePath is returned by Open for disks whose extent or parent file
+	// names are absolute or lead out of the directory of the disk, unless
+	// allowed with WithUnsafePaths.
+	ErrUnsafePath = errors.New("vmdk: file outside the image directory")
+)
+
+// Option configures an Image.
+type Option func(*options)
+
+type options struct {
+	parent      io.ReaderAt
+	unsafePaths bool
+}
+
+// WithParent sets the reader of the parent of a child disk, which supplies
+// the grains the disk does not allocate.
+func WithParent(r io.ReaderAt) Option {
+	return func(o *options) {
+		o.parent = r
+	}
+}
+
+// WithUnsafePaths sets whether Open follows extent and parent file names
+// which are absolute or lead out of the directory of the disk. Names are read
+// from the descriptor, so that an untrusted disk could otherwise make Open
+// read any file on the host.
+func WithUnsafePaths(enabled bool) Option {
+	return func(o *options) {
+		o.unsafePaths = enabled
+	}
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Image is a VMDK disk. It is safe for concurrent use.
+type Image struct {
+	// Descriptor is the descriptor of the disk, or nil for sparse extents
+	// without an embedded one.
+	Descriptor *Descriptor
+
+	size    int64
+	extents []extent
+	parent  io.ReaderAt
+	closers []io.Closer
+}
+
+// extent is an extent of the disk, starting start bytes into it.
+type extent struct {
+	start, size int64
+	typ         string
+	// r and offset locate the data of flat extents.
+	r      io.ReaderAt
+	offset int64
+	sparse *sparseExtent
+}
+
+// New reads the monolithic sparse or stream-optimized VMDK file r of size
+// bytes. Child disks can be read without their parent, except for the grains
+// they leave to it, which fail with ErrNoParent.
+func New(r io.ReaderAt, size int64, opts ...Option) (*Image, error) {
+	sparse, err := newSparseExtent(r, size)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{
+		size:    sparse.capacity,
+		extents: []extent{{size: sparse.capacity, typ: ExtentSparse, sparse: sparse}},
+	}
+	raw, err := sparse.descriptor()
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		if img.Descriptor, err = ParseDescriptor(raw); err != nil {
+			return nil, err
+		}
+	}
+	img.parent = newOptions(opts).parent
+	return img, nil
+}
+
+// Open opens the VMDK disk name, a descriptor file or a monolithic sparse
+// file, along with its extent files and the chain of parents of a child disk.
+// The image must be closed to close the files.
+//
+// Extent and parent files are only opened in the directory of the disk, or
+// below it, unless allowed with WithUnsafePaths. The options apply to every
+// disk of the chain, except for WithParent which Open ignores.
+func Open(name string, opts ...Option) (*Image, error) {
+	o := newOptions(opts)
+	o.parent = nil
+	return open(name, o, 0)
+}
+
+func open(name string, o options, depth int) (*Image, error) {
+	img, err := openDisk(name, o)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", name, err)
+	}
+	if img.Descriptor == nil || !img.Descriptor.HasParent() {
+		return img, nil
+	}
+
+	if depth >= maxParentChain {
+		img.Close()
+		return nil, xerrors.Errorf("vmdk: more than %d parent disks", maxParentChain)
+	}
+	hint := img.Descriptor.ParentFileNameHint
+	if hint == "" {
+		img.Close()
+		return nil, xerrors.Errorf("vmdk: %s has a parent but no parent file name", name)
+	}
+	path := strings.ReplaceAll(hint, `\`, "/")
+	if !o.unsafePaths && !filepath.IsLocal(path) {
+		img.Close()
+		return nil, xerrors.Errorf("vmdk: parent of %s: %q: %w", name, hint, ErrUnsafePath)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(name), path)
+	}
+	parent, err := open(path, o, depth+1)
+	if err != nil {
+		img.Close()
+		return nil, xerrors.Errorf("vmdk: parent of %s: %w", name, err)
+	}
+	if parent.Descriptor == nil || parent.Descriptor.CID != img.Descriptor.ParentCID {
+		parent.Close()
+		img.Close()
+		return nil, xerrors.Errorf("vmdk: %s changed since %s was created from it", path, name)
+	}
+	img.parent = parent
+	img.closers = append(img.closers, parent)
+	return img, nil
+}
+
+// openDisk opens the disk name without its parent.
+func openDisk(name string, o options) (*Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	head := make([]byte, 4)
+	if _, err := f.ReadAt(head, 0); err == nil && string(head) == sparseMagic {
+		img, err := New(f, fi.Size())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		img.closers = append(img.closers, f)
+		return img, nil
+	}
+
+	defer f.Close()
+	if fi.Size() > maxDescriptorSize {
+		return nil, ErrNotVMDK
+	}
+	raw, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	d, err := ParseDescriptor(raw)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{Descriptor: d}
+	for _, ed := range d.Extents {
+		e, err := img.openExtent(filepath.Dir(name), ed, o)
+		if err != nil {
+			img.Close()
+			return nil, err
+		}
+		e.start, e.size = img.size, ed.Sectors*sectorSize
+		img.extents = append(img.extents, e)
+		img.size += e.size
+	}
+	return img, nil
+}
+
+// openExtent opens the file of an extent, relative to dir.
+func (img *Image) openExtent(dir string, ed ExtentDescriptor, o options) (extent, error) {
+	e := extent{typ: ed.Type}
+	switch ed.Type {
+	case ExtentZero:
+		return e, nil
+	case ExtentFlat, ExtentVMFS, ExtentSparse:
+	default:
+		return e, xerrors.Errorf("vmdk: unsupported extent type %s", ed.Type)
+	}
+
+	path := ed.FileName
+	if !o.unsafePaths && !filepath.IsLocal(path) {
+		return e, xerrors.Errorf("vmdk: extent %q: %w", path, ErrUnsafePath)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return e, xerrors.Errorf("vmdk: extent: %w", err)
+	}
+	img.closers = append(img.closers, f)
+	if ed.Type != ExtentSparse {
+		e.r, e.offset = f, ed.Offset*sectorSize
+		return e, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return e, err
+	}
+	if e.sparse, err = newSparseExtent(f, fi.Size()); err != nil {
+		return e, xerrors.Errorf("%s: %w", path, err)
+	}
+	return e, nil
+}
+
+// Size returns the size of the virtual disk in bytes.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// Close closes the files opened by Open. It does nothing for images created
+// by New.
+func (img *Image) Close() error {
+	var err error
+	for _, c := range img.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	img.closers = nil
+	return err
+}
+
+// ReadAt implements io.ReaderAt.ReadAt.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vmdk: negative offset")
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	var err error
+	if rest := img.size - off; int64(len(p)) > rest {
+		p = p[:rest]
+		err = io.EOF
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		i := sort.Search(len(img.extents), func(i int) bool {
+			return img.extents[i].start+img.extents[i].size > pos
+		})
+		e := &img.extents[i]
+		within := pos - e.start
+		buf := p[read:]
+		if rest := e.size - within; int64(len(buf)) > rest {
+			buf = buf[:rest]
+		}
+		if e.sparse != nil {
+			if rest := e.sparse.grainSize - within%e.sparse.grainSize; int64(len(buf)) > rest {
+				buf = buf[:rest]
+			}
+		}
+		if rerr := img.readExtent(e, buf, pos, within); rerr != nil {
+			return read, rerr
+		}
+		read += len(buf)
+	}
+	return read, err
+}
+
+// readExtent reads p from the extent e at offset within of it, pos on the
+// disk. Reads of sparse extents lie within a single grain.
+func (img *Image) readExtent(e *extent, p []byte, pos, within int64) error {
+	switch {
+	case e.sparse != nil:
+		if within >= e.sparse.capacity {
+			break
+		}
+		ok, err := e.sparse.read(p, within)
+		if ok || err != nil {
+			return err
+		}
+		if img.Descriptor != nil && img.Descriptor.HasParent() {
+			return img.readParent(p, pos)
+		}
+	case e.r != nil:
+		return ioutil.ReadFull(e.r, p, e.offset+within)
+	}
+	diskimage.Zero(p)
+	return nil
+}
+
+// readParent reads p from the parent of a child disk at pos.
+func (img *Image) readParent(p []byte, pos int64) error {
+	if img.parent == nil {
+		return ErrNoParent
+	}
+	return diskimage.ReadParent(img.parent, p, pos)
+}
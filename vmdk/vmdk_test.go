@@ -0,0 +1,383 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/imagetest"
+)
+
+const (
+	testGrainSectors = 8
+	testGrainSize    = testGrainSectors * sectorSize
+	testGTEntries    = 64
+	testGTCoverage   = testGrainSize * testGTEntries
+)
+
+// testExtent describes a test sparse extent.
+type testExtent struct {
+	data []byte
+	// present reports whether a grain is allocated; unallocated grains with
+	// an odd index are marked as zero grains instead.
+	present    func(grain int64) bool
+	descriptor string
+	stream     bool
+}
+
+func testHeader(capacity int64, flags uint32, descriptorSectors int64, gdOffset uint64) []byte {
+	le := binary.LittleEndian
+	h := make([]byte, headerSize)
+	copy(h, sparseMagic)
+	le.PutUint32(h[4:], 1)
+	if flags&flagCompressed != 0 {
+		le.PutUint32(h[4:], 3)
+	}
+	le.PutUint32(h[8:], flags|1)
+	le.PutUint64(h[12:], uint64(capacity/sectorSize))
+	le.PutUint64(h[20:], testGrainSectors)
+	if descriptorSectors != 0 {
+		le.PutUint64(h[28:], 1)
+		le.PutUint64(h[36:], uint64(descriptorSectors))
+	}
+	le.PutUint32(h[44:], testGTEntries)
+	le.PutUint64(h[56:], gdOffset)
+	copy(h[73:], "\n \r\n")
+	if flags&flagCompressed != 0 {
+		le.PutUint16(h[77:], compressionDeflate)
+	}
+	return h
+}
+
+func padSector(b []byte) []byte {
+	for len(b)%sectorSize != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func marker(sectors int64, typ uint32) []byte {
+	m := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint64(m, uint64(sectors))
+	binary.LittleEndian.PutUint32(m[12:], typ)
+	return m
+}
+
+func writeSparse(e testExtent) []byte {
+	le := binary.LittleEndian
+	capacity := int64(len(e.data))
+	grains := (capacity + testGrainSize - 1) / testGrainSize
+	tables := (grains + testGTEntries - 1) / testGTEntries
+	descriptorSectors := int64(len(e.descriptor)+sectorSize-1) / sectorSize
+
+	var flags uint32
+	gdOffset := uint64(1 + descriptorSectors)
+	if e.stream {
+		flags = flagCompressed | flagMarkers
+		gdOffset = gdAtEnd
+	}
+	img := testHeader(capacity, flags, descriptorSectors, gdOffset)
+	img = padSector(append(img, e.descriptor...))
+
+	gd := make([]byte, 4*tables)
+	gts := make([]byte, 4*testGTEntries*tables)
+	if !e.stream {
+		// The grain directory and tables follow the descriptor.
+		img = padSector(append(img, gd...))
+		for t := int64(0); t < tables; t++ {
+			le.PutUint32(gd[4*t:], uint32(int64(len(img))/sectorSize))
+			img = padSector(append(img, make([]byte, 4*testGTEntries)...))
+		}
+		copy(img[gdOffset*sectorSize:], gd)
+	} else if len(img) == sectorSize {
+		// Grain table entries of 1 mark zero grains, so no grain may start
+		// at sector 1.
+		img = append(img, make([]byte, sectorSize)...)
+	}
+
+	for g := int64(0); g < grains; g++ {
+		entry := gts[4*g:]
+		if !e.present(g) {
+			if g%2 == 1 {
+				le.PutUint32(entry, grainZero)
+			}
+			continue
+		}
+		grain := make([]byte, testGrainSize)
+		copy(grain, e.data[g*testGrainSize:])
+		le.PutUint32(entry, uint32(int64(len(img))/sectorSize))
+		if !e.stream {
+			img = append(img, grain...)
+			continue
+		}
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(grain)
+		zw.Close()
+		img = le.AppendUint64(img, uint64(g*testGrainSectors))
+		img = le.AppendUint32(img, uint32(z.Len()))
+		img = padSector(append(img, z.Bytes()...))
+	}
+
+	if !e.stream {
+		for t := int64(0); t < tables; t++ {
+			at := int64(le.Uint32(gd[4*t:])) * sectorSize
+			copy(img[at:at+4*testGTEntries], gts[4*testGTEntries*t:])
+		}
+		return img
+	}
+	for t := int64(0); t < tables; t++ {
+		img = append(img, marker(4*testGTEntries/sectorSize, 1)...)
+		le.PutUint32(gd[4*t:], uint32(int64(len(img))/sectorSize))
+		img = padSector(append(img, gts[4*testGTEntries*t:4*testGTEntries*(t+1)]...))
+	}
+	img = append(img, marker(1, 2)...)
+	gdOffset = uint64(len(img)) / sectorSize
+	img = padSector(append(img, gd...))
+	img = append(img, marker(1, 3)...)
+	img = append(img, testHeader(capacity, flags, descriptorSectors, gdOffset)...)
+	return append(img, marker(0, 0)...)
+}
+
+func descriptor(cid, parentCID uint32, createType, parent string, extents ...string) string {
+	s := fmt.Sprintf("# Disk DescriptorFile\nversion=1\nCID=%08x\nparentCID=%08x\ncreateType=%q\n", cid, parentCID, createType)
+	if parent != "" {
+		s += "parentFileNameHint=\"" + parent + "\"\n"
+	}
+	s += "\n# Extent description\n"
+	for _, e := range extents {
+		s += e + "\n"
+	}
+	return s + "\n# The Disk Data Base\n#DDB\n\nddb.adapterType = \"lsilogic\"\n"
+}
+
+func checkRead(t *testing.T, name string, img *Image, want []byte) {
+	t.Helper()
+	imagetest.CheckRead(t, name, img, want, testGTCoverage-testGrainSize-100, 3*testGrainSize)
+}
+
+// sparseData returns random data where the grains for which present is false
+// are zero.
+func sparseData(size int, seed int64, present func(int64) bool) []byte {
+	data := imagetest.RandomData(size, seed)
+	for g := 0; g*testGrainSize < size; g++ {
+		if !present(int64(g)) {
+			end := (g + 1) * testGrainSize
+			if end > size {
+				end = size
+			}
+			copy(data[g*testGrainSize:end], make([]byte, testGrainSize))
+		}
+	}
+	return data
+}
+
+func TestSparse(t *testing.T) {
+	present := func(g int64) bool { return g%5 != 2 && g%7 != 3 }
+	data := sparseData(3*testGTCoverage+5*sectorSize, 1, present)
+	for _, stream := range []bool{false, true} {
+		name := fmt.Sprintf("stream %v", stream)
+		d := descriptor(0x1234abcd, NoParent, "monolithicSparse", "", `RW 100 SPARSE "disk.vmdk"`)
+		raw := writeSparse(testExtent{data: data, present: present, descriptor: d, stream: stream})
+		img, err := New(bytes.NewReader(raw), int64(len(raw)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if img.Size() != int64(len(data)) {
+			t.Errorf("%s: size %d, want %d", name, img.Size(), len(data))
+		}
+		if img.Descriptor == nil || img.Descriptor.CID != 0x1234abcd || img.Descriptor.HasParent() {
+			t.Errorf("%s: descriptor %+v", name, img.Descriptor)
+		}
+		checkRead(t, name, img, data)
+	}
+
+	if _, err := New(bytes.NewReader(data), int64(len(data))); !errors.Is(err, ErrNotVMDK) {
+		t.Errorf("New of a raw image returned %v, want %v", err, ErrNotVMDK)
+	}
+}
+
+func TestParseDescriptor(t *testing.T) {
+	d, err := ParseDescriptor([]byte(descriptor(1, 2, "twoGbMaxExtentSparse", `..\base.vmdk`,
+		`RW 4192256 SPARSE "disk-s001.vmdk"`,
+		`RDONLY 2048 FLAT "name with spaces.vmdk" 17`,
+		`NOACCESS 100 ZERO`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Version != 1 || d.CID != 1 || d.ParentCID != 2 || d.CreateType != "twoGbMaxExtentSparse" || d.ParentFileNameHint != `..\base.vmdk` {
+		t.Errorf("got %+v", d)
+	}
+	if d.DDB["ddb.adapterType"] != "lsilogic" {
+		t.Errorf("DDB = %v", d.DDB)
+	}
+	want := []ExtentDescriptor{
+		{Access: "RW", Sectors: 4192256, Type: ExtentSparse, FileName: "disk-s001.vmdk"},
+		{Access: "RDONLY", Sectors: 2048, Type: ExtentFlat, FileName: "name with spaces.vmdk", Offset: 17},
+		{Access: "NOACCESS", Sectors: 100, Type: ExtentZero},
+	}
+	if fmt.Sprint(d.Extents) != fmt.Sprint(want) {
+		t.Errorf("extents %+v, want %+v", d.Extents, want)
+	}
+
+	for _, bad := range []string{
+		"version=1\n",
+		"RW 10 FLAT\n",
+		"RW x SPARSE \"a.vmdk\"\n",
+		"RW 10 FLAT \"a.vmdk\n",
+		"CID=zz\nRW 10 ZERO\n",
+	} {
+		if _, err := ParseDescriptor([]byte(bad)); err == nil {
+			t.Errorf("ParseDescriptor(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestOpenExtents(t *testing.T) {
+	dir := t.TempDir()
+	flat := imagetest.RandomData(3*testGrainSize, 2)
+	present := func(g int64) bool { return g != 1 }
+	sparse := sparseData(testGTCoverage+testGrainSize, 3, present)
+	os.WriteFile(filepath.Join(dir, "disk-flat.vmdk"), append(make([]byte, 4*sectorSize), flat...), 0o644)
+	os.WriteFile(filepath.Join(dir, "disk-s001.vmdk"), writeSparse(testExtent{data: sparse, present: present}), 0o644)
+	os.WriteFile(filepath.Join(dir, "disk.vmdk"), []byte(descriptor(5, NoParent, "custom", "",
+		fmt.Sprintf(`RW %d FLAT "disk-flat.vmdk" 4`, len(flat)/sectorSize),
+		`RW 16 ZERO`,
+		fmt.Sprintf(`RW %d SPARSE "disk-s001.vmdk"`, len(sparse)/sectorSize))), 0o644)
+
+	img, err := Open(filepath.Join(dir, "disk.vmdk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	want := append(append(append([]byte(nil), flat...), make([]byte, 16*sectorSize)...), sparse...)
+	checkRead(t, "extents", img, want)
+}
+
+func TestOpenUnsafeExtents(t *testing.T) {
+	dir := t.TempDir()
+	flat := imagetest.RandomData(testGTCoverage+2*testGrainSize, 2)
+	os.WriteFile(filepath.Join(dir, "disk-flat.vmdk"), flat, 0o644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	for name, file := range map[string]string{
+		"relative.vmdk": "../disk-flat.vmdk",
+		"absolute.vmdk": filepath.Join(dir, "disk-flat.vmdk"),
+	} {
+		name = filepath.Join(dir, "sub", name)
+		os.WriteFile(name, []byte(descriptor(5, NoParent, "monolithicFlat", "",
+			fmt.Sprintf(`RW %d FLAT %q 0`, len(flat)/sectorSize, file))), 0o644)
+		if _, err := Open(name); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("Open(%q) with extent %q returned %v, want %v", name, file, err, ErrUnsafePath)
+		}
+		img, err := Open(name, WithUnsafePaths(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRead(t, file, img, flat)
+		img.Close()
+	}
+}
+
+func child() (parent, child, want []byte) {
+	size := 2*testGTCoverage + 3*testGrainSize
+	parentData := imagetest.RandomData(size, 4)
+	// The child allocates every third grain; the others come from the
+	// parent, except those marked as zero grains.
+	present := func(g int64) bool { return g%3 == 0 }
+	childData := sparseData(size, 5, present)
+	want = append([]byte(nil), parentData...)
+	for g := 0; g*testGrainSize < size; g++ {
+		if present(int64(g)) || g%2 == 1 {
+			copy(want[g*testGrainSize:], childData[g*testGrainSize:(g+1)*testGrainSize])
+		}
+	}
+	parent = writeSparse(testExtent{data: parentData, present: func(int64) bool { return true },
+		descriptor: descriptor(0xaa, NoParent, "monolithicSparse", "", `RW 1 SPARSE "parent.vmdk"`)})
+	child = writeSparse(testExtent{data: childData, present: present,
+		descriptor: descriptor(0xbb, 0xaa, "monolithicSparse", "parent.vmdk", `RW 1 SPARSE "child.vmdk"`)})
+	return parent, child, want
+}
+
+func TestChild(t *testing.T) {
+	parentRaw, childRaw, want := child()
+	parent, err := New(bytes.NewReader(parentRaw), int64(len(parentRaw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := New(bytes.NewReader(childRaw), int64(len(childRaw)), WithParent(parent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !img.Descriptor.HasParent() || img.Descriptor.ParentFileNameHint != "parent.vmdk" {
+		t.Errorf("descriptor %+v", img.Descriptor)
+	}
+	checkRead(t, "child", img, want)
+
+	img, err = New(bytes.NewReader(childRaw), int64(len(childRaw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.ReadAt(make([]byte, 512), 0); err != nil {
+		t.Errorf("read of a grain held by the child returned %v", err)
+	}
+	if _, err := img.ReadAt(make([]byte, 512), 2*testGrainSize); !errors.Is(err, ErrNoParent) {
+		t.Errorf("read of a parent grain returned %v, want %v", err, ErrNoParent)
+	}
+}
+
+func TestOpenParent(t *testing.T) {
+	parent, child, want := child()
+	imagetest.CheckOpenParent(t, imagetest.OpenParentTest[*Image]{
+		ParentName: "parent.vmdk",
+		ChildName:  "child.vmdk",
+		Parent:     parent,
+		Child:      child,
+		// A parent written since.
+		Other: writeSparse(testExtent{data: make([]byte, len(want)), present: func(int64) bool { return false },
+			descriptor: descriptor(0xcc, NoParent, "monolithicSparse", "", `RW 1 SPARSE "parent.vmdk"`)}),
+		Want:  want,
+		Open:  func(name string) (*Image, error) { return Open(name) },
+		Check: checkRead,
+	})
+}
+
+func TestOpenUnsafeParent(t *testing.T) {
+	parentRaw, childRaw, want := child()
+	// Keep the length of the embedded descriptor.
+	childRaw = bytes.Replace(childRaw, []byte(`"parent.vmdk"`), []byte(`"..\par.vmdk"`), 1)
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	os.WriteFile(filepath.Join(dir, "par.vmdk"), parentRaw, 0o644)
+	os.WriteFile(filepath.Join(dir, "sub", "child.vmdk"), childRaw, 0o644)
+
+	if _, err := Open(filepath.Join(dir, "sub", "child.vmdk")); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("Open with a parent out of its directory returned %v, want %v", err, ErrUnsafePath)
+	}
+	img, err := Open(filepath.Join(dir, "sub", "child.vmdk"), WithUnsafePaths(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	checkRead(t, "unsafe parent", img, want)
+}
+
+func TestFileSystem(t *testing.T) {
+	data := imagetest.FileSystem("inside vmdk")
+	raw := writeSparse(testExtent{data: data, stream: true, present: func(g int64) bool {
+		end := (g + 1) * testGrainSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		return !imagetest.IsZero(data[g*testGrainSize : end])
+	}})
+	img, err := New(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagetest.CheckFileSystem(t, img, "inside vmdk")
+}
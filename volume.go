@@ -0,0 +1,108 @@
+package ext
+
+import (
+	"errors"
+	"io"
+
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/lvm"
+	"github.com/asalih/go-ext/partition"
+	"golang.org/x/xerrors"
+)
+
+// Volume is an ext filesystem found on a disk image by FindVolumes.
+type Volume struct {
+	// Partition is the partition holding the filesystem, or nil if the
+	// filesystem spans the whole image or lies on a logical volume.
+	Partition *partition.Partition
+
+	// LogicalVolume is the LVM2 logical volume holding the filesystem, or
+	// nil.
+	LogicalVolume *lvm.LogicalVolume
+
+	// Type is the ext version reported by Check.
+	Type disklayout.ExtType
+
+	// Reader reads the filesystem and can be passed to NewFS.
+	Reader *io.SectionReader
+}
+
+// FindVolumes looks for ext filesystems on the disk image r, which is size
+// bytes long. It runs Check on every partition of the image's partition
+// table, or on the whole image if it is not partitioned. Partitions, or an
+// unpartitioned image, holding LVM2 physical volumes are assembled into
+// volume groups and Check is run on their visible logical volumes.
+func FindVolumes(r io.ReaderAt, size int64) ([]Volume, error) {
+	table, err := partition.Read(r, size)
+	if errors.Is(err, partition.ErrNoPartitionTable) {
+		whole := io.NewSectionReader(r, 0, size)
+		extType, err := Check(whole)
+		if err == nil {
+			return []Volume{{Type: extType, Reader: whole}}, nil
+		}
+		pv, lvmErr := lvm.ReadPhysicalVolume(whole)
+		if lvmErr != nil {
+			return nil, xerrors.Errorf("no partition table and no ext filesystem: %w", err)
+		}
+		return findLogicalVolumes([]*lvm.PhysicalVolume{pv}), nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read partition table: %w", err)
+	}
+
+	var volumes []Volume
+	var pvs []*lvm.PhysicalVolume
+	for i := range table.Partitions {
+		p := &table.Partitions[i]
+		section := p.Open(r)
+		extType, err := Check(section)
+		if err != nil {
+			if pv, err := lvm.ReadPhysicalVolume(section); err == nil {
+				pvs = append(pvs, pv)
+			}
+			continue
+		}
+		volumes = append(volumes, Volume{Partition: p, Type: extType, Reader: section})
+	}
+	return append(volumes, findLogicalVolumes(pvs)...), nil
+}
+
+// findLogicalVolumes assembles pvs into their volume groups and returns the
+// ext filesystems on their logical volumes. Volume groups which cannot be
+// assembled and logical volumes which cannot be opened are skipped.
+func findLogicalVolumes(pvs []*lvm.PhysicalVolume) []Volume {
+	var names []string
+	groups := make(map[string][]*lvm.PhysicalVolume)
+	for _, pv := range pvs {
+		if pv.Metadata == nil {
+			continue
+		}
+		if _, ok := groups[pv.VolumeGroup]; !ok {
+			names = append(names, pv.VolumeGroup)
+		}
+		groups[pv.VolumeGroup] = append(groups[pv.VolumeGroup], pv)
+	}
+
+	var volumes []Volume
+	for _, name := range names {
+		vg, err := lvm.NewVolumeGroup(groups[name]...)
+		if err != nil {
+			continue
+		}
+		for _, lv := range vg.LogicalVolumes {
+			if !lv.Visible() {
+				continue
+			}
+			section, err := lv.Open()
+			if err != nil {
+				continue
+			}
+			extType, err := Check(section)
+			if err != nil {
+				continue
+			}
+			volumes = append(volumes, Volume{LogicalVolume: lv, Type: extType, Reader: section})
+		}
+	}
+	return volumes
+}
@@ -0,0 +1,152 @@
+package ext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/internal/testimage"
+	"github.com/asalih/go-ext/partition"
+)
+
+func TestFindVolumes(t *testing.T) {
+	b := testimage.New(testimage.Ext4())
+	b.File("a.txt", []byte("hello"))
+	img := b.MustBuild()
+
+	// An MBR disk with an empty partition followed by the filesystem.
+	const sector = 512
+	fsStart := uint32(4096)
+	disk := make([]byte, int(fsStart)*sector+len(img))
+	putEntry := func(i int, typ byte, first, count uint32) {
+		raw := disk[446+16*i:]
+		raw[4] = typ
+		binary.LittleEndian.PutUint32(raw[8:], first)
+		binary.LittleEndian.PutUint32(raw[12:], count)
+	}
+	putEntry(0, partition.TypeLinux, 2048, 2048)
+	putEntry(1, partition.TypeLinux, fsStart, uint32(len(img)/sector))
+	binary.LittleEndian.PutUint16(disk[510:], 0xaa55)
+	copy(disk[int(fsStart)*sector:], img)
+
+	for name, tc := range map[string]struct {
+		disk  []byte
+		index int
+	}{
+		"partitioned":   {disk, 2},
+		"unpartitioned": {img, 0},
+	} {
+		volumes, err := FindVolumes(bytes.NewReader(tc.disk), int64(len(tc.disk)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(volumes) != 1 {
+			t.Fatalf("%s: found %d volumes, want 1", name, len(volumes))
+		}
+		v := volumes[0]
+		if tc.index == 0 && v.Partition != nil || tc.index != 0 && (v.Partition == nil || v.Partition.Index != tc.index) {
+			t.Errorf("%s: volume found in partition %+v", name, v.Partition)
+		}
+		if v.Type != disklayout.Ext4 {
+			t.Errorf("%s: volume type %v", name, v.Type)
+		}
+
+		fsys, err := NewFS(v.Reader)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if data, err := fs.ReadFile(fsys, "a.txt"); err != nil || string(data) != "hello" {
+			t.Errorf("%s: ReadFile returned %q, %v", name, data, err)
+		}
+	}
+}
+
+// lvmMetadata describes a volume group with 1M extents and a visible logical
+// volume "root" of n extents, laid out in two segments in reverse order on
+// the physical volume, plus a hidden one.
+func lvmMetadata(n int) string {
+	half := n / 2
+	return fmt.Sprintf(`vg {
+	id = "vgvgvg-vgvg-vgvg-vgvg-vgvg-vgvg-vgvgvg"
+	seqno = 1
+	extent_size = 2048
+	physical_volumes {
+		pv0 {
+			id = "pv0000-0000-0000-0000-0000-0000-000000"
+			pe_start = %d
+			pe_count = %d
+		}
+	}
+	logical_volumes {
+		root {
+			id = "root00-0000-0000-0000-0000-0000-000000"
+			status = ["READ", "WRITE", "VISIBLE"]
+			segment1 {
+				start_extent = 0
+				extent_count = %d
+				type = "striped"
+				stripe_count = 1
+				stripes = ["pv0", %d]
+			}
+			segment2 {
+				start_extent = %d
+				extent_count = %d
+				type = "striped"
+				stripe_count = 1
+				stripes = ["pv0", 0]
+			}
+		}
+		hidden {
+			id = "hidden-0000-0000-0000-0000-0000-000000"
+			status = ["READ", "WRITE"]
+			segment1 {
+				start_extent = 0
+				extent_count = %d
+				type = "striped"
+				stripe_count = 1
+				stripes = ["pv0", 0]
+			}
+		}
+	}
+}
+`, testimage.LVMPEStart, n, half, n-half, half, n-half, n)
+}
+
+func TestFindVolumesLVM(t *testing.T) {
+	b := testimage.New(testimage.Ext4())
+	b.File("a.txt", []byte("on lvm"))
+	img := b.MustBuild()
+
+	const extent = 1 << 20
+	n := (len(img) + extent - 1) / extent
+	half := n / 2
+	pvStart := testimage.LVMPEStart * 512
+	pv := testimage.LVMPhysicalVolume("pv000000000000000000000000000000", pvStart+n*extent, lvmMetadata(n))
+	// Extents [0, half) of the volume are at the end of the physical volume.
+	padded := make([]byte, n*extent)
+	copy(padded, img)
+	copy(pv[pvStart+(n-half)*extent:], padded[:half*extent])
+	copy(pv[pvStart:], padded[half*extent:])
+
+	volumes, err := FindVolumes(bytes.NewReader(pv), int64(len(pv)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 {
+		t.Fatalf("found %d volumes, want 1", len(volumes))
+	}
+	v := volumes[0]
+	if v.LogicalVolume == nil || v.LogicalVolume.Name != "root" || v.Partition != nil {
+		t.Errorf("volume found in %+v, partition %+v", v.LogicalVolume, v.Partition)
+	}
+	fsys, err := NewFS(v.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile(fsys, "a.txt"); err != nil || string(data) != "on lvm" {
+		t.Errorf("ReadFile returned %q, %v", data, err)
+	}
+}
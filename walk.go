@@ -0,0 +1,345 @@
+package ext
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// WalkFunc is the type of the function called by FileSystem.Walk for every
+// file and directory. It follows the contract of fs.WalkDirFunc: returning
+// fs.SkipDir from a directory skips its content, returning it from a file
+// skips the remaining entries of its directory, and fs.SkipAll stops the walk
+// without error. Any other error stops the walk and is returned by Walk.
+//
+// Unlike fs.WalkDirFunc, it is called concurrently from the walk workers.
+type WalkFunc func(path string, d fs.DirEntry, err error) error
+
+// WalkEntry is a file or directory delivered by FileSystem.WalkEntries. Err is
+// set, possibly along with Entry, if the entry could not be read.
+type WalkEntry struct {
+	Path  string
+	Entry fs.DirEntry
+	Err   error
+}
+
+// WalkOption configures a FileSystem.Walk.
+type WalkOption func(*walkOptions)
+
+type walkOptions struct {
+	workers    int
+	inodeOrder bool
+}
+
+// WithWalkWorkers sets the number of directories read concurrently. It
+// defaults to runtime.GOMAXPROCS(0); values below 1 mean 1.
+func WithWalkWorkers(n int) WalkOption {
+	return func(o *walkOptions) {
+		o.workers = n
+	}
+}
+
+// WithInodeOrder makes the walk read the inodes of every directory's entries
+// up front, in inode number order, and read pending directories in inode
+// number order too. Since inode tables are laid out by inode number, this
+// turns scattered inode reads into mostly sequential ones, at the cost of
+// reading inodes the callback may not need.
+func WithInodeOrder(enabled bool) WalkOption {
+	return func(o *walkOptions) {
+		o.inodeOrder = enabled
+	}
+}
+
+// Walk walks the file tree rooted at root, calling fn for every file and
+// directory, root included. Directories are read by a pool of workers, so fn
+// is called concurrently and in no particular order, except that a directory
+// is always visited before its content. Entries of a single directory are
+// visited in lexical order by one worker.
+//
+// The walk stops early when ctx is done, returning ctx.Err(). Device reads
+// are bound to ctx, as with OpenContext, and so are the entries passed to fn.
+func (f *FileSystem) Walk(ctx context.Context, root string, fn WalkFunc, opts ...WalkOption) error {
+	f = f.withContext(ctx)
+	o := walkOptions{workers: runtime.GOMAXPROCS(0)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.workers < 1 {
+		o.workers = 1
+	}
+
+	info, err := f.ReadDirInfo(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		fi := info.(*fileInfo)
+		rootInfo := &fileInfo{inode: fi.inode, name: path.Base(root)}
+		err = fn(root, fs.FileInfoToDirEntry(rootInfo), nil)
+		if err == nil && fi.isDir() {
+			err = f.walkDirs(ctx, walkDir{path: root, inode: fi.inode}, fn, o)
+		}
+	}
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+// WalkEntries walks the file tree rooted at root like Walk and delivers every
+// file and directory on the returned channel, which is closed once the walk
+// is over. The caller must either drain the channel or cancel ctx.
+func (f *FileSystem) WalkEntries(ctx context.Context, root string, opts ...WalkOption) <-chan WalkEntry {
+	ch := make(chan WalkEntry)
+	go func() {
+		defer close(ch)
+		f.Walk(ctx, root, func(path string, d fs.DirEntry, err error) error {
+			select {
+			case ch <- WalkEntry{Path: path, Entry: d, Err: err}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}, opts...)
+	}()
+	return ch
+}
+
+// walkDir is a directory waiting to be read by a walk worker.
+type walkDir struct {
+	path  string
+	inode *inode
+}
+
+// walkQueue holds the pending directories. In inode order it is a min-heap by
+// inode number, otherwise a FIFO queue.
+type walkQueue struct {
+	dirs       []walkDir
+	inodeOrder bool
+}
+
+func (q *walkQueue) Len() int { return len(q.dirs) }
+
+func (q *walkQueue) Less(i, j int) bool {
+	return q.dirs[i].inode.inodeNum < q.dirs[j].inode.inodeNum
+}
+
+func (q *walkQueue) Swap(i, j int) { q.dirs[i], q.dirs[j] = q.dirs[j], q.dirs[i] }
+
+func (q *walkQueue) Push(x any) { q.dirs = append(q.dirs, x.(walkDir)) }
+
+func (q *walkQueue) Pop() any {
+	n := len(q.dirs) - 1
+	d := q.dirs[n]
+	q.dirs = q.dirs[:n]
+	return d
+}
+
+func (q *walkQueue) push(d walkDir) {
+	if q.inodeOrder {
+		heap.Push(q, d)
+		return
+	}
+	q.dirs = append(q.dirs, d)
+}
+
+func (q *walkQueue) pop() walkDir {
+	if q.inodeOrder {
+		return heap.Pop(q).(walkDir)
+	}
+	d := q.dirs[0]
+	q.dirs = q.dirs[1:]
+	return d
+}
+
+// walker holds the state shared by the workers of a walk.
+type walker struct {
+	fsys *FileSystem
+	ctx  context.Context
+	fn   WalkFunc
+	opts walkOptions
+
+	// mu protects the fields below. cond is signalled when directories are
+	// queued, when the last busy worker is done and when the walk stops.
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue walkQueue
+	// busy is the number of directories being read.
+	busy int
+	// err is the error that stopped the walk.
+	err     error
+	stopped bool
+}
+
+// walkDirs reads root and every directory below it with a pool of workers.
+func (f *FileSystem) walkDirs(ctx context.Context, root walkDir, fn WalkFunc, o walkOptions) error {
+	w := &walker{
+		fsys:  f,
+		ctx:   ctx,
+		fn:    fn,
+		opts:  o,
+		queue: walkQueue{inodeOrder: o.inodeOrder},
+	}
+	w.cond = sync.NewCond(&w.mu)
+	w.queue.push(root)
+
+	// Wake up idle workers when ctx is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.stop(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < o.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+	wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// stop ends the walk with err, unless it has ended already.
+func (w *walker) stop(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.stopped {
+		w.stopped = true
+		w.err = err
+	}
+	w.cond.Broadcast()
+}
+
+// work reads queued directories until there are none left and no other
+// worker can queue more.
+func (w *walker) work() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for {
+		for w.queue.Len() == 0 && w.busy > 0 && !w.stopped {
+			w.cond.Wait()
+		}
+		if w.stopped || w.queue.Len() == 0 {
+			return
+		}
+
+		d := w.queue.pop()
+		w.busy++
+		w.mu.Unlock()
+		subdirs, err := w.readDir(d)
+		w.mu.Lock()
+		w.busy--
+
+		if err != nil {
+			if !w.stopped {
+				w.stopped = true
+				w.err = err
+			}
+			w.cond.Broadcast()
+			return
+		}
+		for _, sub := range subdirs {
+			w.queue.push(sub)
+		}
+		if len(subdirs) > 0 || w.busy == 0 {
+			w.cond.Broadcast()
+		}
+	}
+}
+
+// readDir calls fn for every entry of directory d and returns the
+// subdirectories to walk next.
+func (w *walker) readDir(d walkDir) ([]walkDir, error) {
+	if err := w.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	entries, err := w.fsys.listInoEntries(d.inode)
+	if err != nil {
+		err = w.fn(d.path, fs.FileInfoToDirEntry(&fileInfo{inode: d.inode, name: path.Base(d.path)}), err)
+		if errors.Is(err, fs.SkipDir) {
+			err = nil
+		}
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	if w.opts.inodeOrder {
+		w.prefetch(entries)
+	}
+
+	var subdirs []walkDir
+	for _, entry := range entries {
+		if err := w.ctx.Err(); err != nil {
+			return nil, err
+		}
+		if w.isStopped() {
+			return nil, nil
+		}
+
+		name := path.Join(d.path, entry.name)
+		err := w.fn(name, entry, nil)
+		if errors.Is(err, fs.SkipDir) {
+			if entry.IsDir() {
+				continue
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !entry.IsDir() {
+			continue
+		}
+
+		in, err := entry.getInode()
+		if err == nil && !in.isDir() {
+			err = errors.New("ext fs: directory entry does not link to a directory")
+		}
+		if err != nil {
+			if err := w.fn(name, entry, err); err != nil && !errors.Is(err, fs.SkipDir) {
+				return nil, err
+			}
+			continue
+		}
+		subdirs = append(subdirs, walkDir{path: name, inode: in})
+	}
+	return subdirs, nil
+}
+
+// prefetch loads the inodes of entries in inode number order. Errors are left
+// for the callback to find through the entries.
+func (w *walker) prefetch(entries []*dirEntry) {
+	sorted := make([]*dirEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].inodeNum < sorted[j].inodeNum
+	})
+	for _, entry := range sorted {
+		if w.ctx.Err() != nil {
+			return
+		}
+		entry.getInode()
+	}
+}
+
+func (w *walker) isStopped() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stopped
+}
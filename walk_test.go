@@ -0,0 +1,199 @@
+package ext
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+// walkPaths returns the sorted paths fs.WalkDir visits.
+func walkPaths(t *testing.T, fsys fs.FS) []string {
+	t.Helper()
+	var paths []string
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// collectWalk runs Walk and returns the sorted paths it visited.
+func collectWalk(t *testing.T, fsys *FileSystem, fn WalkFunc, opts ...WalkOption) ([]string, error) {
+	t.Helper()
+	var mu sync.Mutex
+	var paths []string
+	err := fsys.Walk(context.Background(), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		paths = append(paths, path)
+		mu.Unlock()
+		if fn != nil {
+			return fn(path, d, err)
+		}
+		return nil
+	}, opts...)
+	sort.Strings(paths)
+	return paths, err
+}
+
+func TestWalk(t *testing.T) {
+	forEachImage(t, func(t *testing.T, fsys *FileSystem, b *testimage.Builder, entries map[string]testimage.Entry) {
+		want := walkPaths(t, fsys)
+		for _, tc := range []struct {
+			name string
+			opts []WalkOption
+		}{
+			{"default", nil},
+			{"single worker", []WalkOption{WithWalkWorkers(1)}},
+			{"inode order", []WalkOption{WithWalkWorkers(4), WithInodeOrder(true)}},
+		} {
+			got, err := collectWalk(t, fsys, nil, tc.opts...)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: Walk visited %v, want %v", tc.name, got, want)
+			}
+		}
+	})
+}
+
+func TestWalkVisitsParentsFirst(t *testing.T) {
+	fsys, _ := newConcurrentFS(t)
+
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	err := fsys.Walk(context.Background(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if p != "." {
+			if parent := path.Dir(p); !seen[parent] {
+				t.Errorf("%s visited before its parent", p)
+			}
+		}
+		seen[p] = true
+		return nil
+	}, WithWalkWorkers(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalkSkip(t *testing.T) {
+	fsys, _ := newConcurrentFS(t)
+	all := walkPaths(t, fsys)
+
+	// Skipping a directory leaves out its content only.
+	got, err := collectWalk(t, fsys, func(path string, d fs.DirEntry, err error) error {
+		if path == "htree" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, p := range all {
+		if !strings.HasPrefix(p, "htree/") {
+			want = append(want, p)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk with SkipDir visited %v, want %v", got, want)
+	}
+
+	// SkipAll stops the walk without an error.
+	got, err = collectWalk(t, fsys, func(path string, d fs.DirEntry, err error) error {
+		return fs.SkipAll
+	})
+	if err != nil || len(got) != 1 {
+		t.Errorf("Walk with SkipAll visited %v, err %v", got, err)
+	}
+
+	// Other errors stop the walk and are returned.
+	errStop := errors.New("stop")
+	_, err = collectWalk(t, fsys, func(path string, d fs.DirEntry, err error) error {
+		if path == "dir/sub" {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Errorf("Walk returned %v, want %v", err, errStop)
+	}
+}
+
+func TestWalkCancel(t *testing.T) {
+	fsys, _ := newConcurrentFS(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	visited := 0
+	var mu sync.Mutex
+	err := fsys.Walk(ctx, ".", func(path string, d fs.DirEntry, err error) error {
+		mu.Lock()
+		defer mu.Unlock()
+		visited++
+		if visited == 5 {
+			cancel()
+		}
+		return nil
+	}, WithWalkWorkers(2))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Walk returned %v, want %v", err, context.Canceled)
+	}
+	if all := len(walkPaths(t, fsys)); visited >= all {
+		t.Errorf("canceled walk visited all %d entries", all)
+	}
+}
+
+func TestWalkEntries(t *testing.T) {
+	fsys, _ := newConcurrentFS(t)
+	want := walkPaths(t, fsys)
+
+	var got []string
+	for e := range fsys.WalkEntries(context.Background(), ".", WithInodeOrder(true)) {
+		if e.Err != nil {
+			t.Fatal(e.Err)
+		}
+		got = append(got, e.Path)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WalkEntries delivered %v, want %v", got, want)
+	}
+
+	// Canceling the context closes the channel early.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := 0
+	for range fsys.WalkEntries(ctx, ".") {
+		if n++; n == 3 {
+			cancel()
+		}
+	}
+	if n >= len(want) {
+		t.Errorf("canceled WalkEntries delivered all %d entries", n)
+	}
+}
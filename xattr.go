@@ -0,0 +1,286 @@
+package ext
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/asalih/go-ext/disklayout"
+	"github.com/asalih/go-ext/syserror"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// xattrMagic starts both the in-inode attribute area and attribute blocks.
+	xattrMagic = 0xea020000
+
+	// xattrBlockHeaderSize is the size of struct ext4_xattr_header.
+	xattrBlockHeaderSize = 32
+
+	// xattrEntryHeaderSize is the size of struct ext4_xattr_entry without
+	// the name.
+	xattrEntryHeaderSize = 16
+
+	// xattrIndexEncryption is the name index of the fscrypt context, which
+	// is not visible to userspace.
+	xattrIndexEncryption = 9
+
+	// xattrEncryptionContext is the name of the fscrypt context.
+	xattrEncryptionContext = "c"
+
+	// xattrIndexACLAccess and xattrIndexACLDefault are the name indices of
+	// POSIX ACLs, which are stored in their own format.
+	xattrIndexACLAccess  = 2
+	xattrIndexACLDefault = 3
+)
+
+// xattrPrefixes maps the name indices visible to userspace to the prefix of
+// the full attribute name.
+var xattrPrefixes = map[uint8]string{
+	1:                    "user.",
+	xattrIndexACLAccess:  "system.posix_acl_access",
+	xattrIndexACLDefault: "system.posix_acl_default",
+	4:                    "trusted.",
+	6:                    "security.",
+	7:                    "system.",
+	8:                    "system.richacl",
+}
+
+// xattr is an extended attribute with its name split into the name index
+// and the rest of the name.
+type xattr struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+// Xattrs returns the extended attributes of the file name by their full
+// name, such as "user.comment" or "security.selinux". Symlinks are not
+// followed. POSIX ACLs are converted to the format getxattr(2) returns for
+// system.posix_acl_access and system.posix_acl_default, and the fscrypt
+// context is left out.
+func (f *FileSystem) Xattrs(name string) (map[string][]byte, error) {
+	info, err := f.lookupPath(name)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read extended attributes: %w", err)
+	}
+	inodeOff, err := inodeOffset(f, info.inodeNum)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := readXattrs(f, inodeOff, info.diskInode)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read extended attributes of inode %d: %w", info.inodeNum, err)
+	}
+
+	m := make(map[string][]byte, len(attrs))
+	for _, x := range attrs {
+		prefix, ok := xattrPrefixes[x.index]
+		if !ok {
+			continue
+		}
+		value := x.value
+		if x.index == xattrIndexACLAccess || x.index == xattrIndexACLDefault {
+			if value, err = posixACL(value); err != nil {
+				return nil, xerrors.Errorf("inode %d: %w", info.inodeNum, err)
+			}
+		}
+		m[prefix+x.name] = value
+	}
+	return m, nil
+}
+
+// ACL entry tags. Entries for a specific user or group carry an ID, the
+// others do not.
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+// posixACL converts an ACL from the ext4 on-disk format, version 1 with
+// short entries where no ID is needed, to the POSIX ACL xattr format,
+// version 2 with every entry 8 bytes long.
+func posixACL(value []byte) ([]byte, error) {
+	le := binary.LittleEndian
+	if len(value) < 4 || le.Uint32(value) != 1 {
+		return nil, xerrors.Errorf("bad ACL header: %w", syserror.EFSCORRUPTED)
+	}
+	out := make([]byte, 4, 4+2*len(value))
+	le.PutUint32(out, 2)
+	for off := 4; off < len(value); {
+		if off+4 > len(value) {
+			return nil, xerrors.Errorf("truncated ACL entry: %w", syserror.EFSCORRUPTED)
+		}
+		tag, perm := le.Uint16(value[off:]), le.Uint16(value[off+2:])
+		id := uint32(0xffffffff)
+		switch tag {
+		case aclUserObj, aclGroupObj, aclMask, aclOther:
+			off += 4
+		case aclUser, aclGroup:
+			if off+8 > len(value) {
+				return nil, xerrors.Errorf("truncated ACL entry: %w", syserror.EFSCORRUPTED)
+			}
+			id = le.Uint32(value[off+4:])
+			off += 8
+		default:
+			return nil, xerrors.Errorf("bad ACL tag %#x: %w", tag, syserror.EFSCORRUPTED)
+		}
+		var entry [8]byte
+		le.PutUint16(entry[0:], tag)
+		le.PutUint16(entry[2:], perm)
+		le.PutUint32(entry[4:], id)
+		out = append(out, entry[:]...)
+	}
+	return out, nil
+}
+
+// readXattrs returns the extended attributes of the inode whose record
+// starts at inodeOff: those in the inode body first, then those in its
+// attribute block.
+func readXattrs(fsR *FileSystem, inodeOff uint64, diskInode disklayout.Inode) ([]xattr, error) {
+	var attrs []xattr
+
+	// The in-inode area follows i_extra_isize up to the end of the record.
+	if _, ok := diskInode.(*disklayout.InodeNew); ok {
+		recSize := uint64(fsR.sb.InodeSize())
+		start := uint64(diskInode.InodeSize())
+		if start+4 < recSize {
+			region := make([]byte, recSize-start)
+			if err := readXattrRegion(fsR, int64(inodeOff+start), region); err != nil {
+				return nil, err
+			}
+			if binary.LittleEndian.Uint32(region) == xattrMagic {
+				// Value offsets are relative to the first entry.
+				body, err := parseXattrEntries(fsR, region[4:], 0)
+				if err != nil {
+					return nil, xerrors.Errorf("in-inode extended attributes: %w", err)
+				}
+				attrs = append(attrs, body...)
+			}
+		}
+	}
+
+	blk := xattrBlock(fsR.sb, diskInode)
+	if blk == 0 {
+		return attrs, nil
+	}
+	if blk >= fsR.sb.BlocksCount() {
+		return nil, xerrors.Errorf("extended attribute block %d out of range: %w", blk, syserror.EFSCORRUPTED)
+	}
+	block := make([]byte, fsR.sb.BlockSize())
+	if err := readXattrRegion(fsR, int64(blk*fsR.sb.BlockSize()), block); err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if le.Uint32(block[0:]) != xattrMagic || le.Uint32(block[8:]) != 1 {
+		return nil, xerrors.Errorf("extended attribute block %d has a bad header: %w", blk, syserror.EFSCORRUPTED)
+	}
+	// Value offsets are relative to the start of the block.
+	inBlock, err := parseXattrEntries(fsR, block, xattrBlockHeaderSize)
+	if err != nil {
+		return nil, xerrors.Errorf("extended attribute block %d: %w", blk, err)
+	}
+	return append(attrs, inBlock...), nil
+}
+
+// xattrBlock returns the number of the attribute block of an inode, or 0.
+func xattrBlock(sb disklayout.SuperBlock, diskInode disklayout.Inode) uint64 {
+	in := oldInode(diskInode)
+	if in == nil {
+		return 0
+	}
+	blk := uint64(in.FileACLLo)
+	if sb.IncompatibleFeatures().Is64Bit {
+		blk |= uint64(in.FileACLHi) << 32
+	}
+	return blk
+}
+
+func readXattrRegion(fsR *FileSystem, off int64, dst []byte) error {
+	if n, err := fsR.meta.ReadAt(dst, off); n < len(dst) {
+		if err == nil || err == io.EOF {
+			err = syserror.EIO
+		}
+		return err
+	}
+	return nil
+}
+
+// parseXattrEntries decodes the ext4_xattr_entry list starting at offset
+// off of region. Values are found at their offset within region, or in
+// their own inode with the ea_inode feature.
+func parseXattrEntries(fsR *FileSystem, region []byte, off int) ([]xattr, error) {
+	le := binary.LittleEndian
+	var attrs []xattr
+	for {
+		if off+4 > len(region) {
+			return nil, xerrors.Errorf("unterminated entry list: %w", syserror.EFSCORRUPTED)
+		}
+		if le.Uint32(region[off:]) == 0 {
+			return attrs, nil
+		}
+		if off+xattrEntryHeaderSize > len(region) {
+			return nil, xerrors.Errorf("entry at offset %d is truncated: %w", off, syserror.EFSCORRUPTED)
+		}
+		e := region[off:]
+		nameLen := int(e[0])
+		valueOff := int(le.Uint16(e[2:]))
+		valueInum := le.Uint32(e[4:])
+		valueSize := int(le.Uint32(e[8:]))
+		if off+xattrEntryHeaderSize+nameLen > len(region) {
+			return nil, xerrors.Errorf("entry at offset %d has name length %d: %w", off, nameLen, syserror.EFSCORRUPTED)
+		}
+		x := xattr{
+			index: e[1],
+			name:  string(e[xattrEntryHeaderSize : xattrEntryHeaderSize+nameLen]),
+		}
+
+		if valueInum != 0 {
+			value, err := readXattrInode(fsR, valueInum, valueSize)
+			if err != nil {
+				return nil, err
+			}
+			x.value = value
+		} else {
+			if valueOff+valueSize > len(region) {
+				return nil, xerrors.Errorf("value of %q at offset %d has size %d: %w", x.name, valueOff, valueSize, syserror.EFSCORRUPTED)
+			}
+			x.value = append([]byte(nil), region[valueOff:valueOff+valueSize]...)
+		}
+		attrs = append(attrs, x)
+		off += (xattrEntryHeaderSize + nameLen + 3) &^ 3
+	}
+}
+
+// readXattrInode reads a value stored in inode ino (ea_inode feature).
+func readXattrInode(fsR *FileSystem, ino uint32, size int) ([]byte, error) {
+	in, err := fsR.getInode(ino)
+	if err != nil {
+		return nil, xerrors.Errorf("extended attribute inode %d: %w", ino, err)
+	}
+	rf, ok := in.impl.(*regularFile)
+	if !ok || in.diskInode.Size() != uint64(size) {
+		return nil, xerrors.Errorf("extended attribute inode %d is not a %d byte file: %w", ino, size, syserror.EFSCORRUPTED)
+	}
+	value := make([]byte, size)
+	if n, err := rf.reader(fsR).ReadAt(value, 0); n < size {
+		if err == nil || err == io.EOF {
+			err = syserror.EIO
+		}
+		return nil, err
+	}
+	return value, nil
+}
+
+// findXattr returns the value of the attribute index.name, if present.
+func findXattr(attrs []xattr, index uint8, name string) ([]byte, bool) {
+	for _, x := range attrs {
+		if x.index == index && x.name == name {
+			return x.value, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,62 @@
+package ext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/asalih/go-ext/internal/testimage"
+)
+
+func TestXattrs(t *testing.T) {
+	// An ext4 ACL: user::rw-, user:1000:r--, group::r--, mask::r--, other::---.
+	le := binary.LittleEndian
+	var acl []byte
+	acl = le.AppendUint32(acl, 1)
+	for _, e := range []struct {
+		tag, perm uint16
+		id        uint32
+		long      bool
+	}{
+		{aclUserObj, 6, 0, false},
+		{aclUser, 4, 1000, true},
+		{aclGroupObj, 4, 0, false},
+		{aclMask, 4, 0, false},
+		{aclOther, 0, 0, false},
+	} {
+		acl = le.AppendUint16(acl, e.tag)
+		acl = le.AppendUint16(acl, e.perm)
+		if e.long {
+			acl = le.AppendUint32(acl, e.id)
+		}
+	}
+
+	fsys := extractImage(t, testimage.Entry{Name: "a.txt", Mode: 0640, Xattrs: map[string][]byte{
+		"user.comment":            []byte("hello"),
+		"security.selinux":        []byte("system_u:object_r:etc_t:s0\x00"),
+		"system.posix_acl_access": acl,
+	}})
+	attrs, err := fsys.Xattrs("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attrs) != 3 || string(attrs["user.comment"]) != "hello" || string(attrs["security.selinux"]) != "system_u:object_r:etc_t:s0\x00" {
+		t.Errorf("Xattrs returned %q", attrs)
+	}
+
+	want := []byte{
+		2, 0, 0, 0,
+		aclUserObj, 0, 6, 0, 0xff, 0xff, 0xff, 0xff,
+		aclUser, 0, 4, 0, 0xe8, 0x03, 0, 0,
+		aclGroupObj, 0, 4, 0, 0xff, 0xff, 0xff, 0xff,
+		aclMask, 0, 4, 0, 0xff, 0xff, 0xff, 0xff,
+		aclOther, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+	}
+	if got := attrs["system.posix_acl_access"]; !bytes.Equal(got, want) {
+		t.Errorf("system.posix_acl_access = %x, want %x", got, want)
+	}
+
+	if _, err := posixACL(acl[:len(acl)-2]); err == nil {
+		t.Errorf("posixACL accepted a truncated ACL")
+	}
+}